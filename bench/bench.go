@@ -0,0 +1,228 @@
+package bench
+
+// Load generator measuring throughput and latencies of a collection under configurable workloads
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"shardb/db"
+	"shardb/testutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	UNIFORM = iota
+	ZIPF
+)
+
+type Workload struct {
+	Name       string
+	Operations int
+	Workers    int
+	// shares of the operations, the rest are writes
+	ReadRatio float64
+	ScanRatio float64
+	// size of the random payload of every record
+	ValueSize int
+	// records written before the measurement, reads and scans pick from them
+	Keys         int
+	Groups       int
+	Distribution int
+}
+
+var (
+	ReadHeavy  = Workload{Name: "read-heavy", Operations: 10000, Workers: 4, ReadRatio: 0.95, ValueSize: 128, Keys: 1000, Groups: 100}
+	WriteHeavy = Workload{Name: "write-heavy", Operations: 10000, Workers: 4, ReadRatio: 0.05, ValueSize: 128, Keys: 1000, Groups: 100}
+	ScanHeavy  = Workload{Name: "scan", Operations: 1000, Workers: 4, ScanRatio: 1, ValueSize: 128, Keys: 1000, Groups: 10}
+	Mixed      = Workload{Name: "mixed", Operations: 10000, Workers: 4, ReadRatio: 0.6, ScanRatio: 0.1, ValueSize: 128, Keys: 1000, Groups: 100, Distribution: ZIPF}
+)
+
+// Element written by the load generator
+type Record struct {
+	Key   string
+	Group int
+	Value []byte
+}
+
+func (r *Record) GetDataIndex() []*db.FullDataIndex {
+	return []*db.FullDataIndex{
+		{"Key", r.Key, true},
+		{"Group", strconv.Itoa(r.Group), false},
+	}
+}
+
+func RegisterTypes(database *db.Database) {
+	database.RegisterType(&Record{})
+}
+
+type Latencies struct {
+	Count int
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+type Report struct {
+	Workload   string
+	Operations int
+	Errors     int
+	Duration   time.Duration
+	Throughput float64 // operations per second
+	Reads      Latencies
+	Scans      Latencies
+	Writes     Latencies
+}
+
+func (r *Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %d ops (%d errors) in %v, %.0f ops/s\n", r.Workload, r.Operations, r.Errors, r.Duration, r.Throughput)
+	for _, l := range []struct {
+		name string
+		l    Latencies
+	}{{"read", r.Reads}, {"scan", r.Scans}, {"write", r.Writes}} {
+		if l.l.Count == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "  %-5s n=%d p50=%v p90=%v p99=%v max=%v\n", l.name, l.l.Count, l.l.P50, l.l.P90, l.l.P99, l.l.Max)
+	}
+	return b.String()
+}
+
+func percentiles(samples []time.Duration) Latencies {
+	l := Latencies{Count: len(samples)}
+	if l.Count == 0 {
+		return l
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	at := func(p float64) time.Duration {
+		return samples[int(p*float64(l.Count-1))]
+	}
+	l.P50, l.P90, l.P99, l.Max = at(0.5), at(0.9), at(0.99), samples[l.Count-1]
+	return l
+}
+
+type picker func() int
+
+func newPicker(r *rand.Rand, n, distribution int) picker {
+	if n <= 1 {
+		return func() int { return 0 }
+	}
+	if distribution == ZIPF {
+		z := rand.NewZipf(r, 1.1, 1, uint64(n-1))
+		return func() int { return int(z.Uint64()) }
+	}
+	return func() int { return r.Intn(n) }
+}
+
+func randomValue(r *rand.Rand, size int) []byte {
+	v := make([]byte, size)
+	r.Read(v)
+	return v
+}
+
+func recordKey(prefix string, n int) string {
+	return prefix + strconv.Itoa(n)
+}
+
+// fills the collection with w.Keys records and runs w.Operations operations against it
+func Run(c *db.Collection, w Workload) (*Report, error) {
+	if w.Workers <= 0 {
+		w.Workers = 1
+	}
+	if w.Groups <= 0 {
+		w.Groups = 1
+	}
+	if w.ReadRatio+w.ScanRatio > 1 {
+		return nil, errors.New("read and scan ratios exceed 1")
+	}
+	if (w.ReadRatio > 0 || w.ScanRatio > 0) && w.Keys <= 0 {
+		return nil, errors.New("reads require preloaded keys")
+	}
+
+	// keys of different runs against the same collection must not collide
+	prefix := strconv.FormatInt(time.Now().UnixNano(), 36) + "-"
+	g, err := testutil.NewGenerator(&Record{})
+	if err != nil {
+		return nil, err
+	}
+	g.Seed(time.Now().UnixNano()).Field("Key", testutil.Sequence(prefix)).
+		Field("Group", testutil.Modulo(w.Groups)).Field("Value", testutil.Bytes(w.ValueSize))
+	err = g.Populate(c, w.Keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		mx                   sync.Mutex
+		reads, scans, writes []time.Duration
+		errorsCount          int
+		written              int64
+		wg                   sync.WaitGroup
+	)
+	perWorker := w.Operations / w.Workers
+	start := time.Now()
+	for n := 0; n < w.Workers; n++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(time.Now().UnixNano() + int64(worker)))
+			pickKey := newPicker(r, w.Keys, w.Distribution)
+			pickGroup := newPicker(r, w.Groups, w.Distribution)
+			var lr, ls, lw []time.Duration
+			failed := 0
+			ops := perWorker
+			if worker == 0 {
+				ops += w.Operations % w.Workers
+			}
+			for i := 0; i < ops; i++ {
+				p := r.Float64()
+				opStart := time.Now()
+				var err error
+				switch {
+				case p < w.ReadRatio:
+					_, err = c.ScanOne(&Record{Key: recordKey(prefix, pickKey())}, false)
+					lr = append(lr, time.Since(opStart))
+				case p < w.ReadRatio+w.ScanRatio:
+					_, err = c.ScanN(&Record{Group: pickGroup()}, 100, false)
+					ls = append(ls, time.Since(opStart))
+				default:
+					mx.Lock()
+					written++
+					key := recordKey(prefix+"w", int(written))
+					mx.Unlock()
+					err = c.Write(&Record{key, pickGroup(), randomValue(r, w.ValueSize)})
+					lw = append(lw, time.Since(opStart))
+				}
+				if err != nil {
+					failed++
+				}
+			}
+			mx.Lock()
+			reads, scans, writes = append(reads, lr...), append(scans, ls...), append(writes, lw...)
+			errorsCount += failed
+			mx.Unlock()
+		}(n)
+	}
+	wg.Wait()
+	duration := time.Since(start)
+
+	report := &Report{
+		Workload:   w.Name,
+		Operations: w.Operations,
+		Errors:     errorsCount,
+		Duration:   duration,
+		Reads:      percentiles(reads),
+		Scans:      percentiles(scans),
+		Writes:     percentiles(writes),
+	}
+	if duration > 0 {
+		report.Throughput = float64(w.Operations) / duration.Seconds()
+	}
+	return report, nil
+}
@@ -0,0 +1,195 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/rs/xid"
+)
+
+// Writes queued by WriteAsync and not yet taken by the writer, a full queue blocks WriteAsync
+var ASYNC_QUEUE_SIZE = 4096
+
+// Returned for writes queued after the collection was closed
+var ErrAsyncClosed = errors.New("asynchronous writes of the collection are closed")
+
+// Result of WriteAsync, done once the element reached the drive or failed
+type WriteFuture struct {
+	// id of the element, known right away
+	Id   string
+	done chan struct{}
+	err  error
+}
+
+func (f *WriteFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// waits for the write to finish
+func (f *WriteFuture) Wait() error {
+	<-f.done
+	return f.err
+}
+
+// nil while the write is pending
+func (f *WriteFuture) Err() error {
+	select {
+	case <-f.done:
+		return f.err
+	default:
+		return nil
+	}
+}
+
+func (f *WriteFuture) complete(err error) {
+	f.err = err
+	close(f.done)
+}
+
+type asyncWrite struct {
+	payload CustomStructure
+	future  *WriteFuture
+}
+
+type asyncWriter struct {
+	queue chan asyncWrite
+	done  chan struct{}
+}
+
+// Queues the payload and returns right away, the write itself is done by a goroutine of the collection.
+// Writes queued meanwhile are committed together: every element of a batch is appended to its shard,
+// then the database is synchronized like by Sync and the futures of the batch are done.
+// A done future without an error means the element survives a crash
+func (c *Collection) WriteAsync(payload CustomStructure) *WriteFuture {
+	f := &WriteFuture{Id: xid.New().String(), done: make(chan struct{})}
+	if err := c.writable(); err != nil {
+		f.complete(err)
+		return f
+	}
+	c.asyncMx.RLock()
+	defer c.asyncMx.RUnlock()
+	if c.asyncClosed {
+		f.complete(ErrAsyncClosed)
+		return f
+	}
+	if c.async == nil {
+		// the writer is started by the first call
+		c.asyncMx.RUnlock()
+		c.startAsyncWrites()
+		c.asyncMx.RLock()
+		if c.asyncClosed {
+			f.complete(ErrAsyncClosed)
+			return f
+		}
+	}
+	c.async.queue <- asyncWrite{payload, f}
+	return f
+}
+
+func (c *Collection) startAsyncWrites() {
+	c.asyncMx.Lock()
+	defer c.asyncMx.Unlock()
+	if c.async != nil || c.asyncClosed {
+		return
+	}
+	w := &asyncWriter{make(chan asyncWrite, ASYNC_QUEUE_SIZE), make(chan struct{})}
+	c.async = w
+	go c.writeQueued(w)
+}
+
+func (c *Collection) writeQueued(w *asyncWriter) {
+	defer close(w.done)
+	for first := range w.queue {
+		batch := []asyncWrite{first}
+	collect:
+		for len(batch) < ASYNC_QUEUE_SIZE {
+			select {
+			case next, ok := <-w.queue:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, next)
+			default:
+				break collect
+			}
+		}
+		c.commitBatch(batch)
+	}
+}
+
+func (c *Collection) commitBatch(batch []asyncWrite) {
+	errs := make([]error, len(batch))
+	for i, w := range batch {
+		errs[i] = c.commitAsync(w)
+	}
+	// the data reaches the drive before the meta points to it
+	err := c.Map.syncSegments()
+	if err == nil {
+		err = c.syncBatch()
+	}
+	for i, w := range batch {
+		if errs[i] == nil {
+			errs[i] = err
+		}
+		w.future.complete(errs[i])
+	}
+}
+
+// a panic fails the write only
+func (c *Collection) commitAsync(w asyncWrite) (err error) {
+	defer recoverPanic("asynchronous write to "+c.Name, &err)
+	return c.writeWithId(context.Background(), w.future.Id, w.payload)
+}
+
+// Waits for the queued writes and stops the writer, later WriteAsync calls fail with ErrAsyncClosed
+func (c *Collection) closeAsyncWrites() {
+	c.asyncMx.Lock()
+	if c.asyncClosed {
+		c.asyncMx.Unlock()
+		return
+	}
+	c.asyncClosed = true
+	w := c.async
+	c.asyncMx.Unlock()
+	if w == nil {
+		return
+	}
+	close(w.queue)
+	<-w.done
+}
+
+// the segments, the meta files and the index of a batch are only loaded after a crash once the manifest lists them
+func (c *Collection) syncBatch() error {
+	if c.database != nil {
+		return c.database.Sync()
+	}
+	return c.Sync()
+}
+
+// flushes the buffered data of every shard that was appended to since the last call and syncs its active segment
+func (cm *ConcurrentMap) syncSegments() (err error) {
+	for _, shard := range cm.Shared {
+		if serr := shard.syncActive(); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+func (shard *ConcurrentMapShared) syncActive() error {
+	shard.Lock()
+	defer shard.Unlock()
+	end := shard.flushed + int64(len(shard.pending))
+	if shard.synced == end {
+		return nil
+	}
+	err := shard.flushPending()
+	if err != nil {
+		return err
+	}
+	err = shard.instrument(shard.file).Sync()
+	if err != nil {
+		return err
+	}
+	shard.synced = end
+	return nil
+}
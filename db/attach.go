@@ -0,0 +1,84 @@
+package db
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"sort"
+)
+
+// Returned by the writes to a collection attached with AttachCollection
+var ErrReadOnly = errors.New("collection is read-only")
+
+// Mounts a collection directory written elsewhere, e.g. a dataset built by a nightly job, under the name of
+// its directory. The collection is read-only: its files are opened for reading only, writes return ErrReadOnly
+// and Sync, Optimize and the manifest leave it out, so it is not loaded again with the database.
+// Its shard count has to be the one of the database
+func (db *Database) AttachCollection(path string) (*Collection, error) {
+	name := filepath.Base(filepath.Clean(path))
+	if db.GetCollection(name) != nil {
+		return nil, errors.New("collection " + name + " already exists")
+	}
+	fsys, err := db.fileSystem(path)
+	if err != nil {
+		return nil, errors.New("failed to attach collection " + name + " due " + err.Error())
+	}
+	info, err := fs.Stat(fsys, ".")
+	if err != nil {
+		return nil, errors.New("failed to attach collection " + name + " due " + err.Error())
+	}
+	if !info.IsDir() {
+		return nil, errors.New("failed to attach collection " + name + ": " + path + " is not a directory")
+	}
+	c, err := db.scanCollection(name, fsys, path, true)
+	if err != nil {
+		return nil, errors.New("failed to attach collection " + name + " due " + err.Error())
+	}
+	db.collectionMutex.Lock()
+	defer db.collectionMutex.Unlock()
+	if db.collections[name] != nil || db.attached[name] != nil {
+		c.Map.Close()
+		c.Cache.Close()
+		return nil, errors.New("collection " + name + " already exists")
+	}
+	db.attached[name] = c
+	return c, nil
+}
+
+// Unmounts a collection attached with AttachCollection and closes its files, its directory is left as it is.
+// Queries still running on the collection fail
+func (db *Database) DetachCollection(name string) error {
+	db.collectionMutex.Lock()
+	c, ok := db.attached[name]
+	delete(db.attached, name)
+	db.collectionMutex.Unlock()
+	if !ok {
+		return errors.New("collection " + name + " is not attached")
+	}
+	err := c.Map.Close()
+	c.Cache.Close()
+	return err
+}
+
+// names of the attached collections, sorted
+func (db *Database) AttachedCollections() []string {
+	db.collectionMutex.RLock()
+	defer db.collectionMutex.RUnlock()
+	names := make([]string, 0, len(db.attached))
+	for name := range db.attached {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *Collection) IsReadOnly() bool {
+	return c.readOnly
+}
+
+func (c *Collection) writable() error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// Bundles (Database.Bundle) are the backups of a database: VerifyBackup checks one
+// and RestoreBundle unpacks it into a data directory
+
+// What a bundle holds, filled by VerifyBackup and RestoreBundle
+type BackupReport struct {
+	Name string `json:"name"`
+	// elements by collection
+	Collections map[string]int64 `json:"collections"`
+	Files       int              `json:"files"`
+	Bytes       int64            `json:"bytes"`
+}
+
+type RestoreOptions struct {
+	// verifies the bundle and the target and reports what would be restored, nothing is written
+	DryRun bool
+	// modes and owner of the restored files and directories, nil uses DefaultDatabaseOptions
+	Options *DatabaseOptions
+}
+
+// Checks the bundle read from r without writing anything: the structure of the bundle, the checksums of
+// every file and that every element can be loaded and decoded. The types of the elements have to be
+// registered, like for OpenBundle. The bundle is read into memory
+func VerifyBackup(r io.Reader) (*BackupReport, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.New("failed to read the backup due " + err.Error())
+	}
+	_, report, err := verifyBundle(data)
+	return report, err
+}
+
+func verifyBundle(data []byte) (*bundleIndex, *BackupReport, error) {
+	r := bytes.NewReader(data)
+	index, err := readBundleIndex(r, int64(len(data)))
+	if err != nil {
+		return nil, nil, err
+	}
+	report := &BackupReport{Name: index.Name, Collections: make(map[string]int64)}
+	for _, mc := range index.Manifest.Collections {
+		for _, mf := range bundledFiles(mc) {
+			if err = index.verify(r, mc.Path, mf); err != nil {
+				return index, report, errors.New("collection " + mc.Name + " is corrupted due " + err.Error())
+			}
+			report.Files++
+			report.Bytes += mf.Size
+		}
+	}
+	bundled, err := openBundle("", r, int64(len(data)))
+	if err != nil {
+		return index, report, err
+	}
+	defer bundled.Close()
+	for _, mc := range index.Manifest.Collections {
+		c := bundled.GetCollection(mc.Name)
+		n := int64(0)
+		err = c.ForEach(func(e *Element) error {
+			n++
+			return nil
+		})
+		if err != nil {
+			return index, report, errors.New("failed to decode the elements of collection " + mc.Name + " due " + err.Error())
+		}
+		if n != c.Size() {
+			return index, report, errors.New("collection " + mc.Name + " holds " + strconv.FormatInt(n, 10) + " element(s), its counter " + strconv.FormatInt(c.Size(), 10))
+		}
+		report.Collections[mc.Name] = n
+	}
+	return index, report, nil
+}
+
+// every file of the collection in the bundle
+func bundledFiles(mc *ManifestCollection) []*ManifestFile {
+	files := []*ManifestFile{mc.Description, mc.Index}
+	for _, ms := range mc.Shards {
+		files = append(append(files, ms.Segments...), ms.Meta)
+	}
+	return files
+}
+
+// Unpacks the bundle read from r into dir, which has to be empty or missing, so a restore never replaces
+// a database. The bundle is verified like by VerifyBackup first. The header of the database is written last,
+// a failed restore leaves a directory that is not loaded
+func RestoreBundle(r io.Reader, dir string, options RestoreOptions) (*BackupReport, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.New("failed to read the backup due " + err.Error())
+	}
+	index, report, err := verifyBundle(data)
+	if err != nil {
+		return report, errors.New("backup is not restorable due " + err.Error())
+	}
+	if entries, err := ioutil.ReadDir(dir); err == nil && len(entries) > 0 {
+		return report, errors.New("restore target " + dir + " is not empty")
+	} else if err != nil && !os.IsNotExist(err) {
+		return report, err
+	}
+	if !filepath.IsLocal(index.Name) || filepath.Base(index.Name) != index.Name {
+		return report, errors.New("backup has an invalid database name " + index.Name)
+	}
+	for name := range index.Files {
+		// the bundle must not write outside of the target
+		if !filepath.IsLocal(filepath.FromSlash(name)) {
+			return report, errors.New("backup holds a file outside of the data directory " + name)
+		}
+	}
+	if options.DryRun {
+		return report, nil
+	}
+
+	names := make([]string, 0, len(index.Files))
+	for name := range index.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entry := index.Files[name]
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err = options.Options.mkdirAll(filepath.Dir(target)); err != nil {
+			return report, err
+		}
+		err = options.Options.writeAtomically(target, func(w io.Writer) error {
+			_, err := w.Write(data[entry.Offset : entry.Offset+entry.Size])
+			return err
+		})
+		if err != nil {
+			return report, errors.New("failed to restore " + name + " due " + err.Error())
+		}
+	}
+	if err = index.Manifest.save(context.Background(), filepath.Join(dir, MANIFEST_NAME), options.Options); err != nil {
+		return report, err
+	}
+	header, err := json.Marshal(&Database{Name: index.Name, Version: index.Version})
+	if err != nil {
+		return report, err
+	}
+	err = options.Options.writeAtomically(filepath.Join(dir, index.Name+".shardb"), func(w io.Writer) error {
+		_, err := w.Write(header)
+		return err
+	})
+	return report, err
+}
@@ -0,0 +1,376 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+)
+
+// A bundle is the whole database in a single read-only file: a header, the files of the collections
+// one after another and an index at the end, followed by its length and the magic again
+const (
+	BUNDLE_MAGIC   = "SHBN"
+	BUNDLE_VERSION = 1
+	bundleHeader   = 8
+	bundleTrailer  = 12
+)
+
+// position of a file of the data directory in the bundle
+type bundleEntry struct {
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+	// CRC-32 of the file, the manifest has none for the segments. Missing in older bundles
+	Checksum uint32 `json:"crc,omitempty"`
+}
+
+type bundleIndex struct {
+	Name       string    `json:"name"`
+	Version    int       `json:"version"`
+	ShardCount int       `json:"shard_count"`
+	Manifest   *Manifest `json:"manifest"`
+	// by the path relative to the data directory, with slashes
+	Files map[string]bundleEntry `json:"files"`
+}
+
+// the file of a database opened with OpenBundle
+type bundleSource struct {
+	r      io.ReaderAt
+	closer io.Closer
+}
+
+// counts the written bytes, so the files know their offset
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Synchronizes the database and packs it into a single read-only file, which OpenBundle opens without
+// unpacking it, e.g. to ship a dataset in a container image or with go:embed. The segments are copied
+// up to their size at the synchronization, elements written meanwhile are left out.
+// A synchronization running at the same time makes the bundle fail
+func (db *Database) Bundle(outPath string) error {
+	if db.isReadOnly() {
+		return ErrReadOnly
+	}
+	if err := db.Sync(); err != nil {
+		return errors.New("failed to synchronize before bundling due " + err.Error())
+	}
+	// the snapshots the synchronization just listed
+	manifest, err := LoadManifest(filepath.Join(db.dir, MANIFEST_NAME))
+	if err != nil {
+		return err
+	}
+	index := &bundleIndex{Name: db.Name, Version: db.Version, ShardCount: db.options.shardCount(), Manifest: manifest,
+		Files: make(map[string]bundleEntry)}
+	return db.options.writeAtomically(outPath, func(w io.Writer) error {
+		cw := &countingWriter{w: w}
+		header := make([]byte, bundleHeader)
+		copy(header, BUNDLE_MAGIC)
+		binary.LittleEndian.PutUint32(header[4:], BUNDLE_VERSION)
+		if _, err := cw.Write(header); err != nil {
+			return err
+		}
+		for _, mc := range manifest.Collections {
+			for _, mf := range bundledFiles(mc) {
+				name := path.Join(mc.Path, mf.Name)
+				offset := cw.n
+				checksum, err := copyBundled(cw, db.dir, name, mf)
+				if err != nil {
+					return errors.New("failed to bundle " + name + " due " + err.Error())
+				}
+				index.Files[name] = bundleEntry{offset, mf.Size, checksum}
+			}
+		}
+		data, err := json.Marshal(index)
+		if err != nil {
+			return err
+		}
+		trailer := make([]byte, bundleTrailer)
+		binary.LittleEndian.PutUint64(trailer, uint64(len(data)))
+		copy(trailer[8:], BUNDLE_MAGIC)
+		if _, err = cw.Write(data); err != nil {
+			return err
+		}
+		_, err = cw.Write(trailer)
+		return err
+	})
+}
+
+// copies the size recorded by the manifest, the checksum has to match the one of the manifest.
+// Returns the checksum of the copy
+func copyBundled(w io.Writer, dir, name string, mf *ManifestFile) (uint32, error) {
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	h := crc32.NewIEEE()
+	if _, err = io.CopyN(io.MultiWriter(w, h), f, mf.Size); err != nil {
+		return 0, err
+	}
+	if mf.Checksum != 0 && h.Sum32() != mf.Checksum {
+		return 0, errors.New("file changed while it was bundled")
+	}
+	return h.Sum32(), nil
+}
+
+// Opens a database packed by Bundle. Its collections are read-only like attached ones (AttachCollection),
+// the database can not be synchronized and gets no new collections. The types of the elements are
+// registered as usual before the elements are read
+func OpenBundle(bundlePath string) (*Database, error) {
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	db, err := openBundle(bundlePath, f, fi.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	db.bundle.closer = f
+	return db, nil
+}
+
+// same as OpenBundle for a bundle in memory
+func OpenBundleBytes(data []byte) (*Database, error) {
+	return openBundle("", bytes.NewReader(data), int64(len(data)))
+}
+
+// Same as OpenBundle for a bundle in a file system, e.g. an embed.FS compiled into the binary:
+//
+//	//go:embed data/reference.bundle
+//	var reference embed.FS
+//	database, err := db.OpenBundleFS(reference, "data/reference.bundle")
+//
+// Files that can not be read at an offset are read into memory
+func OpenBundleFS(fsys fs.FS, name string) (*Database, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := f.(io.ReaderAt)
+	if !ok {
+		f.Close()
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		return openBundle(name, bytes.NewReader(data), int64(len(data)))
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	db, err := openBundle(name, r, fi.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	db.bundle.closer = f
+	return db, nil
+}
+
+func readBundleIndex(r io.ReaderAt, size int64) (*bundleIndex, error) {
+	if size < bundleHeader+bundleTrailer {
+		return nil, errors.New("bundle is truncated")
+	}
+	header := make([]byte, bundleHeader)
+	trailer := make([]byte, bundleTrailer)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if _, err := r.ReadAt(trailer, size-bundleTrailer); err != nil {
+		return nil, err
+	}
+	if string(header[:4]) != BUNDLE_MAGIC || string(trailer[8:]) != BUNDLE_MAGIC {
+		return nil, errors.New("not a bundle")
+	}
+	if version := binary.LittleEndian.Uint32(header[4:]); version != BUNDLE_VERSION {
+		return nil, errors.New("unsupported bundle version " + strconv.Itoa(int(version)))
+	}
+	length := int64(binary.LittleEndian.Uint64(trailer))
+	if length <= 0 || length > size-bundleHeader-bundleTrailer {
+		return nil, errors.New("bundle index is corrupted")
+	}
+	data := make([]byte, length)
+	if _, err := r.ReadAt(data, size-bundleTrailer-length); err != nil {
+		return nil, err
+	}
+	index := new(bundleIndex)
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, errors.New("bundle index is corrupted due " + err.Error())
+	}
+	if index.Manifest == nil {
+		return nil, errors.New("bundle has no manifest")
+	}
+	for name, entry := range index.Files {
+		if entry.Offset < bundleHeader || entry.Size < 0 || entry.Offset+entry.Size > size-bundleTrailer-length {
+			return nil, errors.New("bundled file " + name + " is out of the bundle bounds")
+		}
+	}
+	return index, nil
+}
+
+func openBundle(bundlePath string, r io.ReaderAt, size int64) (*Database, error) {
+	index, err := readBundleIndex(r, size)
+	if err != nil {
+		return nil, errors.New("failed to open bundle " + bundlePath + " due " + err.Error())
+	}
+	if index.ShardCount <= 0 {
+		return nil, errors.New("bundle has an invalid shard count " + strconv.Itoa(index.ShardCount))
+	}
+	options := DefaultDatabaseOptions()
+	options.ShardCount = index.ShardCount
+	db := NewDatabaseWithOptions(index.Name, options)
+	db.bundle = &bundleSource{r: r}
+	for _, mc := range index.Manifest.Collections {
+		c, err := db.loadBundledCollection(bundlePath, index, mc)
+		if err != nil {
+			db.Close()
+			return nil, errors.New("failed to open collection " + mc.Name + " of the bundle due " + err.Error())
+		}
+		db.attached[mc.Name] = c
+	}
+	db.sequence = index.Manifest.Sequence
+	return db, nil
+}
+
+// the content of a bundled file, checked against the checksum of the manifest
+func (index *bundleIndex) read(r io.ReaderAt, dir string, mf *ManifestFile) ([]byte, error) {
+	if mf == nil {
+		return nil, errors.New("manifest entry is incomplete")
+	}
+	name := path.Join(dir, mf.Name)
+	entry, ok := index.Files[name]
+	if !ok {
+		return nil, errors.New("file " + name + " is not in the bundle")
+	}
+	data := make([]byte, entry.Size)
+	if _, err := r.ReadAt(data, entry.Offset); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(data) != mf.Checksum || entry.Size != mf.Size {
+		return nil, errors.New("file " + name + " does not match the manifest checksum")
+	}
+	return data, nil
+}
+
+// checks a bundled file against the checksum of the manifest, or of the bundle for the segments
+func (index *bundleIndex) verify(r io.ReaderAt, dir string, mf *ManifestFile) error {
+	if mf == nil {
+		return errors.New("manifest entry is incomplete")
+	}
+	if mf.Checksum != 0 {
+		_, err := index.read(r, dir, mf)
+		return err
+	}
+	name := path.Join(dir, mf.Name)
+	entry, ok := index.Files[name]
+	if !ok {
+		return errors.New("file " + name + " is not in the bundle")
+	}
+	if entry.Size != mf.Size {
+		return errors.New("file " + name + " does not match the manifest size")
+	}
+	if entry.Checksum == 0 {
+		// bundled by an older version
+		return nil
+	}
+	data := make([]byte, entry.Size)
+	if _, err := r.ReadAt(data, entry.Offset); err != nil {
+		return err
+	}
+	if crc32.ChecksumIEEE(data) != entry.Checksum {
+		return errors.New("file " + name + " does not match the bundle checksum")
+	}
+	return nil
+}
+
+func (db *Database) loadBundledCollection(bundlePath string, index *bundleIndex, mc *ManifestCollection) (*Collection, error) {
+	r := db.bundle.r
+	if len(mc.Shards) != index.ShardCount {
+		return nil, errors.New("collection has invalid amount of shards " + strconv.Itoa(len(mc.Shards)))
+	}
+	description, err := index.read(r, mc.Path, mc.Description)
+	if err != nil {
+		return nil, err
+	}
+	description, err = gunzip(description)
+	if err != nil {
+		return nil, err
+	}
+	c, err := parseCollectionDescription(description)
+	if err != nil {
+		return nil, err
+	}
+	mapIndex, err := index.read(r, mc.Path, mc.Index)
+	if err != nil {
+		return nil, err
+	}
+	counter, err := strconv.ParseUint(string(bytes.SplitN(mapIndex, []byte("\n"), 2)[0]), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	collectionPath := path.Join(bundlePath, mc.Path)
+	cm := NewConcurrentMap(collectionPath, make([]*os.File, index.ShardCount))
+	cm.SetCounterIndex(counter)
+	loaded := make(map[int]bool, index.ShardCount)
+	for _, ms := range mc.Shards {
+		if ms.Id < 0 || ms.Id >= index.ShardCount || len(ms.Segments) == 0 || loaded[ms.Id] {
+			return nil, errors.New("manifest entry of shard " + strconv.Itoa(ms.Id) + " is invalid")
+		}
+		meta, err := index.read(r, mc.Path, ms.Meta)
+		if err != nil {
+			return nil, err
+		}
+		shard, err := flatMetaShard(meta, func() error { return nil })
+		if err != nil {
+			return nil, err
+		}
+		shard.SyncDestination = collectionPath
+		shard.readOnly = true
+		shard.external = &externalSegments{segments: make(map[int]externalSegment, len(ms.Segments))}
+		for _, segment := range ms.Segments {
+			entry, ok := index.Files[path.Join(mc.Path, segment.Name)]
+			if !ok {
+				return nil, errors.New("segment " + segment.Name + " is not in the bundle")
+			}
+			for _, id := range shard.Segments {
+				if shardSegmentName(shard.Id, id) == segment.Name {
+					shard.external.segments[id] = externalSegment{r, entry.Offset}
+				}
+			}
+			if segment.Name == shardSegmentName(shard.Id, shard.activeSegment()) {
+				shard.flushed = entry.Size
+			}
+		}
+		cm.Shared[ms.Id] = shard
+		loaded[ms.Id] = true
+	}
+	if err = c.open(collectionPath, cm, &db.options); err != nil {
+		return nil, err
+	}
+	c.readOnly = true
+	return c, nil
+}
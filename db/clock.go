@@ -0,0 +1,152 @@
+package db
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Source of the time of the background features: the synchronization and the audit in the background,
+// the expiry of the negative cache, the history and the periods of the partitions.
+// A VirtualClock in DatabaseOptions.Clock lets tests move the time forward instead of sleeping
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+type Ticker interface {
+	// receives the time of every tick, ticks are dropped while the receiver is behind
+	Chan() <-chan time.Time
+	Stop()
+}
+
+// the clock of the process, used when DatabaseOptions.Clock is nil
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	t *time.Ticker
+}
+
+func (t systemTicker) Chan() <-chan time.Time {
+	return t.t.C
+}
+
+func (t systemTicker) Stop() {
+	t.t.Stop()
+}
+
+func (o *DatabaseOptions) clock() Clock {
+	if o == nil || o.Clock == nil {
+		return SystemClock
+	}
+	return o.Clock
+}
+
+// the clock of the database, see DatabaseOptions.Clock. Helpers running on top of the database
+// read the time from it, so they follow a virtual clock as well
+func (db *Database) Clock() Clock {
+	return db.options.clock()
+}
+
+// A clock that only moves when it is told to, for deterministic tests of the time driven behavior:
+//
+//	clock := db.NewVirtualClock(time.Now())
+//	options.Clock = clock
+//	...
+//	clock.Advance(time.Minute) // fires the tickers due within the minute
+type VirtualClock struct {
+	mx      sync.Mutex
+	now     time.Time
+	tickers []*virtualTicker
+}
+
+type virtualTicker struct {
+	clock  *VirtualClock
+	period time.Duration
+	next   time.Time
+	c      chan time.Time
+}
+
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+func (c *VirtualClock) Now() time.Time {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.now
+}
+
+func (c *VirtualClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for VirtualClock.NewTicker")
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	t := &virtualTicker{clock: c, period: d, next: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Moves the time forward and fires the tickers that became due in the order of their ticks.
+// Like the ticks of a real ticker, the ones the receiver is not ready for are dropped
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	end := c.now.Add(d)
+	for {
+		due := make([]*virtualTicker, 0)
+		for _, t := range c.tickers {
+			if !t.next.After(end) {
+				due = append(due, t)
+			}
+		}
+		if len(due) == 0 {
+			break
+		}
+		sort.SliceStable(due, func(i, j int) bool {
+			return due[i].next.Before(due[j].next)
+		})
+		t := due[0]
+		c.now = t.next
+		select {
+		case t.c <- t.next:
+		default:
+		}
+		t.next = t.next.Add(t.period)
+	}
+	c.now = end
+}
+
+// number of running tickers, e.g. to wait until a background loop started
+func (c *VirtualClock) Tickers() int {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return len(c.tickers)
+}
+
+func (t *virtualTicker) Chan() <-chan time.Time {
+	return t.c
+}
+
+func (t *virtualTicker) Stop() {
+	c := t.clock
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	for i, other := range c.tickers {
+		if other == t {
+			c.tickers = append(c.tickers[:i], c.tickers[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"encoding/gob"
+	"errors"
+	"sync/atomic"
+)
+
+// Encoding of the payloads of a collection used instead of gob, e.g. for protobuf types or encrypted envelopes.
+// The id and the computed fields of the elements are still encoded with gob around the marshaled payload
+type Codec struct {
+	MarshalElement   func(payload CustomStructure) ([]byte, error)
+	UnmarshalElement func(data []byte) (CustomStructure, error)
+}
+
+// payload marshaled by the codec of the name
+type codecPayload struct {
+	Codec string
+	Data  []byte
+}
+
+func (p *codecPayload) GetDataIndex() []*FullDataIndex {
+	return nil
+}
+
+func init() {
+	gob.RegisterName("cp", &codecPayload{})
+}
+
+// Codecs are stored by their name only: register them again before loading the collections using them.
+// Every element records the codec it was written with, so it is read with that codec after SetCodec changed it
+func (db *Database) RegisterCodec(name string, codec Codec) error {
+	if name == "" || codec.MarshalElement == nil || codec.UnmarshalElement == nil {
+		return errors.New("invalid codec")
+	}
+	db.codecMutex.Lock()
+	defer db.codecMutex.Unlock()
+	if _, ok := db.codecs[name]; ok {
+		return errors.New("codec " + name + " is already registered")
+	}
+	db.codecs[name] = codec
+	return nil
+}
+
+func (db *Database) codec(name string) (Codec, bool) {
+	if db == nil {
+		return Codec{}, false
+	}
+	db.codecMutex.RLock()
+	defer db.codecMutex.RUnlock()
+	codec, ok := db.codecs[name]
+	return codec, ok
+}
+
+// Elements written from now on are marshaled by the registered codec of the name, an empty name returns to gob.
+// The name is saved with the collection, writes fail after a load until the codec is registered again
+func (c *Collection) SetCodec(name string) error {
+	if err := c.writable(); err != nil {
+		return err
+	}
+	if name != "" {
+		if _, ok := c.database.codec(name); !ok {
+			return errors.New("codec " + name + " is not registered")
+		}
+	}
+	c.sharedDestMx.Lock()
+	c.Codec = name
+	c.sharedDestMx.Unlock()
+	atomic.StoreInt32(&c.dirty, 1)
+	return nil
+}
+
+// the payload to store, marshaled by the codec of the collection if it has one
+func (c *Collection) marshalPayload(payload CustomStructure) (CustomStructure, bool, error) {
+	c.sharedDestMx.RLock()
+	name := c.Codec
+	c.sharedDestMx.RUnlock()
+	if name == "" {
+		return payload, false, nil
+	}
+	codec, ok := c.database.codec(name)
+	if !ok {
+		return nil, false, errors.New("codec " + name + " is not registered")
+	}
+	data, err := codec.MarshalElement(payload)
+	if err != nil {
+		return nil, false, errors.New("failed to marshal the payload with codec " + name + " due " + err.Error())
+	}
+	return &codecPayload{name, data}, true, nil
+}
+
+// replaces a marshaled payload of the decoded element with the one its codec unmarshals
+func (c *Collection) unmarshalPayload(e *Element) error {
+	p, ok := e.Payload.(*codecPayload)
+	if !ok {
+		return nil
+	}
+	codec, ok := c.database.codec(p.Codec)
+	if !ok {
+		return errors.New("codec " + p.Codec + " of element " + e.Id + " is not registered")
+	}
+	payload, err := codec.UnmarshalElement(p.Data)
+	if err != nil {
+		return errors.New("failed to unmarshal element " + e.Id + " with codec " + p.Codec + " due " + err.Error())
+	}
+	e.Payload = payload
+	return nil
+}
@@ -0,0 +1,79 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
+)
+
+// How the string values of an index are compared.
+// Values are indexed by their key, so equal values share a single entry
+type Collation struct {
+	// BCP 47 tag of the ordering of range conditions, e.g. "sv" or "de", byte order if empty
+	Locale string `json:"locale,omitempty"`
+	// values differing only in case are equal
+	IgnoreCase bool `json:"ignore_case,omitempty"`
+	// values are compared in the NFC form, so composed and decomposed characters are equal
+	Normalize bool `json:"normalize,omitempty"`
+}
+
+// a collator keeps buffers between the comparisons, so it is not shared between goroutines
+type lockedCollator struct {
+	mx       sync.Mutex
+	collator *collate.Collator
+}
+
+var collators sync.Map
+
+func (cl *Collation) validate() error {
+	if cl.Locale == "" {
+		return nil
+	}
+	_, err := language.Parse(cl.Locale)
+	if err != nil {
+		return errors.New("invalid locale " + cl.Locale + " due " + err.Error())
+	}
+	return nil
+}
+
+func (cl *Collation) collator() *lockedCollator {
+	if c, ok := collators.Load(cl.Locale); ok {
+		return c.(*lockedCollator)
+	}
+	c, _ := collators.LoadOrStore(cl.Locale, &lockedCollator{collator: collate.New(language.Make(cl.Locale))})
+	return c.(*lockedCollator)
+}
+
+// the form of the value stored in the index
+func (cl *Collation) Key(s string) string {
+	if cl.Normalize {
+		s = norm.NFC.String(s)
+	}
+	if cl.IgnoreCase {
+		s = cases.Fold().String(s)
+	}
+	return s
+}
+
+// 0 exactly when the keys of the values are equal
+func (cl *Collation) Compare(a, b string) int {
+	a, b = cl.Key(a), cl.Key(b)
+	if a == b {
+		return 0
+	}
+	if cl.Locale != "" {
+		lc := cl.collator()
+		lc.mx.Lock()
+		n := lc.collator.CompareString(a, b)
+		lc.mx.Unlock()
+		if n != 0 {
+			return n
+		}
+	}
+	return strings.Compare(a, b)
+}
@@ -1,14 +1,18 @@
 package db
 
 import (
-	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"encoding/binary"
 	"encoding/gob"
 	"encoding/json"
 	"errors"
 	"github.com/allegro/bigcache"
+	"github.com/rs/xid"
 	"io/ioutil"
+	"path/filepath"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,8 +22,11 @@ type UniqueIndexFunc = func(entry CustomStructure, index *FullDataIndex) error
 type IndexFunc = func(entry CustomStructure, index *FullDataIndex, limit int) (int, error)
 
 type Index struct {
-	Field  string
-	Unique bool
+	Field  string `json:"field"` // dotted path, see AddIndex
+	Unique bool   `json:"unique"`
+	Sparse bool   `json:"sparse,omitempty"`
+	// of string values, byte-wise if nil
+	Collation *Collation `json:"collation,omitempty"`
 }
 
 type FullDataIndex struct {
@@ -32,20 +39,93 @@ type Collection struct {
 	Name  string             `json:"name"`
 	Map   *ConcurrentMap     `json:"-"`
 	Cache *bigcache.BigCache `json:"-"`
+	// held while Cache is used, see resizeCache
+	cacheMx sync.RWMutex
 
 	ShardDestinations map[string]*int `json:"dests"`
 	sharedDestMx      sync.RWMutex    `json:"-"`
 
 	ObjectsCounter  int64  `json:"objects"`
 	SyncDestination string `json:"sync_dest"`
+	WriteBufferSize int64  `json:"write_buffer,omitempty"`
+	// sealed before the elements are serialized
+	EncryptedFields []string `json:"encrypted,omitempty"`
+	// elements carry separately decodable fields, see GetField
+	FieldFragments bool `json:"fragments,omitempty"`
+	// built from the dotted paths of the elements in addition to their GetDataIndex
+	Indexes []Index `json:"indexes,omitempty"`
+	// names of the computed fields, their functions are registered again after every load
+	ComputedFields []string `json:"computed,omitempty"`
+	// name of the registered codec of the payloads, see SetCodec
+	Codec string `json:"codec,omitempty"`
+	// composite ids are written to the shard of their partition, see KV.Partition
+	PartitionedKeys bool `json:"partitioned_keys,omitempty"`
+
+	syncLatency     *Histogram
+	optimizeLatency *Histogram
+	// the description changed since the last sync
+	dirty int32
+	// set by SetEncryption, guarded by sharedDestMx
+	fields  *fieldCipher
+	options *DatabaseOptions
+	// started by the first WriteAsync
+	async       *asyncWriter
+	asyncClosed bool
+	asyncMx     sync.RWMutex
+	// held by WithKeyLock
+	keyLocks keyLockTable
+	// held by LockExclusive and LockShared
+	locks collectionLocks
+	// functions of the computed fields, copied on write
+	computed map[string]ComputedFunc
+	// set by SetQueryCache
+	queryCache *queryCache
+	// mounted by AttachCollection
+	readOnly bool
+	// shard reads of FindById and ScanN in progress
+	reads flightGroup
+	// set by SetNegativeCache
+	negativeCache *negativeCache
+	// set by TrackHotKeys
+	hotKeys *hotKeys
+	// set by SetHistory
+	history *history
+	// Merkle trees of the shards, see MerkleTree
+	merkle merkleCache
+	// sorted sort parts of the partitions of the shards, see PartitionedKeys
+	partitions partitionCache
+	// element sizes of the shards, see SizeStats
+	sizes sizeCache
+	// queries that read the whole collection, see IndexSuggestions
+	scans scanStats
+	// the database the collection was added to or loaded by, nil for attached ones
+	database *Database
+	// changed whenever Indexes changes, see PreparedQuery
+	indexVersion uint64
+	// declared indexes that are still backfilled, the planner does not read them. Guarded by sharedDestMx
+	building map[string]bool
 }
 
 type Element struct {
 	Id      string      `json:"x"`
 	Payload interface{} `json:"p"`
+	// values of the computed fields at the time of the write, see AddComputedField
+	Computed map[string]interface{} `json:"c,omitempty"`
+	// set while DatabaseOptions.ReplicaId is, see MergeWith
+	Version *ElementVersion `json:"v,omitempty"`
+	// bytes of the encoded element it was decoded from, see Config.MaxQueryBytes
+	size int
 }
 
 func NewCollectionCache() *bigcache.BigCache {
+	return newCollectionCache(0)
+}
+
+// size in megabytes, 0 takes a quarter of the free memory
+func newCollectionCache(size int) *bigcache.BigCache {
+	if size <= 0 {
+		size = int(GetFreeMemory() / 4)
+	}
 	config := bigcache.Config{
 		// number of shards (must be a power of 2)
 		Shards: 1024,
@@ -60,7 +140,7 @@ func NewCollectionCache() *bigcache.BigCache {
 		// cache will not allocate more memory than this limit, value in MB
 		// if value is reached then the oldest entries can be overridden for the new ones
 		// 0 value means no size limit
-		HardMaxCacheSize: int(GetFreeMemory() / 4),
+		HardMaxCacheSize: size,
 		// callback fired when the oldest entry is removed because of its
 		// expiration time or no space left for the new entry. Default value is nil which
 		// means no callback and it prevents from unwrapping the oldest entry.
@@ -71,9 +151,66 @@ func NewCollectionCache() *bigcache.BigCache {
 	return bc
 }
 
+// Replaces the read cache by one of the size in megabytes, 0 sizes it by the free memory.
+// The entries are carried over as far as they fit, readers of the cache wait meanwhile
+func (c *Collection) resizeCache(size int) {
+	next := newCollectionCache(size)
+	c.cacheMx.Lock()
+	defer c.cacheMx.Unlock()
+	if previous := c.Cache; previous != nil {
+		it := previous.Iterator()
+		for it.SetNext() {
+			if entry, err := it.Value(); err == nil {
+				next.Set(entry.Key(), entry.Value())
+			}
+		}
+		previous.Close()
+	}
+	c.Cache = next
+}
+
+func (c *Collection) cacheSet(key string, entry []byte) error {
+	c.cacheMx.RLock()
+	defer c.cacheMx.RUnlock()
+	return c.Cache.Set(key, entry)
+}
+
+func (c *Collection) cacheGet(key string) ([]byte, error) {
+	c.cacheMx.RLock()
+	defer c.cacheMx.RUnlock()
+	return c.Cache.Get(key)
+}
+
 func NewCollection(path, name string, cm *ConcurrentMap, sd map[string]*int) *Collection {
-	return &Collection{name, cm, NewCollectionCache(),
-		sd, sync.RWMutex{}, 0, path}
+	return &Collection{
+		Name:              name,
+		Map:               cm,
+		Cache:             NewCollectionCache(),
+		ShardDestinations: sd,
+		SyncDestination:   path,
+		syncLatency:       NewHistogram(LATENCY_BUCKETS),
+		optimizeLatency:   NewHistogram(LATENCY_BUCKETS),
+		dirty:             1,
+	}
+}
+
+// attaches the loaded description to the shards on the drive
+func (c *Collection) open(path string, cm *ConcurrentMap, options *DatabaseOptions) error {
+	c.Map = cm
+	c.setOptions(options)
+	c.Cache = newCollectionCache(options.orDefault().Config.CacheSize)
+	c.SyncDestination = path
+	c.syncLatency = NewHistogram(LATENCY_BUCKETS)
+	c.optimizeLatency = NewHistogram(LATENCY_BUCKETS)
+	return cm.SetWriteBufferSize(c.WriteBufferSize)
+}
+
+func (c *Collection) setOptions(options *DatabaseOptions) {
+	c.options = options
+	c.Map.options = options
+	for _, shard := range c.Map.Shared {
+		shard.options = options
+	}
 }
 
 //! Not intended to use in production
@@ -83,13 +220,14 @@ func (c *Collection) GetRandomAliveObject() (string, *Element, error) {
 		return "", nil, errors.New("collections does not have any shards")
 	}
 	attempts := 0
+	shard.loadMeta()
 	for len(shard.Items) <= 0 {
 		shard = c.Map.GetNextShard()
 		if shard == nil {
 			return "", nil, errors.New("collections does not have any shards")
 		}
 		attempts++
-		if attempts >= SHARD_COUNT {
+		if attempts >= len(c.Map.Shared) {
 			return "", nil, errors.New("too many attempts")
 		}
 	}
@@ -118,8 +256,15 @@ func (c *Collection) StringifyDataIndex(index []*FullDataIndex) (result string)
 }
 
 func (c *Collection) DecodeElement(data []byte) (*Element, error) {
-	e := new(Element)
-	return e, gob.NewDecoder(bytes.NewReader(data)).Decode(e)
+	e := &Element{size: len(data)}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(e)
+	if err != nil {
+		return e, err
+	}
+	if err = c.unmarshalPayload(e); err != nil {
+		return e, err
+	}
+	return e, c.decryptPayload(e.Payload)
 }
 
 func (c *Collection) Size() int64 {
@@ -127,32 +272,103 @@ func (c *Collection) Size() int64 {
 }
 
 // synchronizes the collection with the hard drive
-func (c *Collection) Sync() (err error) {
-	err = c.Map.Flush()
+func (c *Collection) Sync() error {
+	return c.SyncContext(context.Background())
+}
+
+// same as Sync, the files are written in chunks and the context is checked between them,
+// so a stuck drive can't hold the caller past its deadline. An attached collection has nothing to save
+func (c *Collection) SyncContext(ctx context.Context) (err error) {
+	if c.readOnly {
+		return nil
+	}
+	start := time.Now()
+	defer func() {
+		c.syncLatency.Observe(time.Since(start))
+	}()
+	err = c.Map.SyncContext(ctx)
 	if err != nil {
-		// very critical error
 		return err
 	}
-	err = c.Map.Sync()
+	err = c.saveHotKeys(ctx)
 	if err != nil {
 		return err
 	}
 	c.sharedDestMx.Lock()
 	defer c.sharedDestMx.Unlock()
+	atomic.StoreInt32(&c.dirty, 0)
 	data, err := json.Marshal(c)
+	if err == nil {
+		p := NewCompressedPackage(filepath.Join(c.SyncDestination, c.Name+".json.gzip"), data)
+		p.SetOptions(c.options)
+		err = p.SaveContext(ctx)
+	}
 	if err != nil {
-		return err
+		atomic.StoreInt32(&c.dirty, 1)
 	}
-	p := NewCompressedPackage(c.SyncDestination+"/"+c.Name+".json.gzip", data)
-	return p.Save()
+	return err
+}
+
+// writers update the objects counter atomically without the lock, so it is marshaled from a snapshot
+func (c *Collection) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Schema            int             `json:"schema"`
+		Name              string          `json:"name"`
+		ShardDestinations map[string]*int `json:"dests"`
+		ObjectsCounter    int64           `json:"objects"`
+		SyncDestination   string          `json:"sync_dest"`
+		WriteBufferSize   int64           `json:"write_buffer,omitempty"`
+		EncryptedFields   []string        `json:"encrypted,omitempty"`
+		FieldFragments    bool            `json:"fragments,omitempty"`
+		Indexes           []Index         `json:"indexes,omitempty"`
+		ComputedFields    []string        `json:"computed,omitempty"`
+		Codec             string          `json:"codec,omitempty"`
+		PartitionedKeys   bool            `json:"partitioned_keys,omitempty"`
+	}{DESCRIPTION_SCHEMA, c.Name, c.ShardDestinations, c.Size(), c.SyncDestination, c.WriteBufferSize,
+		c.EncryptedFields, c.FieldFragments, c.Indexes, c.ComputedFields, c.Codec, c.PartitionedKeys})
 }
 
-func (c *Collection) Optimize() (int64, error) {
-	return c.Map.OptimizeShards()
+// ids of the shards with changes that were not synchronized yet
+func (c *Collection) DirtyShards() []int {
+	return c.Map.DirtyShards()
+}
+
+func (c *Collection) IsDirty() bool {
+	return atomic.LoadInt32(&c.dirty) == 1 || len(c.Map.DirtyShards()) > 0
+}
+
+// inserts are kept in memory until the buffer of the given size (bytes) is full or the collection is synchronized,
+// reads are served from the buffer meanwhile. 0 disables the buffering
+func (c *Collection) SetWriteBufferSize(size int64) error {
+	c.sharedDestMx.Lock()
+	c.WriteBufferSize = size
+	c.sharedDestMx.Unlock()
+	atomic.StoreInt32(&c.dirty, 1)
+	return c.Map.SetWriteBufferSize(size)
+}
+
+func (c *Collection) Optimize() (*OptimizeReport, error) {
+	if err := c.writable(); err != nil {
+		return &OptimizeReport{}, err
+	}
+	start := time.Now()
+	defer func() {
+		c.optimizeLatency.Observe(time.Since(start))
+	}()
+	if err := c.getHistory().prune(c.options.clock().Now()); err != nil {
+		return &OptimizeReport{}, errors.New("failed to prune the history due " + err.Error())
+	}
+	report, err := c.Map.OptimizeShards()
+	report.Duration = time.Since(start)
+	return report, err
 }
 
 func (c *Collection) RestoreN(entry CustomStructure, limit int) (int, error) {
+	if err := c.writable(); err != nil {
+		return 0, err
+	}
 	counter, err := c.iterateIndexes(entry, limit, c.restoreByUniqueIndex, c.restoreByIndex)
+	c.getNegativeCache().clear()
 	if err != nil {
 		return counter, err
 	}
@@ -167,24 +383,105 @@ func (c *Collection) Restore(entry CustomStructure) (int, error) {
 
 // part of the memory will be marked as "deleted". Actual memory will be released after compression
 func (c *Collection) DeleteById(id string) error {
+	if err := c.writable(); err != nil {
+		return err
+	}
+	version, err := c.deleteVersion(id)
+	if err != nil {
+		return err
+	}
+	return c.deleteById(id, version)
+}
+
+// deletes the element, a versioned delete leaves a tombstone so MergeWith does not bring the element back
+func (c *Collection) deleteById(id string, version *ElementVersion) error {
 	idKey := "id:" + id
-	c.Cache.Set(idKey, nil)
+	c.cacheSet(idKey, nil)
 	shard, err := c.getShardByKeySafe(idKey)
 	if err != nil {
 		return err
 	}
 	c.Map.DeleteById(shard, id)
 	//c.deleteDestination(idKey)
+	if version != nil {
+		if err = c.Map.setTombstone(shard, id, version); err != nil {
+			return err
+		}
+	}
+	atomic.AddInt64(&c.ObjectsCounter, -1)
+	return c.getHistory().record(id, nil, true)
+}
+
+// Replaces the element keeping its id. The old version is deleted with every index entry it had,
+// the new one is indexed from scratch, so values that are gone from a multi-value field are no longer found
+func (c *Collection) Update(id string, payload CustomStructure) error {
+	if err := c.writable(); err != nil {
+		return err
+	}
+	version, err := c.nextVersion(id, payload)
+	if err != nil {
+		return err
+	}
+	return c.update(id, payload, version)
+}
+
+// replaces the element by the payload written with the version
+func (c *Collection) update(id string, payload CustomStructure, version *ElementVersion) error {
+	idKey := "id:" + id
+	shard, err := c.getShardByKeySafe(idKey)
+	if err != nil {
+		return errors.New("element " + id + " not found")
+	}
+	shard.Lock()
+	item, ok := shard.Items[idKey]
+	if !ok || item.Deleted {
+		shard.Unlock()
+		return errors.New("element " + id + " not found")
+	}
+	item.Deleted = true
+	shard.offsetChanged(item)
+	shard.markDirty()
+	shard.Unlock()
+	c.cacheSet(idKey, nil)
+
+	err = c.writeVersion(context.Background(), id, payload, version)
+	if err != nil {
+		shard.Lock()
+		item.Deleted = false
+		shard.offsetChanged(item)
+		shard.Unlock()
+		return err
+	}
 	atomic.AddInt64(&c.ObjectsCounter, -1)
 	return nil
 }
 
 func (c *Collection) DeleteN(entry CustomStructure, limit int) (int, error) {
+	if err := c.writable(); err != nil {
+		return 0, err
+	}
+	// the ids of the deleted elements are needed for their history only
+	h := c.getHistory()
+	var ids []string
+	if h != nil {
+		// nothing matches when the scan fails
+		found, _ := c.ScanN(entry, limit, false)
+		for _, data := range found {
+			if e, err := c.DecodeElement(data); err == nil {
+				ids = append(ids, e.Id)
+			}
+		}
+	}
 	counter, err := c.iterateIndexes(entry, limit, c.deleteByUniqueIndex, c.deleteByIndex)
 	if err != nil {
 		return counter, err
 	}
 	atomic.AddInt64(&c.ObjectsCounter, -int64(counter))
+	for _, id := range ids {
+		if err = h.record(id, nil, true); err != nil {
+			return counter, err
+		}
+	}
 	return counter, nil
 }
 
@@ -194,7 +491,48 @@ func (c *Collection) Delete(entry CustomStructure) (int, error) {
 }
 
 func (c *Collection) Write(payload CustomStructure) error {
-	destMap, err := c.Map.Set(payload.GetDataIndex(), payload)
+	return c.writeWithId(context.Background(), xid.New().String(), payload)
+}
+
+// same as Write, gives up once the context ends
+func (c *Collection) WriteContext(ctx context.Context, payload CustomStructure) error {
+	return c.writeWithId(ctx, xid.New().String(), payload)
+}
+
+func (c *Collection) writeWithId(ctx context.Context, id string, payload CustomStructure) error {
+	version, err := c.nextVersion(id, payload)
+	if err != nil {
+		return err
+	}
+	return c.writeVersion(ctx, id, payload, version)
+}
+
+// writes the payload under the id, version is nil unless the database has a ReplicaId
+func (c *Collection) writeVersion(ctx context.Context, id string, payload CustomStructure, version *ElementVersion) error {
+	if err := c.writable(); err != nil {
+		return err
+	}
+	if err := c.database.diskAvailable(); err != nil {
+		return err
+	}
+	// computed from the plain payload
+	computed, err := c.computeFields(payload)
+	if err != nil {
+		return err
+	}
+	indexes, err := c.writeIndex(payload)
+	if err != nil {
+		return err
+	}
+	payload, err = c.encryptPayload(payload)
+	if err != nil {
+		return err
+	}
+	data, err := c.encodeElement(id, payload, computed, version)
+	if err != nil {
+		return err
+	}
+	destMap, err := c.Map.setEncodedToShard(ctx, c.idShard(id), id, indexes, data)
 	if err != nil {
 		return err
 	}
@@ -204,58 +542,143 @@ func (c *Collection) Write(payload CustomStructure) error {
 	}
 	c.sharedDestMx.Unlock()
 	destMap = nil
+	c.forgetAbsent(id, indexes)
 	atomic.AddInt64(&c.ObjectsCounter, 1)
-	return nil
+	return c.getHistory().record(id, data, false)
+}
+
+// an id keeps its shard, so a new version or a write after a delete replaces its entry instead of leaving a deleted one behind
+func (c *Collection) idShard(id string) *ConcurrentMapShared {
+	if shard, err := c.getShardByKeySafe("id:" + id); err == nil {
+		return shard
+	}
+	return c.placeId(id)
 }
 
+// Concurrent misses of the same id share a single read of the shard, the returned data must not be modified
 func (c *Collection) FindById(id string, cacheResult bool) ([]byte, error) {
+	c.getHotKeys().touch(id)
+	return c.findById(id, cacheResult)
+}
+
+func (c *Collection) findById(id string, cacheResult bool) ([]byte, error) {
 	idKey := "id:" + id
-	dataInterface, err := c.loadCache(idKey)
-	if err == nil && dataInterface != nil {
-		return dataInterface.([]byte), nil
+	// a write to the shard of the element drops its cached copy
+	generation := c.keyGeneration(idKey)
+	var cached []byte
+	if c.loadCache(idKey, generation, &cached) == nil {
+		return cached, nil
 	}
-	shard := c.getShardByKey(idKey)
-	data, err := c.Map.FindById(shard, id)
+	nc := c.getNegativeCache()
+	if nc.absent(idKey) {
+		return nil, errNotFound
+	}
+	epoch := nc.currentEpoch()
+	data, err := c.reads.do(idKey, func() (interface{}, error) {
+		if !c.hasKey(idKey) {
+			nc.remember(idKey, epoch)
+			return nil, errNotFound
+		}
+		shard, err := c.getShardByKeySafe(idKey)
+		if err != nil {
+			return nil, errNotFound
+		}
+		data, err := c.Map.FindById(shard, id)
+		if err != nil {
+			return nil, err
+		}
+		if cacheResult {
+			c.cache(idKey, generation, data)
+		}
+		return data, nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	if cacheResult {
-		c.cache(idKey, data)
+	return data.([]byte), nil
+}
+
+// changes of the shard holding the key, 0 if there is none
+func (c *Collection) keyGeneration(key string) uint64 {
+	shard, err := c.getShardByKeySafe(key)
+	if err != nil {
+		return 0
+	}
+	return atomic.LoadUint64(&shard.generation)
+}
+
+// same as FindById without caching, gives up once the context ends
+func (c *Collection) FindByIdContext(ctx context.Context, id string) ([]byte, error) {
+	idKey := "id:" + id
+	shard, err := c.getShardByKeySafe(idKey)
+	if err != nil {
+		return nil, errNotFound
+	}
+	shard.RLock()
+	defer shard.RUnlock()
+	if item, ok := shard.Items[idKey]; ok && !item.Deleted {
+		return shard.readAtContext(ctx, item)
 	}
-	return data, nil
+	return nil, errNotFound
 }
 
 func (c *Collection) ScanN(entry CustomStructure, limit int, cacheResult bool) ([][]byte, error) {
-	indexes := entry.GetDataIndex()
+	indexes, err := c.dataIndex(entry)
+	if err != nil {
+		return nil, err
+	}
 	indexesString := c.StringifyDataIndex(indexes)
-	dataInterface, err := c.loadCache(indexesString)
-	if err == nil && dataInterface != nil {
-		return dataInterface.([][]byte), nil
+	// any write to the collection drops the cached scans
+	generation := c.Map.generation()
+	var cached [][]byte
+	if c.loadCache(indexesString, generation, &cached) == nil {
+		return cached, nil
 	}
-	for _, ix := range indexes {
-		if ix.Data == "" {
-			continue
-		}
-		if ix.Unique {
-			data, err := c.scanByUniqueIndex(entry, ix)
-			if err != nil {
-				return nil, err
+	nc := c.getNegativeCache()
+	epoch := nc.currentEpoch()
+	// misses of the same keys and limit share the read
+	dataSet, err := c.reads.do("scan\x00"+strconv.Itoa(limit)+"\x00"+indexesString, func() (interface{}, error) {
+		for _, ix := range indexes {
+			if ix.Data == "" {
+				continue
+			}
+			key := ix.Field + ":" + ix.Data
+			if nc.absent(key) {
+				return nil, errors.New("no matching data")
+			}
+			var dataSet [][]byte
+			var err error
+			if ix.Unique {
+				if !c.hasKey(key) {
+					nc.remember(key, epoch)
+					return nil, errors.New("no matching data")
+				}
+				data, err := c.scanByUniqueIndex(entry, ix)
+				if err != nil {
+					return nil, err
+				}
+				dataSet = [][]byte{data}
+			} else {
+				dataSet, err = c.Map.FindByKey(ix.Field, ix.Data, limit)
+				if err != nil {
+					return nil, err
+				}
+				if len(dataSet) == 0 {
+					nc.remember(key, epoch)
+					return nil, errors.New("zero results")
+				}
 			}
 			if cacheResult {
-				c.cache(indexesString, data)
+				c.cache(indexesString, generation, dataSet)
 			}
-			return [][]byte{data}, nil
+			return dataSet, nil
 		}
-		dataSet, err := c.scanByIndex(entry, ix, limit)
-		if err != nil {
-			return nil, err
-		}
-		if cacheResult {
-			c.cache(indexesString, dataSet)
-		}
-		return dataSet, nil
+		return nil, errors.New("no matching data")
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil, errors.New("no matching data")
+	return dataSet.([][]byte), nil
 }
 
 func (c *Collection) ScanOne(entry CustomStructure, cacheResult bool) ([]byte, error) {
@@ -332,18 +755,11 @@ func (c *Collection) scanByUniqueIndex(entry CustomStructure, index *FullDataInd
 	return c.Map.FindByUniqueKey(shard, index.Field, index.Data)
 }
 
-func (c *Collection) scanByIndex(entry CustomStructure, index *FullDataIndex, limit int) ([][]byte, error) {
-	data, err := c.Map.FindByKey(index.Field, index.Data, limit)
+func (c *Collection) iterateIndexes(entry CustomStructure, limit int, ucb UniqueIndexFunc, cb IndexFunc) (int, error) {
+	indexes, err := c.dataIndex(entry)
 	if err != nil {
-		return nil, err
-	} else if len(data) == 0 {
-		return nil, errors.New("zero results")
+		return -1, err
 	}
-	return data, nil
-}
-
-func (c *Collection) iterateIndexes(entry CustomStructure, limit int, ucb UniqueIndexFunc, cb IndexFunc) (int, error) {
-	indexes := entry.GetDataIndex()
 	counter := 0
 	for _, ix := range indexes {
 		if ix.Data == "" {
@@ -366,35 +782,44 @@ func (c *Collection) iterateIndexes(entry CustomStructure, limit int, ucb Unique
 	return counter, nil
 }
 
-func (c *Collection) cache(key string, dataInterface interface{}) error {
+// Cached values carry the generation of the shards they were read at, see loadCache
+func (c *Collection) cache(key string, generation uint64, dataInterface interface{}) error {
 	var data bytes.Buffer
 	var compressedBuf bytes.Buffer
-	writer := bufio.NewWriter(&compressedBuf)
+	binary.Write(&compressedBuf, binary.LittleEndian, generation)
 	enc := gob.NewEncoder(&data)
 	err := enc.Encode(dataInterface)
 	if err != nil {
 		return err
 	}
-	gzipw, _ := gzip.NewWriterLevel(writer, gzip.BestSpeed)
+	// straight into the buffer, a buffered writer would have to be flushed before the bytes are cached
+	gzipw, _ := gzip.NewWriterLevel(&compressedBuf, gzip.BestSpeed)
 	_, err = gzipw.Write(data.Bytes())
 	gzipw.Close()
-	return c.Cache.Set(key, compressedBuf.Bytes())
+	return c.cacheSet(key, compressedBuf.Bytes())
 }
 
-func (c *Collection) loadCache(key string) (interface{}, error) {
-	data, err := c.Cache.Get(key)
+// Decodes the cached value into the pointer. Entries invalidated with a nil value and the ones cached
+// at another generation of the shards are misses
+func (c *Collection) loadCache(key string, generation uint64, value interface{}) error {
+	data, err := c.cacheGet(key)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if len(data) < 8 {
+		return errors.New("entry " + key + " was invalidated")
+	}
+	if binary.LittleEndian.Uint64(data) != generation {
+		return errors.New("entry " + key + " is stale")
 	}
-	buf := bytes.NewBuffer(data)
-	reader, err := gzip.NewReader(buf)
+	reader, err := gzip.NewReader(bytes.NewReader(data[8:]))
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer reader.Close()
 	decompressedData, err := ioutil.ReadAll(reader)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return gob.NewDecoder(bytes.NewReader(decompressedData)), nil
+	return gob.NewDecoder(bytes.NewReader(decompressedData)).Decode(value)
 }
@@ -0,0 +1,245 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	LOCK_SHARED    = "shared"
+	LOCK_EXCLUSIVE = "exclusive"
+)
+
+// time after which a collection lock that was neither released nor extended is dropped, see Config.LockTimeout
+const DEFAULT_LOCK_TIMEOUT = 10 * time.Minute
+
+// Returned by Unlock and Extend of a lock that was dropped after its timeout,
+// another holder may have taken the collection since
+var ErrLockExpired = errors.New("collection lock expired")
+
+// A lock of LockExclusive or LockShared, released by Unlock
+type CollectionLock struct {
+	c       *Collection
+	mode    string
+	since   time.Time
+	expires time.Time
+}
+
+// Holders of the lock of a collection at one moment, see Collection.LockInfo
+type CollectionLockInfo struct {
+	Mode    string `json:"mode"`
+	Holders int    `json:"holders"`
+	// acquired by the oldest holder
+	Since time.Time `json:"since"`
+	// the first holder is dropped then unless it is extended
+	Expires time.Time `json:"expires"`
+	// callers waiting for the lock
+	Waiters int `json:"waiters"`
+}
+
+type collectionLocks struct {
+	mx      sync.Mutex
+	holders map[*CollectionLock]struct{}
+	waiters int
+	// exclusive callers waiting, new shared locks wait behind them so they are not starved
+	exclusiveWaiters int
+	// closed and replaced whenever a lock is released
+	released chan struct{}
+}
+
+// Waits until no other LockExclusive or LockShared lock of the collection is held, or ctx is done.
+// Like WithKeyLock the lock is advisory: batch jobs (a rebuild, an export) and the parts of the application
+// that must not interleave with them take it, plain reads and writes go on. A lock that is not released
+// within Config.LockTimeout is dropped, so a crashed job does not block the collection forever,
+// long jobs call Extend
+func (c *Collection) LockExclusive(ctx context.Context) (*CollectionLock, error) {
+	return c.lockCollection(ctx, LOCK_EXCLUSIVE)
+}
+
+// Waits until no LockExclusive lock of the collection is held or waited for, or ctx is done.
+// Shared locks are held at the same time, see LockExclusive
+func (c *Collection) LockShared(ctx context.Context) (*CollectionLock, error) {
+	return c.lockCollection(ctx, LOCK_SHARED)
+}
+
+func (c *Collection) lockTimeout() time.Duration {
+	if c.database != nil {
+		if timeout := c.database.Config().LockTimeout; timeout > 0 {
+			return timeout
+		}
+	}
+	return DEFAULT_LOCK_TIMEOUT
+}
+
+func (c *Collection) lockClock() Clock {
+	if c.database != nil {
+		return c.database.Clock()
+	}
+	return c.options.clock()
+}
+
+func (c *Collection) lockCollection(ctx context.Context, mode string) (*CollectionLock, error) {
+	t := &c.locks
+	clock := c.lockClock()
+	// expired holders are only noticed by the callers, the ticker makes waiting ones look again
+	var ticker Ticker
+	waiting := false
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+	for {
+		t.mx.Lock()
+		now := clock.Now()
+		t.expire(c, now)
+		if t.available(mode) {
+			if waiting {
+				t.stopWaiting(mode)
+			}
+			l := &CollectionLock{c: c, mode: mode, since: now, expires: now.Add(c.lockTimeout())}
+			if t.holders == nil {
+				t.holders = make(map[*CollectionLock]struct{})
+			}
+			t.holders[l] = struct{}{}
+			t.mx.Unlock()
+			return l, nil
+		}
+		if !waiting {
+			waiting = true
+			t.waiters++
+			if mode == LOCK_EXCLUSIVE {
+				t.exclusiveWaiters++
+			}
+		}
+		if t.released == nil {
+			t.released = make(chan struct{})
+		}
+		released := t.released
+		t.mx.Unlock()
+		if ticker == nil {
+			ticker = clock.NewTicker(time.Second)
+		}
+
+		select {
+		case <-ctx.Done():
+			t.mx.Lock()
+			t.stopWaiting(mode)
+			// a waiting exclusive caller may have held back shared ones
+			t.broadcast()
+			t.mx.Unlock()
+			return nil, errors.New("failed to lock collection " + c.Name + " due " + ctx.Err().Error())
+		case <-released:
+		case <-ticker.Chan():
+		}
+	}
+}
+
+// the lock is held
+func (t *collectionLocks) available(mode string) bool {
+	if mode == LOCK_EXCLUSIVE {
+		return len(t.holders) == 0
+	}
+	for l := range t.holders {
+		if l.mode == LOCK_EXCLUSIVE {
+			return false
+		}
+	}
+	return t.exclusiveWaiters == 0
+}
+
+// the lock is held
+func (t *collectionLocks) stopWaiting(mode string) {
+	t.waiters--
+	if mode == LOCK_EXCLUSIVE {
+		t.exclusiveWaiters--
+	}
+}
+
+// the lock is held
+func (t *collectionLocks) broadcast() {
+	if t.released != nil {
+		close(t.released)
+		t.released = nil
+	}
+}
+
+// drops the holders past their timeout, the lock is held
+func (t *collectionLocks) expire(c *Collection, now time.Time) {
+	expired := false
+	for l := range t.holders {
+		if !now.Before(l.expires) {
+			delete(t.holders, l)
+			expired = true
+			if c.database != nil {
+				c.database.logf(LOG_WARNING, "dropped the", l.mode, "lock of collection", c.Name, "held since", l.since.Format(time.RFC3339))
+			}
+		}
+	}
+	if expired {
+		t.broadcast()
+	}
+}
+
+// Releases the lock, ErrLockExpired when it was dropped after its timeout before
+func (l *CollectionLock) Unlock() error {
+	t := &l.c.locks
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.expire(l.c, l.c.lockClock().Now())
+	if _, ok := t.holders[l]; !ok {
+		return ErrLockExpired
+	}
+	delete(t.holders, l)
+	t.broadcast()
+	return nil
+}
+
+// Moves the expiry of the lock a full timeout ahead, ErrLockExpired when it was dropped already
+func (l *CollectionLock) Extend() error {
+	t := &l.c.locks
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	now := l.c.lockClock().Now()
+	t.expire(l.c, now)
+	if _, ok := t.holders[l]; !ok {
+		return ErrLockExpired
+	}
+	l.expires = now.Add(l.c.lockTimeout())
+	return nil
+}
+
+func (l *CollectionLock) Mode() string {
+	return l.mode
+}
+
+func (l *CollectionLock) Expires() time.Time {
+	t := &l.c.locks
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return l.expires
+}
+
+// The holders of LockExclusive and LockShared locks, nil while the collection is not locked
+func (c *Collection) LockInfo() *CollectionLockInfo {
+	t := &c.locks
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.expire(c, c.lockClock().Now())
+	if len(t.holders) == 0 {
+		return nil
+	}
+	info := &CollectionLockInfo{Mode: LOCK_SHARED, Holders: len(t.holders), Waiters: t.waiters}
+	for l := range t.holders {
+		info.Mode = l.mode
+		if info.Since.IsZero() || l.since.Before(info.Since) {
+			info.Since = l.since
+		}
+		if info.Expires.IsZero() || l.expires.Before(info.Expires) {
+			info.Expires = l.expires
+		}
+	}
+	return info
+}
@@ -0,0 +1,44 @@
+package db
+
+import (
+	"io/fs"
+	"sort"
+)
+
+type CompatibilityReport struct {
+	Version     int      // version the data was written with
+	Manifest    bool     // data directory is described by a MANIFEST
+	Collections []string // collections that can be loaded
+	Objects     int64
+}
+
+// checks whether the database under the path can be loaded by this version of the library.
+// Nothing is written, the data is only read
+func CheckCompatibility(path string) (*CompatibilityReport, error) {
+	db := NewDatabase("")
+	fsys, err := db.fileSystem(path)
+	if err != nil {
+		return nil, err
+	}
+	header, err := db.readHeader(fsys)
+	if err != nil {
+		return nil, err
+	}
+	report := &CompatibilityReport{Version: header.Version}
+	_, err = fs.Stat(fsys, MANIFEST_NAME)
+	report.Manifest = err == nil
+
+	err = db.ScanAndLoadData(path)
+	defer db.Close()
+	if err != nil {
+		return report, err
+	}
+	db.collectionMutex.RLock()
+	for name, c := range db.collections {
+		report.Collections = append(report.Collections, name)
+		report.Objects += c.Size()
+	}
+	db.collectionMutex.RUnlock()
+	sort.Strings(report.Collections)
+	return report, nil
+}
@@ -1,8 +1,9 @@
 package db
 
 import (
-	"bytes"
 	"compress/gzip"
+	"context"
+	"io"
 	"io/ioutil"
 	"os"
 )
@@ -11,10 +12,11 @@ type CompressedPackage struct {
 	name             string
 	data             []byte
 	compressionLevel int
+	options          *DatabaseOptions
 }
 
 func NewCompressedPackage(name string, data []byte) *CompressedPackage {
-	return &CompressedPackage{name, data, gzip.BestCompression}
+	return &CompressedPackage{name, data, gzip.BestCompression, nil}
 }
 
 func (p *CompressedPackage) SetData(data []byte) {
@@ -25,19 +27,30 @@ func (p *CompressedPackage) SetCompressionLevel(level int) {
 	p.compressionLevel = level
 }
 
-func (p *CompressedPackage) Save() error {
-	data := bytes.NewBuffer(p.data)
-	f, err := os.Create(p.name)
-	if err != nil {
-		return err
+func (p *CompressedPackage) SetOptions(options *DatabaseOptions) {
+	p.options = options
+	if options != nil {
+		p.compressionLevel = options.CompressionLevel
 	}
-	defer f.Close()
+}
 
-	gzipw, _ := gzip.NewWriterLevel(f, p.compressionLevel)
-	defer gzipw.Close()
-	_, err = gzipw.Write(data.Bytes())
+func (p *CompressedPackage) Save() error {
+	return p.SaveContext(context.Background())
+}
 
-	return err
+// same as Save, the file is written in chunks honoring the context
+func (p *CompressedPackage) SaveContext(ctx context.Context) error {
+	return p.options.writeAtomicallyContext(ctx, p.name, func(w io.Writer) error {
+		gzipw, err := gzip.NewWriterLevel(w, p.compressionLevel)
+		if err != nil {
+			return err
+		}
+		_, err = gzipw.Write(p.data)
+		if err != nil {
+			return err
+		}
+		return gzipw.Close()
+	})
 }
 
 func (p *CompressedPackage) Load() ([]byte, error) {
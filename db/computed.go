@@ -0,0 +1,179 @@
+package db
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// computed fields are addressed as "$<name>" by indexes and queries
+const COMPUTED_PREFIX = "$"
+
+// Value of a computed field derived from the payload: a string, a number, a bool or nil for no value
+type ComputedFunc func(payload CustomStructure) interface{}
+
+// Adds a field derived from the payload, e.g. LowercaseOf("email"). The value is computed by every write
+// and stored with the element, so queries on "$<name>" don't compute it per read, and it can be indexed with
+// AddIndex("$<name>", ...). Elements written before the field was added get their value computed when read.
+// Functions are not stored: register them again after every load, writes fail until then.
+// Values are stored in plain text, even when derived from encrypted fields
+func (c *Collection) AddComputedField(name string, fn ComputedFunc) error {
+	if name == "" || strings.ContainsAny(name, ".[]"+COMPUTED_PREFIX) {
+		return errors.New("invalid computed field name " + name)
+	}
+	if fn == nil {
+		return errors.New("computed field " + name + " has no function")
+	}
+	c.sharedDestMx.Lock()
+	defer c.sharedDestMx.Unlock()
+	if _, ok := c.computed[name]; ok {
+		return errors.New("computed field " + name + " already exists")
+	}
+	computed := make(map[string]ComputedFunc, len(c.computed)+1)
+	for k, v := range c.computed {
+		computed[k] = v
+	}
+	computed[name] = fn
+	c.computed = computed
+	for _, declared := range c.ComputedFields {
+		if declared == name {
+			// registered again after a load
+			return nil
+		}
+	}
+	c.ComputedFields = append(append(make([]string, 0, len(c.ComputedFields)+1), c.ComputedFields...), name)
+	atomic.StoreInt32(&c.dirty, 1)
+	return nil
+}
+
+func (c *Collection) computedFunc(name string) ComputedFunc {
+	c.sharedDestMx.RLock()
+	defer c.sharedDestMx.RUnlock()
+	return c.computed[name]
+}
+
+func (c *Collection) isComputedField(name string) bool {
+	c.sharedDestMx.RLock()
+	defer c.sharedDestMx.RUnlock()
+	for _, declared := range c.ComputedFields {
+		if declared == name {
+			return true
+		}
+	}
+	return false
+}
+
+func computedName(path string) (string, bool) {
+	if !strings.HasPrefix(path, COMPUTED_PREFIX) || isJSONPath(path) {
+		return "", false
+	}
+	return strings.TrimPrefix(path, COMPUTED_PREFIX), true
+}
+
+// values of every computed field of the collection, nil without any
+func (c *Collection) computeFields(payload CustomStructure) (map[string]interface{}, error) {
+	c.sharedDestMx.RLock()
+	names, functions := c.ComputedFields, c.computed
+	c.sharedDestMx.RUnlock()
+	if len(names) == 0 {
+		return nil, nil
+	}
+	values := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		fn, ok := functions[name]
+		if !ok {
+			return nil, errors.New("computed field " + name + " of collection " + c.Name + " is not registered")
+		}
+		v, err := computedValue(fn(payload))
+		if err != nil {
+			return nil, errors.New("computed field " + name + ": " + err.Error())
+		}
+		if v != nil {
+			values[name] = v
+		}
+	}
+	return values, nil
+}
+
+// Values under the path, "$<name>" is the computed field. Stored values are taken when there are any,
+// elements written before the field was added get it computed
+func (c *Collection) resolve(payload interface{}, stored map[string]interface{}, path string) ([]reflect.Value, error) {
+	name, ok := computedName(path)
+	if !ok {
+		return resolvePath(payload, path)
+	}
+	if !c.isComputedField(name) {
+		return nil, errors.New("computed field " + name + " does not exist")
+	}
+	v, ok := stored[name]
+	if !ok {
+		fn := c.computedFunc(name)
+		p, isPayload := payload.(CustomStructure)
+		if fn == nil || !isPayload {
+			return nil, nil
+		}
+		var err error
+		v, err = computedValue(fn(p))
+		if err != nil {
+			return nil, errors.New("computed field " + name + ": " + err.Error())
+		}
+	}
+	if v == nil {
+		return nil, nil
+	}
+	return []reflect.Value{reflect.ValueOf(v)}, nil
+}
+
+// the value in the form it is stored in, gob encodes these without registering them
+func computedValue(value interface{}) (interface{}, error) {
+	v := indirect(reflect.ValueOf(value))
+	switch {
+	case !v.IsValid():
+		return nil, nil
+	case v.Kind() == reflect.String:
+		return v.String(), nil
+	case v.Kind() == reflect.Bool:
+		return v.Bool(), nil
+	case isInt(v.Kind()):
+		return v.Int(), nil
+	case isUint(v.Kind()):
+		return v.Uint(), nil
+	case isNumber(v.Kind()):
+		return v.Float(), nil
+	}
+	return nil, errors.New("unsupported value of type " + v.Type().String())
+}
+
+// lower case of the string under the path
+func LowercaseOf(path string) ComputedFunc {
+	return func(payload CustomStructure) interface{} {
+		values, err := resolvePath(payload, path)
+		if err != nil {
+			return nil
+		}
+		for _, v := range nonNil(values) {
+			if v = indirect(v); v.Kind() == reflect.String {
+				return strings.ToLower(v.String())
+			}
+		}
+		return nil
+	}
+}
+
+// year of the time under the path
+func YearOf(path string) ComputedFunc {
+	return func(payload CustomStructure) interface{} {
+		values, err := resolvePath(payload, path)
+		if err != nil {
+			return nil
+		}
+		for _, v := range nonNil(values) {
+			if v = indirect(v); v.Type() == timeType && v.CanInterface() {
+				return v.Interface().(time.Time).Year()
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,291 @@
+package db
+
+import (
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	LOG_DEBUG = iota
+	LOG_INFO
+	LOG_WARNING
+	LOG_ERROR
+	LOG_NONE
+)
+
+const (
+	EVENT_CONFIG_CHANGED = "config_changed"
+	EVENT_SYNC_FAILED    = "sync_failed"
+	EVENT_PANIC          = "panic"
+	// see CheckInvariants
+	EVENT_INVARIANT_VIOLATED = "invariant_violated"
+	// see CheckDisk
+	EVENT_DISK_LOW       = "disk_low"
+	EVENT_DISK_READ_ONLY = "disk_read_only"
+	EVENT_DISK_RECOVERED = "disk_recovered"
+)
+
+// Tunables that can be changed on a running database with ApplyConfig
+type Config struct {
+	// megabytes of the read cache of every collection, 0 sizes it by the free memory
+	CacheSize int `json:"cache_size"`
+	// bytes of every collection kept in memory before they are written, 0 writes straight to the files
+	WriteBufferSize int64 `json:"write_buffer_size"`
+	// the database is synchronized in the background, 0 disables it
+	SyncInterval time.Duration `json:"sync_interval"`
+	// the invariants are checked in the background (CheckInvariants), 0 disables it
+	AuditInterval time.Duration `json:"audit_interval"`
+	// the free space of the drive is checked in the background (CheckDisk), 0 disables it
+	DiskCheckInterval time.Duration `json:"disk_check_interval"`
+	// free bytes below which the collections are compacted, 0 disables it
+	DiskLowSpace int64 `json:"disk_low_space"`
+	// free bytes below which new elements are refused, 0 disables it
+	DiskCriticalSpace int64 `json:"disk_critical_space"`
+	// locks of LockExclusive and LockShared neither released nor extended within it are dropped, 0 is DEFAULT_LOCK_TIMEOUT
+	LockTimeout time.Duration `json:"lock_timeout"`
+	// bytes per second copied by Optimize, 0 is unlimited
+	CompactionRate int64 `json:"compaction_rate"`
+	// bytes of sort keys an ordered query keeps in memory before it spills them to the drive, 0 is DEFAULT_SORT_MEMORY
+	SortMemory int64 `json:"sort_memory"`
+	LogLevel   int   `json:"log_level"`
+	// tasks of the background scheduler running at the same time, ignored by the databases of a Manager
+	BackgroundWorkers int `json:"background_workers"`
+	// the low priority background work runs only within them, ignored by the databases of a Manager
+	MaintenanceWindows []MaintenanceWindow `json:"maintenance_windows"`
+	// elements a query returns at most, a query matching more fails with ErrQueryRowsExceeded, 0 is unlimited
+	MaxQueryRows int64 `json:"max_query_rows"`
+	// encoded bytes of the elements a query returns at most, a query matching more fails with ErrQueryBytesExceeded, 0 is unlimited
+	MaxQueryBytes int64 `json:"max_query_bytes"`
+	// a query running longer fails with ErrQueryTimeout, 0 is unlimited
+	QueryTimeout time.Duration `json:"query_timeout"`
+}
+
+func DefaultConfig() Config {
+	return Config{LogLevel: LOG_INFO, BackgroundWorkers: 2}
+}
+
+type ConfigChange struct {
+	Field string
+	Old   string
+	New   string
+}
+
+type Event struct {
+	Type       string
+	Time       time.Time
+	Collection string
+	Message    string
+	// []ConfigChange for EVENT_CONFIG_CHANGED, *PanicError for EVENT_PANIC,
+	// []InvariantViolation for EVENT_INVARIANT_VIOLATED, the free bytes (int64) for the disk events
+	Data interface{}
+}
+
+// the handler is called synchronously by the goroutine that caused the event
+func (db *Database) OnEvent(handler func(e Event)) {
+	db.eventMx.Lock()
+	db.eventHandlers = append(db.eventHandlers, handler)
+	db.eventMx.Unlock()
+}
+
+func (db *Database) emit(e Event) {
+	e.Time = db.Clock().Now()
+	db.eventMx.RLock()
+	handlers := db.eventHandlers
+	db.eventMx.RUnlock()
+	for _, handler := range handlers {
+		handler(e)
+	}
+}
+
+func (db *Database) logf(level int, v ...interface{}) {
+	if int32(level) >= atomic.LoadInt32(&db.logLevel) {
+		log.Println(v...)
+	}
+}
+
+func (db *Database) Config() Config {
+	db.configMx.Lock()
+	defer db.configMx.Unlock()
+	cfg := db.options.Config
+	cfg.CompactionRate = db.options.compactionRate()
+	cfg.SortMemory = atomic.LoadInt64(&db.options.Config.SortMemory)
+	cfg.MaintenanceWindows = append([]MaintenanceWindow(nil), cfg.MaintenanceWindows...)
+	return cfg
+}
+
+// Adjusts the tunables of the running database and emits EVENT_CONFIG_CHANGED listing what changed.
+// Changed cache sizes resize the caches of the collections, they keep their entries as far as they fit
+func (db *Database) ApplyConfig(cfg Config) error {
+	db.configMx.Lock()
+	defer db.configMx.Unlock()
+	old := db.options.Config
+	if db.manager != nil {
+		// the workers are shared by the databases of the manager, see Manager.SetWorkers
+		cfg.BackgroundWorkers = old.BackgroundWorkers
+		cfg.MaintenanceWindows = old.MaintenanceWindows
+	}
+	changes := make([]ConfigChange, 0)
+	changed := func(field string, o, n string) {
+		changes = append(changes, ConfigChange{field, o, n})
+	}
+
+	if cfg.WriteBufferSize != old.WriteBufferSize {
+		db.collectionMutex.RLock()
+		for _, c := range db.collections {
+			err := c.SetWriteBufferSize(cfg.WriteBufferSize)
+			if err != nil {
+				db.collectionMutex.RUnlock()
+				return err
+			}
+		}
+		db.collectionMutex.RUnlock()
+		changed("WriteBufferSize", strconv.FormatInt(old.WriteBufferSize, 10), strconv.FormatInt(cfg.WriteBufferSize, 10))
+	}
+	if cfg.CacheSize != old.CacheSize {
+		db.collectionMutex.RLock()
+		for _, c := range db.collections {
+			c.resizeCache(cfg.CacheSize)
+		}
+		db.collectionMutex.RUnlock()
+		changed("CacheSize", strconv.Itoa(old.CacheSize), strconv.Itoa(cfg.CacheSize))
+	}
+	if cfg.SyncInterval != old.SyncInterval {
+		db.stopBackgroundSync()
+		if cfg.SyncInterval > 0 {
+			db.startBackgroundSync(cfg.SyncInterval)
+		}
+		changed("SyncInterval", old.SyncInterval.String(), cfg.SyncInterval.String())
+	}
+	if cfg.AuditInterval != old.AuditInterval {
+		db.stopBackgroundAudit()
+		if cfg.AuditInterval > 0 {
+			db.startBackgroundAudit(cfg.AuditInterval)
+		}
+		changed("AuditInterval", old.AuditInterval.String(), cfg.AuditInterval.String())
+	}
+	if cfg.DiskCheckInterval != old.DiskCheckInterval {
+		db.stopDiskWatchdog()
+		if cfg.DiskCheckInterval > 0 {
+			db.startDiskWatchdog(cfg.DiskCheckInterval)
+		}
+		changed("DiskCheckInterval", old.DiskCheckInterval.String(), cfg.DiskCheckInterval.String())
+	}
+	if cfg.DiskLowSpace != old.DiskLowSpace {
+		changed("DiskLowSpace", strconv.FormatInt(old.DiskLowSpace, 10), strconv.FormatInt(cfg.DiskLowSpace, 10))
+	}
+	if cfg.DiskCriticalSpace != old.DiskCriticalSpace {
+		changed("DiskCriticalSpace", strconv.FormatInt(old.DiskCriticalSpace, 10), strconv.FormatInt(cfg.DiskCriticalSpace, 10))
+	}
+	if cfg.LockTimeout != old.LockTimeout {
+		changed("LockTimeout", old.LockTimeout.String(), cfg.LockTimeout.String())
+	}
+	if cfg.CompactionRate != old.CompactionRate {
+		atomic.StoreInt64(&db.options.Config.CompactionRate, cfg.CompactionRate)
+		changed("CompactionRate", strconv.FormatInt(old.CompactionRate, 10), strconv.FormatInt(cfg.CompactionRate, 10))
+	}
+	if cfg.SortMemory != old.SortMemory {
+		atomic.StoreInt64(&db.options.Config.SortMemory, cfg.SortMemory)
+		changed("SortMemory", strconv.FormatInt(old.SortMemory, 10), strconv.FormatInt(cfg.SortMemory, 10))
+	}
+	if cfg.MaxQueryRows != old.MaxQueryRows {
+		atomic.StoreInt64(&db.options.Config.MaxQueryRows, cfg.MaxQueryRows)
+		changed("MaxQueryRows", strconv.FormatInt(old.MaxQueryRows, 10), strconv.FormatInt(cfg.MaxQueryRows, 10))
+	}
+	if cfg.MaxQueryBytes != old.MaxQueryBytes {
+		atomic.StoreInt64(&db.options.Config.MaxQueryBytes, cfg.MaxQueryBytes)
+		changed("MaxQueryBytes", strconv.FormatInt(old.MaxQueryBytes, 10), strconv.FormatInt(cfg.MaxQueryBytes, 10))
+	}
+	if cfg.QueryTimeout != old.QueryTimeout {
+		atomic.StoreInt64((*int64)(&db.options.Config.QueryTimeout), int64(cfg.QueryTimeout))
+		changed("QueryTimeout", old.QueryTimeout.String(), cfg.QueryTimeout.String())
+	}
+	if cfg.BackgroundWorkers != old.BackgroundWorkers {
+		db.scheduler.SetWorkers(cfg.BackgroundWorkers)
+		changed("BackgroundWorkers", strconv.Itoa(old.BackgroundWorkers), strconv.Itoa(cfg.BackgroundWorkers))
+	}
+	if windows, oldWindows := windowsString(cfg.MaintenanceWindows), windowsString(old.MaintenanceWindows); windows != oldWindows {
+		db.scheduler.SetMaintenanceWindows(cfg.MaintenanceWindows, db.Clock())
+		changed("MaintenanceWindows", oldWindows, windows)
+	}
+	if cfg.LogLevel != old.LogLevel {
+		atomic.StoreInt32(&db.logLevel, int32(cfg.LogLevel))
+		changed("LogLevel", strconv.Itoa(old.LogLevel), strconv.Itoa(cfg.LogLevel))
+	}
+	// the compaction rate, the sort memory and the query guards are read concurrently, they were stored atomically above
+	db.options.Config.CacheSize = cfg.CacheSize
+	db.options.Config.WriteBufferSize = cfg.WriteBufferSize
+	db.options.Config.SyncInterval = cfg.SyncInterval
+	db.options.Config.AuditInterval = cfg.AuditInterval
+	db.options.Config.DiskCheckInterval = cfg.DiskCheckInterval
+	db.options.Config.DiskLowSpace = cfg.DiskLowSpace
+	db.options.Config.DiskCriticalSpace = cfg.DiskCriticalSpace
+	db.options.Config.LockTimeout = cfg.LockTimeout
+	db.options.Config.LogLevel = cfg.LogLevel
+	db.options.Config.BackgroundWorkers = cfg.BackgroundWorkers
+	db.options.Config.MaintenanceWindows = append([]MaintenanceWindow(nil), cfg.MaintenanceWindows...)
+
+	if len(changes) > 0 {
+		db.emit(Event{Type: EVENT_CONFIG_CHANGED, Message: strconv.Itoa(len(changes)) + " setting(s) changed", Data: changes})
+	}
+	return nil
+}
+
+func (db *Database) startBackgroundSync(interval time.Duration) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	db.syncStop, db.syncDone = stop, done
+	// created before the loop runs, so a virtual clock knows the ticker once this returns
+	ticker := db.Clock().NewTicker(interval)
+	go func() {
+		defer close(done)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.Chan():
+				if !db.IsDirty() {
+					continue
+				}
+				err := <-db.scheduler.Submit("sync", PRIORITY_HIGH, db.Sync)
+				if p, ok := err.(*PanicError); ok {
+					db.emit(Event{Type: EVENT_PANIC, Message: p.Error(), Data: p})
+				}
+				if err != nil {
+					db.emit(Event{Type: EVENT_SYNC_FAILED, Message: err.Error(), Data: err})
+				}
+			}
+		}
+	}()
+}
+
+// waits for a running synchronization to finish
+func (db *Database) stopBackgroundSync() {
+	if db.syncStop == nil {
+		return
+	}
+	close(db.syncStop)
+	<-db.syncDone
+	db.syncStop, db.syncDone = nil, nil
+}
+
+// the limit is read for every copied element, so ApplyConfig affects a running compaction
+func (o *DatabaseOptions) compactionRate() int64 {
+	if o == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&o.Config.CompactionRate)
+}
+
+// sleeps until copying the given amount of bytes since the start fits into the rate
+func throttle(rate, copied int64, start time.Time) {
+	if rate <= 0 {
+		return
+	}
+	expected := time.Duration(copied * int64(time.Second) / rate)
+	if elapsed := time.Since(start); expected > elapsed {
+		time.Sleep(expected - elapsed)
+	}
+}
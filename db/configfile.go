@@ -0,0 +1,204 @@
+package db
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Layout of the config files, unset values keep the defaults
+type fileConfig struct {
+	Dir        string `json:"dir" yaml:"dir" toml:"dir"`
+	ShardCount int    `json:"shard_count" yaml:"shard_count" toml:"shard_count"`
+	// octal, e.g. "0640"
+	FileMode string `json:"file_mode" yaml:"file_mode" toml:"file_mode"`
+	DirMode  string `json:"dir_mode" yaml:"dir_mode" toml:"dir_mode"`
+	Owner    *struct {
+		Uid int `json:"uid" yaml:"uid" toml:"uid"`
+		Gid int `json:"gid" yaml:"gid" toml:"gid"`
+	} `json:"owner" yaml:"owner" toml:"owner"`
+	// none, speed, default, best or a gzip level
+	Compression string `json:"compression" yaml:"compression" toml:"compression"`
+
+	CacheSize       int    `json:"cache_size" yaml:"cache_size" toml:"cache_size"`
+	WriteBufferSize int64  `json:"write_buffer_size" yaml:"write_buffer_size" toml:"write_buffer_size"`
+	SyncInterval    string `json:"sync_interval" yaml:"sync_interval" toml:"sync_interval"`
+	AuditInterval   string `json:"audit_interval" yaml:"audit_interval" toml:"audit_interval"`
+	// the disk watchdog, see CheckDisk
+	DiskCheckInterval string `json:"disk_check_interval" yaml:"disk_check_interval" toml:"disk_check_interval"`
+	DiskLowSpace      int64  `json:"disk_low_space" yaml:"disk_low_space" toml:"disk_low_space"`
+	DiskCriticalSpace int64  `json:"disk_critical_space" yaml:"disk_critical_space" toml:"disk_critical_space"`
+	// see LockExclusive
+	LockTimeout    string `json:"lock_timeout" yaml:"lock_timeout" toml:"lock_timeout"`
+	CompactionRate int64  `json:"compaction_rate" yaml:"compaction_rate" toml:"compaction_rate"`
+	SortMemory     int64  `json:"sort_memory" yaml:"sort_memory" toml:"sort_memory"`
+	// the query guards, see Config.MaxQueryRows
+	MaxQueryRows  int64  `json:"max_query_rows" yaml:"max_query_rows" toml:"max_query_rows"`
+	MaxQueryBytes int64  `json:"max_query_bytes" yaml:"max_query_bytes" toml:"max_query_bytes"`
+	QueryTimeout  string `json:"query_timeout" yaml:"query_timeout" toml:"query_timeout"`
+	// 0 keeps the default
+	BackgroundWorkers int `json:"background_workers" yaml:"background_workers" toml:"background_workers"`
+	// see ParseMaintenanceWindow
+	MaintenanceWindows []string `json:"maintenance_windows" yaml:"maintenance_windows" toml:"maintenance_windows"`
+	// debug, info, warning, error or none
+	LogLevel string `json:"log_level" yaml:"log_level" toml:"log_level"`
+
+	Sync *struct {
+		Attempts       int    `json:"attempts" yaml:"attempts" toml:"attempts"`
+		Backoff        string `json:"backoff" yaml:"backoff" toml:"backoff"`
+		RollbackHeader bool   `json:"rollback_header" yaml:"rollback_header" toml:"rollback_header"`
+	} `json:"sync" yaml:"sync" toml:"sync"`
+	IORetry *struct {
+		Attempts int    `json:"attempts" yaml:"attempts" toml:"attempts"`
+		Backoff  string `json:"backoff" yaml:"backoff" toml:"backoff"`
+	} `json:"io_retry" yaml:"io_retry" toml:"io_retry"`
+}
+
+var LOG_LEVELS = map[string]int{"debug": LOG_DEBUG, "info": LOG_INFO, "warning": LOG_WARNING, "error": LOG_ERROR, "none": LOG_NONE}
+
+var compressionLevels = map[string]int{"none": gzip.NoCompression, "speed": gzip.BestSpeed,
+	"default": gzip.DefaultCompression, "best": gzip.BestCompression}
+
+// Reads the database options from a YAML (.yaml, .yml), TOML (.toml) or JSON (.json) file
+func LoadConfig(path string) (DatabaseOptions, error) {
+	options := DefaultDatabaseOptions()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return options, err
+	}
+	fc := new(fileConfig)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, fc)
+	case ".toml":
+		err = toml.Unmarshal(data, fc)
+	case ".json":
+		err = json.Unmarshal(data, fc)
+	default:
+		return options, errors.New("unknown config format " + filepath.Ext(path))
+	}
+	if err != nil {
+		return options, errors.New("failed to parse " + path + " due " + err.Error())
+	}
+	err = fc.apply(&options)
+	if err != nil {
+		return options, errors.New("invalid config " + path + " due " + err.Error())
+	}
+	return options, nil
+}
+
+func parseMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, errors.New("invalid file mode " + value)
+	}
+	return os.FileMode(mode), nil
+}
+
+func (fc *fileConfig) apply(o *DatabaseOptions) (err error) {
+	o.Dir = fc.Dir
+	if fc.ShardCount < 0 {
+		return errors.New("invalid shard count " + strconv.Itoa(fc.ShardCount))
+	}
+	o.ShardCount = fc.ShardCount
+	if fc.FileMode != "" {
+		if o.FileMode, err = parseMode(fc.FileMode); err != nil {
+			return err
+		}
+	}
+	if fc.DirMode != "" {
+		if o.DirMode, err = parseMode(fc.DirMode); err != nil {
+			return err
+		}
+	}
+	if fc.Owner != nil {
+		o.Owner = &FileOwner{fc.Owner.Uid, fc.Owner.Gid}
+	}
+	if fc.Compression != "" {
+		level, ok := compressionLevels[fc.Compression]
+		if !ok {
+			level, err = strconv.Atoi(fc.Compression)
+			if err != nil || level < gzip.HuffmanOnly || level > gzip.BestCompression {
+				return errors.New("invalid compression " + fc.Compression)
+			}
+		}
+		o.CompressionLevel = level
+	}
+
+	o.Config.CacheSize = fc.CacheSize
+	o.Config.WriteBufferSize = fc.WriteBufferSize
+	o.Config.CompactionRate = fc.CompactionRate
+	o.Config.SortMemory = fc.SortMemory
+	o.Config.MaxQueryRows = fc.MaxQueryRows
+	o.Config.MaxQueryBytes = fc.MaxQueryBytes
+	o.Config.DiskLowSpace = fc.DiskLowSpace
+	o.Config.DiskCriticalSpace = fc.DiskCriticalSpace
+	if fc.BackgroundWorkers > 0 {
+		o.Config.BackgroundWorkers = fc.BackgroundWorkers
+	}
+	if fc.SyncInterval != "" {
+		if o.Config.SyncInterval, err = time.ParseDuration(fc.SyncInterval); err != nil {
+			return err
+		}
+	}
+	if fc.AuditInterval != "" {
+		if o.Config.AuditInterval, err = time.ParseDuration(fc.AuditInterval); err != nil {
+			return err
+		}
+	}
+	if fc.LockTimeout != "" {
+		if o.Config.LockTimeout, err = time.ParseDuration(fc.LockTimeout); err != nil {
+			return err
+		}
+	}
+	if fc.DiskCheckInterval != "" {
+		if o.Config.DiskCheckInterval, err = time.ParseDuration(fc.DiskCheckInterval); err != nil {
+			return err
+		}
+	}
+	if fc.QueryTimeout != "" {
+		if o.Config.QueryTimeout, err = time.ParseDuration(fc.QueryTimeout); err != nil {
+			return err
+		}
+	}
+	for _, s := range fc.MaintenanceWindows {
+		w, err := ParseMaintenanceWindow(s)
+		if err != nil {
+			return err
+		}
+		o.Config.MaintenanceWindows = append(o.Config.MaintenanceWindows, w)
+	}
+	if fc.LogLevel != "" {
+		level, ok := LOG_LEVELS[fc.LogLevel]
+		if !ok {
+			return errors.New("invalid log level " + fc.LogLevel)
+		}
+		o.Config.LogLevel = level
+	}
+	if fc.Sync != nil {
+		o.SyncPolicy.Retry.Attempts = fc.Sync.Attempts
+		o.SyncPolicy.RollbackHeader = fc.Sync.RollbackHeader
+		if fc.Sync.Backoff != "" {
+			if o.SyncPolicy.Retry.Backoff, err = time.ParseDuration(fc.Sync.Backoff); err != nil {
+				return err
+			}
+		}
+	}
+	if fc.IORetry != nil {
+		o.IORetry.Attempts = fc.IORetry.Attempts
+		if fc.IORetry.Backoff != "" {
+			if o.IORetry.Backoff, err = time.ParseDuration(fc.IORetry.Backoff); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
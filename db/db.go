@@ -2,23 +2,28 @@ package db
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/gob"
 	"encoding/json"
 	"errors"
+	"io/fs"
 	"io/ioutil"
-	"log"
 	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	COLLECTION_DIR_NAME = "collections"
-	DB_VERSION          = 1
+	DB_VERSION          = 4
 )
 
 type Database struct {
@@ -26,6 +31,75 @@ type Database struct {
 	Version         int                    `json:"version"`
 	collections     map[string]*Collection `json:"-"`
 	collectionMutex sync.RWMutex           `json:"-"`
+	// mounted by AttachCollection, guarded by collectionMutex
+	attached map[string]*Collection
+
+	dir      string
+	sequence uint64
+	// held by Sync from writing the header until the snapshots of the previous manifest are removed
+	manifestMx sync.Mutex
+
+	syncLatency     *Histogram
+	optimizeLatency *Histogram
+	syncPolicy      SyncPolicy
+	// collections were added or dropped since the last sync
+	dirty int32
+
+	procedures     map[string]Procedure
+	procedureMutex sync.RWMutex
+	// set by RegisterCodec
+	codecs     map[string]Codec
+	codecMutex sync.RWMutex
+
+	options DatabaseOptions
+
+	configMx      sync.Mutex
+	logLevel      int32
+	eventHandlers []func(e Event)
+	eventMx       sync.RWMutex
+	syncStop      chan struct{}
+	syncDone      chan struct{}
+	auditStop     chan struct{}
+	auditDone     chan struct{}
+	diskStop      chan struct{}
+	diskDone      chan struct{}
+	scheduler     *Scheduler
+	// set for the databases opened by a Manager, which owns the scheduler
+	manager *Manager
+	// set by OpenBundle
+	bundle *bundleSource
+	// set by SetAutoIndex
+	autoIndexRows uint64
+	// set by CheckDisk while the drive is almost full, an emergency compaction is running
+	diskFull   int32
+	compacting int32
+}
+
+type SyncPolicy struct {
+	// applied to the synchronization of every collection
+	Retry RetryPolicy
+	// keep the previous header and manifest when any collection fails to synchronize,
+	// so the next load sees the last complete state. The collections that synchronized replaced their files,
+	// the load restores them from the snapshots the previous manifest lists
+	RollbackHeader bool
+}
+
+// Returned by Sync when some of the collections failed to synchronize
+type SyncError struct {
+	Collections map[string]error
+}
+
+func (e *SyncError) Error() string {
+	names := make([]string, 0, len(e.Collections))
+	for name := range e.Collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msg := "synchronization of " + strconv.Itoa(len(names)) + " collection(s) failed:"
+	for _, name := range names {
+		msg += " " + name + " (" + e.Collections[name].Error() + ")"
+	}
+	return msg
 }
 
 type CustomStructure interface {
@@ -33,6 +107,18 @@ type CustomStructure interface {
 }
 
 func NewDatabase(name string) *Database {
+	return NewDatabaseWithOptions(name, DefaultDatabaseOptions())
+}
+
+func NewDatabaseWithOptions(name string, options DatabaseOptions) *Database {
+	scheduler := NewScheduler(options.Config.BackgroundWorkers)
+	if len(options.Config.MaintenanceWindows) > 0 {
+		scheduler.SetMaintenanceWindows(options.Config.MaintenanceWindows, options.clock())
+	}
+	return newDatabase(name, options, scheduler)
+}
+
+func newDatabase(name string, options DatabaseOptions, scheduler *Scheduler) *Database {
 	rand.Seed(time.Now().UnixNano())
 
 	gob.RegisterName("so", &ShardOffset{})
@@ -42,7 +128,35 @@ func NewDatabase(name string) *Database {
 
 	ProfileSystemMemory()
 
-	return &Database{name, DB_VERSION, make(map[string]*Collection), sync.RWMutex{}}
+	db := &Database{
+		Name:            name,
+		Version:         DB_VERSION,
+		collections:     make(map[string]*Collection),
+		attached:        make(map[string]*Collection),
+		syncLatency:     NewHistogram(LATENCY_BUCKETS),
+		optimizeLatency: NewHistogram(LATENCY_BUCKETS),
+		procedures:      make(map[string]Procedure),
+		codecs:          make(map[string]Codec),
+		options:         options,
+		logLevel:        int32(options.Config.LogLevel),
+		dir:             options.Dir,
+		syncPolicy:      options.SyncPolicy,
+		scheduler:       scheduler,
+	}
+	if options.Config.SyncInterval > 0 {
+		db.startBackgroundSync(options.Config.SyncInterval)
+	}
+	if options.Config.AuditInterval > 0 {
+		db.startBackgroundAudit(options.Config.AuditInterval)
+	}
+	if options.Config.DiskCheckInterval > 0 {
+		db.startDiskWatchdog(options.Config.DiskCheckInterval)
+	}
+	return db
+}
+
+func (db *Database) SetSyncPolicy(policy SyncPolicy) {
+	db.syncPolicy = policy
 }
 
 func (db *Database) RegisterTypeName(name string, value CustomStructure) {
@@ -53,216 +167,611 @@ func (db *Database) RegisterType(value CustomStructure) {
 	gob.Register(value)
 }
 
-// delete redundant data from all of the existing collections
-func (db *Database) Optimize() (n int64, err error) {
+// delete redundant data from all of the existing collections.
+// The files of the merged segments are removed by the next Sync, once the manifest no longer lists them
+func (db *Database) Optimize() (*DatabaseOptimizeReport, error) {
+	start := time.Now()
+	defer func() {
+		db.optimizeLatency.Observe(time.Since(start))
+	}()
 	db.collectionMutex.Lock()
 	defer db.collectionMutex.Unlock()
-	n = 0
-	for _, c := range db.collections {
+	report := &DatabaseOptimizeReport{Collections: make(map[string]*OptimizeReport, len(db.collections))}
+	defer func() {
+		report.Duration = time.Since(start)
+	}()
+	for name, c := range db.collections {
 		opt, err := c.Optimize()
+		report.Collections[name] = opt
+		report.Reclaimed += opt.Reclaimed
+		report.Rewritten += opt.Rewritten
 		if err != nil {
-			return 0, err
+			return report, err
 		}
-		n += opt
 	}
-	return n, err
+	return report, nil
 }
 
-// locate the header file (.shardb)
+// locate the header file (.shardb), within DatabaseOptions.FS when it is set
 func (db *Database) LocateDatabase(path string) (string, error) {
-	prefix := path
-	if path == "" {
-		prefix = "./"
+	fsys, err := db.fileSystem(path)
+	if err != nil {
+		return "", err
 	}
-	files, err := ioutil.ReadDir(prefix)
+	name, err := locateHeader(fsys)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(path, name), nil
+}
+
+func locateHeader(fsys fs.FS) (string, error) {
+	files, err := fs.ReadDir(fsys, ".")
 	if err != nil {
 		return "", err
 	}
 	for _, f := range files {
 		if !f.IsDir() && strings.HasSuffix(f.Name(), ".shardb") {
-			if path == "" {
-				return f.Name(), nil
-			}
-			return prefix + "\\" + f.Name(), nil
+			return f.Name(), nil
 		}
 	}
 	return "", errors.New("database header not found")
 }
 
-// load the database
-func (db *Database) ScanAndLoadData(path string) error {
-	ln := len(path)
-	if ln > 0 && path[len(path)-1] != '\\' {
-		path += "\\"
-	}
-
-	// Locate the header and compare the version of the database
-	headerFilename, err := db.LocateDatabase(path)
+// locates the header and compares the version of the data with the version of the library
+func (db *Database) readHeader(fsys fs.FS) (*Database, error) {
+	headerFilename, err := locateHeader(fsys)
 	if err != nil {
-		return errors.New("failed to locate the header due " + err.Error())
+		return nil, errors.New("failed to locate the header due " + err.Error())
 	}
-	headerData, err := ioutil.ReadFile(headerFilename)
+	headerData, err := db.options.readFile(fsys, headerFilename)
 	if err != nil {
-		return errors.New("failed to load the header due " + err.Error())
+		return nil, errors.New("failed to load the header due " + err.Error())
 	}
 	header := new(Database)
 	err = json.Unmarshal(headerData, &header)
 	if err != nil {
-		return errors.New("failed to unmarshal the header due " + err.Error())
+		return nil, errors.New("failed to unmarshal the header due " + err.Error())
 	}
 	// Compare the version now
 	vdif := int(math.Abs(float64(db.Version - header.Version)))
 	if vdif != 0 {
 		// if the version of the file is below the major release, then problems may occur
 		if vdif >= 10 {
-			return errors.New("old database version")
+			return header, errors.New("old database version")
 		}
-		log.Println("WARNING! Attempt to load the dataset with a different version", header.Version, "( current", db.Version, ")")
+		db.logf(LOG_WARNING, "WARNING! Attempt to load the dataset with a different version", header.Version, "( current", db.Version, ")")
 	}
+	return header, nil
+}
 
-	fullPath := path + COLLECTION_DIR_NAME
-	_, err = os.Stat(fullPath)
-	if os.IsNotExist(err) {
-		return errors.New("collections folder does not exist")
+// Result of a lenient load, failed collections are left unloaded
+type LoadReport struct {
+	Loaded []string         `json:"loaded"`
+	Failed map[string]error `json:"failed"`
+}
+
+// load the database
+func (db *Database) ScanAndLoadData(path string) error {
+	return db.load(path, nil)
+}
+
+// Loads every collection it can instead of stopping at the first broken one.
+// An error is returned only if the database itself can not be read (header, manifest or the collections directory),
+// failures of single collections are listed in the report
+func (db *Database) ScanAndLoadDataLenient(path string) (*LoadReport, error) {
+	report := &LoadReport{Loaded: make([]string, 0), Failed: make(map[string]error)}
+	return report, db.load(path, report)
+}
+
+// collects the failure in the lenient mode, otherwise returns it
+func (r *LoadReport) fail(name string, err error) error {
+	if r == nil {
+		return err
 	}
+	r.Failed[name] = err
+	return nil
+}
+
+func (db *Database) addLoaded(name string, c *Collection, report *LoadReport) {
+	c.database = db
+	db.collectionMutex.Lock()
+	db.collections[name] = c
+	db.collectionMutex.Unlock()
+	if report != nil {
+		report.Loaded = append(report.Loaded, name)
+	}
+}
 
-	collections, err := ioutil.ReadDir(fullPath)
+func (db *Database) load(path string, report *LoadReport) error {
+	if path == "" {
+		path = db.options.Dir
+	}
+	db.dir = path
+	fsys, err := db.fileSystem(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.readHeader(fsys)
+	if err != nil {
+		return err
+	}
+
+	// the manifest lists everything that belongs to the database,
+	// directories synchronized before it existed are scanned instead
+	data, err := db.options.readFile(fsys, MANIFEST_NAME)
+	if err == nil {
+		manifest, err := parseManifest(data)
+		if err != nil {
+			return errors.New("failed to load the manifest due " + err.Error())
+		}
+		return db.loadFromManifest(fsys, manifest, report)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return errors.New("failed to load the manifest due " + err.Error())
+	}
+
+	fullPath := filepath.Join(path, COLLECTION_DIR_NAME)
+	collections, err := fs.ReadDir(fsys, COLLECTION_DIR_NAME)
+	if errors.Is(err, fs.ErrNotExist) {
+		return errors.New("collections folder does not exist")
+	} else if err != nil {
+		return err
+	}
+	collectionsFS, err := fs.Sub(fsys, COLLECTION_DIR_NAME)
 	if err != nil {
 		return err
 	}
 
 	for _, c := range collections {
 		if c.IsDir() {
-			collectionPath := fullPath + "/" + c.Name()
-
-			collectionFiles, err := ioutil.ReadDir(collectionPath)
+			var collection *Collection
+			sub, err := fs.Sub(collectionsFS, c.Name())
+			if err == nil {
+				collection, err = db.scanCollection(c.Name(), sub, filepath.Join(fullPath, c.Name()), db.isReadOnly())
+			}
 			if err != nil {
-				return err
+				if err = report.fail(c.Name(), err); err != nil {
+					return err
+				}
+				continue
 			}
+			db.addLoaded(c.Name(), collection, report)
+		}
+	}
+
+	return nil
+}
 
-			cfLen := len(collectionFiles)
-			if cfLen < SHARD_COUNT {
-				return errors.New("collection has invalid amount of shards " + strconv.Itoa(cfLen) + ". Expected " + strconv.Itoa(SHARD_COUNT))
+func (db *Database) loadFromManifest(fsys fs.FS, m *Manifest, report *LoadReport) error {
+	for _, mc := range m.Collections {
+		collection, err := db.loadManifestCollection(fsys, mc)
+		if err != nil {
+			if err = report.fail(mc.Name, err); err != nil {
+				return errors.New("failed to load collection " + mc.Name + " due " + err.Error())
 			}
+			continue
+		}
+		db.addLoaded(mc.Name, collection, report)
+	}
+	db.sequence = m.Sequence
+	return nil
+}
 
-			var collection *Collection
-			loaded := 0
-			files := make([]*os.File, SHARD_COUNT)
-			cm := NewConcurrentMap(collectionPath, files)
-			cNameExt := c.Name() + ".json.gzip"
-			mapIndexLoaded := false
-
-			for _, f := range collectionFiles {
-				fName := f.Name()
-				if strings.HasPrefix(fName, "shard_") {
-					// loading the shard main data
-					if strings.HasSuffix(fName, ".gobs") {
-						fi, err := os.OpenFile(collectionPath+"/"+fName, os.O_RDWR, os.ModePerm)
-						if err != nil {
-							return errors.New("collection (" + fName + ") shard (" + fName + ") is unavailable")
-						}
-						files[loaded] = fi
-						// loading the meta
-						fName := strings.TrimSuffix(fName, ".gobs") + "_meta.gob.gzip"
-						p := NewEncodedCompressedPackage(collectionPath + "/" + fName)
-						dec, err := p.LoadDecoder()
-						if err != nil {
-							return err
-						}
-						var shard ConcurrentMapShared
-						err = dec.Decode(&shard)
-						if err != nil {
-							return err
-						}
-						dec = nil
-						shard.file = fi
-						cm.Shared[shard.Id] = &shard
-						loaded++
-					}
-
-					// loading the map index
-				} else if f.Name() == "map.index" {
-					inFile, _ := os.Open(collectionPath + "/" + fName)
-					scanner := bufio.NewScanner(inFile)
-					scanner.Split(bufio.ScanLines)
-					// current map index
-					if scanner.Scan() {
-						num, err := strconv.ParseUint(scanner.Text(), 10, 64)
-						if err != nil {
-							return err
-						}
-						cm.SetCounterIndex(num)
-					}
-					// sync path
-					if scanner.Scan() {
-						cm.SyncDestination = path + "/" + scanner.Text()
-					}
-					inFile.Close()
-					mapIndexLoaded = true
-
-					// loading the collection's description
-				} else if f.Name() == cNameExt {
-					data, err := NewCompressedPackage(collectionPath+"/"+cNameExt, nil).Load()
-					if err != nil {
-						return err
-					}
-					collection = new(Collection)
-					err = json.Unmarshal(data, collection)
-					if err != nil {
-						return err
-					}
+func (db *Database) loadManifestCollection(fsys fs.FS, mc *ManifestCollection) (*Collection, error) {
+	collectionPath := filepath.Join(db.dir, filepath.FromSlash(mc.Path))
+	if len(mc.Shards) != db.options.shardCount() {
+		return nil, errors.New("collection has invalid amount of shards " + strconv.Itoa(len(mc.Shards)) + ". Expected " + strconv.Itoa(db.options.shardCount()))
+	}
+	if mc.Description == nil || mc.Index == nil {
+		return nil, errors.New("manifest entry is incomplete")
+	}
+	fsys, err := fs.Sub(fsys, mc.Path)
+	if err != nil {
+		return nil, err
+	}
+	err = db.options.verify(mc.Description, fsys, true)
+	if err != nil {
+		return nil, err
+	}
+	err = db.options.verify(mc.Index, fsys, true)
+	if err != nil {
+		return nil, err
+	}
+
+	cm := NewConcurrentMap(collectionPath, make([]*os.File, db.options.shardCount()))
+	for _, ms := range mc.Shards {
+		if ms.Id < 0 || ms.Id >= db.options.shardCount() || len(ms.Segments) == 0 || ms.Meta == nil {
+			return nil, errors.New("manifest entry of shard " + strconv.Itoa(ms.Id) + " is invalid")
+		}
+		for _, segment := range ms.Segments {
+			err = db.options.verify(segment, fsys, false)
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = db.options.verify(ms.Meta, fsys, true)
+		if err != nil {
+			return nil, err
+		}
+		err = db.restoreSnapshots(collectionPath, ms.Meta)
+		if err != nil {
+			return nil, err
+		}
+		shard, err := db.openShard(fsys, collectionPath, ms.Meta.Name, ms.Meta.Size, db.isReadOnly())
+		if err != nil {
+			return nil, err
+		}
+		cm.Shared[ms.Id] = shard
+	}
+	err = db.restoreSnapshots(collectionPath, mc.Index, mc.Description)
+	if err != nil {
+		return nil, err
+	}
+	err = loadMapIndex(cm, fsys, mc.Index.Name)
+	if err != nil {
+		return nil, err
+	}
+	collection, err := loadCollectionDescription(fsys, mc.Description.Name, &db.options)
+	if err != nil {
+		return nil, err
+	}
+	err = collection.open(collectionPath, cm, &db.options)
+	if err != nil {
+		return nil, err
+	}
+	collection.readOnly = db.isReadOnly()
+	return collection, nil
+}
+
+// the files the syncs write to are replaced by the snapshots the manifest lists, see Manifest
+func (db *Database) restoreSnapshots(collectionPath string, files ...*ManifestFile) error {
+	if db.isReadOnly() {
+		return nil
+	}
+	for _, mf := range files {
+		if err := db.options.restoreSnapshot(collectionPath, mf.Name); err != nil {
+			return errors.New("failed to restore " + mf.Name + " due " + err.Error())
+		}
+	}
+	return nil
+}
+
+// loads a collection by looking at the files of its directory, fsys is rooted at it.
+// the files of a read-only collection are opened for reading only
+func (db *Database) scanCollection(name string, fsys fs.FS, collectionPath string, readOnly bool) (*Collection, error) {
+	collectionFiles, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	cfLen := len(collectionFiles)
+	if cfLen < db.options.shardCount() {
+		return nil, errors.New("collection has invalid amount of shards " + strconv.Itoa(cfLen) + ". Expected " + strconv.Itoa(db.options.shardCount()))
+	}
 
+	var collection *Collection
+	loaded := 0
+	cm := NewConcurrentMap(collectionPath, make([]*os.File, db.options.shardCount()))
+	cNameExt := name + ".json.gzip"
+	mapIndexLoaded := false
+
+	for _, f := range collectionFiles {
+		fName := f.Name()
+		if strings.HasPrefix(fName, "shard_") {
+			// loading the shard main data and the meta, additional segments are listed in the meta
+			if strings.HasSuffix(fName, ".gobs") && strings.Count(fName, ".") == 1 {
+				metaName := strings.TrimSuffix(fName, ".gobs") + "_meta.flat"
+				if _, err := fs.Stat(fsys, metaName); errors.Is(err, fs.ErrNotExist) {
+					// written by an older version
+					metaName = strings.TrimSuffix(fName, ".gobs") + "_meta.gob.gzip"
+				}
+				shard, err := db.openShard(fsys, collectionPath, metaName, -1, readOnly)
+				if err != nil {
+					return nil, err
 				}
+				cm.Shared[shard.Id] = shard
+				loaded++
 			}
 
-			if !mapIndexLoaded {
-				return errors.New("map index file was not loaded")
+			// loading the map index
+		} else if fName == "map.index" {
+			err = loadMapIndex(cm, fsys, fName)
+			if err != nil {
+				return nil, err
 			}
-			if collection == nil {
-				return errors.New("collection description file missing")
+			mapIndexLoaded = true
+
+			// loading the collection's description
+		} else if fName == cNameExt {
+			collection, err = loadCollectionDescription(fsys, cNameExt, &db.options)
+			if err != nil {
+				return nil, err
 			}
+		}
+	}
+
+	if !mapIndexLoaded {
+		return nil, errors.New("map index file was not loaded")
+	}
+	if collection == nil {
+		return nil, errors.New("collection description file missing")
+	}
+	if loaded < db.options.shardCount() {
+		return nil, errors.New("collection " + name + " files are corrupted")
+	}
 
-			collection.Map = cm
-			collection.Cache = NewCollectionCache()
+	err = collection.open(collectionPath, cm, &db.options)
+	if err != nil {
+		return nil, err
+	}
+	collection.readOnly = readOnly
+	return collection, nil
+}
 
-			db.collectionMutex.Lock()
-			db.collections[c.Name()] = collection
-			db.collectionMutex.Unlock()
+// Maps the flat meta of the shard up to the given size (-1 is the whole file), the gob meta of older versions
+// is decoded right away. Transient failures are retried with the IORetry of the options
+func loadShard(collectionPath, metaName string, size int64, options *DatabaseOptions, readOnly bool) (*ConcurrentMapShared, error) {
+	var shard *ConcurrentMapShared
+	err := options.retryIO(func() (err error) {
+		path := filepath.Join(collectionPath, metaName)
+		if strings.HasSuffix(metaName, "_meta.gob.gzip") {
+			shard, err = loadLegacyShard(path)
+		} else {
+			shard, err = mapShard(path, size)
+		}
+		if err != nil {
+			return err
+		}
+		shard.SyncDestination = collectionPath
+		shard.readOnly = readOnly
+		err = shard.openSegments()
+		if err != nil {
+			shard.closeMeta()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return shard, nil
+}
 
-			if loaded < SHARD_COUNT {
-				return errors.New("collection " + c.Name() + " files are corrupted")
+func loadLegacyShard(path string) (*ConcurrentMapShared, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeLegacyShard(data)
+}
+
+// decodes the gzipped gob meta
+func decodeLegacyShard(data []byte) (*ConcurrentMapShared, error) {
+	data, err := gunzip(data)
+	if err != nil {
+		return nil, err
+	}
+	shard := new(ConcurrentMapShared)
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(shard)
+	if err != nil {
+		return nil, err
+	}
+	shard.shareOffsets()
+	shard.legacy = true
+	return shard, nil
+}
+
+// gob metas are removed once the flat ones replaced them and the manifest no longer lists them
+func (db *Database) removeLegacyMetas() {
+	db.collectionMutex.RLock()
+	defer db.collectionMutex.RUnlock()
+	for _, c := range db.collections {
+		for _, shard := range c.Map.Shared {
+			// mapped shards are never legacy ones, so the meta is not decoded for this
+			shard.mx.Lock()
+			if shard.legacy {
+				if _, err := os.Stat(filepath.Join(shard.SyncDestination, shardMetaName(shard.Id))); err == nil {
+					os.Remove(filepath.Join(shard.SyncDestination, legacyShardMetaName(shard.Id)))
+					shard.legacy = false
+				}
 			}
+			shard.mx.Unlock()
 		}
 	}
+}
 
+func loadMapIndex(cm *ConcurrentMap, fsys fs.FS, name string) error {
+	inFile, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+	scanner := bufio.NewScanner(inFile)
+	scanner.Split(bufio.ScanLines)
+	// current map index, the sync path that follows is only kept for older versions
+	if scanner.Scan() {
+		num, err := strconv.ParseUint(scanner.Text(), 10, 64)
+		if err != nil {
+			return err
+		}
+		cm.SetCounterIndex(num)
+	}
 	return nil
 }
 
-// synchronizes the database with the hard drive
+func loadCollectionDescription(fsys fs.FS, name string, options *DatabaseOptions) (*Collection, error) {
+	data, err := options.readFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	data, err = gunzip(data)
+	if err != nil {
+		return nil, err
+	}
+	return parseCollectionDescription(data)
+}
+
+// the description is migrated from older versions first
+func parseCollectionDescription(data []byte) (*Collection, error) {
+	data, err := migrateDescription(data)
+	if err != nil {
+		return nil, err
+	}
+	collection := new(Collection)
+	err = json.Unmarshal(data, collection)
+	if err != nil {
+		return nil, err
+	}
+	return collection, nil
+}
+
+// synchronizes the database with the hard drive.
+// Failed collections are reported with a *SyncError
 func (db *Database) Sync() error {
+	return db.SyncContext(context.Background())
+}
+
+// Same as Sync, but gives up once the context ends. The files are written in chunks checking the context
+// between them, so a stuck drive or network mount can't block the caller past its deadline
+func (db *Database) SyncContext(ctx context.Context) error {
+	if db.isReadOnly() {
+		return ErrReadOnly
+	}
+	start := time.Now()
+	defer func() {
+		db.syncLatency.Observe(time.Since(start))
+	}()
+	policy := db.syncPolicy
+	failed := make(map[string]error)
+	failedMx := sync.Mutex{}
+
 	db.collectionMutex.RLock()
 	wg := sync.WaitGroup{}
 	wg.Add(len(db.collections))
 	for _, c := range db.collections {
 		go func(cl *Collection) {
-			log.Println("Synchronizing " + cl.Name)
-			err := cl.Sync()
+			defer wg.Done()
+			db.logf(LOG_INFO, "Synchronizing "+cl.Name)
+			err := db.syncCollection(ctx, cl, policy)
+			if p, ok := err.(*PanicError); ok {
+				db.emit(Event{Type: EVENT_PANIC, Collection: cl.Name, Message: p.Error(), Data: p})
+			}
 			if err != nil {
-				log.Println("Collection "+cl.Name+" syncronization failed:", err.Error())
+				db.logf(LOG_ERROR, "Collection "+cl.Name+" syncronization failed:", err.Error())
+				failedMx.Lock()
+				failed[cl.Name] = err
+				failedMx.Unlock()
 			}
-			wg.Done()
 		}(c)
 	}
 	db.collectionMutex.RUnlock()
 
 	wg.Wait()
 
+	var syncErr error
+	if len(failed) > 0 {
+		syncErr = &SyncError{failed}
+		if policy.RollbackHeader {
+			return syncErr
+		}
+	}
+
+	// the header, the manifest and the snapshots it lists are replaced by one sync at a time
+	db.manifestMx.Lock()
+	defer db.manifestMx.Unlock()
 	data, err := json.Marshal(db)
 	if err != nil {
 		return err
 	}
 
-	return ioutil.WriteFile(db.Name+".shardb", data, os.ModePerm)
+	headerPath := filepath.Join(db.dir, db.Name+".shardb")
+	previousHeader, _ := ioutil.ReadFile(headerPath)
+	err = db.options.writeFileContext(ctx, headerPath, data)
+	if err != nil {
+		return err
+	}
+
+	obsolete := db.obsoleteSegments()
+	manifest, err := db.buildManifest()
+	if err == nil {
+		err = manifest.save(ctx, filepath.Join(db.dir, MANIFEST_NAME), &db.options)
+	}
+	if err != nil {
+		if policy.RollbackHeader && previousHeader != nil {
+			db.options.writeFile(headerPath, previousHeader)
+		}
+		return err
+	}
+	db.sequence = manifest.Sequence
+	db.removeSnapshots(manifest)
+	for shard, segments := range obsolete {
+		shard.removeSegments(segments)
+	}
+	db.removeLegacyMetas()
+	if syncErr == nil {
+		atomic.StoreInt32(&db.dirty, 0)
+	}
+	return syncErr
+}
+
+// a panic fails only the synchronization of the collection
+func (db *Database) syncCollection(ctx context.Context, c *Collection, policy SyncPolicy) (err error) {
+	defer recoverPanic("synchronization of "+c.Name, &err)
+	return policy.Retry.Do(func() error { return c.SyncContext(ctx) })
+}
+
+// reports whether there are changes that were not synchronized with the drive yet
+func (db *Database) IsDirty() bool {
+	if atomic.LoadInt32(&db.dirty) == 1 {
+		return true
+	}
+	db.collectionMutex.RLock()
+	defer db.collectionMutex.RUnlock()
+	for _, c := range db.collections {
+		if c.IsDirty() {
+			return true
+		}
+	}
+	return false
+}
+
+// releases the files of every collection, changes made after the last sync are not saved
+func (db *Database) Close() (err error) {
+	db.configMx.Lock()
+	db.stopBackgroundSync()
+	db.stopBackgroundAudit()
+	db.stopDiskWatchdog()
+	db.configMx.Unlock()
+	if db.manager == nil {
+		db.scheduler.Close()
+	}
+	// the queued writes synchronize the database, they are finished before the collections are locked
+	db.collectionMutex.RLock()
+	collections := make([]*Collection, 0, len(db.collections))
+	for _, c := range db.collections {
+		collections = append(collections, c)
+	}
+	db.collectionMutex.RUnlock()
+	for _, c := range collections {
+		c.closeAsyncWrites()
+	}
+	db.collectionMutex.Lock()
+	defer db.collectionMutex.Unlock()
+	for _, c := range db.collections {
+		c.closeAsyncWrites()
+		if cerr := c.Map.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	for _, c := range db.attached {
+		c.Map.Close()
+	}
+	if db.bundle != nil && db.bundle.closer != nil {
+		if cerr := db.bundle.closer.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
 }
 
 func (db *Database) GetCollectionsCount() int {
@@ -300,15 +809,21 @@ func (db *Database) GetRandomCollection() (*Collection, error) {
 }
 
 func (db *Database) AddCollection(name string) (*Collection, error) {
+	if db.isReadOnly() {
+		return nil, ErrReadOnly
+	}
 	if db.GetCollection(name) != nil {
 		return nil, errors.New("collection is already exist")
 	}
 
-	files := make([]*os.File, SHARD_COUNT)
-	path := COLLECTION_DIR_NAME + "/" + name
-	os.MkdirAll(path, os.ModePerm)
-	for i := 0; i < SHARD_COUNT; i++ {
-		f, err := os.Create(path + "/shard_" + strconv.Itoa(i) + ".gobs")
+	files := make([]*os.File, db.options.shardCount())
+	path := filepath.Join(db.dir, COLLECTION_DIR_NAME, name)
+	err := db.options.mkdirAll(path)
+	if err != nil {
+		return nil, errors.New("failed to create the collection directory due " + err.Error())
+	}
+	for i := 0; i < db.options.shardCount(); i++ {
+		f, err := db.options.create(filepath.Join(path, shardDataName(i)))
 		if err != nil {
 			return nil, errors.New("failed to create a shard")
 		}
@@ -316,22 +831,50 @@ func (db *Database) AddCollection(name string) (*Collection, error) {
 	}
 
 	c := NewCollection(path, name, NewConcurrentMap(path, files), make(map[string]*int))
+	c.setOptions(&db.options)
+	cfg := db.Config()
+	if cfg.CacheSize != 0 {
+		c.resizeCache(cfg.CacheSize)
+	}
+	if cfg.WriteBufferSize != 0 {
+		c.SetWriteBufferSize(cfg.WriteBufferSize)
+	}
+	c.Map.markDirty()
+	c.database = db
 	db.collectionMutex.Lock()
 	db.collections[name] = c
 	db.collectionMutex.Unlock()
+	atomic.StoreInt32(&db.dirty, 1)
 
+	if db.manager != nil {
+		// the collection takes its share of the cache budget of the manager
+		return c, db.manager.Rebalance()
+	}
 	return c, nil
 }
 
 func (db *Database) GetCollection(name string) *Collection {
 	db.collectionMutex.RLock()
-	c := db.collections[name]
+	c, ok := db.collections[name]
+	if !ok {
+		c = db.attached[name]
+	}
 	db.collectionMutex.RUnlock()
 	return c
 }
 
+// drops the collection and deletes its files
+func (db *Database) removeCollection(c *Collection) error {
+	db.DropCollection(c.Name)
+	c.closeAsyncWrites()
+	c.Map.Close()
+	c.Cache.Close()
+	return os.RemoveAll(c.SyncDestination)
+}
+
 func (db *Database) DropCollection(name string) {
 	db.collectionMutex.Lock()
 	delete(db.collections, name)
 	db.collectionMutex.Unlock()
+	atomic.StoreInt32(&db.dirty, 1)
 }
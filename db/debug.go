@@ -0,0 +1,107 @@
+package db
+
+import (
+	"bytes"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"time"
+
+	"github.com/allegro/bigcache"
+)
+
+// State of the engine at one moment for debugging a running process, see DebugDump
+type DebugState struct {
+	Time       time.Time `json:"time"`
+	Goroutines int       `json:"goroutines"`
+	// stacks of every goroutine in the format of a panic
+	Stacks    string `json:"stacks"`
+	HeapAlloc uint64 `json:"heap_alloc"`
+	HeapInuse uint64 `json:"heap_inuse"`
+	NumGC     uint32 `json:"num_gc"`
+	// tasks of the scheduler waiting for a worker
+	PendingTasks int                              `json:"pending_tasks"`
+	Workers      int                              `json:"workers"`
+	Collections  map[string]*CollectionDebugState `json:"collections"`
+}
+
+type CollectionDebugState struct {
+	Objects  int64 `json:"objects"`
+	ReadOnly bool  `json:"read_only"`
+	// shards changed since the last sync
+	DirtyShards []int `json:"dirty_shards"`
+	// shards a writer held or waited for while the dump was taken
+	BusyShards []int `json:"busy_shards"`
+	// keys locked by WithKeyLock and the callers waiting for them
+	LockedKeys int `json:"locked_keys"`
+	KeyWaiters int `json:"key_waiters"`
+	// held by LockExclusive or LockShared, nil while the collection is not locked
+	Lock        *CollectionLockInfo `json:"lock,omitempty"`
+	AsyncQueued int                 `json:"async_queued"`
+	// element cache
+	CacheEntries  int                `json:"cache_entries"`
+	Cache         bigcache.Stats     `json:"cache"`
+	QueryCache    QueryCacheStats    `json:"query_cache"`
+	NegativeCache NegativeCacheStats `json:"negative_cache"`
+}
+
+// Captures the goroutines, the lock and the cache state of the engine, e.g. for an admin endpoint of the
+// application or a signal handler. The shard locks are only probed, so a stuck shard shows up as busy
+// instead of blocking the dump. Profiling endpoints are left to the application, net/http/pprof serves them
+func (db *Database) DebugDump() *DebugState {
+	state := &DebugState{Time: time.Now(), Goroutines: runtime.NumGoroutine(), Collections: make(map[string]*CollectionDebugState)}
+	var stacks bytes.Buffer
+	if p := pprof.Lookup("goroutine"); p != nil {
+		p.WriteTo(&stacks, 2)
+	}
+	state.Stacks = stacks.String()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	state.HeapAlloc, state.HeapInuse, state.NumGC = mem.HeapAlloc, mem.HeapInuse, mem.NumGC
+	if db.scheduler != nil {
+		state.PendingTasks = db.scheduler.Pending()
+		state.Workers = db.scheduler.Workers()
+	}
+
+	db.collectionMutex.RLock()
+	collections := make([]*Collection, 0, len(db.collections)+len(db.attached))
+	for _, c := range db.collections {
+		collections = append(collections, c)
+	}
+	for _, c := range db.attached {
+		collections = append(collections, c)
+	}
+	db.collectionMutex.RUnlock()
+	for _, c := range collections {
+		state.Collections[c.Name] = c.debugState()
+	}
+	return state
+}
+
+func (c *Collection) debugState() *CollectionDebugState {
+	s := &CollectionDebugState{Objects: c.Size(), ReadOnly: c.readOnly, DirtyShards: c.Map.DirtyShards(), BusyShards: make([]int, 0)}
+	for i, shard := range c.Map.Shared {
+		if !shard.mx.TryRLock() {
+			s.BusyShards = append(s.BusyShards, i)
+			continue
+		}
+		shard.mx.RUnlock()
+	}
+	sort.Ints(s.BusyShards)
+	s.LockedKeys, s.KeyWaiters = c.keyLocks.stats()
+	s.Lock = c.LockInfo()
+	c.asyncMx.RLock()
+	if c.async != nil {
+		s.AsyncQueued = len(c.async.queue)
+	}
+	c.asyncMx.RUnlock()
+	c.cacheMx.RLock()
+	if c.Cache != nil {
+		s.CacheEntries = c.Cache.Len()
+		s.Cache = c.Cache.Stats()
+	}
+	c.cacheMx.RUnlock()
+	s.QueryCache = c.getQueryCache().stats()
+	s.NegativeCache = c.getNegativeCache().stats()
+	return s
+}
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Schema of the collection description written by this version of the library,
+// descriptions without a schema were written before it was introduced and count as 1
+const DESCRIPTION_SCHEMA = 3
+
+// keys added to the description by every schema, descriptionKeys[n] by schema n+1.
+// A description may only have the keys of its schema and of the older ones
+var descriptionKeys = [][]string{
+	{"name", "dests", "objects", "sync_dest", "write_buffer", "encrypted"},
+	{"schema"},
+	{"fragments", "indexes", "computed", "codec", "partitioned_keys"},
+}
+
+// descriptionMigrations[n] upgrades a description of schema n+1 to n+2,
+// every change of the description format adds a step and bumps DESCRIPTION_SCHEMA
+var descriptionMigrations = []func(d map[string]interface{}) error{
+	// 1 -> 2: descriptions written on Windows joined the sync destination with backslashes
+	func(d map[string]interface{}) error {
+		if dest, ok := d["sync_dest"].(string); ok {
+			d["sync_dest"] = strings.Replace(dest, "\\", "/", -1)
+		}
+		return nil
+	},
+	// 2 -> 3: field fragments, declared indexes, computed fields, codecs and partitioned keys,
+	// a description without them has every one of them off
+	func(d map[string]interface{}) error {
+		return nil
+	},
+}
+
+// the key is not known to the schema, e.g. it was added to Collection.MarshalJSON without a new schema
+func unknownDescriptionKey(d map[string]interface{}, schema int) string {
+	known := make(map[string]bool)
+	for _, keys := range descriptionKeys[:schema] {
+		for _, key := range keys {
+			known[key] = true
+		}
+	}
+	for key := range d {
+		if !known[key] {
+			return key
+		}
+	}
+	return ""
+}
+
+// upgrades the raw description to DESCRIPTION_SCHEMA, descriptions of newer libraries are refused
+func migrateDescription(data []byte) ([]byte, error) {
+	d := make(map[string]interface{})
+	err := json.Unmarshal(data, &d)
+	if err != nil {
+		return nil, err
+	}
+	schema := 1
+	if v, ok := d["schema"]; ok {
+		f, ok := v.(float64)
+		if !ok || f < 1 || f != float64(int(f)) {
+			return nil, errors.New("invalid description schema")
+		}
+		schema = int(f)
+	}
+	if schema > DESCRIPTION_SCHEMA {
+		return nil, errors.New("description schema " + strconv.Itoa(schema) +
+			" is newer than the supported " + strconv.Itoa(DESCRIPTION_SCHEMA) + ", upgrade the library")
+	}
+	if key := unknownDescriptionKey(d, schema); key != "" {
+		return nil, errors.New("description of schema " + strconv.Itoa(schema) + " has the unknown key " + key)
+	}
+	if schema == DESCRIPTION_SCHEMA {
+		return data, nil
+	}
+	for ; schema < DESCRIPTION_SCHEMA; schema++ {
+		err = descriptionMigrations[schema-1](d)
+		if err != nil {
+			return nil, errors.New("failed to migrate the description to schema " + strconv.Itoa(schema+1) + " due " + err.Error())
+		}
+	}
+	d["schema"] = DESCRIPTION_SCHEMA
+	return json.Marshal(d)
+}
@@ -0,0 +1,231 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+type DiffOptions struct {
+	// report the changed fields of the changed elements
+	Values bool
+	// compare only these collections, all of them when empty
+	Collections []string
+}
+
+type DiffReport struct {
+	// collections only the second database has
+	AddedCollections []string `json:"added_collections,omitempty"`
+	// collections only the first database has
+	RemovedCollections []string `json:"removed_collections,omitempty"`
+	// the collections both databases have and that differ, by name
+	Collections map[string]*CollectionDiff `json:"collections,omitempty"`
+}
+
+// ids of the elements that differ, sorted
+type CollectionDiff struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Changed []string `json:"changed,omitempty"`
+	// the changed fields by id, set with DiffOptions.Values
+	Values map[string][]FieldChange `json:"values,omitempty"`
+}
+
+// a field of an element that differs, Old or New is nil if the field is missing in the version
+type FieldChange struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old"`
+	New  interface{} `json:"new"`
+}
+
+// the databases hold the same collections and elements
+func (r *DiffReport) Identical() bool {
+	return len(r.AddedCollections) == 0 && len(r.RemovedCollections) == 0 && len(r.Collections) == 0
+}
+
+// Compares the databases under the paths element by element, e.g. a migrated copy with its source or two
+// replicas. Added and removed are seen from the first database. Elements are matched by id and are equal when
+// their decoded payloads are, so the types of the payloads have to be registered. Nothing is written
+func Diff(pathA, pathB string) (*DiffReport, error) {
+	return DiffWithOptions(pathA, pathB, nil)
+}
+
+func DiffWithOptions(pathA, pathB string, options *DiffOptions) (*DiffReport, error) {
+	if options == nil {
+		options = &DiffOptions{}
+	}
+	a := NewDatabase("")
+	defer a.Close()
+	if err := a.ScanAndLoadData(pathA); err != nil {
+		return nil, errors.New("failed to load " + pathA + " due " + err.Error())
+	}
+	b := NewDatabase("")
+	defer b.Close()
+	if err := b.ScanAndLoadData(pathB); err != nil {
+		return nil, errors.New("failed to load " + pathB + " due " + err.Error())
+	}
+	return a.diff(b, options)
+}
+
+func (db *Database) collectionNames() map[string]bool {
+	db.collectionMutex.RLock()
+	defer db.collectionMutex.RUnlock()
+	names := make(map[string]bool, len(db.collections))
+	for name := range db.collections {
+		names[name] = true
+	}
+	return names
+}
+
+func (db *Database) diff(other *Database, options *DiffOptions) (*DiffReport, error) {
+	report := &DiffReport{Collections: make(map[string]*CollectionDiff)}
+	namesA, namesB := db.collectionNames(), other.collectionNames()
+	if len(options.Collections) > 0 {
+		selected := make(map[string]bool, len(options.Collections))
+		for _, name := range options.Collections {
+			selected[name] = true
+		}
+		for _, names := range []map[string]bool{namesA, namesB} {
+			for name := range names {
+				if !selected[name] {
+					delete(names, name)
+				}
+			}
+		}
+	}
+	for name := range namesB {
+		if !namesA[name] {
+			report.AddedCollections = append(report.AddedCollections, name)
+		}
+	}
+	sort.Strings(report.AddedCollections)
+	compared := make([]string, 0, len(namesA))
+	for name := range namesA {
+		if namesB[name] {
+			compared = append(compared, name)
+		} else {
+			report.RemovedCollections = append(report.RemovedCollections, name)
+		}
+	}
+	sort.Strings(report.RemovedCollections)
+	sort.Strings(compared)
+	for _, name := range compared {
+		cd, err := db.GetCollection(name).diff(other.GetCollection(name), options)
+		if err != nil {
+			return report, errors.New("failed to compare collection " + name + " due " + err.Error())
+		}
+		if len(cd.Added)+len(cd.Removed)+len(cd.Changed) > 0 {
+			report.Collections[name] = cd
+		}
+	}
+	return report, nil
+}
+
+func (c *Collection) diff(other *Collection, options *DiffOptions) (*CollectionDiff, error) {
+	cd := &CollectionDiff{}
+	err := c.ForEach(func(e *Element) error {
+		if !other.hasId(e.Id) {
+			cd.Removed = append(cd.Removed, e.Id)
+			return nil
+		}
+		data, err := other.findById(e.Id, false)
+		if err != nil {
+			return err
+		}
+		oe, err := other.DecodeElement(data)
+		if err != nil {
+			return err
+		}
+		if reflect.DeepEqual(e.Payload, oe.Payload) && reflect.DeepEqual(e.Computed, oe.Computed) {
+			return nil
+		}
+		cd.Changed = append(cd.Changed, e.Id)
+		if !options.Values {
+			return nil
+		}
+		changes, err := fieldChanges(e.Payload, oe.Payload)
+		if err != nil {
+			return err
+		}
+		if cd.Values == nil {
+			cd.Values = make(map[string][]FieldChange)
+		}
+		cd.Values[e.Id] = changes
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = other.ForEach(func(e *Element) error {
+		if !c.hasId(e.Id) {
+			cd.Added = append(cd.Added, e.Id)
+		}
+		return nil
+	})
+	sort.Strings(cd.Added)
+	sort.Strings(cd.Removed)
+	sort.Strings(cd.Changed)
+	return cd, err
+}
+
+// the fields of the JSON documents of the payloads that differ, sorted by path
+func fieldChanges(a, b interface{}) ([]FieldChange, error) {
+	docA, err := jsonDocument(a)
+	if err != nil {
+		return nil, err
+	}
+	docB, err := jsonDocument(b)
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]FieldChange, 0)
+	compareDocuments("", docA, docB, &changes)
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+func jsonDocument(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	err = json.Unmarshal(data, &doc)
+	return doc, err
+}
+
+// paths are dotted, elements of slices are addressed by their index: "items.0.sku"
+func compareDocuments(path string, a, b interface{}, changes *[]FieldChange) {
+	join := func(name string) string {
+		if path == "" {
+			return name
+		}
+		return path + "." + name
+	}
+	switch ta := a.(type) {
+	case map[string]interface{}:
+		if tb, ok := b.(map[string]interface{}); ok {
+			for k, va := range ta {
+				compareDocuments(join(k), va, tb[k], changes)
+			}
+			for k, vb := range tb {
+				if _, ok := ta[k]; !ok {
+					compareDocuments(join(k), nil, vb, changes)
+				}
+			}
+			return
+		}
+	case []interface{}:
+		if tb, ok := b.([]interface{}); ok && len(ta) == len(tb) {
+			for i := range ta {
+				compareDocuments(join(strconv.Itoa(i)), ta[i], tb[i], changes)
+			}
+			return
+		}
+	}
+	if !reflect.DeepEqual(a, b) {
+		*changes = append(*changes, FieldChange{path, a, b})
+	}
+}
@@ -0,0 +1,151 @@
+package db
+
+import (
+	"errors"
+	"github.com/shirou/gopsutil/disk"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Returned by the writes of new elements while the disk watchdog holds the database read-only.
+// Deletes and Optimize keep working, so space can still be reclaimed
+var ErrDiskFull = errors.New("database is read-only, the drive is almost full")
+
+// What the disk watchdog saw at its last check, see CheckDisk
+type DiskStatus struct {
+	Free int64 `json:"free"`
+	// the free space is below Config.DiskLowSpace
+	Low bool `json:"low"`
+	// new elements are refused until the free space is above Config.DiskLowSpace again
+	ReadOnly bool `json:"read_only"`
+	// collection an emergency compaction was started for, empty when none was
+	Compacting string `json:"compacting,omitempty"`
+}
+
+func (o *DatabaseOptions) diskFree(dir string) (int64, error) {
+	if o != nil && o.DiskFree != nil {
+		return o.DiskFree(dir)
+	}
+	usage, err := disk.Usage(dir)
+	if err != nil {
+		return 0, err
+	}
+	return int64(usage.Free), nil
+}
+
+// nil unless the disk watchdog holds the database read-only
+func (db *Database) diskAvailable() error {
+	if db != nil && atomic.LoadInt32(&db.diskFull) == 1 {
+		return ErrDiskFull
+	}
+	return nil
+}
+
+// Checks the free space of the data directory against the thresholds of the config, like the watchdog
+// (Config.DiskCheckInterval) does in the background:
+//   - below DiskLowSpace EVENT_DISK_LOW is emitted and the collection with the highest share of
+//     reclaimable bytes is compacted and synchronized at a high priority, so it runs outside of the maintenance windows
+//   - below DiskCriticalSpace new elements are refused with ErrDiskFull and EVENT_DISK_READ_ONLY is emitted
+//   - once the space is above DiskLowSpace again writes are accepted and EVENT_DISK_RECOVERED is emitted
+//
+// The compaction runs in the background, CheckDisk does not wait for it
+func (db *Database) CheckDisk() (*DiskStatus, error) {
+	dir := db.dir
+	if dir == "" {
+		dir = "."
+	}
+	free, err := db.options.diskFree(dir)
+	if err != nil {
+		return nil, errors.New("failed to read the free space of " + dir + " due " + err.Error())
+	}
+	cfg := db.Config()
+	status := &DiskStatus{Free: free, Low: cfg.DiskLowSpace > 0 && free < cfg.DiskLowSpace}
+	space := strconv.FormatInt(free, 10) + " bytes free"
+	if cfg.DiskCriticalSpace > 0 && free < cfg.DiskCriticalSpace {
+		if atomic.CompareAndSwapInt32(&db.diskFull, 0, 1) {
+			db.logf(LOG_ERROR, "drive is almost full, the database is read-only:", space)
+			db.emit(Event{Type: EVENT_DISK_READ_ONLY, Message: space, Data: free})
+		}
+	} else if !status.Low && atomic.CompareAndSwapInt32(&db.diskFull, 1, 0) {
+		db.logf(LOG_WARNING, "drive has space again, the database is writable:", space)
+		db.emit(Event{Type: EVENT_DISK_RECOVERED, Message: space, Data: free})
+	}
+	status.ReadOnly = atomic.LoadInt32(&db.diskFull) == 1
+	if !status.Low {
+		return status, nil
+	}
+	db.logf(LOG_WARNING, "drive is running out of space:", space)
+	if c := db.mostGarbage(); c != nil && atomic.CompareAndSwapInt32(&db.compacting, 0, 1) {
+		status.Compacting = c.Name
+		done := db.scheduler.Submit("emergency compaction "+c.Name, PRIORITY_HIGH, func() error {
+			if _, err := c.Optimize(); err != nil {
+				return err
+			}
+			// the merged segments are removed by the manifest of the sync
+			return db.Sync()
+		})
+		go func() {
+			err := <-done
+			atomic.StoreInt32(&db.compacting, 0)
+			if p, ok := err.(*PanicError); ok {
+				db.emit(Event{Type: EVENT_PANIC, Message: p.Error(), Data: p})
+			} else if err != nil && err != ErrSchedulerClosed {
+				db.logf(LOG_ERROR, "emergency compaction of", c.Name, "failed:", err)
+			}
+		}()
+	}
+	db.emit(Event{Type: EVENT_DISK_LOW, Collection: status.Compacting, Message: space, Data: free})
+	return status, nil
+}
+
+// the collection with the highest share of reclaimable bytes, nil when there is nothing to reclaim
+func (db *Database) mostGarbage() *Collection {
+	db.collectionMutex.RLock()
+	defer db.collectionMutex.RUnlock()
+	var found *Collection
+	best := 0.0
+	for _, c := range db.collections {
+		if c.readOnly {
+			continue
+		}
+		g := c.GarbageStats()
+		if g.Reclaimable == 0 {
+			continue
+		}
+		if ratio := float64(g.Reclaimable) / float64(g.Reclaimable+g.LiveBytes); ratio > best {
+			found, best = c, ratio
+		}
+	}
+	return found
+}
+
+func (db *Database) startDiskWatchdog(interval time.Duration) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	db.diskStop, db.diskDone = stop, done
+	ticker := db.Clock().NewTicker(interval)
+	go func() {
+		defer close(done)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.Chan():
+				if _, err := db.CheckDisk(); err != nil {
+					db.logf(LOG_ERROR, err)
+				}
+			}
+		}
+	}()
+}
+
+func (db *Database) stopDiskWatchdog() {
+	if db.diskStop == nil {
+		return
+	}
+	close(db.diskStop)
+	<-db.diskDone
+	db.diskStop, db.diskDone = nil, nil
+}
@@ -2,20 +2,23 @@ package db
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"os"
 	"compress/gzip"
+	"io"
 	"io/ioutil"
 )
 
 type EncodedCompressedPackage struct {
-	name string
-	data interface{}
+	name             string
+	data             interface{}
 	compressionLevel int
+	options          *DatabaseOptions
 }
 
 func NewEncodedCompressedPackage(name string) *EncodedCompressedPackage {
-	return &EncodedCompressedPackage{name, nil, gzip.BestCompression}
+	return &EncodedCompressedPackage{name, nil, gzip.BestCompression, nil}
 }
 
 func (p *EncodedCompressedPackage) SetData(data interface{}) {
@@ -26,7 +29,19 @@ func (p *EncodedCompressedPackage) SetCompressionLevel(level int) {
 	p.compressionLevel = level
 }
 
+func (p *EncodedCompressedPackage) SetOptions(options *DatabaseOptions) {
+	p.options = options
+	if options != nil {
+		p.compressionLevel = options.CompressionLevel
+	}
+}
+
 func (p *EncodedCompressedPackage) Save() error {
+	return p.SaveContext(context.Background())
+}
+
+// same as Save, the file is written in chunks honoring the context
+func (p *EncodedCompressedPackage) SaveContext(ctx context.Context) error {
 	var data bytes.Buffer
 
 	enc := gob.NewEncoder(&data)
@@ -35,17 +50,17 @@ func (p *EncodedCompressedPackage) Save() error {
 		return err
 	}
 
-	f, err := os.Create(p.name)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	gzipw, _ := gzip.NewWriterLevel(f, p.compressionLevel)
-	defer gzipw.Close()
-	_, err = gzipw.Write(data.Bytes())
-
-	return err
+	return p.options.writeAtomicallyContext(ctx, p.name, func(w io.Writer) error {
+		gzipw, err := gzip.NewWriterLevel(w, p.compressionLevel)
+		if err != nil {
+			return err
+		}
+		_, err = gzipw.Write(data.Bytes())
+		if err != nil {
+			return err
+		}
+		return gzipw.Close()
+	})
 }
 
 func (p *EncodedCompressedPackage) LoadDecoder() (*gob.Decoder, error) {
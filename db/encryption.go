@@ -0,0 +1,230 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"sync/atomic"
+)
+
+// Supplies the keys of the encrypted fields, e.g. from a KMS
+type KeyProvider interface {
+	// 16, 24 or 32 bytes selecting AES-128, AES-192 or AES-256
+	CollectionKey(collection string) ([]byte, error)
+}
+
+// The same key for every collection
+type StaticKey []byte
+
+func (k StaticKey) CollectionKey(string) ([]byte, error) {
+	return k, nil
+}
+
+type fieldCipher struct {
+	aead cipher.AEAD
+	// key of the index blinding, values of encrypted fields are indexed by their HMAC
+	blind  []byte
+	fields map[string]bool
+}
+
+func newFieldCipher(key []byte, fields []string) (*fieldCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("shardb index"))
+	fc := &fieldCipher{aead, mac.Sum(nil), make(map[string]bool, len(fields))}
+	for _, f := range fields {
+		fc.fields[f] = true
+	}
+	return fc, nil
+}
+
+func (fc *fieldCipher) seal(plain []byte) ([]byte, error) {
+	nonce := make([]byte, fc.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return fc.aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+func (fc *fieldCipher) open(sealed []byte) ([]byte, error) {
+	n := fc.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, errors.New("encrypted value is too short")
+	}
+	return fc.aead.Open(nil, sealed[:n], sealed[n:], nil)
+}
+
+func (fc *fieldCipher) blindValue(value string) string {
+	mac := hmac.New(sha256.New, fc.blind)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Encrypts the given fields of every element written from now on, the rest of the element stays readable.
+// Only string and []byte fields can be encrypted. Index values of the fields are replaced with keyed hashes,
+// so equality lookups keep working without storing the plain values in the meta files.
+// The field names are stored in the description of the collection, the keys never are:
+// a loaded collection needs SetEncryption(keys) before writes, reads without it return the ciphertext
+func (c *Collection) SetEncryption(keys KeyProvider, fields ...string) error {
+	if len(fields) == 0 {
+		fields = c.EncryptedFields
+	} else if c.Size() > 0 && !sameFields(fields, c.EncryptedFields) {
+		return errors.New("encrypted fields of a non-empty collection can not be changed")
+	}
+	if len(fields) == 0 {
+		return errors.New("no fields to encrypt")
+	}
+	key, err := keys.CollectionKey(c.Name)
+	if err != nil {
+		return errors.New("failed to get the key of collection " + c.Name + " due " + err.Error())
+	}
+	fc, err := newFieldCipher(key, fields)
+	if err != nil {
+		return err
+	}
+	c.sharedDestMx.Lock()
+	c.EncryptedFields = fields
+	c.fields = fc
+	c.sharedDestMx.Unlock()
+	atomic.StoreInt32(&c.dirty, 1)
+	return nil
+}
+
+// the cipher set by SetEncryption, nil without the keys
+func (c *Collection) getFields() *fieldCipher {
+	c.sharedDestMx.RLock()
+	defer c.sharedDestMx.RUnlock()
+	return c.fields
+}
+
+func sameFields(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// the index of the payload with the values of encrypted fields blinded
+func (c *Collection) dataIndex(payload CustomStructure) ([]*FullDataIndex, error) {
+	indexes := payload.GetDataIndex()
+	if len(c.EncryptedFields) == 0 {
+		return indexes, nil
+	}
+	fc := c.getFields()
+	if fc == nil {
+		return nil, errors.New("keys of the encrypted fields of collection " + c.Name + " are not set")
+	}
+	blinded := make([]*FullDataIndex, len(indexes))
+	for i, ix := range indexes {
+		blinded[i] = ix
+		if fc.fields[ix.Field] && ix.Data != "" {
+			blinded[i] = &FullDataIndex{ix.Field, fc.blindValue(ix.Data), ix.Unique}
+		}
+	}
+	return blinded, nil
+}
+
+// copy of the payload with the encrypted fields sealed, the payload itself is not modified
+func (c *Collection) encryptPayload(payload CustomStructure) (CustomStructure, error) {
+	if len(c.EncryptedFields) == 0 {
+		return payload, nil
+	}
+	fc := c.getFields()
+	if fc == nil {
+		return nil, errors.New("keys of the encrypted fields of collection " + c.Name + " are not set")
+	}
+	v := reflect.ValueOf(payload)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil, errors.New("only pointers to structures can have encrypted fields")
+	}
+	cp := reflect.New(v.Elem().Type())
+	cp.Elem().Set(v.Elem())
+	for _, name := range c.EncryptedFields {
+		f := cp.Elem().FieldByName(name)
+		if !f.IsValid() {
+			return nil, errors.New("unknown encrypted field " + name)
+		}
+		switch {
+		case f.Kind() == reflect.String:
+			sealed, err := fc.seal([]byte(f.String()))
+			if err != nil {
+				return nil, err
+			}
+			f.SetString(base64.StdEncoding.EncodeToString(sealed))
+		case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.Uint8:
+			sealed, err := fc.seal(f.Bytes())
+			if err != nil {
+				return nil, err
+			}
+			f.SetBytes(sealed)
+		default:
+			return nil, errors.New("field " + name + " of type " + f.Type().String() + " can not be encrypted")
+		}
+	}
+	return cp.Interface().(CustomStructure), nil
+}
+
+// decrypts the encrypted fields of the decoded payload in place, nothing happens without the keys
+func (c *Collection) decryptPayload(payload interface{}) error {
+	fc := c.getFields()
+	if fc == nil {
+		return nil
+	}
+	v := reflect.ValueOf(payload)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	for _, name := range c.EncryptedFields {
+		f := v.Elem().FieldByName(name)
+		if !f.IsValid() {
+			continue
+		}
+		err := fc.openValue(name, f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decrypts the value of the encrypted field in place
+func (fc *fieldCipher) openValue(name string, f reflect.Value) error {
+	switch {
+	case f.Kind() == reflect.String:
+		sealed, err := base64.StdEncoding.DecodeString(f.String())
+		if err != nil {
+			return errors.New("field " + name + " is not encrypted")
+		}
+		plain, err := fc.open(sealed)
+		if err != nil {
+			return errors.New("failed to decrypt field " + name + " due " + err.Error())
+		}
+		f.SetString(string(plain))
+	case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.Uint8:
+		plain, err := fc.open(f.Bytes())
+		if err != nil {
+			return errors.New("failed to decrypt field " + name + " due " + err.Error())
+		}
+		f.SetBytes(plain)
+	}
+	return nil
+}
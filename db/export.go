@@ -0,0 +1,107 @@
+package db
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+)
+
+const REDACTED = "[REDACTED]"
+
+// Fields are named as they appear in the JSON of the payload, nested fields are separated by dots
+type ExportOptions struct {
+	// replaced with REDACTED
+	Redact []string
+	// replaced with the hex SHA-256 of Salt and the value, equal values stay equal
+	Hash []string
+	Salt string
+}
+
+type exportedElement struct {
+	Id      string      `json:"x"`
+	Payload interface{} `json:"p"`
+}
+
+// writes every live element as a line of JSON, returns the number of written elements
+func (c *Collection) ExportJSONL(w io.Writer, opts *ExportOptions) (int, error) {
+	if opts == nil {
+		opts = &ExportOptions{}
+	}
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	n := 0
+	err := c.ForEach(func(e *Element) error {
+		payload, err := opts.apply(e.Payload)
+		if err != nil {
+			return errors.New("failed to export element " + e.Id + " due " + err.Error())
+		}
+		err = enc.Encode(exportedElement{e.Id, payload})
+		if err == nil {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+// JSON document of the payload with the configured fields masked
+func (opts *ExportOptions) apply(payload interface{}) (interface{}, error) {
+	if len(opts.Redact) == 0 && len(opts.Hash) == 0 {
+		return payload, nil
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	err = json.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range opts.Redact {
+		maskField(doc, strings.Split(path, "."), func(interface{}) interface{} {
+			return REDACTED
+		})
+	}
+	for _, path := range opts.Hash {
+		maskField(doc, strings.Split(path, "."), opts.hash)
+	}
+	return doc, nil
+}
+
+func (opts *ExportOptions) hash(v interface{}) interface{} {
+	s, ok := v.(string)
+	if !ok {
+		data, _ := json.Marshal(v)
+		s = string(data)
+	}
+	sum := sha256.Sum256([]byte(opts.Salt + s))
+	return hex.EncodeToString(sum[:])
+}
+
+// replaces the value under the path, lists are masked element by element
+func maskField(doc interface{}, path []string, mask func(interface{}) interface{}) {
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		value, ok := v[path[0]]
+		if !ok || value == nil {
+			return
+		}
+		if len(path) == 1 {
+			v[path[0]] = mask(value)
+			return
+		}
+		maskField(value, path[1:], mask)
+	case []interface{}:
+		for _, item := range v {
+			maskField(item, path, mask)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// file operations a FaultInjector decides on
+type FileOp int
+
+const (
+	// a write to a shard segment or to the temporary file of an atomic write (meta, description, header)
+	FAULT_WRITE FileOp = iota
+	// the fsync of a segment or of a temporary file
+	FAULT_SYNC
+	// the rename of a temporary file over the file it replaces
+	FAULT_RENAME
+)
+
+// Returned by the torn writes of Faults
+var ErrTornWrite = errors.New("torn write")
+
+// What happens to an operation, the zero value lets it through
+type Fault struct {
+	Err error
+	// bytes of a failing write that reach the file anyway
+	Written int
+	// the operation waits this long first, e.g. a slow fsync
+	Delay time.Duration
+}
+
+// Decides the fault of every file operation of the database (DatabaseOptions.Faults), for testing
+// what crashes and broken drives leave behind. Size is the length of a write. It is called concurrently
+type FaultInjector interface {
+	Fault(op FileOp, path string, size int) Fault
+}
+
+func (o *DatabaseOptions) fault(op FileOp, path string, size int) Fault {
+	if o == nil || o.Faults == nil {
+		return Fault{}
+	}
+	f := o.Faults.Fault(op, path, size)
+	if f.Delay > 0 {
+		time.Sleep(f.Delay)
+	}
+	return f
+}
+
+// runs the write unless the injector fails it, a torn write writes the first bytes only
+func (o *DatabaseOptions) faultyWrite(path string, p []byte, write func(p []byte) (int, error)) (int, error) {
+	f := o.fault(FAULT_WRITE, path, len(p))
+	if f.Err == nil {
+		return write(p)
+	}
+	n := 0
+	if f.Written > 0 {
+		if f.Written > len(p) {
+			f.Written = len(p)
+		}
+		n, _ = write(p[:f.Written])
+	}
+	return n, f.Err
+}
+
+// an atomically written file going through the injector
+type faultyWriter struct {
+	options *DatabaseOptions
+	path    string
+	w       interface{ Write(p []byte) (int, error) }
+}
+
+func (fw faultyWriter) Write(p []byte) (int, error) {
+	return fw.options.faultyWrite(fw.path, p, fw.w.Write)
+}
+
+// FaultInjector with the usual failures, armed by its methods:
+//
+//	faults := db.NewFaults()
+//	options.Faults = faults
+//	faults.FailWrite(3, syscall.EIO)  // the third write from now fails
+//	faults.NoSpaceAfter(1 << 20)      // ENOSPC once another megabyte is written
+type Faults struct {
+	mx sync.Mutex
+	// writes and bytes since the faults were armed
+	writes  int
+	written int64
+	rules   []faultRule
+	match   string
+}
+
+type faultRule struct {
+	op FileOp
+	// the operation number the rule fires at, 0 fires at every one
+	at    int
+	fault Fault
+	// failing writes once this many bytes are written, negative is off
+	limit int64
+}
+
+func NewFaults() *Faults {
+	return &Faults{}
+}
+
+// only the files whose path contains the substring are affected, "" affects every file
+func (f *Faults) Only(substring string) *Faults {
+	f.mx.Lock()
+	f.match = substring
+	f.mx.Unlock()
+	return f
+}
+
+func (f *Faults) add(r faultRule) *Faults {
+	f.mx.Lock()
+	f.rules = append(f.rules, r)
+	f.mx.Unlock()
+	return f
+}
+
+// the nth write from now fails with err
+func (f *Faults) FailWrite(n int, err error) *Faults {
+	return f.add(faultRule{op: FAULT_WRITE, at: f.Writes() + n, fault: Fault{Err: err}, limit: -1})
+}
+
+// the nth write from now writes only keep bytes and fails with ErrTornWrite, like a crash in the middle of it
+func (f *Faults) TearWrite(n, keep int) *Faults {
+	return f.add(faultRule{op: FAULT_WRITE, at: f.Writes() + n, fault: Fault{Err: ErrTornWrite, Written: keep}, limit: -1})
+}
+
+// every fsync waits for d
+func (f *Faults) DelaySync(d time.Duration) *Faults {
+	return f.add(faultRule{op: FAULT_SYNC, fault: Fault{Delay: d}, limit: -1})
+}
+
+// every fsync fails with err
+func (f *Faults) FailSync(err error) *Faults {
+	return f.add(faultRule{op: FAULT_SYNC, fault: Fault{Err: err}, limit: -1})
+}
+
+// every rename of an atomic write fails with err, the replaced files stay as they were
+func (f *Faults) FailRename(err error) *Faults {
+	return f.add(faultRule{op: FAULT_RENAME, fault: Fault{Err: err}, limit: -1})
+}
+
+// writes fail with ENOSPC once n more bytes are written, the write crossing the limit is torn at it
+func (f *Faults) NoSpaceAfter(n int64) *Faults {
+	f.mx.Lock()
+	limit := f.written + n
+	f.mx.Unlock()
+	return f.add(faultRule{op: FAULT_WRITE, fault: Fault{Err: syscall.ENOSPC}, limit: limit})
+}
+
+// disarms every fault, the counters go on
+func (f *Faults) Clear() {
+	f.mx.Lock()
+	f.rules = nil
+	f.mx.Unlock()
+}
+
+// writes seen so far
+func (f *Faults) Writes() int {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	return f.writes
+}
+
+func (f *Faults) Fault(op FileOp, path string, size int) Fault {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if f.match != "" && !strings.Contains(path, f.match) {
+		return Fault{}
+	}
+	if op == FAULT_WRITE {
+		f.writes++
+	}
+	for _, r := range f.rules {
+		if r.op != op {
+			continue
+		}
+		switch {
+		case r.limit >= 0:
+			if f.written+int64(size) > r.limit {
+				kept := r.limit - f.written
+				if kept < 0 {
+					kept = 0
+				}
+				f.written += kept
+				return Fault{Err: r.fault.Err, Written: int(kept)}
+			}
+		case r.at == 0 || r.at == f.writes:
+			if op == FAULT_WRITE {
+				f.written += int64(r.fault.Written)
+			}
+			return r.fault
+		}
+	}
+	if op == FAULT_WRITE {
+		f.written += int64(size)
+	}
+	return Fault{}
+}
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// IO of a shard since the start or the last ResetMetrics
+type IOStats struct {
+	BytesRead    uint64            `json:"bytes_read"`
+	BytesWritten uint64            `json:"bytes_written"`
+	Reads        uint64            `json:"reads"`
+	Writes       uint64            `json:"writes"`
+	Syncs        uint64            `json:"syncs"`
+	ReadLatency  HistogramSnapshot `json:"read_latency"`
+	WriteLatency HistogramSnapshot `json:"write_latency"`
+	SyncLatency  HistogramSnapshot `json:"sync_latency"`
+}
+
+// counters of a shard, updated by the instrumented files
+type shardIO struct {
+	bytesRead    uint64
+	bytesWritten uint64
+	reads        uint64
+	writes       uint64
+	syncs        uint64
+	readLatency  *Histogram
+	writeLatency *Histogram
+	syncLatency  *Histogram
+}
+
+func newShardIO() *shardIO {
+	return &shardIO{readLatency: NewHistogram(LATENCY_BUCKETS), writeLatency: NewHistogram(LATENCY_BUCKETS),
+		syncLatency: NewHistogram(LATENCY_BUCKETS)}
+}
+
+func (s *shardIO) snapshot() IOStats {
+	return IOStats{atomic.LoadUint64(&s.bytesRead), atomic.LoadUint64(&s.bytesWritten), atomic.LoadUint64(&s.reads),
+		atomic.LoadUint64(&s.writes), atomic.LoadUint64(&s.syncs),
+		s.readLatency.Snapshot(), s.writeLatency.Snapshot(), s.syncLatency.Snapshot()}
+}
+
+func (s *shardIO) reset() {
+	atomic.StoreUint64(&s.bytesRead, 0)
+	atomic.StoreUint64(&s.bytesWritten, 0)
+	atomic.StoreUint64(&s.reads, 0)
+	atomic.StoreUint64(&s.writes, 0)
+	atomic.StoreUint64(&s.syncs, 0)
+	s.readLatency.Reset()
+	s.writeLatency.Reset()
+	s.syncLatency.Reset()
+}
+
+// adds up the stats of several shards, the latency buckets are shared by all of them
+func (s IOStats) add(other IOStats) IOStats {
+	return IOStats{s.BytesRead + other.BytesRead, s.BytesWritten + other.BytesWritten, s.Reads + other.Reads,
+		s.Writes + other.Writes, s.Syncs + other.Syncs, s.ReadLatency.add(other.ReadLatency),
+		s.WriteLatency.add(other.WriteLatency), s.SyncLatency.add(other.SyncLatency)}
+}
+
+// A segment file of a shard, every call is accounted to the shard
+type instrumentedFile struct {
+	f       *os.File
+	io      *shardIO
+	options *DatabaseOptions
+}
+
+// shards are created and decoded in several places, the counters come with the first use
+func (shard *ConcurrentMapShared) counters() *shardIO {
+	shard.ioOnce.Do(func() { shard.io = newShardIO() })
+	return shard.io
+}
+
+func (shard *ConcurrentMapShared) instrument(f *os.File) instrumentedFile {
+	return instrumentedFile{f, shard.counters(), shard.options}
+}
+
+func (f instrumentedFile) ReadAt(p []byte, off int64) (int, error) {
+	start := time.Now()
+	n, err := f.f.ReadAt(p, off)
+	f.io.readLatency.Observe(time.Since(start))
+	atomic.AddUint64(&f.io.reads, 1)
+	atomic.AddUint64(&f.io.bytesRead, uint64(n))
+	return n, err
+}
+
+func (f instrumentedFile) WriteAt(p []byte, off int64) (int, error) {
+	start := time.Now()
+	n, err := f.options.faultyWrite(f.f.Name(), p, func(p []byte) (int, error) { return f.f.WriteAt(p, off) })
+	f.observeWrite(n, start)
+	return n, err
+}
+
+func (f instrumentedFile) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := f.options.faultyWrite(f.f.Name(), p, f.f.Write)
+	f.observeWrite(n, start)
+	return n, err
+}
+
+func (f instrumentedFile) observeWrite(n int, start time.Time) {
+	f.io.writeLatency.Observe(time.Since(start))
+	atomic.AddUint64(&f.io.writes, 1)
+	atomic.AddUint64(&f.io.bytesWritten, uint64(n))
+}
+
+func (f instrumentedFile) Sync() error {
+	start := time.Now()
+	err := f.options.fault(FAULT_SYNC, f.f.Name(), 0).Err
+	if err == nil {
+		err = f.f.Sync()
+	}
+	f.io.syncLatency.Observe(time.Since(start))
+	atomic.AddUint64(&f.io.syncs, 1)
+	return err
+}
+
+// IO of the shard
+func (shard *ConcurrentMapShared) IOStats() IOStats {
+	return shard.counters().snapshot()
+}
+
+// IO of every shard by its id
+func (cm *ConcurrentMap) ShardIOStats() []IOStats {
+	stats := make([]IOStats, len(cm.Shared))
+	for i, shard := range cm.Shared {
+		stats[i] = shard.IOStats()
+	}
+	return stats
+}
+
+// IO of all of the shards of the collection
+func (c *Collection) IOStats() IOStats {
+	total := IOStats{}
+	for _, s := range c.Map.ShardIOStats() {
+		total = total.add(s)
+	}
+	return total
+}
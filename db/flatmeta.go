@@ -0,0 +1,610 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// The shard meta is stored as flat little endian tables, so the loading only maps the file
+// and checks it, the offsets are decoded into the maps on the first access of the shard.
+//
+//	header:     magic, version, crc32 of the tables, id and the number of entries of every table
+//	segments:   uint32 per segment
+//	offsets:    start uint64, length uint64, segment uint32, flags uint32 (1 = deleted)
+//	keys:       blob position uint32, length uint32, index of the offset uint32
+//	capacities: blob position uint32, length uint32, value int64
+//	blob:       the bytes of the keys
+//
+// A sync appends the entries changed since the previous one as a delta with the same tables behind
+// its own header (delta magic, crc32 of the rest of the delta, id and the sizes of the tables),
+// instead of encoding the whole shard again. A delta lists every segment, its offsets replace the ones
+// at the same position, removed keys point to no offset (FLAT_META_REMOVED) and removed capacities
+// are negative. The file is rewritten once the deltas outgrow the base tables or the shard is optimized
+const (
+	FLAT_META_MAGIC       = "SHFM"
+	FLAT_META_DELTA_MAGIC = "SHFD"
+	// version 1 has no deltas
+	FLAT_META_VERSION = 2
+	// offset index of a removed key in a delta
+	FLAT_META_REMOVED = math.MaxUint32
+
+	flatHeaderSize      = 36
+	flatDeltaHeaderSize = 32
+	flatOffsetSize      = 24
+	flatKeySize         = 12
+	flatCapacitySize    = 16
+	flatOffsetDeleted   = 1
+	flatOffsetTombstone = 2
+	// the checksum covers the bytes from the id on
+	flatChecksumOffset = 12
+	// the checksum of a delta covers the bytes from its id on
+	flatDeltaChecksumOffset = 8
+)
+
+type flatMeta struct {
+	data       []byte
+	release    func() error
+	header     int
+	segments   int
+	offsets    int
+	keys       int
+	capacities int
+	blobSize   int
+	// appended to the base tables, in their order
+	deltas []*flatMeta
+	// bytes of the file and of the base tables, a torn delta at the end is not counted
+	size, base int
+}
+
+func (m *flatMeta) offsetsStart() int {
+	return m.header + 4*m.segments
+}
+
+func (m *flatMeta) keysStart() int {
+	return m.offsetsStart() + flatOffsetSize*m.offsets
+}
+
+func (m *flatMeta) capacitiesStart() int {
+	return m.keysStart() + flatKeySize*m.keys
+}
+
+func (m *flatMeta) blobStart() int {
+	return m.capacitiesStart() + flatCapacitySize*m.capacities
+}
+
+func (m *flatMeta) end() int {
+	return m.blobStart() + m.blobSize
+}
+
+// the entries of the tables, keys of an element share a single offset
+type flatTables struct {
+	segments   []int
+	offsets    []*ShardOffset
+	indexes    map[*ShardOffset]uint32
+	keys       []string
+	targets    []uint32
+	capacities []string
+	values     []int64
+	blobSize   int
+}
+
+func newFlatTables(segments []int) *flatTables {
+	return &flatTables{segments: segments, indexes: make(map[*ShardOffset]uint32)}
+}
+
+func (t *flatTables) offset(item *ShardOffset) uint32 {
+	if i, ok := t.indexes[item]; ok {
+		return i
+	}
+	i := uint32(len(t.offsets))
+	t.indexes[item] = i
+	t.offsets = append(t.offsets, item)
+	return i
+}
+
+// nil removes the key
+func (t *flatTables) key(key string, item *ShardOffset) {
+	target := uint32(FLAT_META_REMOVED)
+	if item != nil {
+		target = t.offset(item)
+	}
+	t.keys = append(t.keys, key)
+	t.targets = append(t.targets, target)
+	t.blobSize += len(key)
+}
+
+func (t *flatTables) capacity(key string, value int64) {
+	t.capacities = append(t.capacities, key)
+	t.values = append(t.values, value)
+	t.blobSize += len(key)
+}
+
+// writes the tables behind a header of the given size, the header is left to the caller
+func (t *flatTables) encode(header int) ([]byte, *flatMeta, error) {
+	if int64(t.blobSize) > math.MaxUint32 || int64(len(t.keys)) > math.MaxUint32 {
+		return nil, nil, errors.New("meta is too large")
+	}
+	m := &flatMeta{header: header, segments: len(t.segments), offsets: len(t.offsets), keys: len(t.keys),
+		capacities: len(t.capacities), blobSize: t.blobSize}
+	data := make([]byte, m.end())
+	le := binary.LittleEndian
+	pos := header
+	for _, segment := range t.segments {
+		le.PutUint32(data[pos:], uint32(segment))
+		pos += 4
+	}
+	for _, item := range t.offsets {
+		le.PutUint64(data[pos:], uint64(item.Start))
+		le.PutUint64(data[pos+8:], uint64(item.Length))
+		le.PutUint32(data[pos+16:], uint32(item.Segment))
+		flags := uint32(0)
+		if item.Deleted {
+			flags |= flatOffsetDeleted
+		}
+		if item.Tombstone {
+			flags |= flatOffsetTombstone
+		}
+		le.PutUint32(data[pos+20:], flags)
+		pos += flatOffsetSize
+	}
+	blob := m.blobStart()
+	for i, key := range t.keys {
+		le.PutUint32(data[pos:], uint32(blob-m.blobStart()))
+		le.PutUint32(data[pos+4:], uint32(len(key)))
+		le.PutUint32(data[pos+8:], t.targets[i])
+		blob += copy(data[blob:], key)
+		pos += flatKeySize
+	}
+	for i, key := range t.capacities {
+		le.PutUint32(data[pos:], uint32(blob-m.blobStart()))
+		le.PutUint32(data[pos+4:], uint32(len(key)))
+		le.PutUint64(data[pos+8:], uint64(t.values[i]))
+		blob += copy(data[blob:], key)
+		pos += flatCapacitySize
+	}
+	return data, m, nil
+}
+
+// encodes the meta, the lock must be held. Keys are sorted so unchanged shards give identical files
+func (shard *ConcurrentMapShared) encodeFlatMeta() ([]byte, error) {
+	keys := make([]string, 0, len(shard.Items))
+	for key := range shard.Items {
+		keys = append(keys, key)
+	}
+	capacities := make([]string, 0, len(shard.Capacities))
+	for key := range shard.Capacities {
+		capacities = append(capacities, key)
+	}
+	sort.Strings(keys)
+	sort.Strings(capacities)
+	t := newFlatTables(shard.Segments)
+	for _, key := range keys {
+		t.key(key, shard.Items[key])
+	}
+	for _, key := range capacities {
+		t.capacity(key, int64(shard.Capacities[key]))
+	}
+	data, m, err := t.encode(flatHeaderSize)
+	if err != nil {
+		return nil, errors.New(err.Error() + " in shard " + strconv.Itoa(shard.Id))
+	}
+	le := binary.LittleEndian
+	copy(data, FLAT_META_MAGIC)
+	le.PutUint32(data[4:], FLAT_META_VERSION)
+	le.PutUint32(data[12:], uint32(shard.Id))
+	le.PutUint32(data[16:], uint32(m.segments))
+	le.PutUint32(data[20:], uint32(m.offsets))
+	le.PutUint32(data[24:], uint32(m.keys))
+	le.PutUint32(data[28:], uint32(m.capacities))
+	le.PutUint32(data[32:], uint32(m.blobSize))
+	le.PutUint32(data[8:], crc32.ChecksumIEEE(data[flatChecksumOffset:]))
+	return data, nil
+}
+
+// Encodes the entries changed since the meta was written as a delta to append to it, the lock must be held.
+// False when the meta has to be rewritten instead
+func (shard *ConcurrentMapShared) encodeMetaDelta() ([]byte, bool, error) {
+	if shard.metaSize == 0 || shard.rewriteMeta || shard.legacy {
+		return nil, false, nil
+	}
+	t := newFlatTables(shard.Segments)
+	for item := range shard.changedOffsets {
+		t.offset(item)
+	}
+	keys := make([]string, 0, len(shard.changedKeys))
+	for key := range shard.changedKeys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		t.key(key, shard.Items[key])
+	}
+	capacities := make([]string, 0, len(shard.changedCapacities))
+	for key := range shard.changedCapacities {
+		capacities = append(capacities, key)
+	}
+	sort.Strings(capacities)
+	for _, key := range capacities {
+		value, ok := shard.Capacities[key]
+		if !ok {
+			value = -1
+		}
+		t.capacity(key, int64(value))
+	}
+	data, m, err := t.encode(flatDeltaHeaderSize)
+	if err != nil {
+		return nil, false, errors.New(err.Error() + " in shard " + strconv.Itoa(shard.Id))
+	}
+	// the deltas are replayed by every load, past the size of the base a rewrite is cheaper
+	if shard.metaSize-shard.metaBase+int64(len(data)) > shard.metaBase {
+		return nil, false, nil
+	}
+	le := binary.LittleEndian
+	copy(data, FLAT_META_DELTA_MAGIC)
+	le.PutUint32(data[8:], uint32(shard.Id))
+	le.PutUint32(data[12:], uint32(m.segments))
+	le.PutUint32(data[16:], uint32(m.offsets))
+	le.PutUint32(data[20:], uint32(m.keys))
+	le.PutUint32(data[24:], uint32(m.capacities))
+	le.PutUint32(data[28:], uint32(m.blobSize))
+	le.PutUint32(data[4:], crc32.ChecksumIEEE(data[flatDeltaChecksumOffset:]))
+	return data, true, nil
+}
+
+// the entries changed since the meta was written, the lock must be held
+func (shard *ConcurrentMapShared) keyChanged(key string) {
+	if shard.changedKeys == nil {
+		shard.changedKeys = make(map[string]bool)
+	}
+	shard.changedKeys[key] = true
+}
+
+func (shard *ConcurrentMapShared) offsetChanged(item *ShardOffset) {
+	if shard.changedOffsets == nil {
+		shard.changedOffsets = make(map[*ShardOffset]bool)
+	}
+	shard.changedOffsets[item] = true
+}
+
+func (shard *ConcurrentMapShared) capacityChanged(key string) {
+	if shard.changedCapacities == nil {
+		shard.changedCapacities = make(map[string]bool)
+	}
+	shard.changedCapacities[key] = true
+}
+
+// the meta on the drive is up to date and has the given size, base is the size of its base tables
+func (shard *ConcurrentMapShared) metaWritten(size, base int64) {
+	shard.metaSize, shard.metaBase = size, base
+	shard.changedKeys, shard.changedOffsets, shard.changedCapacities = nil, nil, nil
+	shard.rewriteMeta = false
+	// the meta no longer lists the merged segments
+	shard.obsolete, shard.retired = append(shard.obsolete, shard.retired...), nil
+}
+
+// checks the tables of the meta against its size
+func (m *flatMeta) check(removed bool) error {
+	le := binary.LittleEndian
+	if m.end() > len(m.data) {
+		return errors.New("shard meta is truncated")
+	}
+	pos := m.keysStart()
+	for i := 0; i < m.keys+m.capacities; i++ {
+		at, n := int(le.Uint32(m.data[pos:])), int(le.Uint32(m.data[pos+4:]))
+		if at+n > m.blobSize {
+			return errors.New("shard meta key is out of bounds")
+		}
+		if i < m.keys {
+			target := le.Uint32(m.data[pos+8:])
+			if int(target) >= m.offsets && !(removed && target == FLAT_META_REMOVED) {
+				return errors.New("shard meta offset is out of bounds")
+			}
+			pos += flatKeySize
+		} else {
+			pos += flatCapacitySize
+		}
+	}
+	return nil
+}
+
+// Checks the mapped meta completely, so the deferred decoding can't fail.
+// A delta cut short by a crash is left out, the sync that appended it had failed
+func parseFlatMeta(data []byte) (*flatMeta, int, error) {
+	le := binary.LittleEndian
+	if len(data) < flatHeaderSize || string(data[:4]) != FLAT_META_MAGIC {
+		return nil, 0, errors.New("not a shard meta")
+	}
+	version := le.Uint32(data[4:])
+	if version != 1 && version != FLAT_META_VERSION {
+		return nil, 0, errors.New("unknown shard meta version " + strconv.Itoa(int(version)))
+	}
+	m := &flatMeta{data: data, header: flatHeaderSize, segments: int(le.Uint32(data[16:])), offsets: int(le.Uint32(data[20:])),
+		keys: int(le.Uint32(data[24:])), capacities: int(le.Uint32(data[28:])), blobSize: int(le.Uint32(data[32:]))}
+	if m.end() > len(data) || (version == 1 && m.end() != len(data)) {
+		return nil, 0, errors.New("shard meta is truncated")
+	}
+	if le.Uint32(data[8:]) != crc32.ChecksumIEEE(data[flatChecksumOffset:m.end()]) {
+		return nil, 0, errors.New("shard meta checksum mismatch")
+	}
+	if err := m.check(false); err != nil {
+		return nil, 0, err
+	}
+	id := int(le.Uint32(data[12:]))
+	m.base = m.end()
+	m.size = m.base
+	for m.size < len(data) {
+		delta, err := parseFlatDelta(data[m.size:], id)
+		if err != nil {
+			return nil, 0, err
+		}
+		if delta == nil {
+			break
+		}
+		m.deltas = append(m.deltas, delta)
+		m.size += delta.end()
+	}
+	return m, id, nil
+}
+
+// Nil when the delta is the last one and was cut short, a delta is appended in one go and synced,
+// so only the last one can be incomplete
+func parseFlatDelta(data []byte, id int) (*flatMeta, error) {
+	le := binary.LittleEndian
+	if len(data) < flatDeltaHeaderSize || allZero(data) {
+		return nil, nil
+	}
+	if string(data[:4]) != FLAT_META_DELTA_MAGIC {
+		return nil, errors.New("shard meta delta is invalid")
+	}
+	m := &flatMeta{data: data, header: flatDeltaHeaderSize, segments: int(le.Uint32(data[12:])), offsets: int(le.Uint32(data[16:])),
+		keys: int(le.Uint32(data[20:])), capacities: int(le.Uint32(data[24:])), blobSize: int(le.Uint32(data[28:]))}
+	end := m.end()
+	if end > len(data) || end < flatDeltaHeaderSize {
+		return nil, nil
+	}
+	if le.Uint32(data[4:]) != crc32.ChecksumIEEE(data[flatDeltaChecksumOffset:end]) {
+		if end == len(data) {
+			return nil, nil
+		}
+		return nil, errors.New("shard meta delta checksum mismatch")
+	}
+	if int(le.Uint32(data[8:])) != id {
+		return nil, errors.New("shard meta delta belongs to another shard")
+	}
+	m.data = data[:end]
+	return m, m.check(true)
+}
+
+// a crash may extend a file with zeros instead of the appended data
+func allZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Maps the meta file of a shard up to the given size, -1 maps all of it. Deltas appended after the sync
+// of the manifest are left out that way. Only the id and the segments are read, the rest waits for the first access
+func mapShard(path string, size int64) (*ConcurrentMapShared, error) {
+	data, release, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	whole := len(data)
+	if size >= 0 && size < int64(whole) {
+		data = data[:size]
+	}
+	shard, err := flatMetaShard(data, release)
+	if err != nil {
+		release()
+		return nil, errors.New("failed to load " + path + " due " + err.Error())
+	}
+	if len(data) != whole {
+		// the left out deltas are still in the file, the next sync rewrites it
+		shard.metaSize, shard.metaBase = 0, 0
+	}
+	return shard, nil
+}
+
+// the shard of the meta, decoded by the first lock. Release is called once the meta is decoded
+func flatMetaShard(data []byte, release func() error) (*ConcurrentMapShared, error) {
+	m, id, err := parseFlatMeta(data)
+	if err != nil {
+		return nil, err
+	}
+	m.release = release
+	shard := &ConcurrentMapShared{Id: id, Items: make(map[string]*ShardOffset), Capacities: make(map[string]int),
+		meta: m, mapped: 1}
+	// the segments of the last delta are the current ones
+	last := m
+	if len(m.deltas) > 0 {
+		last = m.deltas[len(m.deltas)-1]
+	}
+	shard.Segments = make([]int, last.segments)
+	for i := range shard.Segments {
+		shard.Segments[i] = int(binary.LittleEndian.Uint32(last.data[last.header+4*i:]))
+	}
+	// a torn delta at the end has to be overwritten, so the next sync rewrites the file
+	if m.size == len(data) {
+		shard.metaSize, shard.metaBase = int64(m.size), int64(m.base)
+	}
+	return shard, nil
+}
+
+func (m *flatMeta) decodeOffsets() []*ShardOffset {
+	le := binary.LittleEndian
+	offsets := make([]*ShardOffset, m.offsets)
+	pos := m.offsetsStart()
+	for i := range offsets {
+		offsets[i] = &ShardOffset{Start: int64(le.Uint64(m.data[pos:])), Length: int(le.Uint64(m.data[pos+8:])),
+			Segment: int(le.Uint32(m.data[pos+16:])), Deleted: le.Uint32(m.data[pos+20:])&flatOffsetDeleted != 0,
+			Tombstone: le.Uint32(m.data[pos+20:])&flatOffsetTombstone != 0}
+		pos += flatOffsetSize
+	}
+	return offsets
+}
+
+func (m *flatMeta) eachKey(fn func(key string, offset uint32)) {
+	le := binary.LittleEndian
+	blob, pos := m.blobStart(), m.keysStart()
+	for i := 0; i < m.keys; i++ {
+		at, n := blob+int(le.Uint32(m.data[pos:])), int(le.Uint32(m.data[pos+4:]))
+		fn(string(m.data[at:at+n]), le.Uint32(m.data[pos+8:]))
+		pos += flatKeySize
+	}
+}
+
+func (m *flatMeta) eachCapacity(fn func(key string, value int64)) {
+	le := binary.LittleEndian
+	blob, pos := m.blobStart(), m.capacitiesStart()
+	for i := 0; i < m.capacities; i++ {
+		at, n := blob+int(le.Uint32(m.data[pos:])), int(le.Uint32(m.data[pos+4:]))
+		fn(string(m.data[at:at+n]), int64(le.Uint64(m.data[pos+8:])))
+		pos += flatCapacitySize
+	}
+}
+
+func (m *flatMeta) offsetAt(i uint32) (pos segmentPosition, length int, flags uint32) {
+	le := binary.LittleEndian
+	at := m.offsetsStart() + flatOffsetSize*int(i)
+	pos = segmentPosition{int(le.Uint32(m.data[at+16:])), int64(le.Uint64(m.data[at:]))}
+	return pos, int(le.Uint64(m.data[at+8:])), le.Uint32(m.data[at+20:])
+}
+
+// Lengths of the live elements the decoded meta would have, read from the tables and the deltas
+// without building the maps. Only the id keys and the offsets changed by the deltas are kept
+func (m *flatMeta) eachLive(fn func(length int)) {
+	type state struct {
+		length int
+		flags  uint32
+	}
+	// the last offsets of the deltas by position, and the id keys they changed, nil when removed
+	changed := make(map[segmentPosition]state)
+	ids := make(map[string]*segmentPosition)
+	for _, delta := range m.deltas {
+		for i := 0; i < delta.offsets; i++ {
+			pos, length, flags := delta.offsetAt(uint32(i))
+			changed[pos] = state{length, flags}
+		}
+		delta.eachKey(func(key string, offset uint32) {
+			if !strings.HasPrefix(key, "id:") {
+				return
+			}
+			if offset == FLAT_META_REMOVED {
+				ids[key] = nil
+				return
+			}
+			pos, _, _ := delta.offsetAt(offset)
+			ids[key] = &pos
+		})
+	}
+	live := func(s state) {
+		if s.flags&flatOffsetDeleted == 0 {
+			fn(s.length)
+		}
+	}
+	m.eachKey(func(key string, offset uint32) {
+		if !strings.HasPrefix(key, "id:") {
+			return
+		}
+		if _, ok := ids[key]; ok {
+			return
+		}
+		pos, length, flags := m.offsetAt(offset)
+		if s, ok := changed[pos]; ok {
+			live(s)
+		} else {
+			live(state{length, flags})
+		}
+	})
+	for _, pos := range ids {
+		if pos != nil {
+			live(changed[*pos])
+		}
+	}
+}
+
+// fills the maps from the mapped meta and releases the mapping, the lock must not be held
+func (shard *ConcurrentMapShared) loadMeta() {
+	shard.metaOnce.Do(func() {
+		m := shard.meta
+		if m == nil {
+			return
+		}
+		offsets := m.decodeOffsets()
+		items := make(map[string]*ShardOffset, m.keys)
+		m.eachKey(func(key string, offset uint32) {
+			items[key] = offsets[offset]
+		})
+		capacities := make(map[string]int, m.capacities)
+		m.eachCapacity(func(key string, value int64) {
+			capacities[key] = int(value)
+		})
+		if len(m.deltas) > 0 {
+			// keys of an element share its offset, the offsets of a delta update the ones at their position
+			positions := make(map[segmentPosition]*ShardOffset, len(offsets))
+			for _, item := range offsets {
+				positions[segmentPosition{item.Segment, item.Start}] = item
+			}
+			for _, delta := range m.deltas {
+				changed := delta.decodeOffsets()
+				for i, item := range changed {
+					pos := segmentPosition{item.Segment, item.Start}
+					if current, ok := positions[pos]; ok {
+						current.Length, current.Deleted, current.Tombstone = item.Length, item.Deleted, item.Tombstone
+						changed[i] = current
+					} else {
+						positions[pos] = item
+					}
+				}
+				delta.eachKey(func(key string, offset uint32) {
+					if offset == FLAT_META_REMOVED {
+						delete(items, key)
+					} else {
+						items[key] = changed[offset]
+					}
+				})
+				delta.eachCapacity(func(key string, value int64) {
+					if value < 0 {
+						delete(capacities, key)
+					} else {
+						capacities[key] = int(value)
+					}
+				})
+			}
+		}
+		shard.mx.Lock()
+		shard.Items, shard.Capacities = items, capacities
+		shard.mx.Unlock()
+		shard.releaseMeta()
+	})
+}
+
+// drops the mapping without decoding it, used when the shard is closed
+func (shard *ConcurrentMapShared) closeMeta() {
+	shard.metaOnce.Do(shard.releaseMeta)
+}
+
+// readers of the mapped tables hold the lock, see Collection.shardSizes
+func (shard *ConcurrentMapShared) releaseMeta() {
+	shard.mx.Lock()
+	defer shard.mx.Unlock()
+	if shard.meta != nil {
+		shard.meta.release()
+		shard.meta = nil
+	}
+	atomic.StoreInt32(&shard.mapped, 0)
+}
+
+// reports whether the meta of the shard was loaded but not decoded yet
+func (shard *ConcurrentMapShared) IsMapped() bool {
+	return atomic.LoadInt32(&shard.mapped) == 1
+}
@@ -0,0 +1,117 @@
+package db
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Space the operations of the database need on the drive, in bytes. Optimize copies the live data of a shard
+// into a new segment before the old ones are removed, so for a while the shard takes up to twice its size.
+// The figures are estimates made from the index, nothing is read from the drive
+type DiskForecast struct {
+	Used    int64 `json:"used"`    // files of the database
+	Pending int64 `json:"pending"` // buffered writes that are not on the drive yet
+	Free    int64 `json:"free"`    // available on the filesystem of the database
+	// needed on top of Used by the next Sync (buffered data and the temporary copies of the rewritten meta files)
+	Sync int64 `json:"sync"`
+	// peak needed on top of Used by Optimize, the shards are compacted one by one
+	Optimize int64 `json:"optimize"`
+	// a full copy of the database on the same filesystem
+	Backup int64 `json:"backup"`
+}
+
+// Returned by DiskForecast.Check when the operation would run out of space halfway through
+type InsufficientSpaceError struct {
+	Needed int64
+	Free   int64
+}
+
+func (e *InsufficientSpaceError) Error() string {
+	return "insufficient disk space: " + strconv.FormatInt(e.Needed, 10) + " bytes needed, " +
+		strconv.FormatInt(e.Free, 10) + " available"
+}
+
+// fails with InsufficientSpaceError when the needed bytes (e.g. f.Optimize) don't fit into the free space
+func (f *DiskForecast) Check(needed int64) error {
+	if needed > f.Free {
+		return &InsufficientSpaceError{needed, f.Free}
+	}
+	return nil
+}
+
+// files rewritten by every Sync, they exist twice until the temporary copy replaces the old one
+func isRewrittenOnSync(name string) bool {
+	return strings.HasSuffix(name, "_meta.flat") || strings.HasSuffix(name, ".json.gzip") || name == "map.index"
+}
+
+func (c *Collection) forecastDiskUsage(f *DiskForecast) error {
+	files, err := ioutil.ReadDir(c.SyncDestination)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, fi := range files {
+		// links of the files the syncs write to
+		if _, ok := snapshotOf(fi.Name()); fi.IsDir() || ok {
+			continue
+		}
+		f.Used += fi.Size()
+		if isRewrittenOnSync(fi.Name()) {
+			f.Sync += fi.Size()
+		}
+	}
+	largest := int64(0)
+	for _, shard := range c.Map.Shared {
+		g := shard.garbage()
+		shard.RLock()
+		pending := int64(len(shard.pending))
+		shard.RUnlock()
+		f.Pending += pending
+		if g.LiveBytes > largest {
+			largest = g.LiveBytes
+		}
+	}
+	if largest > f.Optimize {
+		f.Optimize = largest
+	}
+	return nil
+}
+
+// Estimates the space needed by the next Sync, Optimize or a backup, so operators can refuse to start
+// an operation that would fail with ENOSPC halfway through
+func (db *Database) ForecastDiskUsage() (*DiskForecast, error) {
+	f := &DiskForecast{}
+	dir := db.dir
+	if dir == "" {
+		dir = "."
+	}
+	for _, name := range []string{db.Name + ".shardb", MANIFEST_NAME} {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err == nil {
+			f.Used += fi.Size()
+			f.Sync += fi.Size()
+		}
+	}
+	db.collectionMutex.RLock()
+	for _, c := range db.collections {
+		if err := c.forecastDiskUsage(f); err != nil {
+			db.collectionMutex.RUnlock()
+			return nil, err
+		}
+	}
+	db.collectionMutex.RUnlock()
+	// buffered data is written by every operation first
+	f.Sync += f.Pending
+	f.Optimize += f.Pending
+	f.Backup = f.Used + f.Pending
+
+	free, err := db.options.diskFree(dir)
+	if err != nil {
+		return nil, errors.New("failed to read the free space of " + dir + " due " + err.Error())
+	}
+	f.Free = free
+	return f, nil
+}
@@ -0,0 +1,183 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"reflect"
+	"sync/atomic"
+)
+
+// Elements of collections with field fragments are followed by every exported field encoded on its own
+// and a directory of the fragments, so a single field can be decoded without the rest of the element:
+// [element][fragment]...[directory][directory length uint32][FRAGMENTS_MAGIC]
+// The element itself is unchanged, readers that do not know the fragments ignore them.
+const FRAGMENTS_MAGIC = "SFR1"
+
+type fragment struct {
+	start  int
+	length int
+}
+
+// Elements written from now on carry field fragments, the elements written before are decoded as a whole by GetField
+func (c *Collection) SetFieldFragments(enabled bool) {
+	c.sharedDestMx.Lock()
+	c.FieldFragments = enabled
+	c.sharedDestMx.Unlock()
+	atomic.StoreInt32(&c.dirty, 1)
+}
+
+func (c *Collection) encodeElement(id string, payload CustomStructure, computed map[string]interface{}, version *ElementVersion) ([]byte, error) {
+	stored, marshaled, err := c.marshalPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+	data, err := EncodeGob(Element{Id: id, Payload: stored, Computed: computed, Version: version})
+	// the fields of a marshaled payload are left to its codec
+	if err != nil || !c.FieldFragments || marshaled {
+		return data, err
+	}
+	return appendFragments(data, payload), nil
+}
+
+func appendFragments(data []byte, payload interface{}) []byte {
+	v := reflect.ValueOf(payload)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return data
+	}
+	buf := bytes.NewBuffer(data)
+	var directory []byte
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath != "" {
+			// unexported
+			continue
+		}
+		start := buf.Len()
+		// fields gob can not encode on their own (e.g. nil pointers) are left to the full decode
+		err := gob.NewEncoder(buf).EncodeValue(v.Field(i))
+		if err != nil {
+			buf.Truncate(start)
+			continue
+		}
+		name := t.Field(i).Name
+		directory = appendUvarint(directory, uint64(len(name)))
+		directory = append(directory, name...)
+		directory = appendUvarint(directory, uint64(start))
+		directory = appendUvarint(directory, uint64(buf.Len()-start))
+	}
+	buf.Write(directory)
+	binary.Write(buf, binary.LittleEndian, uint32(len(directory)))
+	buf.WriteString(FRAGMENTS_MAGIC)
+	return buf.Bytes()
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// the directory of the fragments, false for elements without a valid one
+func parseFragments(data []byte) (map[string]fragment, bool) {
+	n := len(data)
+	if n < 8 || string(data[n-4:]) != FRAGMENTS_MAGIC {
+		return nil, false
+	}
+	size := int(binary.LittleEndian.Uint32(data[n-8 : n-4]))
+	if size > n-8 {
+		return nil, false
+	}
+	directory := data[n-8-size : n-8]
+	end := n - 8 - size
+	fragments := make(map[string]fragment)
+	for len(directory) > 0 {
+		var values [3]uint64
+		var name string
+		for i := range values {
+			v, read := binary.Uvarint(directory)
+			if read <= 0 {
+				return nil, false
+			}
+			directory = directory[read:]
+			values[i] = v
+			if i == 0 {
+				if v > uint64(len(directory)) {
+					return nil, false
+				}
+				name = string(directory[:v])
+				directory = directory[v:]
+			}
+		}
+		if values[1]+values[2] > uint64(end) {
+			return nil, false
+		}
+		fragments[name] = fragment{int(values[1]), int(values[2])}
+	}
+	return fragments, true
+}
+
+// raw data of the live element
+func (c *Collection) readElement(id string) ([]byte, error) {
+	idKey := "id:" + id
+	shard, err := c.getShardByKeySafe(idKey)
+	if err != nil {
+		return nil, errors.New("element " + id + " not found")
+	}
+	shard.RLock()
+	defer shard.RUnlock()
+	item, ok := shard.Items[idKey]
+	if !ok || item.Deleted {
+		return nil, errors.New("element " + id + " not found")
+	}
+	return shard.readAt(item)
+}
+
+// Decodes a single top-level field of the element into dst, a pointer to a value of the field's type.
+// Elements with field fragments decode only the requested field, others are decoded as a whole
+func (c *Collection) GetField(id, field string, dst interface{}) error {
+	dv := reflect.ValueOf(dst)
+	if dv.Kind() != reflect.Ptr || dv.IsNil() {
+		return errors.New("destination must be a non-nil pointer")
+	}
+	data, err := c.readElement(id)
+	if err != nil {
+		return err
+	}
+	if fragments, ok := parseFragments(data); ok {
+		if f, ok := fragments[field]; ok {
+			err = gob.NewDecoder(bytes.NewReader(data[f.start : f.start+f.length])).Decode(dst)
+			if err != nil {
+				return errors.New("failed to decode field " + field + " due " + err.Error())
+			}
+			if fc := c.getFields(); fc != nil && fc.fields[field] {
+				return fc.openValue(field, dv.Elem())
+			}
+			return nil
+		}
+	}
+
+	e, err := c.DecodeElement(data)
+	if err != nil {
+		return err
+	}
+	v := reflect.ValueOf(e.Payload)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return errors.New("element " + id + " is not a structure")
+	}
+	fv := v.FieldByName(field)
+	if !fv.IsValid() {
+		return errors.New("element " + id + " has no field " + field)
+	}
+	if !fv.Type().AssignableTo(dv.Elem().Type()) {
+		return errors.New("field " + field + " of type " + fv.Type().String() + " can not be stored in " + dv.Elem().Type().String())
+	}
+	dv.Elem().Set(fv)
+	return nil
+}
@@ -0,0 +1,148 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// segments read through a reader instead of the files of the shard: a bundle holds all of them at their offset,
+// a file system (DatabaseOptions.FS) opens each of them on its own
+type externalSegments struct {
+	segments map[int]externalSegment
+	closers  []io.Closer
+}
+
+type externalSegment struct {
+	r    io.ReaderAt
+	base int64
+}
+
+// Files that can be read at an offset are kept open, the others are read into memory.
+// Returns the size of the segment
+func (e *externalSegments) open(fsys fs.FS, name string) (io.ReaderAt, int64, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	if r, ok := f.(io.ReaderAt); ok {
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		e.closers = append(e.closers, f)
+		return r, fi.Size(), nil
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewReader(data), int64(len(data)), nil
+}
+
+func (e *externalSegments) close() {
+	for _, c := range e.closers {
+		c.Close()
+	}
+	e.closers = nil
+}
+
+// The directory of the database as a file system: the one of DatabaseOptions.FS, the drive otherwise
+func (db *Database) fileSystem(dir string) (fs.FS, error) {
+	if db.options.FS == nil {
+		if dir == "" {
+			dir = "."
+		}
+		return os.DirFS(dir), nil
+	}
+	dir = filepath.ToSlash(filepath.Clean(dir))
+	if dir == "." {
+		return db.options.FS, nil
+	}
+	return fs.Sub(db.options.FS, strings.TrimPrefix(dir, "/"))
+}
+
+// bundles and databases loaded from DatabaseOptions.FS are never written
+func (db *Database) isReadOnly() bool {
+	return db.bundle != nil || db.options.FS != nil
+}
+
+func (o *DatabaseOptions) readFile(fsys fs.FS, name string) ([]byte, error) {
+	var data []byte
+	err := o.retryIO(func() (err error) {
+		data, err = fs.ReadFile(fsys, name)
+		return err
+	})
+	return data, err
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// The shards of the drive are mapped and their segments opened as files,
+// the ones of DatabaseOptions.FS are read through the file system
+func (db *Database) openShard(fsys fs.FS, collectionPath, metaName string, size int64, readOnly bool) (*ConcurrentMapShared, error) {
+	if db.options.FS == nil {
+		return loadShard(collectionPath, metaName, size, &db.options, readOnly)
+	}
+	return loadShardFS(fsys, collectionPath, metaName, size, &db.options)
+}
+
+// Reads the meta of the shard into memory and opens its segments through the file system, the shard is read-only
+func loadShardFS(fsys fs.FS, collectionPath, metaName string, size int64, options *DatabaseOptions) (*ConcurrentMapShared, error) {
+	data, err := options.readFile(fsys, metaName)
+	if err != nil {
+		return nil, err
+	}
+	if size >= 0 && size < int64(len(data)) {
+		data = data[:size]
+	}
+	var shard *ConcurrentMapShared
+	if strings.HasSuffix(metaName, "_meta.gob.gzip") {
+		shard, err = decodeLegacyShard(data)
+	} else {
+		shard, err = flatMetaShard(data, func() error { return nil })
+	}
+	if err != nil {
+		return nil, errors.New("failed to load " + metaName + " due " + err.Error())
+	}
+	shard.SyncDestination = collectionPath
+	shard.readOnly = true
+	if len(shard.Segments) == 0 {
+		// shard was written before the segments existed
+		shard.Segments = []int{0}
+	}
+	shard.external = &externalSegments{segments: make(map[int]externalSegment, len(shard.Segments))}
+	for _, segment := range shard.Segments {
+		name := shardSegmentName(shard.Id, segment)
+		var r io.ReaderAt
+		var size int64
+		err = options.retryIO(func() (err error) {
+			r, size, err = shard.external.open(fsys, name)
+			return err
+		})
+		if err != nil {
+			shard.closeSegments()
+			return nil, errors.New("shard segment (" + name + ") is unavailable due " + err.Error())
+		}
+		shard.external.segments[segment] = externalSegment{r, 0}
+		if segment == shard.activeSegment() {
+			shard.flushed = size
+		}
+	}
+	return shard, nil
+}
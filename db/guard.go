@@ -0,0 +1,69 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Returned by a query that matched more elements than Config.MaxQueryRows, fn got the ones up to it
+var ErrQueryRowsExceeded = errors.New("query matched more elements than the configured maximum")
+
+// Returned by a query whose elements are larger than Config.MaxQueryBytes, fn got the ones up to it
+var ErrQueryBytesExceeded = errors.New("query matched more bytes than the configured maximum")
+
+// Returned by a query that ran longer than Config.QueryTimeout
+var ErrQueryTimeout = errors.New("query ran longer than the configured timeout")
+
+// The guards of the config, applied once to a query however many collections it reads,
+// see Query.Stream, UnionQuery.Stream and PartitionedQuery.Stream
+type queryGuard struct {
+	rows    int64
+	bytes   int64
+	timeout time.Duration
+}
+
+func (o *DatabaseOptions) queryGuard() queryGuard {
+	if o == nil {
+		return queryGuard{}
+	}
+	return queryGuard{atomic.LoadInt64(&o.Config.MaxQueryRows), atomic.LoadInt64(&o.Config.MaxQueryBytes),
+		time.Duration(atomic.LoadInt64((*int64)(&o.Config.QueryTimeout)))}
+}
+
+// Wraps fn, so it fails once the rows or the bytes are exceeded, and ends ctx with the timeout.
+// A limit of the query within the rows leaves them out. The returned done releases ctx
+// and turns its timeout into ErrQueryTimeout, it has to be called with the result of the query
+func (g queryGuard) apply(ctx context.Context, limit int, fn func(e *Element) error) (context.Context, func(e *Element) error, func(err error) error) {
+	rows := g.rows
+	if rows > 0 && limit > 0 && int64(limit) <= rows {
+		rows = 0
+	}
+	if rows > 0 || g.bytes > 0 {
+		returned, size, deliver := int64(0), int64(0), fn
+		fn = func(e *Element) error {
+			if rows > 0 && returned == rows {
+				return ErrQueryRowsExceeded
+			}
+			if g.bytes > 0 && size+int64(e.size) > g.bytes {
+				return ErrQueryBytesExceeded
+			}
+			returned++
+			size += int64(e.size)
+			return deliver(e)
+		}
+	}
+	if g.timeout <= 0 {
+		return ctx, fn, func(err error) error { return err }
+	}
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, g.timeout)
+	return ctx, fn, func(err error) error {
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) && parent.Err() == nil {
+			return ErrQueryTimeout
+		}
+		return err
+	}
+}
@@ -0,0 +1,219 @@
+package db
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"sort"
+	"time"
+)
+
+// versions of a collection keeping its history are elements of the collection named by it with this prefix
+const HISTORY_COLLECTION_PREFIX = "history_"
+
+// Bounds of the versions kept by SetHistory, enforced by Optimize. 0 does not bound
+type HistoryOptions struct {
+	// versions kept per element, the current one included
+	MaxVersions int
+	// replaced and deleted versions are dropped this long after they stopped being current
+	MaxAge time.Duration
+}
+
+// A version of an element, Element is nil for the deletion
+type Version struct {
+	Time    time.Time
+	Deleted bool
+	Element *Element
+}
+
+// an element of the history collection, Data is the element as it was stored
+type historyVersion struct {
+	Key     string
+	Time    int64
+	Deleted bool
+	Data    []byte
+}
+
+func (v *historyVersion) GetDataIndex() []*FullDataIndex {
+	return nil
+}
+
+func init() {
+	gob.Register(&historyVersion{})
+}
+
+type history struct {
+	c       *Collection
+	options HistoryOptions
+}
+
+// Keeps every version of the elements written from now on, History and GetAsOf read them.
+// The versions are stored in the collection HISTORY_COLLECTION_PREFIX+name, old ones are removed by Optimize
+// as the options say and their space is reclaimed by the next Optimize of the history collection.
+// The setting is not saved, call it again after every load. Nil options stop recording, the kept versions stay
+func (c *Collection) SetHistory(options *HistoryOptions) error {
+	if options == nil {
+		c.sharedDestMx.Lock()
+		c.history = nil
+		c.sharedDestMx.Unlock()
+		return nil
+	}
+	if options.MaxVersions < 0 || options.MaxAge < 0 {
+		return errors.New("history bounds can not be negative")
+	}
+	if c.database == nil {
+		return errors.New("collection " + c.Name + " does not belong to a database")
+	}
+	name := HISTORY_COLLECTION_PREFIX + c.Name
+	hc := c.database.GetCollection(name)
+	if hc == nil {
+		var err error
+		hc, err = c.database.AddCollection(name)
+		if err != nil {
+			return errors.New("failed to add history of " + c.Name + " due " + err.Error())
+		}
+	}
+	if _, ok := hc.declaredIndex("Key"); !ok {
+		if err := hc.AddIndex("Key", false); err != nil {
+			return err
+		}
+	}
+	c.sharedDestMx.Lock()
+	c.history = &history{hc, *options}
+	c.sharedDestMx.Unlock()
+	return nil
+}
+
+func (c *Collection) getHistory() *history {
+	c.sharedDestMx.RLock()
+	defer c.sharedDestMx.RUnlock()
+	return c.history
+}
+
+func (h *history) record(id string, data []byte, deleted bool) error {
+	if h == nil {
+		return nil
+	}
+	err := h.c.Write(&historyVersion{id, h.c.options.clock().Now().UnixNano(), deleted, data})
+	if err != nil {
+		return errors.New("failed to record the version of " + id + " due " + err.Error())
+	}
+	return nil
+}
+
+// a version with the id of its element in the history collection
+type storedVersion struct {
+	id string
+	*historyVersion
+}
+
+// versions of the key, or of every key for "", by key and sorted oldest first
+func readVersions(hc *Collection, key string) (map[string][]storedVersion, error) {
+	q := hc.Query()
+	q.unguarded = true
+	if key != "" {
+		q.Where("Key", Eq, key)
+	}
+	versions := make(map[string][]storedVersion)
+	err := q.Stream(context.Background(), func(e *Element) error {
+		if v, ok := e.Payload.(*historyVersion); ok {
+			versions[v.Key] = append(versions[v.Key], storedVersion{e.Id, v})
+		}
+		return nil
+	})
+	for _, kept := range versions {
+		sort.SliceStable(kept, func(i, j int) bool { return kept[i].Time < kept[j].Time })
+	}
+	return versions, err
+}
+
+func (c *Collection) historyCollection() (*Collection, error) {
+	if h := c.getHistory(); h != nil {
+		return h.c, nil
+	}
+	if c.database != nil {
+		if hc := c.database.GetCollection(HISTORY_COLLECTION_PREFIX + c.Name); hc != nil {
+			return hc, nil
+		}
+	}
+	return nil, errors.New("collection " + c.Name + " keeps no history")
+}
+
+// the recorded versions of the element, the oldest first. Versions written before SetHistory are not known
+func (c *Collection) History(key string) ([]Version, error) {
+	hc, err := c.historyCollection()
+	if err != nil {
+		return nil, err
+	}
+	all, err := readVersions(hc, key)
+	if err != nil {
+		return nil, err
+	}
+	versions := all[key]
+	result := make([]Version, len(versions))
+	for i, v := range versions {
+		result[i] = Version{Time: time.Unix(0, v.Time), Deleted: v.Deleted}
+		if v.Deleted {
+			continue
+		}
+		if result[i].Element, err = c.DecodeElement(v.Data); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// The element as it was at the time, ErrKeyNotFound if it did not exist then or its versions were removed
+func (c *Collection) GetAsOf(key string, t time.Time) (*Element, error) {
+	versions, err := c.History(key)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Time.After(t) {
+			continue
+		}
+		if versions[i].Deleted {
+			break
+		}
+		return versions[i].Element, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+// removes the versions past the bounds, the current version of an element is kept
+func (h *history) prune(now time.Time) error {
+	if h == nil || (h.options.MaxVersions == 0 && h.options.MaxAge == 0) {
+		return nil
+	}
+	versions, err := readVersions(h.c, "")
+	if err != nil {
+		return err
+	}
+	for _, kept := range versions {
+		for _, i := range h.expired(kept, now) {
+			if err = h.c.DeleteById(kept[i].id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// positions of the versions to remove, sorted oldest first
+func (h *history) expired(versions []storedVersion, now time.Time) []int {
+	expired := make([]int, 0)
+	last := len(versions) - 1
+	for i := range versions {
+		switch {
+		case h.options.MaxVersions > 0 && last-i >= h.options.MaxVersions:
+			expired = append(expired, i)
+		case h.options.MaxAge > 0 && i < last && now.Sub(time.Unix(0, versions[i+1].Time)) > h.options.MaxAge:
+			// replaced long ago
+			expired = append(expired, i)
+		case h.options.MaxAge > 0 && i == last && versions[i].Deleted && now.Sub(time.Unix(0, versions[i].Time)) > h.options.MaxAge:
+			expired = append(expired, i)
+		}
+	}
+	return expired
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+// Reads the records of an import one after another
+type Decoder interface {
+	// the next record of r, io.EOF once r ends
+	Decode(r *bufio.Reader) (interface{}, error)
+}
+
+// Decodes a JSON document per line, empty lines are skipped
+type JSONLDecoder struct {
+	// a new value to decode a line into, e.g. func() interface{} { return &Person{} }.
+	// Lines are decoded into a map[string]interface{} when it is nil
+	New func() interface{}
+}
+
+func (d JSONLDecoder) Decode(r *bufio.Reader) (interface{}, error) {
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return nil, err
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			continue
+		}
+		var v interface{}
+		if d.New != nil {
+			v = d.New()
+		} else {
+			v = &map[string]interface{}{}
+		}
+		if err = json.Unmarshal(line, v); err != nil {
+			return nil, err
+		}
+		if d.New == nil {
+			v = *v.(*map[string]interface{})
+		}
+		return v, nil
+	}
+}
+
+type ImportReport struct {
+	Read     int `json:"read"`
+	Imported int `json:"imported"`
+	// records the transformation left out
+	Dropped int `json:"dropped"`
+}
+
+// Writes the records decoded from r without staging them in a file. transform may change a record
+// or drop it by returning false, a nil transform imports every record as decoded. The records have to be
+// a CustomStructure once transformed. The import stops at the first record failing to decode or write,
+// the records imported before it are kept
+func (c *Collection) ImportStream(r io.Reader, decoder Decoder, transform func(interface{}) (interface{}, bool)) (*ImportReport, error) {
+	report := &ImportReport{}
+	if err := c.writable(); err != nil {
+		return report, err
+	}
+	br := bufio.NewReader(r)
+	for {
+		record, err := decoder.Decode(br)
+		if err == io.EOF {
+			return report, nil
+		}
+		n := strconv.Itoa(report.Read + 1)
+		if err != nil {
+			return report, errors.New("failed to decode record " + n + " due " + err.Error())
+		}
+		report.Read++
+		if transform != nil {
+			var keep bool
+			if record, keep = transform(record); !keep {
+				report.Dropped++
+				continue
+			}
+		}
+		payload, ok := record.(CustomStructure)
+		if !ok {
+			typ := "nil"
+			if record != nil {
+				typ = reflect.TypeOf(record).String()
+			}
+			return report, errors.New("record " + n + " of type " + typ + " is not a CustomStructure")
+		}
+		if err = c.Write(payload); err != nil {
+			return report, errors.New("failed to import record " + n + " due " + err.Error())
+		}
+		report.Imported++
+	}
+}
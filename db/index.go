@@ -0,0 +1,301 @@
+package db
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync/atomic"
+)
+
+// Declared indexes are built from the values under dotted paths of the elements, see path.go.
+// They are stored next to the keys of GetDataIndex and used by the planner of Query
+
+// Index value of the elements without a value under the path of a non-sparse index
+const NULL_INDEX_VALUE = "\x00null"
+
+func (c *Collection) declaredIndexes() []Index {
+	c.sharedDestMx.RLock()
+	defer c.sharedDestMx.RUnlock()
+	return c.Indexes
+}
+
+func (c *Collection) declaredIndex(path string) (Index, bool) {
+	for _, ix := range c.declaredIndexes() {
+		if ix.Field == path {
+			return ix, true
+		}
+	}
+	return Index{}, false
+}
+
+// the declared index of the path once every element is in it, see CreateIndex
+func (c *Collection) readyIndex(path string) (Index, bool) {
+	ix, ok := c.declaredIndex(path)
+	if !ok {
+		return ix, false
+	}
+	c.sharedDestMx.RLock()
+	defer c.sharedDestMx.RUnlock()
+	return ix, !c.building[path]
+}
+
+// Indexes the values under the dotted path of every element, existing elements are indexed right away.
+// A path fanning out over a slice ("tags[]") indexes every value of it. Elements without a value
+// are indexed as null, so a unique index admits only one of them. A unique index fails
+// if two elements share a value, the index is not added then
+func (c *Collection) AddIndex(path string, unique bool) error {
+	return c.CreateIndex(Index{Field: path, Unique: unique})
+}
+
+// same as AddIndex, but only the elements having a value under the path are indexed
+func (c *Collection) AddSparseIndex(path string, unique bool) error {
+	return c.CreateIndex(Index{Field: path, Unique: unique, Sparse: true})
+}
+
+// same as AddIndex with every option of the index, e.g. its collation
+func (c *Collection) CreateIndex(ix Index) error {
+	if err := c.writable(); err != nil {
+		return err
+	}
+	path := ix.Field
+	if _, err := parsePath(path); err != nil {
+		return err
+	}
+	if name, ok := computedName(path); ok && c.computedFunc(name) == nil {
+		return errors.New("computed field " + name + " is not registered")
+	}
+	if ix.Collation != nil {
+		if err := ix.Collation.validate(); err != nil {
+			return err
+		}
+	}
+	if _, ok := c.declaredIndex(path); ok {
+		return errors.New("index " + path + " already exists")
+	}
+	c.sharedDestMx.Lock()
+	// copied on write, writers hold on to the previous slice
+	c.Indexes = append(append(make([]Index, 0, len(c.Indexes)+1), c.Indexes...), ix)
+	if c.building == nil {
+		c.building = make(map[string]bool)
+	}
+	c.building[path] = true
+	atomic.AddUint64(&c.indexVersion, 1)
+	c.sharedDestMx.Unlock()
+	atomic.StoreInt32(&c.dirty, 1)
+
+	// elements written from now on are indexed by the writers, the rest is backfilled shard by shard
+	// under the write lock of the shard. Queries read the index once it is complete
+	err := c.buildIndex(ix)
+	c.sharedDestMx.Lock()
+	delete(c.building, path)
+	if err != nil {
+		indexes := make([]Index, 0, len(c.Indexes))
+		for _, declared := range c.Indexes {
+			if declared.Field != path {
+				indexes = append(indexes, declared)
+			}
+		}
+		c.Indexes = indexes
+	}
+	atomic.AddUint64(&c.indexVersion, 1)
+	c.sharedDestMx.Unlock()
+	if err != nil {
+		return err
+	}
+	c.getNegativeCache().clear()
+	return nil
+}
+
+type addedKey struct {
+	shard *ConcurrentMapShared
+	key   string
+}
+
+func (c *Collection) buildIndex(ix Index) error {
+	added := make([]addedKey, 0)
+	// unique values are checked across the shards
+	owners := make(map[string]*ShardOffset)
+	err := func() error {
+		for _, shard := range c.Map.Shared {
+			err := c.buildShardIndex(shard, ix, owners, &added)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		for _, a := range added {
+			a.shard.Lock()
+			delete(a.shard.Items, a.key)
+			a.shard.keyChanged(a.key)
+			a.shard.Unlock()
+		}
+		return err
+	}
+
+	c.sharedDestMx.Lock()
+	for _, a := range added {
+		id := a.shard.Id
+		c.ShardDestinations[a.key] = &id
+	}
+	c.sharedDestMx.Unlock()
+	return nil
+}
+
+func (c *Collection) buildShardIndex(shard *ConcurrentMapShared, ix Index, owners map[string]*ShardOffset, added *[]addedKey) error {
+	shard.Lock()
+	defer shard.Unlock()
+	for key, item := range shard.Items {
+		if item.Deleted || !strings.HasPrefix(key, "id:") {
+			continue
+		}
+		data, err := shard.readAt(item)
+		if err != nil {
+			return err
+		}
+		e, err := c.DecodeElement(data)
+		if err != nil {
+			return err
+		}
+		payload, ok := e.Payload.(CustomStructure)
+		if !ok {
+			return errors.New("element " + e.Id + " is not a registered custom structure")
+		}
+		entries, err := c.pathIndex(payload, []Index{ix})
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.Unique {
+				if owner, ok := owners[entry.Data]; ok && owner != item {
+					return errors.New("value " + entry.Data + " of unique index " + ix.Field + " is not unique")
+				}
+				owners[entry.Data] = item
+			}
+			// written after the index was declared
+			if shard.hasIndexKey(entry, item) {
+				continue
+			}
+			k, err := shard.addIndexKey(entry, item)
+			if err != nil {
+				return errors.New("value " + entry.Data + " of unique index " + ix.Field + " is not unique")
+			}
+			*added = append(*added, addedKey{shard, k})
+		}
+	}
+	if len(*added) > 0 {
+		shard.markDirty()
+	}
+	return nil
+}
+
+// index entries of the values under the declared paths of the payload
+func (c *Collection) pathIndex(payload CustomStructure, indexes []Index) ([]*FullDataIndex, error) {
+	entries := make([]*FullDataIndex, 0, len(indexes))
+	for _, ix := range indexes {
+		resolved, err := c.resolve(payload, nil, ix.Field)
+		if err != nil {
+			return nil, err
+		}
+		values := nonNil(resolved)
+		if len(values) == 0 {
+			if !ix.Sparse {
+				entries = append(entries, &FullDataIndex{ix.Field, NULL_INDEX_VALUE, ix.Unique})
+			}
+			continue
+		}
+		seen := make(map[string]bool, len(values))
+		for _, v := range values {
+			s, ok := ix.key(v)
+			if !ok || seen[s] {
+				continue
+			}
+			seen[s] = true
+			if c.isEncrypted(ix.Field) {
+				fc := c.getFields()
+				if fc == nil {
+					return nil, errors.New("keys of the encrypted fields of collection " + c.Name + " are not set")
+				}
+				s = fc.blindValue(s)
+			}
+			entries = append(entries, &FullDataIndex{ix.Field, s, ix.Unique})
+		}
+	}
+	return entries, nil
+}
+
+// the value of the index entry, strings are collated
+func (ix *Index) key(v reflect.Value) (string, bool) {
+	s, ok := indexString(v)
+	if ok && ix.Collation != nil && indirect(v).Kind() == reflect.String {
+		s = ix.Collation.Key(s)
+	}
+	return s, ok
+}
+
+func (c *Collection) isEncrypted(field string) bool {
+	for _, f := range c.EncryptedFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// the index the payload is written with, GetDataIndex followed by the declared indexes.
+// An element is stored once under every distinct value, a field may contribute several of them
+func (c *Collection) writeIndex(payload CustomStructure) ([]*FullDataIndex, error) {
+	indexes, err := c.dataIndex(payload)
+	if err != nil {
+		return nil, err
+	}
+	if declared := c.declaredIndexes(); len(declared) > 0 {
+		entries, err := c.pathIndex(payload, declared)
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, entries...)
+	}
+	// a path can name a field GetDataIndex already covers, unique and regular keys are stored apart
+	taken := make(map[FullDataIndex]bool, len(indexes))
+	distinct := make([]*FullDataIndex, 0, len(indexes))
+	for _, ix := range indexes {
+		if !taken[*ix] {
+			taken[*ix] = true
+			distinct = append(distinct, ix)
+		}
+	}
+	return distinct, nil
+}
+
+// offsets of the live elements of the shard with a value of the scanned index.
+// Copies, so they can be read one by one without holding the lock meanwhile
+func (c *Collection) scanOffsets(shard *ConcurrentMapShared, scan *indexScan) []ShardOffset {
+	shard.RLock()
+	defer shard.RUnlock()
+	offsets := make([]ShardOffset, 0)
+	if scan.from == scan.to {
+		value := *scan.from
+		if fc := c.getFields(); value != NULL_INDEX_VALUE && c.isEncrypted(scan.ix.Field) && fc != nil {
+			value = fc.blindValue(value)
+		}
+		for _, item := range shard.indexItems(&FullDataIndex{scan.ix.Field, value, scan.ix.Unique}) {
+			offsets = append(offsets, *item)
+		}
+		return offsets
+	}
+	seen := make(map[*ShardOffset]bool)
+	for key, item := range shard.Items {
+		if item.Deleted || seen[item] {
+			continue
+		}
+		value, ok := indexedValue(key, scan.ix.Field)
+		if !ok || (scan.from != nil && value < *scan.from) || (scan.to != nil && value > *scan.to) {
+			continue
+		}
+		seen[item] = true
+		offsets = append(offsets, *item)
+	}
+	return offsets
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math"
+	"time"
+)
+
+// Index values are strings compared byte by byte, so "10" < "9".
+// The encodings below keep the order of the encoded values, which makes range conditions
+// on numbers and times work on the index. Use them for the Data of FullDataIndex, e.g.
+// {"Age", EncodeInt(int64(p.Age)), false}. Declared indexes (AddIndex) encode numbers as floats
+// and times with EncodeTime on their own
+
+func EncodeUint(v uint64) string {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return hex.EncodeToString(b)
+}
+
+func DecodeUint(s string) (uint64, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 8 {
+		return 0, errors.New("invalid encoded index value " + s)
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// the sign bit is flipped, so negative numbers come first
+func EncodeInt(v int64) string {
+	return EncodeUint(uint64(v) ^ (1 << 63))
+}
+
+func DecodeInt(s string) (int64, error) {
+	v, err := DecodeUint(s)
+	if err != nil {
+		return 0, err
+	}
+	return int64(v ^ (1 << 63)), nil
+}
+
+// positive numbers get the sign bit set, the bits of negative ones are inverted
+func EncodeFloat(v float64) string {
+	if v == 0 {
+		// -0 and 0 share the entry
+		v = 0
+	}
+	bits := math.Float64bits(v)
+	if bits>>63 == 1 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	return EncodeUint(bits)
+}
+
+func DecodeFloat(s string) (float64, error) {
+	bits, err := DecodeUint(s)
+	if err != nil {
+		return 0, err
+	}
+	if bits>>63 == 1 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return math.Float64frombits(bits), nil
+}
+
+// nanoseconds since the epoch, the time zone is not kept
+func EncodeTime(t time.Time) string {
+	return EncodeInt(t.UnixNano())
+}
+
+func DecodeTime(s string) (time.Time, error) {
+	v, err := DecodeInt(s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, v), nil
+}
+
+func EncodeBool(v bool) string {
+	if v {
+		return "1"
+	}
+	return "0"
+}
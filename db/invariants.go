@@ -0,0 +1,248 @@
+package db
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A broken invariant of the data structures, see CheckInvariants
+type InvariantViolation struct {
+	Collection string `json:"collection"`
+	// -1 for the invariants of the whole collection
+	Shard   int    `json:"shard"`
+	Key     string `json:"key,omitempty"`
+	Message string `json:"message"`
+}
+
+func (v InvariantViolation) String() string {
+	s := v.Collection
+	if v.Shard >= 0 {
+		s += " shard " + strconv.Itoa(v.Shard)
+	}
+	if v.Key != "" {
+		s += " key " + v.Key
+	}
+	return s + ": " + v.Message
+}
+
+// Verifies the invariants every collection has to keep whatever was done to it:
+//   - every live index entry points to a live element of its shard
+//   - an id is live in one shard at most and its destination is that shard
+//   - the objects counter equals the number of live elements
+//   - the capacity of a set of regular index entries covers its highest slot
+//   - offsets are within the bounds of their segments
+//   - cached elements equal their data on the drive
+//
+// Meant for tests and for the background audit (Config.AuditInterval). The shards are checked one after
+// another under their read lock, the invariants spanning the collection are skipped while writes change it
+func (db *Database) CheckInvariants() []InvariantViolation {
+	db.collectionMutex.RLock()
+	collections := make([]*Collection, 0, len(db.collections)+len(db.attached))
+	for _, c := range db.collections {
+		collections = append(collections, c)
+	}
+	for _, c := range db.attached {
+		collections = append(collections, c)
+	}
+	db.collectionMutex.RUnlock()
+	violations := make([]InvariantViolation, 0)
+	for _, c := range collections {
+		violations = append(violations, c.CheckInvariants()...)
+	}
+	return violations
+}
+
+// same as Database.CheckInvariants for a single collection
+func (c *Collection) CheckInvariants() []InvariantViolation {
+	violations := make([]InvariantViolation, 0)
+	report := func(shard int, key, message string) {
+		violations = append(violations, InvariantViolation{c.Name, shard, key, message})
+	}
+	generation := c.Map.generation()
+	// shard of every live id
+	live := make(map[string]int)
+	for _, shard := range c.Map.Shared {
+		shard.RLock()
+		c.checkShard(shard, live, report)
+		shard.RUnlock()
+	}
+	if c.Map.generation() != generation {
+		return violations
+	}
+	if size := c.Size(); size != int64(len(live)) {
+		report(-1, "", "objects counter is "+strconv.FormatInt(size, 10)+", "+strconv.Itoa(len(live))+" element(s) are live")
+	}
+	c.sharedDestMx.RLock()
+	for id, shard := range live {
+		dest, ok := c.ShardDestinations["id:"+id]
+		if !ok || dest == nil {
+			report(shard, "id:"+id, "live element has no destination")
+		} else if *dest != shard {
+			report(shard, "id:"+id, "live element is routed to shard "+strconv.Itoa(*dest))
+		}
+	}
+	c.sharedDestMx.RUnlock()
+	return violations
+}
+
+// the read lock of the shard must be held
+func (c *Collection) checkShard(shard *ConcurrentMapShared, live map[string]int, report func(shard int, key, message string)) {
+	sizes := make(map[int]int64, len(shard.Segments))
+	for _, segment := range shard.Segments {
+		if size, ok := shard.segmentSize(segment); ok {
+			sizes[segment] = size
+		}
+	}
+	segments := make(map[int]bool, len(shard.Segments))
+	for _, segment := range shard.Segments {
+		segments[segment] = true
+	}
+	positions := make(map[segmentPosition]bool)
+	for key, item := range shard.Items {
+		if !segments[item.Segment] {
+			report(shard.Id, key, "segment "+strconv.Itoa(item.Segment)+" does not exist")
+		} else if size, ok := sizes[item.Segment]; ok && (item.Start < 0 || item.Length < 0 || item.Start+int64(item.Length) > size) {
+			report(shard.Id, key, "offset "+strconv.FormatInt(item.Start, 10)+"+"+strconv.Itoa(item.Length)+
+				" is out of the "+strconv.FormatInt(size, 10)+" bytes of segment "+strconv.Itoa(item.Segment))
+		}
+		if !strings.HasPrefix(key, "id:") || item.Deleted {
+			continue
+		}
+		id := key[len("id:"):]
+		if other, ok := live[id]; ok {
+			report(shard.Id, key, "element is live in shard "+strconv.Itoa(other)+" as well")
+		}
+		live[id] = shard.Id
+		positions[segmentPosition{item.Segment, item.Start}] = true
+	}
+
+	// highest slot of every set of regular index entries
+	slots := make(map[string]int)
+	for key, item := range shard.Items {
+		if strings.HasPrefix(key, "id:") {
+			continue
+		}
+		if slot, set, ok := slotKey(key); ok {
+			if max, seen := slots[set]; !seen || slot > max {
+				slots[set] = slot
+			}
+		}
+		if !item.Deleted && !positions[segmentPosition{item.Segment, item.Start}] {
+			report(shard.Id, key, "index entry points to no live element")
+		}
+	}
+	for set, max := range slots {
+		capacity := shard.GetCapacityKey(set)
+		// older versions stored the last slot as the capacity
+		if capacity <= max && !(shard.legacy && capacity == max) {
+			report(shard.Id, "n:"+set, "capacity "+strconv.Itoa(capacity)+" does not cover slot "+strconv.Itoa(max))
+		}
+	}
+
+	c.cacheMx.RLock()
+	cached := c.Cache != nil
+	c.cacheMx.RUnlock()
+	if !cached {
+		return
+	}
+	generation := atomic.LoadUint64(&shard.generation)
+	for key, item := range shard.Items {
+		if !strings.HasPrefix(key, "id:") || item.Deleted {
+			continue
+		}
+		var cached []byte
+		if c.loadCache(key, generation, &cached) != nil {
+			continue
+		}
+		data, err := shard.readAt(item)
+		if err != nil {
+			report(shard.Id, key, "cached element can not be read from the drive due "+err.Error())
+		} else if !bytes.Equal(cached, data) {
+			report(shard.Id, key, "cached element differs from the drive")
+		}
+	}
+}
+
+// bytes of the segment including the write buffer, false when the size is unknown
+func (shard *ConcurrentMapShared) segmentSize(segment int) (int64, bool) {
+	if shard.external != nil {
+		return 0, false
+	}
+	if segment == shard.activeSegment() {
+		return shard.flushed + int64(len(shard.pending)), true
+	}
+	f, err := shard.segmentFile(segment)
+	if err != nil {
+		return 0, false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, false
+	}
+	return fi.Size(), true
+}
+
+func (db *Database) startBackgroundAudit(interval time.Duration) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	db.auditStop, db.auditDone = stop, done
+	ticker := db.Clock().NewTicker(interval)
+	go func() {
+		defer close(done)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.Chan():
+				var violations []InvariantViolation
+				result := db.scheduler.Submit("audit", PRIORITY_LOW, func() error {
+					violations = db.CheckInvariants()
+					return nil
+				})
+				var err error
+				select {
+				case err = <-result:
+				case <-stop:
+					// held back until a maintenance window opens
+					return
+				}
+				if p, ok := err.(*PanicError); ok {
+					db.emit(Event{Type: EVENT_PANIC, Message: p.Error(), Data: p})
+				}
+				db.emitViolations(violations)
+			}
+		}
+	}()
+}
+
+// one event per collection with a violation
+func (db *Database) emitViolations(violations []InvariantViolation) {
+	byCollection := make(map[string][]InvariantViolation)
+	names := make([]string, 0)
+	for _, v := range violations {
+		if _, ok := byCollection[v.Collection]; !ok {
+			names = append(names, v.Collection)
+		}
+		byCollection[v.Collection] = append(byCollection[v.Collection], v)
+	}
+	for _, name := range names {
+		found := byCollection[name]
+		db.logf(LOG_ERROR, "invariant violated:", found[0].String())
+		db.emit(Event{Type: EVENT_INVARIANT_VIOLATED, Collection: name,
+			Message: strconv.Itoa(len(found)) + " invariant violation(s), first: " + found[0].String(), Data: found})
+	}
+}
+
+// waits for a running audit to finish
+func (db *Database) stopBackgroundAudit() {
+	if db.auditStop == nil {
+		return
+	}
+	close(db.auditStop)
+	<-db.auditDone
+	db.auditStop, db.auditDone = nil, nil
+}
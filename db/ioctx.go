@@ -0,0 +1,90 @@
+package db
+
+import (
+	"context"
+	"io"
+)
+
+// File IO of the operations taking a context is split into chunks of this size,
+// the context is checked between the chunks
+var IO_CHUNK_SIZE = 256 * 1024
+
+// Runs the IO of a single chunk. A chunk still blocked when the context ends (e.g. on a stuck network mount)
+// is abandoned: the caller gets the context error right away, the IO finishes in the background.
+// The buffer of an abandoned chunk must not be reused
+func chunkContext(ctx context.Context, fn func() (int, error)) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if ctx.Done() == nil {
+		// never ends, no need to watch it
+		return fn()
+	}
+	type result struct {
+		n   int
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		n, err := fn()
+		done <- result{n, err}
+	}()
+	select {
+	case r := <-done:
+		return r.n, r.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func chunkEnd(pos, length int) int {
+	if pos+IO_CHUNK_SIZE < length {
+		return pos + IO_CHUNK_SIZE
+	}
+	return length
+}
+
+func chunkedReadAt(ctx context.Context, r io.ReaderAt, data []byte, off int64) (int, error) {
+	read := 0
+	for read < len(data) {
+		chunk, at := data[read:chunkEnd(read, len(data))], off+int64(read)
+		n, err := chunkContext(ctx, func() (int, error) { return r.ReadAt(chunk, at) })
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+func chunkedWriteAt(ctx context.Context, w io.WriterAt, data []byte, off int64) (int, error) {
+	written := 0
+	for written < len(data) {
+		chunk, at := data[written:chunkEnd(written, len(data))], off+int64(written)
+		n, err := chunkContext(ctx, func() (int, error) { return w.WriteAt(chunk, at) })
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// writes through to w in chunks honoring the context
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (cw *contextWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:chunkEnd(written, len(p))]
+		n, err := chunkContext(cw.ctx, func() (int, error) { return cw.w.Write(chunk) })
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,35 @@
+package db
+
+import (
+	"context"
+	"iter"
+)
+
+// Loop over every element of the collection by its id, breaking out of the loop stops the scan.
+// A failed read ends the loop early, use Query().Iter() and Err to see the error
+func (c *Collection) All() iter.Seq2[string, *Element] {
+	return c.Query().Iter()
+}
+
+// Loop over the matching elements by their ids. Breaking out of the loop stops the query
+// like returning StopIteration from Stream, the error that ended the last loop is returned by Err
+func (q *Query) Iter() iter.Seq2[string, *Element] {
+	return q.IterContext(context.Background())
+}
+
+// same as Iter, the query gives up once the context ends
+func (q *Query) IterContext(ctx context.Context) iter.Seq2[string, *Element] {
+	return func(yield func(string, *Element) bool) {
+		q.iterErr = q.Stream(ctx, func(e *Element) error {
+			if !yield(e.Id, e) {
+				return StopIteration
+			}
+			return nil
+		})
+	}
+}
+
+// error of the last loop over Iter, nil when it ended normally or by a break
+func (q *Query) Err() error {
+	return q.iterErr
+}
@@ -0,0 +1,113 @@
+package db
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// JSONPath selectors address the decoded document the way GJSON and JSONPath tools do, useful for payloads
+// holding arbitrary maps and slices. They work wherever a dotted path does, in queries, indexes and ordering:
+//
+//	$.items[0].sku       first element of items
+//	$.items[-1].sku      last element
+//	$.items[*].sku       every element, like "items[].sku"
+//	$.attributes.*       every value of a map or field of a structure
+//	$['odd.key'].value   keys with dots or spaces
+//
+// Names match like the segments of dotted paths. Recursive descent (..), filters and slices are not supported
+
+func isJSONPath(path string) bool {
+	return strings.HasPrefix(path, "$.") || strings.HasPrefix(path, "$[")
+}
+
+func parseJSONPath(path string) ([]pathSegment, error) {
+	invalid := func(reason string) error {
+		return errors.New("invalid path " + path + ": " + reason)
+	}
+	segments := make([]pathSegment, 0)
+	for i := 1; i < len(path); {
+		switch path[i] {
+		case '.':
+			i++
+			if i < len(path) && path[i] == '.' {
+				return nil, invalid("recursive descent is not supported")
+			}
+			end := i
+			for end < len(path) && path[end] != '.' && path[end] != '[' {
+				end++
+			}
+			name := path[i:end]
+			switch {
+			case name == "":
+				return nil, invalid("empty name")
+			case name == "*":
+				segments = append(segments, pathSegment{wildcard: true})
+			case strings.ContainsAny(name, "]'\""):
+				return nil, invalid("unexpected character in " + name)
+			default:
+				segments = append(segments, pathSegment{name: name})
+			}
+			i = end
+		case '[':
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, invalid("unclosed [")
+			}
+			// a quoted key may hold a bracket
+			if quote := path[i+1]; quote == '\'' || quote == '"' {
+				closing := strings.IndexByte(path[i+2:], quote)
+				if closing < 0 {
+					return nil, invalid("unterminated key")
+				}
+				keyEnd := i + 2 + closing
+				end = strings.IndexByte(path[keyEnd:], ']')
+				if end < 0 || strings.TrimSpace(path[keyEnd+1:keyEnd+end]) != "" {
+					return nil, invalid("unclosed [")
+				}
+				segments = append(segments, pathSegment{name: path[i+2 : keyEnd]})
+				i = keyEnd + end + 1
+				continue
+			}
+			inner := strings.TrimSpace(path[i+1 : i+end])
+			switch {
+			case inner == "*":
+				segments = append(segments, pathSegment{wildcard: true})
+			case strings.HasPrefix(inner, "?"):
+				return nil, invalid("filters are not supported")
+			case strings.Contains(inner, ":"):
+				return nil, invalid("slices are not supported")
+			default:
+				index, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, invalid("index " + inner + " is not a number")
+				}
+				segments = append(segments, pathSegment{indexed: true, index: index})
+			}
+			i += end + 1
+		default:
+			return nil, invalid("expected . or [ at " + strconv.Itoa(i))
+		}
+	}
+	if len(segments) == 0 {
+		return nil, invalid("no selector")
+	}
+	return segments, nil
+}
+
+// Projection of an element: every value under the path, a dotted path, a JSONPath selector
+// or a computed field, in the order of the document. Nil values are left out
+func (c *Collection) Select(e *Element, path string) ([]interface{}, error) {
+	values, err := c.resolve(e.Payload, e.Computed, path)
+	if err != nil {
+		return nil, err
+	}
+	values = nonNil(values)
+	result := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		if v.CanInterface() {
+			result = append(result, v.Interface())
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,63 @@
+package db
+
+import "sync"
+
+type keyLock struct {
+	mx sync.Mutex
+	// callers holding or waiting for the lock, the lock is dropped from the table at 0
+	refs int
+}
+
+// per key mutexes created on demand, the zero value is ready to use
+type keyLockTable struct {
+	mx    sync.Mutex
+	locks map[string]*keyLock
+}
+
+func (t *keyLockTable) lock(key string) *keyLock {
+	t.mx.Lock()
+	if t.locks == nil {
+		t.locks = make(map[string]*keyLock)
+	}
+	l, ok := t.locks[key]
+	if !ok {
+		l = &keyLock{}
+		t.locks[key] = l
+	}
+	l.refs++
+	t.mx.Unlock()
+	l.mx.Lock()
+	return l
+}
+
+func (t *keyLockTable) unlock(key string, l *keyLock) {
+	l.mx.Unlock()
+	t.mx.Lock()
+	l.refs--
+	if l.refs == 0 {
+		delete(t.locks, key)
+	}
+	t.mx.Unlock()
+}
+
+// Calls fn while holding the lock of the key, usually the id of an element, so a read-modify-write
+// of the element (FindById, change, Update) is not interleaved with another one of the same key.
+// The lock is advisory: it excludes other WithKeyLock calls of the key only, plain writes go on.
+// The shard lock is not held during fn, so fn may use every method of the collection.
+// Locks of different keys are independent, fn must not lock the same key again
+func (c *Collection) WithKeyLock(key string, fn func() error) error {
+	l := c.keyLocks.lock(key)
+	defer c.keyLocks.unlock(key, l)
+	return fn()
+}
+
+// keys in the table and the callers waiting for them behind the holder
+func (t *keyLockTable) stats() (int, int) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	waiters := 0
+	for _, l := range t.locks {
+		waiters += l.refs - 1
+	}
+	return len(t.locks), waiters
+}
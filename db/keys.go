@@ -0,0 +1,89 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// Ids are strings compared byte by byte. Keys of the KV buckets following the encodings below
+// are read in the order of their values by KV.Range:
+//   - uint64 keys are EncodeUint(n), fixed width hex, so 9 < 10 as numbers
+//   - composite keys are CompositeKey(partition, sort), the keys of a partition are adjacent
+//     and ordered by their sort part, like the partition and sort keys of DynamoDB
+//
+// Further encodings (EncodeInt, EncodeTime) can make up the sort part of a composite key
+
+// separates the partition of a composite key from its sort part, the partition is escaped
+const COMPOSITE_KEY_SEPARATOR = "/"
+
+var compositeEscaper = strings.NewReplacer("%", "%25", COMPOSITE_KEY_SEPARATOR, "%2F")
+var compositeUnescaper = strings.NewReplacer("%2F", COMPOSITE_KEY_SEPARATOR, "%25", "%")
+
+// the key of the element sort in the partition, any string is a valid partition or sort part
+func CompositeKey(partition, sort string) string {
+	return compositeEscaper.Replace(partition) + COMPOSITE_KEY_SEPARATOR + sort
+}
+
+// the partition and the sort part of a key made by CompositeKey
+func SplitCompositeKey(key string) (partition, sort string, err error) {
+	i := strings.Index(key, COMPOSITE_KEY_SEPARATOR)
+	if i < 0 {
+		return "", "", errors.New("key " + key + " is not a composite key")
+	}
+	return compositeUnescaper.Replace(key[:i]), key[i+1:], nil
+}
+
+// the composite keys of the partition are below the returned key, the separator is followed by the next byte
+func partitionEnd(partition string) string {
+	return compositeEscaper.Replace(partition) + string(rune(COMPOSITE_KEY_SEPARATOR[0]+1))
+}
+
+// the keys of the buckets are indexed in their order, so a range reads only its own entries
+const kvKeyIndex = "Key"
+
+// Calls fn with the keys within [from, to) and their values in the order of the keys until fn returns an error.
+// An empty to leaves the range open: Range(db.EncodeUint(100), "", fn) reads the uint64 keys from 100 on
+func (kv *KV) Range(from, to string, fn func(key string, value []byte) error) error {
+	q := kv.c.Query().Unguarded().Where(kvKeyIndex, Gte, from)
+	if to != "" {
+		q.Where(kvKeyIndex, Lt, to)
+	}
+	return q.OrderBy(kvKeyIndex, false).Stream(context.Background(), func(e *Element) error {
+		entry, ok := e.Payload.(*kvEntry)
+		if !ok {
+			return errors.New("element " + e.Id + " is not a key-value entry")
+		}
+		return fn(entry.Key, entry.Value)
+	})
+}
+
+// Calls fn with the sort part and the value of the composite keys of the partition with a sort part
+// within [from, to), ordered by the sort part. An empty to leaves the range open.
+// The partitions of buckets added by this version are read from a single shard, see PartitionedKeys
+func (kv *KV) Partition(partition, from, to string, fn func(sort string, value []byte) error) error {
+	if kv.c.PartitionedKeys {
+		return kv.c.partitionRange(context.Background(), partition, from, to, func(e *Element) error {
+			entry, ok := e.Payload.(*kvEntry)
+			if !ok {
+				return errors.New("element " + e.Id + " is not a key-value entry")
+			}
+			_, sort, err := SplitCompositeKey(entry.Key)
+			if err != nil {
+				return err
+			}
+			return fn(sort, entry.Value)
+		})
+	}
+	end := partitionEnd(partition)
+	if to != "" {
+		end = CompositeKey(partition, to)
+	}
+	return kv.Range(CompositeKey(partition, from), end, func(key string, value []byte) error {
+		_, sort, err := SplitCompositeKey(key)
+		if err != nil {
+			return err
+		}
+		return fn(sort, value)
+	})
+}
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+)
+
+// collections of the buckets of KV are named by the bucket with this prefix
+const KV_COLLECTION_PREFIX = "kv_"
+
+// Returned by KV.Get for keys that are not set
+var ErrKeyNotFound = errors.New("key not found")
+
+// an element of a bucket, its id is the key
+type kvEntry struct {
+	Key   string
+	Value []byte
+}
+
+func (e *kvEntry) GetDataIndex() []*FullDataIndex {
+	return nil
+}
+
+func init() {
+	gob.Register(&kvEntry{})
+}
+
+// Plain key-value view of a collection: string keys, byte values, nothing to register
+type KV struct {
+	c *Collection
+}
+
+// The bucket of the name, its collection is added on the first use. Keys are the ids of the elements,
+// so Get, Set and Delete never scan the collection
+func (db *Database) KV(bucket string) (*KV, error) {
+	name := KV_COLLECTION_PREFIX + bucket
+	c := db.GetCollection(name)
+	if c == nil {
+		var err error
+		c, err = db.AddCollection(name)
+		if err != nil {
+			return nil, errors.New("failed to add bucket " + bucket + " due " + err.Error())
+		}
+	}
+	// the elements of a partition share a shard, buckets written by older versions are left as they are
+	if !c.PartitionedKeys && c.Size() == 0 && c.writable() == nil {
+		c.partitionKeys()
+	}
+	// buckets of older versions get the index of the keys on their first use, read-only ones are scanned by Range
+	if _, ok := c.declaredIndex(kvKeyIndex); !ok && c.writable() == nil {
+		if err := c.AddIndex(kvKeyIndex, true); err != nil {
+			// unless a concurrent first use added it
+			if _, ok = c.declaredIndex(kvKeyIndex); !ok {
+				return nil, errors.New("failed to index the keys of bucket " + bucket + " due " + err.Error())
+			}
+		}
+	}
+	return &KV{c}, nil
+}
+
+// the collection holding the bucket
+func (kv *KV) Collection() *Collection {
+	return kv.c
+}
+
+// the value of the key, ErrKeyNotFound if it is not set
+func (kv *KV) Get(key string) ([]byte, error) {
+	if !kv.c.hasId(key) {
+		return nil, ErrKeyNotFound
+	}
+	data, err := kv.c.FindByIdContext(context.Background(), key)
+	if err != nil {
+		// deleted meanwhile
+		return nil, ErrKeyNotFound
+	}
+	e, err := kv.c.DecodeElement(data)
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := e.Payload.(*kvEntry)
+	if !ok {
+		return nil, errors.New("element " + key + " is not a key-value entry")
+	}
+	return entry.Value, nil
+}
+
+// sets the value of the key, replacing the previous one
+func (kv *KV) Set(key string, value []byte) error {
+	entry := &kvEntry{key, value}
+	return kv.c.WithKeyLock(key, func() error {
+		if kv.c.hasId(key) {
+			return kv.c.Update(key, entry)
+		}
+		return kv.c.writeWithId(context.Background(), key, entry)
+	})
+}
+
+// removes the key, a key that is not set is not an error
+func (kv *KV) Delete(key string) error {
+	return kv.c.WithKeyLock(key, func() error {
+		if !kv.c.hasId(key) {
+			return nil
+		}
+		return kv.c.DeleteById(key)
+	})
+}
+
+// calls fn with every key and its value in the order of the keys until fn returns an error
+func (kv *KV) Iterate(fn func(key string, value []byte) error) error {
+	return kv.Range("", "", fn)
+}
+
+// number of the keys of the bucket
+func (kv *KV) Len() int64 {
+	return kv.c.Size()
+}
+
+// the element of the id is written and not deleted
+func (c *Collection) hasId(id string) bool {
+	return c.hasKey("id:" + id)
+}
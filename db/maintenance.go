@@ -0,0 +1,179 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Time of the week the heavy background work (PRIORITY_LOW: audits, index builds, compactions) may run in.
+// Outside of every window the scheduler holds such tasks back, the urgent ones (PRIORITY_NORMAL and
+// PRIORITY_HIGH, e.g. the synchronization) run at any time
+type MaintenanceWindow struct {
+	// days the window opens on, every day when empty
+	Days []time.Weekday
+	// time of the day the window opens at and its length, a window may run past midnight
+	Start    time.Duration
+	Duration time.Duration
+}
+
+var weekdayNames = map[string]time.Weekday{"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday,
+	"wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday}
+
+// Parses a window like the day fields of a crontab followed by the hours: "* 01:00-05:00",
+// "sat,sun 00:00-06:00" or "mon-fri 22:00-02:00". A window ending before its start runs past midnight
+func ParseMaintenanceWindow(s string) (MaintenanceWindow, error) {
+	w := MaintenanceWindow{}
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return w, errors.New("maintenance window " + s + " is not of the form <days> <hh:mm>-<hh:mm>")
+	}
+	if fields[0] != "*" {
+		for _, part := range strings.Split(strings.ToLower(fields[0]), ",") {
+			bounds := strings.SplitN(part, "-", 2)
+			first, ok := weekdayNames[bounds[0]]
+			last := first
+			if ok && len(bounds) == 2 {
+				last, ok = weekdayNames[bounds[1]]
+			}
+			if !ok {
+				return w, errors.New("invalid days " + fields[0] + " of maintenance window " + s)
+			}
+			for day := first; ; day = (day + 1) % 7 {
+				w.Days = append(w.Days, day)
+				if day == last {
+					break
+				}
+			}
+		}
+	}
+	hours := strings.SplitN(fields[1], "-", 2)
+	if len(hours) != 2 {
+		return w, errors.New("invalid hours " + fields[1] + " of maintenance window " + s)
+	}
+	start, err := time.Parse("15:04", hours[0])
+	if err != nil {
+		return w, errors.New("invalid hours " + fields[1] + " of maintenance window " + s)
+	}
+	end, err := time.Parse("15:04", hours[1])
+	if err != nil || end.Equal(start) {
+		return w, errors.New("invalid hours " + fields[1] + " of maintenance window " + s)
+	}
+	w.Start = time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute
+	w.Duration = end.Sub(start)
+	if w.Duration < 0 {
+		w.Duration += 24 * time.Hour
+	}
+	return w, nil
+}
+
+func (w MaintenanceWindow) String() string {
+	days := "*"
+	if len(w.Days) > 0 {
+		names := make([]string, len(w.Days))
+		for i, day := range w.Days {
+			names[i] = strings.ToLower(day.String()[:3])
+		}
+		days = strings.Join(names, ",")
+	}
+	clock := func(d time.Duration) string {
+		return time.Time{}.Add(d % (24 * time.Hour)).Format("15:04")
+	}
+	return days + " " + clock(w.Start) + "-" + clock(w.Start+w.Duration)
+}
+
+func windowsString(windows []MaintenanceWindow) string {
+	names := make([]string, len(windows))
+	for i, w := range windows {
+		names[i] = w.String()
+	}
+	return strings.Join(names, "; ")
+}
+
+func (w MaintenanceWindow) opensOn(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// the window is open at t, in the time zone of t
+func (w MaintenanceWindow) Contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	// opened today or, running past midnight, yesterday
+	for _, day := range []time.Time{midnight, midnight.AddDate(0, 0, -1)} {
+		start := day.Add(w.Start)
+		if w.opensOn(day.Weekday()) && !t.Before(start) && t.Before(start.Add(w.Duration)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Low priority tasks are held back while no window is open, an empty list lets them run at any time.
+// The windows are read in the time zone of the clock, nil is the SystemClock. Held tasks start
+// within a minute of the opening of a window
+func (s *Scheduler) SetMaintenanceWindows(windows []MaintenanceWindow, clock Clock) {
+	if clock == nil {
+		clock = SystemClock
+	}
+	s.mx.Lock()
+	stop, done := s.windowStop, s.windowDone
+	s.windows = append([]MaintenanceWindow(nil), windows...)
+	s.clock = clock
+	s.windowStop, s.windowDone = nil, nil
+	if len(windows) > 0 && !s.closed {
+		s.windowStop, s.windowDone = make(chan struct{}), make(chan struct{})
+		s.watchWindows(clock.NewTicker(time.Minute), s.windowStop, s.windowDone)
+	}
+	// tasks held by the previous windows may run now
+	s.cond.Broadcast()
+	s.mx.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// wakes the workers every tick, so they pick up the held tasks once a window opened
+func (s *Scheduler) watchWindows(ticker Ticker, stop, done chan struct{}) {
+	go func() {
+		defer close(done)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.Chan():
+				s.mx.Lock()
+				s.cond.Broadcast()
+				s.mx.Unlock()
+			}
+		}
+	}()
+}
+
+func (s *Scheduler) MaintenanceWindows() []MaintenanceWindow {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return append([]MaintenanceWindow(nil), s.windows...)
+}
+
+// low priority tasks may run, the lock is held
+func (s *Scheduler) inMaintenance() bool {
+	if len(s.windows) == 0 {
+		return true
+	}
+	now := s.clock.Now()
+	for _, w := range s.windows {
+		if w.Contains(now) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,210 @@
+package db
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+type ManagerOptions struct {
+	// tasks of the shared background scheduler running at the same time
+	BackgroundWorkers int
+	// megabytes of the read caches of all collections of all databases, 0 leaves the caches as configured
+	CacheSize int
+}
+
+// Hosts several independent databases, each in its own directory. They share a background scheduler,
+// so synchronizations of all of them never take more than the set number of workers,
+// and a cache budget split evenly between their collections
+type Manager struct {
+	mx        sync.RWMutex
+	databases map[string]*Database
+	scheduler *Scheduler
+	cacheSize int
+	closed    bool
+}
+
+func NewManager(options ManagerOptions) *Manager {
+	return &Manager{
+		databases: make(map[string]*Database),
+		scheduler: NewScheduler(options.BackgroundWorkers),
+		cacheSize: options.CacheSize,
+	}
+}
+
+// Opens the database under the name, loaded from options.Dir if it holds one, empty otherwise.
+// The types of the elements have to be registered (RegisterType) before. Databases of a manager
+// are closed with CloseDatabase, their Config().BackgroundWorkers is the one of the manager
+func (m *Manager) Open(name string, options DatabaseOptions) (*Database, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	if m.closed {
+		return nil, errors.New("manager is closed")
+	}
+	if _, ok := m.databases[name]; ok {
+		return nil, errors.New("database " + name + " is already open")
+	}
+	for other, db := range m.databases {
+		if options.Dir != "" && db.options.Dir == options.Dir {
+			return nil, errors.New("directory " + options.Dir + " is already used by database " + other)
+		}
+	}
+	options.Config.BackgroundWorkers = m.scheduler.Workers()
+	options.Config.MaintenanceWindows = m.scheduler.MaintenanceWindows()
+	db := newDatabase(name, options, m.scheduler)
+	db.manager = m
+	if _, err := db.LocateDatabase(options.Dir); err == nil {
+		if err = db.ScanAndLoadData(""); err != nil {
+			db.Close()
+			return nil, errors.New("failed to load database " + name + " due " + err.Error())
+		}
+	}
+	m.databases[name] = db
+	return db, m.rebalance()
+}
+
+// the database opened under the name, nil if there is none
+func (m *Manager) Get(name string) *Database {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	return m.databases[name]
+}
+
+// names of the open databases, sorted
+func (m *Manager) Names() []string {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	names := make([]string, 0, len(m.databases))
+	for name := range m.databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// changes the number of workers of the shared scheduler
+func (m *Manager) SetWorkers(workers int) {
+	m.scheduler.SetWorkers(workers)
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	for _, db := range m.databases {
+		db.configMx.Lock()
+		db.options.Config.BackgroundWorkers = m.scheduler.Workers()
+		db.configMx.Unlock()
+	}
+}
+
+// changes the maintenance windows of the shared scheduler, see Scheduler.SetMaintenanceWindows
+func (m *Manager) SetMaintenanceWindows(windows []MaintenanceWindow) {
+	m.scheduler.SetMaintenanceWindows(windows, nil)
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	for _, db := range m.databases {
+		db.configMx.Lock()
+		db.options.Config.MaintenanceWindows = m.scheduler.MaintenanceWindows()
+		db.configMx.Unlock()
+	}
+}
+
+// Splits the cache budget between the collections of all databases again. Done by Open, CloseDatabase
+// and by AddCollection of the databases of the manager. Resized caches keep their entries as far as they fit
+func (m *Manager) Rebalance() error {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	return m.rebalance()
+}
+
+func (m *Manager) rebalance() error {
+	if m.cacheSize <= 0 {
+		return nil
+	}
+	collections := 0
+	for _, db := range m.databases {
+		collections += db.GetCollectionsCount()
+	}
+	share := m.cacheSize
+	if collections > 0 {
+		share = m.cacheSize / collections
+	}
+	if share < 1 {
+		share = 1
+	}
+	for _, db := range m.databases {
+		cfg := db.Config()
+		cfg.CacheSize = share
+		if err := db.ApplyConfig(cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Synchronizes every database, the errors are collected by the name of the database
+func (m *Manager) Sync() error {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	failed := make(map[string]error)
+	for name, db := range m.databases {
+		if err := db.Sync(); err != nil {
+			failed[name] = err
+		}
+	}
+	if len(failed) > 0 {
+		return &ManagerError{failed}
+	}
+	return nil
+}
+
+// closes the database and gives its cache budget to the others
+func (m *Manager) CloseDatabase(name string) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	db, ok := m.databases[name]
+	if !ok {
+		return errors.New("database " + name + " is not open")
+	}
+	delete(m.databases, name)
+	err := db.Close()
+	if rerr := m.rebalance(); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// closes every database, then the shared scheduler
+func (m *Manager) Close() error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.closed = true
+	failed := make(map[string]error)
+	for name, db := range m.databases {
+		if err := db.Close(); err != nil {
+			failed[name] = err
+		}
+	}
+	m.databases = make(map[string]*Database)
+	m.scheduler.Close()
+	if len(failed) > 0 {
+		return &ManagerError{failed}
+	}
+	return nil
+}
+
+// Returned when some of the databases of a manager failed
+type ManagerError struct {
+	Databases map[string]error
+}
+
+func (e *ManagerError) Error() string {
+	names := make([]string, 0, len(e.Databases))
+	for name := range e.Databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msg := strconv.Itoa(len(names)) + " database(s) failed:"
+	for _, name := range names {
+		msg += " " + name + " (" + e.Databases[name].Error() + ")"
+	}
+	return msg
+}
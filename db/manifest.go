@@ -0,0 +1,355 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const MANIFEST_NAME = "MANIFEST"
+
+// Explicit description of the data directory. It is rewritten atomically on every sync,
+// so the loader never has to guess which files belong to the database.
+//
+// The files a sync replaces (the descriptions, the map indexes and the shard metas) are listed by snapshots
+// named after the sequence of the manifest (map.index.7), links no sync writes to. A crash after the collections
+// replaced their files but before the manifest was saved leaves the snapshots of the previous manifest
+// in place, the loader restores the files from them
+type Manifest struct {
+	Version     int                   `json:"version"`
+	Sequence    uint64                `json:"seq"`
+	Collections []*ManifestCollection `json:"collections"`
+}
+
+type ManifestCollection struct {
+	Name        string           `json:"name"`
+	Path        string           `json:"path"` // relative to the database directory
+	Description *ManifestFile    `json:"description"`
+	Index       *ManifestFile    `json:"index"`
+	Shards      []*ManifestShard `json:"shards"`
+}
+
+type ManifestShard struct {
+	Id       int             `json:"id"`
+	Segments []*ManifestFile `json:"segments"`
+	Meta     *ManifestFile   `json:"meta"`
+}
+
+// Name is relative to the collection directory.
+// Shard segments are only verified by their size (the active one is appended to between syncs),
+// everything else must match the checksum exactly.
+type ManifestFile struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Checksum uint32 `json:"crc32,omitempty"`
+	// the checksum covers the first Size bytes, the file may have grown since (shard metas)
+	Appendable bool `json:"appendable,omitempty"`
+}
+
+func shardDataName(id int) string {
+	return "shard_" + strconv.Itoa(id) + ".gobs"
+}
+
+func shardMetaName(id int) string {
+	return "shard_" + strconv.Itoa(id) + "_meta.flat"
+}
+
+// gob encoded meta written by versions before the flat one
+func legacyShardMetaName(id int) string {
+	return "shard_" + strconv.Itoa(id) + "_meta.gob.gzip"
+}
+
+func snapshotName(name string, seq uint64) string {
+	return name + "." + strconv.FormatUint(seq, 10)
+}
+
+// the file a snapshot was taken of, false for other files
+func snapshotOf(name string) (string, bool) {
+	i := strings.LastIndexByte(name, '.')
+	if i <= 0 {
+		return "", false
+	}
+	if _, err := strconv.ParseUint(name[i+1:], 10, 64); err != nil {
+		return "", false
+	}
+	return name[:i], isRewrittenOnSync(name[:i])
+}
+
+// links the file under the name of the snapshot, it is copied where links are not supported
+func (o *DatabaseOptions) snapshot(dir, name string, seq uint64) (string, error) {
+	snapshot := snapshotName(name, seq)
+	target := filepath.Join(dir, snapshot)
+	// left by a sync that failed before its manifest was saved
+	os.Remove(target)
+	if os.Link(filepath.Join(dir, name), target) == nil {
+		return snapshot, nil
+	}
+	return snapshot, o.copyFile(filepath.Join(dir, name), target)
+}
+
+// Replaces the file the snapshot was taken of by the snapshot, unless it is the snapshot already.
+// Afterwards the syncs append to the file the manifest describes
+func (o *DatabaseOptions) restoreSnapshot(dir, snapshot string) error {
+	name, ok := snapshotOf(snapshot)
+	if !ok {
+		// listed by a manifest written before the snapshots
+		return nil
+	}
+	source, target := filepath.Join(dir, snapshot), filepath.Join(dir, name)
+	si, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if ti, err := os.Stat(target); err == nil && os.SameFile(si, ti) {
+		return nil
+	}
+	tmp := target + ".tmp"
+	os.Remove(tmp)
+	if err = os.Link(source, tmp); err != nil {
+		if err = o.copyFile(source, tmp); err != nil {
+			return err
+		}
+	}
+	if err = os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+func (o *DatabaseOptions) copyFile(source, target string) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return o.writeAtomically(target, func(w io.Writer) error {
+		_, err := io.Copy(w, f)
+		return err
+	})
+}
+
+func describeFile(dir, name string, checksum bool) (*ManifestFile, error) {
+	return describeFileFS(os.DirFS(dir), name, checksum)
+}
+
+func describeFileFS(fsys fs.FS, name string, checksum bool) (*ManifestFile, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	mf := &ManifestFile{Name: name}
+	if !checksum {
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		mf.Size = fi.Size()
+		return mf, nil
+	}
+	h := crc32.NewIEEE()
+	mf.Size, err = io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	mf.Checksum = h.Sum32()
+	return mf, nil
+}
+
+// checks that the file on the drive is the one that was recorded in the manifest
+func (mf *ManifestFile) Verify(dir string, checksum bool) error {
+	return mf.verify(os.DirFS(dir), checksum)
+}
+
+func (mf *ManifestFile) verify(fsys fs.FS, checksum bool) error {
+	actual, err := describeFileFS(fsys, mf.Name, checksum)
+	if err != nil {
+		return err
+	}
+	if !checksum {
+		// data could have been appended after the sync, but never truncated
+		if actual.Size < mf.Size {
+			return errors.New("file " + mf.Name + " is truncated")
+		}
+		return nil
+	}
+	if mf.Appendable {
+		return mf.verifyPrefix(fsys)
+	}
+	if actual.Size != mf.Size || actual.Checksum != mf.Checksum {
+		return errors.New("file " + mf.Name + " does not match the manifest checksum")
+	}
+	return nil
+}
+
+func (mf *ManifestFile) verifyPrefix(fsys fs.FS) error {
+	f, err := fsys.Open(mf.Name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := crc32.NewIEEE()
+	n, err := io.CopyN(h, f, mf.Size)
+	if n < mf.Size {
+		return errors.New("file " + mf.Name + " is truncated")
+	}
+	if err != nil {
+		return err
+	}
+	if h.Sum32() != mf.Checksum {
+		return errors.New("file " + mf.Name + " does not match the manifest checksum")
+	}
+	return nil
+}
+
+// describes the collection by snapshots of the files a sync replaces, see Manifest
+func (db *Database) describeCollection(c *Collection, seq uint64) (*ManifestCollection, error) {
+	dir := c.Map.SyncDestination
+	mc := &ManifestCollection{
+		Name:   c.Name,
+		Path:   filepath.ToSlash(filepath.Join(COLLECTION_DIR_NAME, c.Name)),
+		Shards: make([]*ManifestShard, 0, len(c.Map.Shared)),
+	}
+	describeSnapshot := func(name string) (*ManifestFile, error) {
+		snapshot, err := db.options.snapshot(dir, name, seq)
+		if err != nil {
+			return nil, err
+		}
+		return describeFile(dir, snapshot, true)
+	}
+	var err error
+	mc.Description, err = describeSnapshot(c.Name + ".json.gzip")
+	if err != nil {
+		return nil, err
+	}
+	mc.Index, err = describeSnapshot("map.index")
+	if err != nil {
+		return nil, err
+	}
+	for _, shard := range c.Map.Shared {
+		ms := &ManifestShard{Id: shard.Id}
+		// the segments are known without decoding a mapped meta
+		shard.mx.RLock()
+		segments := append([]int(nil), shard.Segments...)
+		shard.mx.RUnlock()
+		for _, segment := range segments {
+			mf, err := describeFile(dir, shardSegmentName(shard.Id, segment), false)
+			if err != nil {
+				return nil, err
+			}
+			ms.Segments = append(ms.Segments, mf)
+		}
+		ms.Meta, err = describeSnapshot(shardMetaName(shard.Id))
+		if err != nil {
+			return nil, err
+		}
+		// later syncs append to the meta, the loader reads it up to the size of the manifest
+		ms.Meta.Appendable = true
+		mc.Shards = append(mc.Shards, ms)
+	}
+	// the links have to be durable before the manifest refers to them
+	syncDir(dir)
+	return mc, nil
+}
+
+func (db *Database) buildManifest() (*Manifest, error) {
+	db.collectionMutex.RLock()
+	defer db.collectionMutex.RUnlock()
+	m := &Manifest{db.Version, db.sequence + 1, make([]*ManifestCollection, 0, len(db.collections))}
+	for _, c := range db.collections {
+		mc, err := db.describeCollection(c, m.Sequence)
+		if err != nil {
+			return nil, errors.New("failed to describe collection " + c.Name + " due " + err.Error())
+		}
+		m.Collections = append(m.Collections, mc)
+	}
+	return m, nil
+}
+
+// the snapshots of the files the manifest lists
+func (mc *ManifestCollection) snapshots() []string {
+	names := []string{mc.Description.Name, mc.Index.Name}
+	for _, ms := range mc.Shards {
+		names = append(names, ms.Meta.Name)
+	}
+	return names
+}
+
+// the obsolete segments by shard, taken before the manifest is built so it describes the metas without them
+func (db *Database) obsoleteSegments() map[*ConcurrentMapShared][]int {
+	db.collectionMutex.RLock()
+	defer db.collectionMutex.RUnlock()
+	obsolete := make(map[*ConcurrentMapShared][]int)
+	for _, c := range db.collections {
+		for _, shard := range c.Map.Shared {
+			if segments := shard.obsoleteSegments(); len(segments) > 0 {
+				obsolete[shard] = segments
+			}
+		}
+	}
+	return obsolete
+}
+
+// removes the snapshots the saved manifest does not list: the ones of the previous manifest
+// and the ones left by syncs that failed before their manifest was saved
+func (db *Database) removeSnapshots(m *Manifest) {
+	for _, mc := range m.Collections {
+		dir := filepath.Join(db.dir, filepath.FromSlash(mc.Path))
+		keep := make(map[string]bool)
+		for _, name := range mc.snapshots() {
+			keep[name] = true
+		}
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, fi := range files {
+			if _, ok := snapshotOf(fi.Name()); ok && !keep[fi.Name()] {
+				os.Remove(filepath.Join(dir, fi.Name()))
+			}
+		}
+	}
+}
+
+// writes the manifest to a temporary file and renames it only after it reached the drive
+func (m *Manifest) Save(path string) error {
+	return m.save(context.Background(), path, nil)
+}
+
+func (m *Manifest) save(ctx context.Context, path string, options *DatabaseOptions) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return options.writeAtomicallyContext(ctx, path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+func LoadManifest(path string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(data)
+}
+
+func parseManifest(data []byte) (*Manifest, error) {
+	m := new(Manifest)
+	err := json.Unmarshal(data, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
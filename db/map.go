@@ -3,20 +3,23 @@ package db
 // Original idea of the concurrent map was taken from https://github.com/orcaman/concurrent-map
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"github.com/rs/xid"
-	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
+	"time"
 )
 
-// Every collection will be split along %SHARD_COUNT% files
+// Every collection will be split along %SHARD_COUNT% files, unless DatabaseOptions.ShardCount is set
 var SHARD_COUNT = 32
 
 // A "thread" safe map of type string:Anything.
-// To avoid lock bottlenecks this map is dived to several (SHARD_COUNT) map shards.
+// To avoid lock bottlenecks this map is dived to several (SHARD_COUNT by default) map shards.
 
 type ConcurrentMap struct {
 	Shared []*ConcurrentMapShared
@@ -24,12 +27,18 @@ type ConcurrentMap struct {
 	counter         uint64
 	counterMx       sync.Mutex
 	SyncDestination string
+
+	flushLatency []*Histogram
+	options      *DatabaseOptions
 }
 
 type ShardOffset struct {
 	Start   int64 `json:"s"`
 	Length  int   `json:"l"`
 	Deleted bool  `json:"!,omitempty"`
+	Segment int   `json:"g,omitempty"`
+	// a deleted id kept by Optimize, the data is a tombstone instead of the element
+	Tombstone bool `json:"t,omitempty"`
 }
 
 func (cm *ConcurrentMap) GetRandomShard() *ConcurrentMapShared {
@@ -40,32 +49,76 @@ func (cm *ConcurrentMap) GetRandomShard() *ConcurrentMapShared {
 func (cm *ConcurrentMap) Flush() error {
 	for _, shard := range cm.Shared {
 		shard.Lock()
-		shard.file.Close()
-		f, err := os.OpenFile(shard.SyncDestination+"/shard_"+strconv.Itoa(shard.Id)+".gobs", os.O_RDWR, os.ModePerm)
+		err := shard.reopenActive(context.Background())
+		shard.Unlock()
 		if err != nil {
-			shard.Unlock()
 			return err
 		}
-		shard.file = f
-		shard.Unlock()
 	}
 	return nil
 }
 
-// deletes redundant data from the drive
-// n - total sized of the data that has been removed
-func (cm *ConcurrentMap) OptimizeShards() (n int64, err error) {
+// ids of the shards changed since they were synchronized the last time
+func (cm *ConcurrentMap) DirtyShards() []int {
+	dirty := make([]int, 0)
+	for _, shard := range cm.Shared {
+		if shard.IsDirty() {
+			dirty = append(dirty, shard.Id)
+		}
+	}
+	return dirty
+}
+
+func (cm *ConcurrentMap) markDirty() {
+	for _, shard := range cm.Shared {
+		shard.markDirty()
+	}
+}
+
+// writes out the buffered data and closes every segment file
+func (cm *ConcurrentMap) Close() (err error) {
+	for _, shard := range cm.Shared {
+		shard.closeMeta()
+		shard.Lock()
+		if ferr := shard.flushPending(); ferr != nil {
+			err = ferr
+		}
+		shard.closeSegments()
+		shard.Unlock()
+	}
+	return err
+}
+
+// deletes redundant data from the drive, the report covers the shards optimized before a failure
+func (cm *ConcurrentMap) OptimizeShards() (*OptimizeReport, error) {
+	report := &OptimizeReport{Shards: make([]ShardOptimization, 0, len(cm.Shared))}
 	for _, shard := range cm.Shared {
-		n, err = shard.Optimize()
+		start := time.Now()
+		reclaimed, rewritten, err := shard.Optimize()
+		report.add(ShardOptimization{shard.Id, reclaimed, rewritten, time.Since(start)})
 		if err != nil {
-			return n, err
+			return report, err
 		}
 	}
-	return
+	return report, nil
+}
+
+// the buffer size is shared evenly among the shards, 0 writes everything straight to the files
+func (cm *ConcurrentMap) SetWriteBufferSize(size int64) error {
+	for _, shard := range cm.Shared {
+		// the buffer does not need the items, a mapped meta stays mapped
+		shard.mx.Lock()
+		err := shard.setBufferLimit(int(size / int64(len(cm.Shared))))
+		shard.mx.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (cm *ConcurrentMap) SetCounterIndex(value uint64) error {
-	if value >= uint64(SHARD_COUNT) || value < 0 {
+	if value >= uint64(len(cm.Shared)) {
 		return errors.New("invalid value")
 	}
 	cm.counterMx.Lock()
@@ -75,25 +128,42 @@ func (cm *ConcurrentMap) SetCounterIndex(value uint64) error {
 }
 
 // synchronizes database with the drive
-func (cm *ConcurrentMap) Sync() (err error) {
+func (cm *ConcurrentMap) Sync() error {
+	return cm.SyncContext(context.Background())
+}
+
+// same as Sync, gives up once the context ends
+func (cm *ConcurrentMap) SyncContext(ctx context.Context) (err error) {
 	for _, shard := range cm.Shared {
-		err = shard.Sync()
+		if shard.IsMapped() {
+			// untouched since the load, nothing to flush or save
+			continue
+		}
+		start := time.Now()
+		// flush the data first, the meta must never point past it
+		err = shard.reopenActiveLocked(ctx)
 		if err != nil {
+			// very critical error
 			return err
 		}
+		err = shard.SyncContext(ctx)
+		if err != nil {
+			return err
+		}
+		cm.flushLatency[shard.Id].Observe(time.Since(start))
 	}
 	cm.counterMx.Lock()
-	err = ioutil.WriteFile(cm.SyncDestination+"/map.index",
-		[]byte(strconv.FormatUint(cm.counter, 10)+"\n"+cm.SyncDestination), os.ModePerm)
+	err = cm.options.writeFileContext(ctx, filepath.Join(cm.SyncDestination, "map.index"),
+		[]byte(strconv.FormatUint(cm.counter, 10)+"\n"+cm.SyncDestination))
 	cm.counterMx.Unlock()
 	return err
 }
 
-// Creates a new concurrent map.
+// Creates a new concurrent map with a shard per file.
 func NewConcurrentMap(syncDest string, files []*os.File) *ConcurrentMap {
-	m := &ConcurrentMap{make([]*ConcurrentMapShared, SHARD_COUNT),
-		0, sync.Mutex{}, syncDest}
-	for i := 0; i < SHARD_COUNT; i++ {
+	m := &ConcurrentMap{make([]*ConcurrentMapShared, len(files)),
+		0, sync.Mutex{}, syncDest, newLatencyHistograms(len(files)), nil}
+	for i := range files {
 		m.Shared[i] = NewConcurrentMapShared(syncDest, i, files[i])
 	}
 	return m
@@ -101,7 +171,7 @@ func NewConcurrentMap(syncDest string, files []*os.File) *ConcurrentMap {
 
 // Returns shard under given key
 func (m *ConcurrentMap) GetShard(key string) *ConcurrentMapShared {
-	return m.Shared[uint(fnv32(key))%uint(SHARD_COUNT)]
+	return m.Shared[uint(fnv32(key))%uint(len(m.Shared))]
 }
 
 func (m *ConcurrentMap) GetNextShard() *ConcurrentMapShared {
@@ -109,45 +179,31 @@ func (m *ConcurrentMap) GetNextShard() *ConcurrentMapShared {
 	defer m.counterMx.Unlock()
 
 	m.counter++
-	if m.counter >= 32 {
+	if m.counter >= uint64(len(m.Shared)) {
 		m.counter = 0
 	}
 	return m.Shared[m.counter]
 }
 
 func (m *ConcurrentMap) ReadAtOffset(shard *ConcurrentMapShared, offset *ShardOffset) ([]byte, error) {
-	data := make([]byte, offset.Length)
-	_, err := shard.file.ReadAt(data, offset.Start)
-	return data, err
+	return shard.readAt(offset)
 }
 
 func (m *ConcurrentMap) RestoreByKey(key, value string, limit int) int {
 	counter := 0
-	for n := 0; n < SHARD_COUNT; n++ {
+	for n := 0; n < len(m.Shared) && counter < limit; n++ {
 		shard := m.Shared[n]
 		shard.Lock()
-		kv := key + ":" + value
-		en := ":" + kv
-		length := shard.GetCapacityKey(kv)
-		tempKey := ""
-		for i := length - 1; i >= 0; i-- {
-			tempKey = strconv.Itoa(i) + en
-			if item, ok := shard.Items[tempKey]; ok {
-				if !item.Deleted {
-					continue
-				}
-				item.Deleted = false
-				counter++
-				if counter == limit {
-					shard.Unlock()
-					return limit
-				}
-			} else {
-				break
+		shard.eachSlot(key+":"+value, func(slot string, item *ShardOffset) bool {
+			if !item.Deleted {
+				return true
 			}
-			i++
-		}
-		shard.SetCapacityKey(kv, length+counter)
+			item.Deleted = false
+			shard.offsetChanged(item)
+			shard.markDirty()
+			counter++
+			return counter < limit
+		})
 		shard.Unlock()
 	}
 	return counter
@@ -156,8 +212,11 @@ func (m *ConcurrentMap) RestoreByKey(key, value string, limit int) int {
 func (m *ConcurrentMap) RestoreByUniqueKey(shard *ConcurrentMapShared, key, value string) error {
 	shard.Lock()
 	defer shard.Unlock()
-	if item, ok := shard.Items[key+":"+value]; ok {
+	// a tombstone has no element to restore
+	if item, ok := shard.Items[key+":"+value]; ok && !item.Tombstone {
 		item.Deleted = false
+		shard.offsetChanged(item)
+		shard.markDirty()
 		return nil
 	}
 	return errors.New("object footprint was already evicted")
@@ -172,39 +231,28 @@ func (m *ConcurrentMap) DeleteByUniqueKey(shard *ConcurrentMapShared, key, value
 	defer shard.Unlock()
 	if item, ok := shard.Items[key+":"+value]; ok {
 		item.Deleted = true
+		shard.offsetChanged(item)
+		shard.markDirty()
 		return nil
 	}
 	return errors.New("object under specified unique key was not found")
 }
 
 func (m *ConcurrentMap) DeleteByKey(key, value string, limit int) (deletedDests []string) {
-	counter := 0
 	deletedDests = make([]string, 0)
-	for n := 0; n < SHARD_COUNT; n++ {
+	for n := 0; n < len(m.Shared) && len(deletedDests) < limit; n++ {
 		shard := m.Shared[n]
 		shard.Lock()
-		kv := key + ":" + value
-		en := ":" + kv
-		length := shard.GetCapacityKey(kv)
-		tempKey := ""
-		for i := length - 1; i >= 0; i-- {
-			tempKey = strconv.Itoa(i) + en
-			if item, ok := shard.Items[tempKey]; ok {
-				if item.Deleted {
-					continue
-				}
-				item.Deleted = true
-				deletedDests = append(deletedDests, tempKey)
-				counter++
-				if counter == limit {
-					shard.Unlock()
-					return deletedDests
-				}
-			} else {
-				break
+		shard.eachSlot(key+":"+value, func(slot string, item *ShardOffset) bool {
+			if item.Deleted {
+				return true
 			}
-			i++
-		}
+			item.Deleted = true
+			shard.offsetChanged(item)
+			shard.markDirty()
+			deletedDests = append(deletedDests, slot)
+			return len(deletedDests) < limit
+		})
 		shard.Unlock()
 	}
 	return deletedDests
@@ -214,138 +262,130 @@ func (m *ConcurrentMap) FindById(shard *ConcurrentMapShared, id string) ([]byte,
 	return m.FindByUniqueKey(shard, "id", id)
 }
 
+// returned by the lookups of an id or a unique key without a live element
+var errNotFound = errors.New("not found")
+
 func (m *ConcurrentMap) FindByUniqueKey(shard *ConcurrentMapShared, key, value string) ([]byte, error) {
 	shard.RLock()
 	defer shard.RUnlock()
 
-	if item, ok := shard.Items[key+":"+value]; ok {
+	if item, ok := shard.Items[key+":"+value]; ok && !item.Deleted {
 		return m.ReadAtOffset(shard, item)
 	}
-	return nil, errors.New("not found")
+	return nil, errNotFound
 }
 
 func (m *ConcurrentMap) FindByKeyInShard(shard *ConcurrentMapShared, key, value string, limit int) ([][]byte, error) {
 	shard.RLock()
 	defer shard.RUnlock()
+	return m.findByKeyInShard(shard, key, value, limit, make([][]byte, 0, limit))
+}
 
-	kv := ":" + key + ":" + value
-	results := make([][]byte, 0, limit)
-	i := 0
-	for {
-		if item, ok := shard.Items[strconv.Itoa(i)+kv]; ok {
-			if item.Deleted {
-				continue
-			}
-			data, err := m.ReadAtOffset(shard, item)
-			if err != nil {
-				return nil, err
-			}
-			results = append(results, data)
-			if len(results) == limit {
-				return results, nil
-			}
-		} else {
-			break
+// appends the live elements of the set to the results until there are limit of them
+func (m *ConcurrentMap) findByKeyInShard(shard *ConcurrentMapShared, key, value string, limit int, results [][]byte) ([][]byte, error) {
+	var err error
+	shard.eachSlot(key+":"+value, func(slot string, item *ShardOffset) bool {
+		if item.Deleted {
+			return true
 		}
-		i++
-	}
-	return results, nil
+		var data []byte
+		data, err = m.ReadAtOffset(shard, item)
+		if err != nil {
+			return false
+		}
+		results = append(results, data)
+		return len(results) < limit
+	})
+	return results, err
 }
 
 func (m *ConcurrentMap) FindByKey(key, value string, limit int) ([][]byte, error) {
 	results := make([][]byte, 0, limit)
-	kv := ":" + key + ":" + value
-	for n := 0; n < SHARD_COUNT; n++ {
+	var err error
+	for n := 0; n < len(m.Shared) && len(results) < limit; n++ {
 		shard := m.Shared[n]
-		shard.Lock()
-		i := 0
-		for {
-			if item, ok := shard.Items[strconv.Itoa(i)+kv]; ok {
-				if item.Deleted {
-					continue
-				}
-				data, err := m.ReadAtOffset(shard, item)
-				if err != nil {
-					shard.Unlock()
-					return nil, err
-				}
-				results = append(results, data)
-				if len(results) == limit {
-					shard.Unlock()
-					return results, nil
-				}
-			} else {
-				break
-			}
-			i++
+		shard.RLock()
+		results, err = m.findByKeyInShard(shard, key, value, limit, results)
+		shard.RUnlock()
+		if err != nil {
+			return nil, err
 		}
-		shard.Unlock()
 	}
 	return results, nil
 }
 
 func (m *ConcurrentMap) Set(indexData []*FullDataIndex, value interface{}) (map[string]*int, error) {
-	idStr := xid.New().String()
+	return m.SetWithId(xid.New().String(), indexData, value)
+}
+
+// same as Set, but the element keeps the given id
+func (m *ConcurrentMap) SetWithId(idStr string, indexData []*FullDataIndex, value interface{}) (map[string]*int, error) {
 	// marshal the payload
-	elem := Element{idStr, value}
+	elem := Element{Id: idStr, Payload: value}
 	encodedData, err := EncodeGob(elem)
 	if err != nil {
 		return nil, err
 	}
-	// get map shard
-	shard := m.GetNextShard()
+	return m.SetEncoded(idStr, indexData, encodedData)
+}
+
+// stores an already encoded element under the given id
+func (m *ConcurrentMap) SetEncoded(idStr string, indexData []*FullDataIndex, encodedData []byte) (map[string]*int, error) {
+	return m.SetEncodedContext(context.Background(), idStr, indexData, encodedData)
+}
+
+// same as SetEncoded, the data is written in chunks honoring the context
+func (m *ConcurrentMap) SetEncodedContext(ctx context.Context, idStr string, indexData []*FullDataIndex, encodedData []byte) (map[string]*int, error) {
+	return m.setEncodedToShard(ctx, m.GetNextShard(), idStr, indexData, encodedData)
+}
+
+// same as SetEncodedContext, the element is written to the given shard
+func (m *ConcurrentMap) setEncodedToShard(ctx context.Context, shard *ConcurrentMapShared, idStr string, indexData []*FullDataIndex, encodedData []byte) (map[string]*int, error) {
 	shard.Lock()
 	defer shard.Unlock()
-	// write to the end of the file
-	ret, err := shard.file.Seek(0, 2)
+	// write encoded data to the end of the active segment
+	offset, err := shard.appendDataContext(ctx, encodedData)
 	if err != nil {
 		return nil, err
 	}
-	// write encoded data to the file
-	n := 0
-	n, err = shard.file.Write(encodedData)
-	if err != nil {
-		return nil, err
-	}
-	// write "next line" symbol to the file
+	shard.markDirty()
 	destMap := make(map[string]*int)
 	pId := &shard.Id
 
-	offset := ShardOffset{ret, n, false}
-	if indexData != nil {
-		for _, ix := range indexData {
-			fullKey := ix.Field + ":" + ix.Data
-			// Unique index key
-			if ix.Unique {
-				if _, ok := shard.Items[fullKey]; ok {
-					return nil, errors.New("unique primary key duplicate")
-				}
-				shard.Items[fullKey] = &offset
-				destMap[fullKey] = pId
-			} else {
-				// Regular key
-				index := shard.GetCapacityKey(fullKey)
-				lastAvailable := ""
-				for {
-					lastAvailable = strconv.Itoa(index) + ":" + fullKey
-					if _, ok := shard.Items[lastAvailable]; ok {
-						index++
-					} else {
-						break
-					}
-				}
-				shard.Items[lastAvailable] = &offset
-				shard.SetCapacityKey(fullKey, index)
-				destMap[lastAvailable] = pId
-			}
+	for _, ix := range indexData {
+		key, err := shard.addIndexKey(ix, offset)
+		if err != nil {
+			return nil, err
 		}
+		destMap[key] = pId
 	}
 	idKey := "id:" + idStr
-	shard.Items[idKey] = &offset
+	shard.Items[idKey] = offset
+	shard.keyChanged(idKey)
 	destMap[idKey] = pId
 	return destMap, nil
 }
 
+// points the id to a new tombstone of the version, the deleted element is left to Optimize
+func (m *ConcurrentMap) setTombstone(shard *ConcurrentMapShared, id string, version *ElementVersion) error {
+	data, err := json.Marshal(newTombstone(id, version))
+	if err != nil {
+		return err
+	}
+	shard.Lock()
+	defer shard.Unlock()
+	offset, err := shard.appendDataContext(context.Background(), data)
+	if err != nil {
+		return err
+	}
+	offset.Deleted, offset.Tombstone = true, true
+	idKey := "id:" + id
+	shard.Items[idKey] = offset
+	shard.keyChanged(idKey)
+	shard.markDirty()
+	return nil
+}
+
 // Retrieves an element from map under given key.
 func (m *ConcurrentMap) Get(key string) (*ShardOffset, bool) {
 	// Get shard
@@ -360,7 +400,7 @@ func (m *ConcurrentMap) Get(key string) (*ShardOffset, bool) {
 // Returns the number of elements within the map.
 func (m *ConcurrentMap) Count() int {
 	count := 0
-	for i := 0; i < SHARD_COUNT; i++ {
+	for i := 0; i < len(m.Shared); i++ {
 		shard := m.Shared[i]
 		shard.RLock()
 		count += len(shard.Items)
@@ -418,9 +458,9 @@ func (m *ConcurrentMap) IterBuffered() <-chan Tuple {
 // It returns once the size of each buffered channel is determined,
 // before all the channels are populated using goroutines.
 func snapshot(m *ConcurrentMap) (chans []chan Tuple) {
-	chans = make([]chan Tuple, SHARD_COUNT)
+	chans = make([]chan Tuple, len(m.Shared))
 	wg := sync.WaitGroup{}
-	wg.Add(SHARD_COUNT)
+	wg.Add(len(m.Shared))
 	// Foreach shard.
 	for index, shard := range m.Shared {
 		go func(index int, shard *ConcurrentMapShared) {
@@ -0,0 +1,223 @@
+package db
+
+import (
+	"context"
+	"errors"
+)
+
+type MergeReport struct {
+	Added     int // elements copied from the other database
+	Updated   int // elements replaced by a newer version of the other database or merged with a concurrent one
+	Deleted   int // elements deleted because the other database removed them
+	Conflicts int // elements skipped because a unique key is taken by a different element
+}
+
+type mergeEntry struct {
+	id      string
+	deleted bool
+	offset  *ShardOffset
+}
+
+// Merges the changes of another instance into the database.
+// Elements unknown to this database are copied unless the other side already deleted them.
+// When both databases have a ReplicaId the elements carry vector clocks: the version that has seen the other one
+// wins, an update wins over a concurrent delete and concurrent updates are merged field by field (see ElementVersion).
+// Deletes leave tombstones that Optimize keeps, so a merge does not bring a deleted element back.
+// Elements written without a ReplicaId are not versioned, a delete wins over an element both sides know
+// and the updates of an element are not exchanged.
+// Merging in both directions makes two instances converge.
+func (db *Database) MergeWith(other *Database) (*MergeReport, error) {
+	if other == nil || other == db {
+		return nil, errors.New("invalid database to merge with")
+	}
+	report := new(MergeReport)
+	other.collectionMutex.RLock()
+	collections := make([]*Collection, 0, len(other.collections))
+	for _, c := range other.collections {
+		collections = append(collections, c)
+	}
+	other.collectionMutex.RUnlock()
+
+	for _, oc := range collections {
+		c := db.GetCollection(oc.Name)
+		if c == nil {
+			var err error
+			c, err = db.AddCollection(oc.Name)
+			if err != nil {
+				return report, err
+			}
+		}
+		err := c.mergeWith(oc, report)
+		if err != nil {
+			return report, errors.New("failed to merge collection " + oc.Name + " due " + err.Error())
+		}
+	}
+	return report, nil
+}
+
+func (c *Collection) mergeWith(other *Collection, report *MergeReport) error {
+	// a live entry wins over a deleted one an older version left in another shard
+	for _, e := range other.idEntries(func(string) bool { return true }) {
+		if err := c.mergeEntry(other, e.shard, e.entry, report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applies an element of the other collection: a delete of a known element or a copy of an unknown one,
+// versioned elements are resolved by their clocks
+func (c *Collection) mergeEntry(other *Collection, shard *ConcurrentMapShared, entry mergeEntry, report *MergeReport) error {
+	shard.RLock()
+	offset := *entry.offset
+	data, err := shard.readAt(entry.offset)
+	shard.RUnlock()
+	if err != nil {
+		return err
+	}
+	version, err := decodeVersion(&offset, data)
+	if err != nil {
+		return err
+	}
+	var payload CustomStructure
+	if !offset.Deleted {
+		e, err := other.DecodeElement(data)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if payload, ok = e.Payload.(CustomStructure); !ok {
+			return errors.New("element " + entry.id + " is not a registered custom structure")
+		}
+	}
+
+	local, known := c.lookupId(entry.id)
+	if known && version != nil {
+		return c.mergeVersion(entry.id, version, payload, report)
+	}
+	if known {
+		if offset.Deleted && !local.Deleted {
+			err := c.DeleteById(entry.id)
+			if err != nil {
+				return err
+			}
+			report.Deleted++
+		}
+		return nil
+	}
+	if offset.Deleted {
+		return nil
+	}
+	return c.mergeAdd(entry.id, payload, version, report)
+}
+
+// copies the element keeping its version
+func (c *Collection) mergeAdd(id string, payload CustomStructure, version *ElementVersion, report *MergeReport) error {
+	if c.uniqueKeyTaken(payload) {
+		report.Conflicts++
+		return nil
+	}
+	err := c.writeVersion(context.Background(), id, payload, version)
+	if err != nil {
+		return err
+	}
+	report.Added++
+	return nil
+}
+
+// resolves the version of the other database against the local one, payload is nil for a tombstone
+func (c *Collection) mergeVersion(id string, version *ElementVersion, payload CustomStructure, report *MergeReport) error {
+	local, localPayload, err := c.storedVersion(id)
+	if err != nil {
+		return err
+	}
+	if local == nil {
+		// written before the database had a ReplicaId
+		local = &ElementVersion{}
+	}
+	switch local.Clock.compare(version.Clock) {
+	case clockEqual, clockAfter:
+		return nil
+	case clockBefore:
+		switch {
+		case payload == nil && localPayload == nil:
+			return nil
+		case payload == nil:
+			if err = c.deleteById(id, version); err != nil {
+				return err
+			}
+			report.Deleted++
+			return nil
+		case localPayload == nil:
+			return c.mergeAdd(id, payload, version, report)
+		}
+		if err = c.update(id, payload, version); err != nil {
+			return err
+		}
+		report.Updated++
+		return nil
+	}
+
+	// concurrent versions, an update wins over a delete
+	clock := local.Clock.merge(version.Clock)
+	switch {
+	case payload == nil && localPayload == nil:
+		return nil
+	case payload == nil:
+		kept, ok := localPayload.(CustomStructure)
+		if !ok {
+			return errors.New("element " + id + " is not a registered custom structure")
+		}
+		// the clock takes in the delete, so the other side takes the element back instead of merging again
+		return c.update(id, kept, &ElementVersion{clock, local.Fields, local.Values})
+	case localPayload == nil:
+		return c.mergeAdd(id, payload, &ElementVersion{clock, version.Fields, version.Values}, report)
+	}
+	merged, mergedVersion, err := mergeVersions(local, localPayload, version, payload)
+	if err != nil {
+		return errors.New("failed to merge the versions of " + id + " due " + err.Error())
+	}
+	mergedPayload, ok := merged.(CustomStructure)
+	if !ok {
+		return errors.New("element " + id + " is not a registered custom structure")
+	}
+	if err = c.update(id, mergedPayload, mergedVersion); err != nil {
+		return err
+	}
+	report.Updated++
+	return nil
+}
+
+// copy of the offset of the element with the given id
+func (c *Collection) lookupId(id string) (ShardOffset, bool) {
+	idKey := "id:" + id
+	shard, err := c.getShardByKeySafe(idKey)
+	if err != nil {
+		return ShardOffset{}, false
+	}
+	shard.RLock()
+	defer shard.RUnlock()
+	item, ok := shard.Items[idKey]
+	if !ok {
+		return ShardOffset{}, false
+	}
+	return *item, true
+}
+
+// unique keys are only enforced within a shard on write, the merge checks the whole collection
+func (c *Collection) uniqueKeyTaken(payload CustomStructure) bool {
+	indexes, err := c.writeIndex(payload)
+	if err != nil {
+		return false
+	}
+	for _, ix := range indexes {
+		if !ix.Unique {
+			continue
+		}
+		// the key of a deleted element is taken over
+		if c.hasKey(ix.Field + ":" + ix.Data) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// leaves of the Merkle tree of a collection, the ids are spread over them by their hash
+const MERKLE_LEAVES = 256
+
+// Merkle tree of a collection: every leaf hashes the ids falling into it with their deleted flags and the clocks
+// of their versions, the root hashes the leaves. Elements are placed on the shards round-robin, so the leaves are cut
+// by id, not by shard. Like MergeWith, the tree covers the contents of the versioned elements only, the ones written
+// without a ReplicaId are compared by their ids
+type MerkleTree struct {
+	Root   []byte   `json:"root"`
+	Leaves [][]byte `json:"leaves"`
+}
+
+// the tree of the last generation of the shards it was built at
+type merkleCache struct {
+	mx         sync.Mutex
+	generation uint64
+	tree       *MerkleTree
+}
+
+type RepairReport struct {
+	MergeReport
+	// leaves whose hashes differed, only their elements were exchanged
+	Leaves int
+}
+
+func merkleLeaf(id string) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % MERKLE_LEAVES)
+}
+
+// an element by its id, an update by an older version may have left a deleted entry in another shard
+type idEntry struct {
+	shard *ConcurrentMapShared
+	entry mergeEntry
+}
+
+// the current entry of every id the filter accepts, a live one wins over the deleted ones
+func (c *Collection) idEntries(accept func(id string) bool) map[string]idEntry {
+	entries := make(map[string]idEntry)
+	for _, shard := range c.Map.Shared {
+		shard.RLock()
+		for key, item := range shard.Items {
+			if !strings.HasPrefix(key, "id:") || !accept(key[3:]) {
+				continue
+			}
+			id := key[3:]
+			if known, ok := entries[id]; ok && !known.entry.deleted {
+				continue
+			}
+			entries[id] = idEntry{shard, mergeEntry{id, item.Deleted, item}}
+		}
+		shard.RUnlock()
+	}
+	return entries
+}
+
+// the clock of the version of the element, empty for an unversioned one. An update changes it, so the leaf
+// of an element differs until both replicas have the same version
+func (e idEntry) clock() string {
+	e.shard.RLock()
+	offset := *e.entry.offset
+	data, err := e.shard.readAt(e.entry.offset)
+	e.shard.RUnlock()
+	if err != nil {
+		// unknown, the leaf is exchanged
+		return "?"
+	}
+	version, err := decodeVersion(&offset, data)
+	if err != nil {
+		return "?"
+	}
+	if version == nil {
+		return ""
+	}
+	// the keys are sorted
+	encoded, err := json.Marshal(version.Clock)
+	if err != nil {
+		return "?"
+	}
+	return string(encoded)
+}
+
+// The Merkle tree of the collection, rebuilt by the first call after a change. Reads every element
+func (c *Collection) MerkleTree() *MerkleTree {
+	generation := c.Map.generation()
+	c.merkle.mx.Lock()
+	defer c.merkle.mx.Unlock()
+	if c.merkle.tree != nil && c.merkle.generation == generation {
+		return c.merkle.tree
+	}
+
+	leaves := make([][]string, MERKLE_LEAVES)
+	for id, e := range c.idEntries(func(string) bool { return true }) {
+		entry := id + "\x00"
+		if e.entry.deleted {
+			entry += "d"
+		}
+		entry += e.clock()
+		leaf := merkleLeaf(id)
+		leaves[leaf] = append(leaves[leaf], entry)
+	}
+	tree := &MerkleTree{Leaves: make([][]byte, MERKLE_LEAVES)}
+	root := sha256.New()
+	for i, entries := range leaves {
+		sort.Strings(entries)
+		h := sha256.New()
+		for _, entry := range entries {
+			h.Write([]byte(entry))
+			h.Write([]byte{'\n'})
+		}
+		tree.Leaves[i] = h.Sum(nil)
+		root.Write(tree.Leaves[i])
+	}
+	tree.Root = root.Sum(nil)
+	c.merkle.generation, c.merkle.tree = generation, tree
+	return tree
+}
+
+// leaves of the trees that differ
+func (t *MerkleTree) divergentLeaves(other *MerkleTree) map[int]bool {
+	divergent := make(map[int]bool)
+	if bytes.Equal(t.Root, other.Root) {
+		return divergent
+	}
+	for i := range t.Leaves {
+		if !bytes.Equal(t.Leaves[i], other.Leaves[i]) {
+			divergent[i] = true
+		}
+	}
+	return divergent
+}
+
+// Brings in the changes of another replica like MergeWith, but compares the Merkle trees of the collections
+// first and reads only the elements of the leaves that differ
+func (db *Database) RepairFrom(other *Database) (*RepairReport, error) {
+	if other == nil || other == db {
+		return nil, errors.New("invalid database to repair from")
+	}
+	report := new(RepairReport)
+	other.collectionMutex.RLock()
+	collections := make([]*Collection, 0, len(other.collections))
+	for _, c := range other.collections {
+		collections = append(collections, c)
+	}
+	other.collectionMutex.RUnlock()
+
+	for _, oc := range collections {
+		c := db.GetCollection(oc.Name)
+		if c == nil {
+			var err error
+			c, err = db.AddCollection(oc.Name)
+			if err != nil {
+				return report, err
+			}
+		}
+		if err := c.repairFrom(oc, report); err != nil {
+			return report, errors.New("failed to repair collection " + oc.Name + " due " + err.Error())
+		}
+	}
+	return report, nil
+}
+
+func (c *Collection) repairFrom(other *Collection, report *RepairReport) error {
+	divergent := c.MerkleTree().divergentLeaves(other.MerkleTree())
+	if len(divergent) == 0 {
+		return nil
+	}
+	report.Leaves += len(divergent)
+	entries := other.idEntries(func(id string) bool { return divergent[merkleLeaf(id)] })
+	for _, e := range entries {
+		if err := c.mergeEntry(other, e.shard, e.entry, &report.MergeReport); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Upper bounds (seconds) of the latency buckets, the last bucket is always +Inf
+var LATENCY_BUCKETS = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+type Histogram struct {
+	mx     sync.Mutex
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type Bucket struct {
+	UpperBound float64 `json:"le"`
+	Count      uint64  `json:"count"` // cumulative, like Prometheus buckets
+}
+
+type HistogramSnapshot struct {
+	Buckets []Bucket `json:"buckets"`
+	Sum     float64  `json:"sum"` // seconds of the latencies
+	Count   uint64   `json:"count"`
+}
+
+type CollectionMetrics struct {
+	Sync       HistogramSnapshot   `json:"sync"`
+	Optimize   HistogramSnapshot   `json:"optimize"`
+	ShardFlush []HistogramSnapshot `json:"shard_flush"` // by shard id
+	ShardIO    []IOStats           `json:"shard_io"`    // by shard id
+	QueryCache QueryCacheStats     `json:"query_cache"`
+	// reads of FindById and ScanN that waited for the same read of another caller
+	CoalescedReads uint64             `json:"coalesced_reads"`
+	NegativeCache  NegativeCacheStats `json:"negative_cache"`
+	// see SizeStats
+	ElementSize   HistogramSnapshot `json:"element_size"`
+	ShardElements []int             `json:"shard_elements"` // by shard id
+}
+
+type Metrics struct {
+	Sync        HistogramSnapshot             `json:"sync"`
+	Optimize    HistogramSnapshot             `json:"optimize"`
+	Collections map[string]*CollectionMetrics `json:"collections"`
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func newLatencyHistograms(n int) []*Histogram {
+	hs := make([]*Histogram, n)
+	for i := range hs {
+		hs[i] = NewHistogram(LATENCY_BUCKETS)
+	}
+	return hs
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	h.observe(d.Seconds())
+}
+
+func (h *Histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.mx.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+	h.mx.Unlock()
+}
+
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	s := HistogramSnapshot{make([]Bucket, len(h.counts)), h.sum, h.count}
+	cumulative := uint64(0)
+	for i, n := range h.counts {
+		cumulative += n
+		bound := math.Inf(1)
+		if i < len(h.bounds) {
+			bound = h.bounds[i]
+		}
+		s.Buckets[i] = Bucket{bound, cumulative}
+	}
+	return s
+}
+
+// sums snapshots of histograms with the same buckets
+func (s HistogramSnapshot) add(other HistogramSnapshot) HistogramSnapshot {
+	if len(s.Buckets) == 0 {
+		return other
+	} else if len(other.Buckets) == 0 {
+		return s
+	}
+	buckets := make([]Bucket, len(s.Buckets))
+	for i, b := range s.Buckets {
+		buckets[i] = Bucket{b.UpperBound, b.Count + other.Buckets[i].Count}
+	}
+	return HistogramSnapshot{buckets, s.Sum + other.Sum, s.Count + other.Count}
+}
+
+func (h *Histogram) Reset() {
+	h.mx.Lock()
+	for i := range h.counts {
+		h.counts[i] = 0
+	}
+	h.sum = 0
+	h.count = 0
+	h.mx.Unlock()
+}
+
+func (c *Collection) Metrics() *CollectionMetrics {
+	m := &CollectionMetrics{
+		Sync:           c.syncLatency.Snapshot(),
+		Optimize:       c.optimizeLatency.Snapshot(),
+		ShardFlush:     make([]HistogramSnapshot, len(c.Map.flushLatency)),
+		ShardIO:        c.Map.ShardIOStats(),
+		QueryCache:     c.getQueryCache().stats(),
+		CoalescedReads: c.reads.coalescedReads(),
+		NegativeCache:  c.getNegativeCache().stats(),
+	}
+	for i, h := range c.Map.flushLatency {
+		m.ShardFlush[i] = h.Snapshot()
+	}
+	sizes := c.SizeStats()
+	m.ElementSize, m.ShardElements = sizes.ElementSize, sizes.Shards
+	return m
+}
+
+func (c *Collection) ResetMetrics() {
+	c.syncLatency.Reset()
+	c.optimizeLatency.Reset()
+	for _, h := range c.Map.flushLatency {
+		h.Reset()
+	}
+	for _, shard := range c.Map.Shared {
+		shard.counters().reset()
+	}
+	c.getQueryCache().resetStats()
+	c.reads.resetStats()
+	c.getNegativeCache().resetStats()
+}
+
+// latency histograms of the durability path (sync, shard flushes and optimization), the file IO of the shards and the element sizes
+func (db *Database) Metrics() *Metrics {
+	m := &Metrics{
+		Sync:        db.syncLatency.Snapshot(),
+		Optimize:    db.optimizeLatency.Snapshot(),
+		Collections: make(map[string]*CollectionMetrics),
+	}
+	db.collectionMutex.RLock()
+	for name, c := range db.collections {
+		m.Collections[name] = c.Metrics()
+	}
+	db.collectionMutex.RUnlock()
+	return m
+}
+
+func (db *Database) ResetMetrics() {
+	db.syncLatency.Reset()
+	db.optimizeLatency.Reset()
+	db.collectionMutex.RLock()
+	for _, c := range db.collections {
+		c.ResetMetrics()
+	}
+	db.collectionMutex.RUnlock()
+}
+
+func writeHistogram(w io.Writer, name, labels string, s HistogramSnapshot) error {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for _, b := range s.Buckets {
+		le := "+Inf"
+		if !math.IsInf(b.UpperBound, 1) {
+			le = strconv.FormatFloat(b.UpperBound, 'g', -1, 64)
+		}
+		_, err := fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, le, b.Count)
+		if err != nil {
+			return err
+		}
+	}
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	_, err := fmt.Fprintf(w, "%s_sum%s %g\n%s_count%s %d\n", name, labels, s.Sum, name, labels, s.Count)
+	return err
+}
+
+// writes the metrics in the Prometheus text exposition format
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	err := writeHistogram(w, "shardb_sync_duration_seconds", "", m.Sync)
+	if err != nil {
+		return err
+	}
+	err = writeHistogram(w, "shardb_optimize_duration_seconds", "", m.Optimize)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(m.Collections))
+	for name := range m.Collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cm := m.Collections[name]
+		labels := "collection=\"" + name + "\""
+		err = writeHistogram(w, "shardb_collection_sync_duration_seconds", labels, cm.Sync)
+		if err != nil {
+			return err
+		}
+		err = writeHistogram(w, "shardb_collection_optimize_duration_seconds", labels, cm.Optimize)
+		if err != nil {
+			return err
+		}
+		err = writeHistogram(w, "shardb_collection_element_size_bytes", labels, cm.ElementSize)
+		if err != nil {
+			return err
+		}
+		for id, n := range cm.ShardElements {
+			_, err = fmt.Fprintf(w, "shardb_shard_elements{%s,shard=\"%d\"} %d\n", labels, id, n)
+			if err != nil {
+				return err
+			}
+		}
+		for id, s := range cm.ShardFlush {
+			err = writeHistogram(w, "shardb_shard_flush_duration_seconds", labels+",shard=\""+strconv.Itoa(id)+"\"", s)
+			if err != nil {
+				return err
+			}
+		}
+		for id, s := range cm.ShardIO {
+			err = writeIOStats(w, labels+",shard=\""+strconv.Itoa(id)+"\"", s)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeIOStats(w io.Writer, labels string, s IOStats) error {
+	_, err := fmt.Fprintf(w, "shardb_shard_read_bytes_total{%s} %d\nshardb_shard_written_bytes_total{%s} %d\n"+
+		"shardb_shard_reads_total{%s} %d\nshardb_shard_writes_total{%s} %d\nshardb_shard_syncs_total{%s} %d\n",
+		labels, s.BytesRead, labels, s.BytesWritten, labels, s.Reads, labels, s.Writes, labels, s.Syncs)
+	if err != nil {
+		return err
+	}
+	err = writeHistogram(w, "shardb_shard_read_duration_seconds", labels, s.ReadLatency)
+	if err != nil {
+		return err
+	}
+	err = writeHistogram(w, "shardb_shard_write_duration_seconds", labels, s.WriteLatency)
+	if err != nil {
+		return err
+	}
+	return writeHistogram(w, "shardb_shard_sync_duration_seconds", labels, s.SyncLatency)
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package db
+
+import "io/ioutil"
+
+// the file is read into memory where mapping is not supported
+func mapFile(path string) (data []byte, release func() error, err error) {
+	data, err = ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return nil }, nil
+}
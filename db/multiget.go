@@ -0,0 +1,102 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Elements read by MultiGet
+type MultiGetResult struct {
+	// decoded elements by collection and id, the missing ids are left out
+	Elements map[string]map[string]*Element `json:"elements"`
+	// ids without an element by collection, in the order they were asked for
+	Missing map[string][]string `json:"missing,omitempty"`
+}
+
+// the element of the id in the collection, nil when it is missing
+func (r *MultiGetResult) Get(collection, id string) *Element {
+	return r.Elements[collection][id]
+}
+
+// Reads the elements of the ids by collection name with one goroutine per collection, e.g. for a request
+// handler assembling a response from many collections. Missing ids are listed in the result instead of failing
+// the call, unknown collections and failed reads fail it
+func (db *Database) MultiGet(keys map[string][]string) (*MultiGetResult, error) {
+	return db.MultiGetContext(context.Background(), keys)
+}
+
+// Same as MultiGet, gives up once the context ends. The context is checked between the reads of the ids
+func (db *Database) MultiGetContext(ctx context.Context, keys map[string][]string) (*MultiGetResult, error) {
+	result := &MultiGetResult{Elements: make(map[string]map[string]*Element, len(keys)), Missing: make(map[string][]string)}
+	collections := make(map[string]*Collection, len(keys))
+	for name := range keys {
+		c := db.GetCollection(name)
+		if c == nil {
+			return nil, errors.New("collection " + name + " does not exist")
+		}
+		collections[name] = c
+		result.Elements[name] = make(map[string]*Element, len(keys[name]))
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var mx sync.Mutex
+	var getErr error
+	var wg sync.WaitGroup
+	wg.Add(len(collections))
+	for name, c := range collections {
+		go func(c *Collection, ids []string, elements map[string]*Element) {
+			defer wg.Done()
+			missing, err := c.multiGet(runCtx, ids, elements)
+			mx.Lock()
+			defer mx.Unlock()
+			if err != nil {
+				if getErr == nil && runCtx.Err() == nil {
+					getErr = err
+				}
+				// the other collections are not needed anymore
+				cancel()
+				return
+			}
+			if len(missing) > 0 {
+				result.Missing[c.Name] = missing
+			}
+		}(c, keys[name], result.Elements[name])
+	}
+	wg.Wait()
+	if getErr != nil {
+		return nil, getErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// decodes the elements of the ids into elements, returns the missing ids
+func (c *Collection) multiGet(ctx context.Context, ids []string, elements map[string]*Element) ([]string, error) {
+	var missing []string
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if _, ok := elements[id]; ok {
+			continue
+		}
+		data, err := c.FindById(id, true)
+		if err == errNotFound {
+			missing = append(missing, id)
+			continue
+		}
+		if err != nil {
+			return nil, errors.New("failed to read " + id + " of collection " + c.Name + " due " + err.Error())
+		}
+		e, err := c.DecodeElement(data)
+		if err != nil {
+			return nil, errors.New("failed to decode " + id + " of collection " + c.Name + " due " + err.Error())
+		}
+		elements[id] = e
+	}
+	return missing, nil
+}
@@ -0,0 +1,161 @@
+package db
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// absent keys remembered at most, the expired ones are dropped when it is reached and all of them if none expired
+const NEGATIVE_CACHE_MAX_ENTRIES = 100000
+
+type NegativeCacheStats struct {
+	Hits    uint64 `json:"hits"`
+	Entries int    `json:"entries"`
+}
+
+// keys found absent by FindById and ScanN with their expiry, forgotten when an element with the key is written
+type negativeCache struct {
+	mx      sync.Mutex
+	ttl     time.Duration
+	clock   Clock
+	entries map[string]time.Time
+	// changed by every write, a lookup started before a write does not remember its result
+	epoch uint64
+	hits  uint64
+}
+
+// Remembers ids and index keys that FindById and ScanN did not find for ttl, 0 disables it.
+// Writing an element forgets its id and its index keys, so it is found right away; restores and new
+// indexes forget every key. Replacing the cache drops the remembered keys
+func (c *Collection) SetNegativeCache(ttl time.Duration) {
+	var nc *negativeCache
+	if ttl > 0 {
+		nc = &negativeCache{ttl: ttl, clock: c.options.clock(), entries: make(map[string]time.Time)}
+	}
+	c.sharedDestMx.Lock()
+	c.negativeCache = nc
+	c.sharedDestMx.Unlock()
+}
+
+func (c *Collection) getNegativeCache() *negativeCache {
+	c.sharedDestMx.RLock()
+	defer c.sharedDestMx.RUnlock()
+	return c.negativeCache
+}
+
+// the key is known to be absent
+func (nc *negativeCache) absent(key string) bool {
+	if nc == nil {
+		return false
+	}
+	nc.mx.Lock()
+	defer nc.mx.Unlock()
+	expiry, ok := nc.entries[key]
+	if !ok {
+		return false
+	}
+	if nc.clock.Now().After(expiry) {
+		delete(nc.entries, key)
+		return false
+	}
+	nc.hits++
+	return true
+}
+
+// read before the lookup and passed to remember
+func (nc *negativeCache) currentEpoch() uint64 {
+	if nc == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&nc.epoch)
+}
+
+func (nc *negativeCache) remember(key string, epoch uint64) {
+	if nc == nil {
+		return
+	}
+	nc.mx.Lock()
+	defer nc.mx.Unlock()
+	if atomic.LoadUint64(&nc.epoch) != epoch {
+		return
+	}
+	now := nc.clock.Now()
+	if len(nc.entries) >= NEGATIVE_CACHE_MAX_ENTRIES {
+		for k, expiry := range nc.entries {
+			if now.After(expiry) {
+				delete(nc.entries, k)
+			}
+		}
+		if len(nc.entries) >= NEGATIVE_CACHE_MAX_ENTRIES {
+			nc.entries = make(map[string]time.Time)
+		}
+	}
+	nc.entries[key] = now.Add(nc.ttl)
+}
+
+func (nc *negativeCache) forget(keys []string) {
+	if nc == nil {
+		return
+	}
+	nc.mx.Lock()
+	defer nc.mx.Unlock()
+	atomic.AddUint64(&nc.epoch, 1)
+	for _, key := range keys {
+		delete(nc.entries, key)
+	}
+}
+
+func (nc *negativeCache) clear() {
+	if nc == nil {
+		return
+	}
+	nc.mx.Lock()
+	defer nc.mx.Unlock()
+	atomic.AddUint64(&nc.epoch, 1)
+	nc.entries = make(map[string]time.Time)
+}
+
+func (nc *negativeCache) stats() NegativeCacheStats {
+	if nc == nil {
+		return NegativeCacheStats{}
+	}
+	nc.mx.Lock()
+	defer nc.mx.Unlock()
+	return NegativeCacheStats{nc.hits, len(nc.entries)}
+}
+
+func (nc *negativeCache) resetStats() {
+	if nc == nil {
+		return
+	}
+	nc.mx.Lock()
+	nc.hits = 0
+	nc.mx.Unlock()
+}
+
+// the written element is no longer absent under its id and index keys
+func (c *Collection) forgetAbsent(id string, indexes []*FullDataIndex) {
+	nc := c.getNegativeCache()
+	if nc == nil {
+		return
+	}
+	keys := make([]string, 0, len(indexes)+1)
+	keys = append(keys, "id:"+id)
+	for _, ix := range indexes {
+		keys = append(keys, ix.Field+":"+ix.Data)
+	}
+	nc.forget(keys)
+}
+
+// the element or index entry under the key is written and not deleted
+func (c *Collection) hasKey(key string) bool {
+	shard, err := c.getShardByKeySafe(key)
+	if err != nil {
+		return false
+	}
+	shard.RLock()
+	defer shard.RUnlock()
+	item, ok := shard.Items[key]
+	return ok && !item.Deleted
+}
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"strings"
+	"time"
+)
+
+type ShardOptimization struct {
+	Shard     int           `json:"shard"`
+	Reclaimed int64         `json:"reclaimed"` // bytes
+	Rewritten int           `json:"rewritten"` // elements copied into the merged segment
+	Duration  time.Duration `json:"duration"`
+}
+
+type OptimizeReport struct {
+	Reclaimed int64               `json:"reclaimed"`
+	Rewritten int                 `json:"rewritten"`
+	Duration  time.Duration       `json:"duration"`
+	Shards    []ShardOptimization `json:"shards"`
+}
+
+type DatabaseOptimizeReport struct {
+	Reclaimed   int64                      `json:"reclaimed"`
+	Rewritten   int                        `json:"rewritten"`
+	Duration    time.Duration              `json:"duration"`
+	Collections map[string]*OptimizeReport `json:"collections"`
+}
+
+func (r *OptimizeReport) add(s ShardOptimization) {
+	r.Shards = append(r.Shards, s)
+	r.Reclaimed += s.Reclaimed
+	r.Rewritten += s.Rewritten
+}
+
+type ShardGarbage struct {
+	Shard       int   `json:"shard"`
+	Segments    int   `json:"segments"`
+	Live        int   `json:"live"` // elements
+	LiveBytes   int64 `json:"live_bytes"`
+	Deleted     int   `json:"deleted"` // elements
+	Reclaimable int64 `json:"reclaimable"`
+}
+
+type GarbageStats struct {
+	Live        int            `json:"live"`
+	LiveBytes   int64          `json:"live_bytes"`
+	Deleted     int            `json:"deleted"`
+	Reclaimable int64          `json:"reclaimable"` // bytes Optimize would remove
+	Shards      []ShardGarbage `json:"shards"`
+}
+
+// estimates the space Optimize would reclaim from the shard, nothing is read from the drive
+func (shard *ConcurrentMapShared) garbage() ShardGarbage {
+	shard.RLock()
+	defer shard.RUnlock()
+	g := ShardGarbage{Shard: shard.Id, Segments: len(shard.Segments)}
+	for key, item := range shard.Items {
+		// every element has exactly one id key
+		if !strings.HasPrefix(key, "id:") || item.Tombstone {
+			continue
+		}
+		if item.Deleted {
+			g.Deleted++
+			g.Reclaimable += int64(item.Length)
+		} else {
+			g.Live++
+			g.LiveBytes += int64(item.Length)
+		}
+	}
+	return g
+}
+
+// estimates the reclaimable space of every shard without running Optimize
+func (c *Collection) GarbageStats() *GarbageStats {
+	stats := &GarbageStats{Shards: make([]ShardGarbage, 0, len(c.Map.Shared))}
+	for _, shard := range c.Map.Shared {
+		g := shard.garbage()
+		stats.Shards = append(stats.Shards, g)
+		stats.Live += g.Live
+		stats.LiveBytes += g.LiveBytes
+		stats.Deleted += g.Deleted
+		stats.Reclaimable += g.Reclaimable
+	}
+	return stats
+}
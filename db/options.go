@@ -0,0 +1,209 @@
+package db
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+type FileOwner struct {
+	Uid int
+	Gid int
+}
+
+type DatabaseOptions struct {
+	// directory of the database, used when ScanAndLoadData gets an empty path
+	Dir string
+	// number of shards of the collections of the database, 0 keeps SHARD_COUNT
+	ShardCount int
+	// gzip level of the meta and description files
+	CompressionLevel int
+	SyncPolicy       SyncPolicy
+	// applied to shard segments, meta files, descriptions, headers and manifests
+	FileMode os.FileMode
+	// applied to the collection directories
+	DirMode os.FileMode
+	// nil keeps the owner of the process
+	Owner *FileOwner
+	// applied to the reads and writes of the shard segments and to the loading of the meta files,
+	// so a short hiccup of a network filesystem is not reported as a corruption
+	IORetry RetryPolicy
+	// tunables, later changed with ApplyConfig
+	Config Config
+	// File system the database is loaded from, nil reads the drive. Dir and the path of ScanAndLoadData are
+	// paths within it, e.g. a zip (archive/zip), an in-memory file system of a test or a caching wrapper of a
+	// network file system. A database loaded from it is read-only
+	FS fs.FS
+	// decides the failures of the file operations, for tests of crash recovery. Nil injects none
+	Faults FaultInjector
+	// time of the background features, nil is SystemClock. See VirtualClock
+	Clock Clock
+	// free bytes of the filesystem of the directory, nil asks the drive. For tests of the disk watchdog
+	DiskFree func(dir string) (int64, error)
+	// id of the instance among the replicas merged by MergeWith, e.g. the id of the device. When it is set the writes
+	// stamp the elements with a version, so MergeWith resolves concurrent updates field by field, see ElementVersion
+	ReplicaId string
+}
+
+func DefaultDatabaseOptions() DatabaseOptions {
+	return DatabaseOptions{CompressionLevel: gzip.BestCompression, FileMode: 0600, DirMode: 0700, Config: DefaultConfig()}
+}
+
+func (o *DatabaseOptions) shardCount() int {
+	if o != nil && o.ShardCount > 0 {
+		return o.ShardCount
+	}
+	return SHARD_COUNT
+}
+
+// empty unless the elements are versioned
+func (o *DatabaseOptions) replicaId() string {
+	if o == nil {
+		return ""
+	}
+	return o.ReplicaId
+}
+
+// nil options fall back to the defaults
+func (o *DatabaseOptions) orDefault() *DatabaseOptions {
+	if o == nil {
+		d := DefaultDatabaseOptions()
+		return &d
+	}
+	return o
+}
+
+// the mode is set explicitly, so the umask of the process does not change it
+func (o *DatabaseOptions) apply(path string, mode os.FileMode) error {
+	err := os.Chmod(path, mode)
+	if err == nil && o.Owner != nil {
+		err = os.Chown(path, o.Owner.Uid, o.Owner.Gid)
+	}
+	return err
+}
+
+func (o *DatabaseOptions) openFile(path string, flag int) (*os.File, error) {
+	o = o.orDefault()
+	f, err := os.OpenFile(path, flag, o.FileMode)
+	if err != nil || flag&os.O_CREATE == 0 {
+		return f, err
+	}
+	err = o.apply(path, o.FileMode)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (o *DatabaseOptions) create(path string) (*os.File, error) {
+	return o.openFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+}
+
+func (o *DatabaseOptions) writeFile(path string, data []byte) error {
+	return o.writeFileContext(context.Background(), path, data)
+}
+
+// the file is replaced like by writeAtomically, a crash never leaves it torn
+func (o *DatabaseOptions) writeFileContext(ctx context.Context, path string, data []byte) error {
+	return o.writeAtomicallyContext(ctx, path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+func (o *DatabaseOptions) retryIO(fn func() error) error {
+	if o == nil {
+		return fn()
+	}
+	return o.IORetry.Do(fn)
+}
+
+func (o *DatabaseOptions) verify(mf *ManifestFile, fsys fs.FS, checksum bool) error {
+	return o.retryIO(func() error { return mf.verify(fsys, checksum) })
+}
+
+func (o *DatabaseOptions) mkdirAll(path string) error {
+	o = o.orDefault()
+	err := os.MkdirAll(path, o.DirMode)
+	if err != nil {
+		return err
+	}
+	return o.apply(path, o.DirMode)
+}
+
+// Writes the file to a temporary file next to it and renames it over the old one only after it reached the drive,
+// so a crash leaves either the old or the new file, never a truncated one
+func (o *DatabaseOptions) writeAtomically(path string, write func(w io.Writer) error) error {
+	return o.writeAtomicallyContext(context.Background(), path, write)
+}
+
+// same as writeAtomically, gives up once the context ends. A write abandoned in the background
+// only reaches the temporary file, which is removed
+func (o *DatabaseOptions) writeAtomicallyContext(ctx context.Context, path string, write func(w io.Writer) error) error {
+	tmp := path + ".tmp"
+	f, err := o.create(tmp)
+	if err != nil {
+		return err
+	}
+	err = write(&contextWriter{ctx, faultyWriter{o, tmp, f}})
+	if err == nil {
+		_, err = chunkContext(ctx, func() (int, error) {
+			if fault := o.fault(FAULT_SYNC, tmp, 0); fault.Err != nil {
+				return 0, fault.Err
+			}
+			return 0, f.Sync()
+		})
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = o.fault(FAULT_RENAME, path, 0).Err
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// Appends the data to the existing file and syncs it. A failed append may leave a part of the data behind
+func (o *DatabaseOptions) appendContext(ctx context.Context, path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	_, err = (&contextWriter{ctx, faultyWriter{o, path, f}}).Write(data)
+	if err == nil {
+		_, err = chunkContext(ctx, func() (int, error) {
+			if fault := o.fault(FAULT_SYNC, path, 0); fault.Err != nil {
+				return 0, fault.Err
+			}
+			return 0, f.Sync()
+		})
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// makes the rename durable, not supported everywhere so the error is ignored
+func syncDir(path string) {
+	d, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,497 @@
+package db
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// bytes of sort keys kept in memory by an ordered query when Config.SortMemory is 0
+const DEFAULT_SORT_MEMORY = 64 << 20
+
+// sorted runs merged at once, more of them are merged in several passes
+const SORT_MERGE_WAY = 64
+
+// prefix of the temporary directories of ordered queries in the data directory
+const SORT_DIR_PREFIX = ".sort-"
+
+// rough memory of a sort entry besides its strings
+const sortEntryOverhead = 64
+
+// tags of the sort values, values of different kinds are ordered by them
+const (
+	sortMissing = iota
+	sortBool
+	sortNumber
+	sortTime
+	sortString
+)
+
+type ordering struct {
+	path       string
+	descending bool
+}
+
+// Orders the results by the value under the path, later calls order the elements with equal values.
+// Missing and nil values come first, last when descending; a path with several values is ordered by the first one.
+// Strings are compared with the collation of the index of the path, numbers and times by their value.
+// Only the sort keys and the ids of the matching elements are kept in memory, up to Config.SortMemory bytes;
+// larger result sets are sorted in runs spilled to temporary files under the data directory and merged.
+// The elements are read again in the sorted order, the ones deleted or changed to not match meanwhile are left out
+func (q *Query) OrderBy(path string, descending bool) *Query {
+	q.order = append(q.order, ordering{path, descending})
+	return q
+}
+
+type sortEntry struct {
+	keys []string
+	id   string
+}
+
+func (e sortEntry) size() int64 {
+	size := int64(sortEntryOverhead + len(e.id))
+	for _, k := range e.keys {
+		size += int64(len(k))
+	}
+	return size
+}
+
+// the value of the path in a form compared byte by byte, prefixed with the kind of the value
+func (q *Query) sortKey(e *Element, o ordering) (string, error) {
+	values, err := q.c.resolve(e.Payload, e.Computed, o.path)
+	if err != nil {
+		return "", err
+	}
+	values = nonNil(values)
+	if len(values) == 0 {
+		return string(rune(sortMissing)), nil
+	}
+	v := values[0]
+	switch {
+	case v.Kind() == reflect.String:
+		s := v.String()
+		if ix, ok := q.c.declaredIndex(o.path); ok && ix.Collation != nil {
+			s = ix.Collation.Key(s)
+		}
+		return string(rune(sortString)) + s, nil
+	case isNumber(v.Kind()):
+		return string(rune(sortNumber)) + EncodeFloat(toFloat(v)), nil
+	case v.Kind() == reflect.Bool:
+		return string(rune(sortBool)) + EncodeBool(v.Bool()), nil
+	case v.Type() == timeType && v.CanInterface():
+		return string(rune(sortTime)) + EncodeTime(v.Interface().(time.Time)), nil
+	}
+	return "", errors.New("value of type " + v.Type().String() + " under " + o.path + " can not be ordered")
+}
+
+// orders the entries by their keys, then by their ids
+type entrySorter struct {
+	order      []ordering
+	collations []*Collation
+}
+
+func (q *Query) entrySorter() *entrySorter {
+	s := &entrySorter{order: q.order, collations: make([]*Collation, len(q.order))}
+	for i, o := range q.order {
+		if ix, ok := q.c.declaredIndex(o.path); ok && ix.Collation != nil && ix.Collation.Locale != "" {
+			s.collations[i] = ix.Collation
+		}
+	}
+	return s
+}
+
+func (s *entrySorter) compare(a, b sortEntry) int {
+	for i, o := range s.order {
+		x, y := a.keys[i], b.keys[i]
+		var n int
+		if cl := s.collations[i]; cl != nil && x[0] == sortString && y[0] == sortString {
+			n = cl.Compare(x[1:], y[1:])
+		} else {
+			n = strings.Compare(x, y)
+		}
+		if o.descending {
+			n = -n
+		}
+		if n != 0 {
+			return n
+		}
+	}
+	return strings.Compare(a.id, b.id)
+}
+
+func (s *entrySorter) sort(entries []sortEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return s.compare(entries[i], entries[j]) < 0
+	})
+}
+
+func (o *DatabaseOptions) sortMemory() int64 {
+	if o != nil {
+		if memory := atomic.LoadInt64(&o.Config.SortMemory); memory > 0 {
+			return memory
+		}
+	}
+	return DEFAULT_SORT_MEMORY
+}
+
+// the matching elements in the order of OrderBy, see Stream
+func (q *Query) streamOrdered(ctx context.Context, fn func(e *Element) error) error {
+	for _, o := range q.order {
+		if _, err := parsePath(o.path); err != nil {
+			return err
+		}
+	}
+	unordered := *q
+	// the guards apply to the ordered query, see Stream
+	unordered.order, unordered.limit, unordered.unguarded = nil, 0, true
+	sorter := q.entrySorter()
+	memory := q.c.options.sortMemory()
+
+	var spill *sortSpill
+	defer func() {
+		if spill != nil {
+			spill.remove()
+		}
+	}()
+	entries := make([]sortEntry, 0)
+	used := int64(0)
+	err := unordered.Stream(ctx, func(e *Element) error {
+		entry := sortEntry{keys: make([]string, len(q.order)), id: e.Id}
+		for i, o := range q.order {
+			key, err := q.sortKey(e, o)
+			if err != nil {
+				return err
+			}
+			entry.keys[i] = key
+		}
+		entries = append(entries, entry)
+		used += entry.size()
+		if used < memory {
+			return nil
+		}
+		if spill == nil {
+			if err := q.checkSpill(); err != nil {
+				return err
+			}
+			var err error
+			if spill, err = newSortSpill(q.c.dataDir(), len(q.order)); err != nil {
+				return err
+			}
+		}
+		sorter.sort(entries)
+		if err := spill.writeRun(entries); err != nil {
+			return err
+		}
+		entries, used = entries[:0], 0
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	found := 0
+	visit := func(entry sortEntry) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		e, err := q.reread(ctx, entry.id)
+		if err != nil || e == nil {
+			return err
+		}
+		if err = fn(e); err != nil {
+			return err
+		}
+		found++
+		if q.limit > 0 && found >= q.limit {
+			return StopIteration
+		}
+		return nil
+	}
+	sorter.sort(entries)
+	if spill == nil {
+		for _, entry := range entries {
+			if err = visit(entry); err != nil {
+				break
+			}
+		}
+	} else if err = spill.writeRun(entries); err == nil {
+		err = spill.merge(sorter, visit)
+	}
+	if err == StopIteration {
+		return nil
+	}
+	return err
+}
+
+// the sort keys are written in plain text, values of encrypted fields are not
+func (q *Query) checkSpill() error {
+	for _, o := range q.order {
+		if q.c.isEncrypted(o.path) {
+			return errors.New("results ordered by the encrypted field " + o.path + " do not fit into the sort memory")
+		}
+	}
+	return nil
+}
+
+// the element as it is now, nil if it was deleted or does not match anymore
+func (q *Query) reread(ctx context.Context, id string) (*Element, error) {
+	idKey := "id:" + id
+	shard, err := q.c.getShardByKeySafe(idKey)
+	if err != nil {
+		return nil, nil
+	}
+	shard.RLock()
+	item, ok := shard.Items[idKey]
+	if !ok || item.Deleted {
+		shard.RUnlock()
+		return nil, nil
+	}
+	data, err := shard.readAtContext(ctx, item)
+	shard.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	e, err := q.c.DecodeElement(data)
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := q.matches(e); err != nil || !ok {
+		return nil, err
+	}
+	return e, nil
+}
+
+// sorted runs of sort entries in a temporary directory, removed when the query ends
+type sortSpill struct {
+	dir  string
+	keys int
+	runs []string
+	// number of the last created run
+	next int
+}
+
+// the directory the database was loaded from, the sort directories are created in it
+func (c *Collection) dataDir() string {
+	if c.database == nil || c.database.dir == "" {
+		return "."
+	}
+	return c.database.dir
+}
+
+func newSortSpill(parent string, keys int) (*sortSpill, error) {
+	dir, err := ioutil.TempDir(parent, SORT_DIR_PREFIX)
+	if err != nil {
+		return nil, errors.New("failed to create the sort directory due " + err.Error())
+	}
+	return &sortSpill{dir: dir, keys: keys}, nil
+}
+
+func (s *sortSpill) remove() {
+	os.RemoveAll(s.dir)
+}
+
+func (s *sortSpill) create() (*os.File, error) {
+	s.next++
+	return os.Create(filepath.Join(s.dir, "run_"+strconv.Itoa(s.next)))
+}
+
+// every entry is its keys followed by its id, each one prefixed with its length
+func (s *sortSpill) writeRun(entries []sortEntry) error {
+	f, err := s.create()
+	if err != nil {
+		return err
+	}
+	w := newRunWriter(f)
+	for _, entry := range entries {
+		if err = w.write(entry); err != nil {
+			break
+		}
+	}
+	if err = w.close(err); err != nil {
+		return errors.New("failed to write a sorted run due " + err.Error())
+	}
+	s.runs = append(s.runs, f.Name())
+	return nil
+}
+
+// merges the runs in passes of SORT_MERGE_WAY until the last pass visits the entries
+func (s *sortSpill) merge(sorter *entrySorter, visit func(entry sortEntry) error) error {
+	for len(s.runs) > SORT_MERGE_WAY {
+		merged := make([]string, 0, len(s.runs)/SORT_MERGE_WAY+1)
+		for start := 0; start < len(s.runs); start += SORT_MERGE_WAY {
+			end := start + SORT_MERGE_WAY
+			if end > len(s.runs) {
+				end = len(s.runs)
+			}
+			f, err := s.create()
+			if err != nil {
+				return err
+			}
+			w := newRunWriter(f)
+			err = w.close(s.mergeRuns(s.runs[start:end], sorter, w.write))
+			if err != nil {
+				return errors.New("failed to merge sorted runs due " + err.Error())
+			}
+			merged = append(merged, f.Name())
+		}
+		for _, run := range s.runs {
+			os.Remove(run)
+		}
+		s.runs = merged
+	}
+	return s.mergeRuns(s.runs, sorter, visit)
+}
+
+func (s *sortSpill) mergeRuns(runs []string, sorter *entrySorter, visit func(entry sortEntry) error) error {
+	h := &runHeap{sorter: sorter}
+	defer func() {
+		for _, r := range h.readers {
+			r.f.Close()
+		}
+	}()
+	for _, run := range runs {
+		f, err := os.Open(run)
+		if err != nil {
+			return err
+		}
+		r := &runReader{f: f, r: bufio.NewReader(f), keys: s.keys}
+		ok, err := r.next()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if !ok {
+			f.Close()
+			continue
+		}
+		h.readers = append(h.readers, r)
+	}
+	heap.Init(h)
+	for h.Len() > 0 {
+		r := h.readers[0]
+		if err := visit(r.entry); err != nil {
+			return err
+		}
+		ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(h, 0)
+		} else {
+			r.f.Close()
+			heap.Pop(h)
+		}
+	}
+	return nil
+}
+
+type runWriter struct {
+	f   *os.File
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+}
+
+func newRunWriter(f *os.File) *runWriter {
+	return &runWriter{f: f, w: bufio.NewWriter(f)}
+}
+
+func (w *runWriter) writeString(s string) error {
+	n := binary.PutUvarint(w.buf[:], uint64(len(s)))
+	if _, err := w.w.Write(w.buf[:n]); err != nil {
+		return err
+	}
+	_, err := w.w.WriteString(s)
+	return err
+}
+
+func (w *runWriter) write(entry sortEntry) error {
+	for _, k := range entry.keys {
+		if err := w.writeString(k); err != nil {
+			return err
+		}
+	}
+	return w.writeString(entry.id)
+}
+
+// flushes and closes the run, err is the result of the writes
+func (w *runWriter) close(err error) error {
+	if err == nil {
+		err = w.w.Flush()
+	}
+	if closeErr := w.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type runReader struct {
+	f     *os.File
+	r     *bufio.Reader
+	keys  int
+	entry sortEntry
+}
+
+func (r *runReader) readString() (string, error) {
+	n, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err = io.ReadFull(r.r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// false at the end of the run
+func (r *runReader) next() (bool, error) {
+	entry := sortEntry{keys: make([]string, r.keys)}
+	for i := range entry.keys {
+		k, err := r.readString()
+		if err == io.EOF && i == 0 {
+			return false, nil
+		}
+		if err != nil {
+			return false, errors.New("sorted run " + r.f.Name() + " is corrupted due " + err.Error())
+		}
+		entry.keys[i] = k
+	}
+	id, err := r.readString()
+	if err != nil {
+		return false, errors.New("sorted run " + r.f.Name() + " is corrupted due " + err.Error())
+	}
+	entry.id = id
+	r.entry = entry
+	return true, nil
+}
+
+// the runs by their current entries
+type runHeap struct {
+	sorter  *entrySorter
+	readers []*runReader
+}
+
+func (h *runHeap) Len() int { return len(h.readers) }
+func (h *runHeap) Less(i, j int) bool {
+	return h.sorter.compare(h.readers[i].entry, h.readers[j].entry) < 0
+}
+func (h *runHeap) Swap(i, j int)      { h.readers[i], h.readers[j] = h.readers[j], h.readers[i] }
+func (h *runHeap) Push(x interface{}) { h.readers = append(h.readers, x.(*runReader)) }
+func (h *runHeap) Pop() interface{} {
+	last := h.readers[len(h.readers)-1]
+	h.readers = h.readers[:len(h.readers)-1]
+	return last
+}
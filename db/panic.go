@@ -0,0 +1,24 @@
+package db
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// A panic recovered in a goroutine of the database, returned instead of taking the process down
+type PanicError struct {
+	Op    string
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return e.Op + " panicked: " + fmt.Sprint(e.Value)
+}
+
+// deferred by the goroutines of the database, turns a panic into a PanicError stored in err
+func recoverPanic(op string, err *error) {
+	if r := recover(); r != nil {
+		*err = &PanicError{op, r, debug.Stack()}
+	}
+}
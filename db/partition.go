@@ -0,0 +1,300 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PARTITION_NONE = iota
+	PARTITION_HOUR
+	PARTITION_DAY
+	PARTITION_MONTH
+)
+
+// layouts of the time part of the partition names, by period
+var PARTITION_LAYOUTS = map[int]string{PARTITION_HOUR: "2006_01_02_15", PARTITION_DAY: "2006_01_02", PARTITION_MONTH: "2006_01"}
+
+type PartitionOptions struct {
+	// PARTITION_HOUR, PARTITION_DAY or PARTITION_MONTH (in UTC), PARTITION_NONE partitions by size only
+	Period int
+	// a partition with this many elements rolls over to the next one, 0 is unlimited.
+	// Concurrent writers may exceed the limit by a few elements
+	MaxElements int64
+	// partitions that ended longer than this ago are dropped by DropExpired, 0 keeps them
+	Retention time.Duration
+	// DropExpired keeps at most this many of the newest partitions, 0 is unlimited
+	MaxPartitions int
+	// applied to every new partition, nil adds plain collections
+	Template *CollectionTemplate
+	// the clock of the database when nil
+	Now func() time.Time
+}
+
+// A family of collections named after the family and the period of their data (events_2024_06),
+// followed by a sequence number when a period needs several partitions (events_2024_06_1).
+// Writes go to the partition of the current period, queries read every partition.
+// The partitions are regular collections of the database, the family itself is not stored:
+// declare it with the same options after every load
+type PartitionedCollection struct {
+	Name    string
+	db      *Database
+	options PartitionOptions
+	mx      sync.Mutex
+}
+
+type partition struct {
+	c     *Collection
+	start time.Time
+	seq   int
+}
+
+func (db *Database) PartitionedCollection(name string, options PartitionOptions) (*PartitionedCollection, error) {
+	if _, ok := PARTITION_LAYOUTS[options.Period]; !ok && options.Period != PARTITION_NONE {
+		return nil, errors.New("unknown partition period " + strconv.Itoa(options.Period))
+	}
+	if options.Period == PARTITION_NONE && options.MaxElements <= 0 {
+		return nil, errors.New("partitions need a period or a maximal number of elements")
+	}
+	if options.Template != nil {
+		if err := options.Template.validate(); err != nil {
+			return nil, errors.New("invalid template due " + err.Error())
+		}
+	}
+	if options.Now == nil {
+		options.Now = db.Clock().Now
+	}
+	return &PartitionedCollection{Name: name, db: db, options: options}, nil
+}
+
+func (p *PartitionedCollection) periodStart(t time.Time) time.Time {
+	t = t.UTC()
+	switch p.options.Period {
+	case PARTITION_HOUR:
+		return t.Truncate(time.Hour)
+	case PARTITION_DAY:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case PARTITION_MONTH:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Time{}
+}
+
+func (p *PartitionedCollection) periodEnd(start time.Time) time.Time {
+	switch p.options.Period {
+	case PARTITION_HOUR:
+		return start.Add(time.Hour)
+	case PARTITION_DAY:
+		return start.AddDate(0, 0, 1)
+	case PARTITION_MONTH:
+		return start.AddDate(0, 1, 0)
+	}
+	return start
+}
+
+func (p *PartitionedCollection) partitionName(start time.Time, seq int) string {
+	name := p.Name
+	if p.options.Period != PARTITION_NONE {
+		name += "_" + start.Format(PARTITION_LAYOUTS[p.options.Period])
+	}
+	if seq > 0 || p.options.Period == PARTITION_NONE {
+		name += "_" + strconv.Itoa(seq)
+	}
+	return name
+}
+
+// parses the name of a partition of the family
+func (p *PartitionedCollection) parseName(name string) (start time.Time, seq int, ok bool) {
+	if !strings.HasPrefix(name, p.Name+"_") {
+		return start, 0, false
+	}
+	parts := strings.Split(strings.TrimPrefix(name, p.Name+"_"), "_")
+	if p.options.Period != PARTITION_NONE {
+		layout := PARTITION_LAYOUTS[p.options.Period]
+		n := strings.Count(layout, "_") + 1
+		if len(parts) < n {
+			return start, 0, false
+		}
+		var err error
+		start, err = time.Parse(layout, strings.Join(parts[:n], "_"))
+		if err != nil {
+			return start, 0, false
+		}
+		parts = parts[n:]
+		if len(parts) == 0 {
+			return start, 0, true
+		}
+	}
+	if len(parts) != 1 {
+		return start, 0, false
+	}
+	seq, err := strconv.Atoi(parts[0])
+	if err != nil || seq < 0 || strconv.Itoa(seq) != parts[0] {
+		return start, 0, false
+	}
+	return start, seq, true
+}
+
+// the partitions of the family, oldest first
+func (p *PartitionedCollection) partitions() []partition {
+	partitions := make([]partition, 0)
+	p.db.collectionMutex.RLock()
+	for name, c := range p.db.collections {
+		if start, seq, ok := p.parseName(name); ok {
+			partitions = append(partitions, partition{c, start, seq})
+		}
+	}
+	p.db.collectionMutex.RUnlock()
+	sort.Slice(partitions, func(i, j int) bool {
+		if !partitions[i].start.Equal(partitions[j].start) {
+			return partitions[i].start.Before(partitions[j].start)
+		}
+		return partitions[i].seq < partitions[j].seq
+	})
+	return partitions
+}
+
+// collections of the family, oldest first
+func (p *PartitionedCollection) Partitions() []*Collection {
+	partitions := p.partitions()
+	collections := make([]*Collection, len(partitions))
+	for i, part := range partitions {
+		collections[i] = part.c
+	}
+	return collections
+}
+
+// the partition writes go to, created when the period starts or the last partition is full
+func (p *PartitionedCollection) Active() (*Collection, error) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	start := p.periodStart(p.options.Now())
+	var last *partition
+	partitions := p.partitions()
+	for i := range partitions {
+		if partitions[i].start.Equal(start) {
+			last = &partitions[i]
+		}
+	}
+	seq := 0
+	if last != nil {
+		if p.options.MaxElements <= 0 || last.c.Size() < p.options.MaxElements {
+			return last.c, nil
+		}
+		seq = last.seq + 1
+	}
+	return p.db.AddCollectionFromTemplate(p.partitionName(start, seq), p.options.Template)
+}
+
+func (p *PartitionedCollection) Write(payload CustomStructure) error {
+	c, err := p.Active()
+	if err != nil {
+		return err
+	}
+	return c.Write(payload)
+}
+
+// number of elements in every partition
+func (p *PartitionedCollection) Size() int64 {
+	size := int64(0)
+	for _, c := range p.Partitions() {
+		size += c.Size()
+	}
+	return size
+}
+
+// Deletes the partitions older than the retention and those beyond MaxPartitions together with their files.
+// The active partition is never dropped. Returns the names of the dropped partitions
+func (p *PartitionedCollection) DropExpired() ([]string, error) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	now := p.options.Now()
+	partitions := p.partitions()
+	dropped := make([]string, 0)
+	for i, part := range partitions {
+		if i == len(partitions)-1 {
+			break
+		}
+		expired := p.options.Period != PARTITION_NONE && p.options.Retention > 0 &&
+			p.periodEnd(part.start).Before(now.Add(-p.options.Retention))
+		surplus := p.options.MaxPartitions > 0 && len(partitions)-i > p.options.MaxPartitions
+		if !expired && !surplus {
+			continue
+		}
+		err := p.db.removeCollection(part.c)
+		if err != nil {
+			return dropped, errors.New("failed to drop partition " + part.c.Name + " due " + err.Error())
+		}
+		dropped = append(dropped, part.c.Name)
+	}
+	return dropped, nil
+}
+
+// Conditions are the same as the ones of Query, the partitions are read oldest first
+type PartitionedQuery struct {
+	p          *PartitionedCollection
+	conditions []condition
+	limit      int
+}
+
+func (p *PartitionedCollection) Query() *PartitionedQuery {
+	return &PartitionedQuery{p: p}
+}
+
+func (pq *PartitionedQuery) Where(path string, op Operator, value ...interface{}) *PartitionedQuery {
+	q := &Query{conditions: pq.conditions}
+	pq.conditions = q.Where(path, op, value...).conditions
+	return pq
+}
+
+// at most n elements are returned from all of the partitions, 0 means no limit
+func (pq *PartitionedQuery) Limit(n int) *PartitionedQuery {
+	pq.limit = n
+	return pq
+}
+
+func (pq *PartitionedQuery) Run() ([]*Element, error) {
+	results := make([]*Element, 0)
+	err := pq.Stream(context.Background(), func(e *Element) error {
+		results = append(results, e)
+		return nil
+	})
+	return results, err
+}
+
+// same as Query.Stream across the partitions, the guards of the config apply to all of them together
+func (pq *PartitionedQuery) Stream(ctx context.Context, fn func(e *Element) error) error {
+	ctx, fn, done := pq.p.db.options.queryGuard().apply(ctx, pq.limit, fn)
+	return done(pq.stream(ctx, fn))
+}
+
+func (pq *PartitionedQuery) stream(ctx context.Context, fn func(e *Element) error) error {
+	found, stopped := 0, false
+	for _, c := range pq.p.Partitions() {
+		q := &Query{c: c, conditions: pq.conditions, unguarded: true}
+		err := q.Stream(ctx, func(e *Element) error {
+			err := fn(e)
+			if err == StopIteration {
+				stopped = true
+				return err
+			} else if err != nil {
+				return err
+			}
+			found++
+			if pq.limit > 0 && found >= pq.limit {
+				stopped = true
+				return StopIteration
+			}
+			return nil
+		})
+		if err != nil || stopped {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Composite ids (CompositeKey) of a collection with PartitionedKeys are written to the shard of their partition,
+// so a partition is read from a single shard. The shards keep the sort parts of their partitions sorted,
+// a shard rebuilds them on the first read after it changed
+
+type partitionCache struct {
+	mx     sync.Mutex
+	shards map[int]*shardPartitions
+}
+
+type shardPartitions struct {
+	generation uint64
+	// sorted sort parts of the live elements, by partition
+	sorts map[string][]string
+}
+
+// elements written from now on are placed by their partition, the collection has to be empty
+func (c *Collection) partitionKeys() {
+	c.sharedDestMx.Lock()
+	c.PartitionedKeys = true
+	c.sharedDestMx.Unlock()
+	atomic.StoreInt32(&c.dirty, 1)
+}
+
+func (c *Collection) partitionShard(partition string) *ConcurrentMapShared {
+	return c.Map.Shared[uint(fnv32(partition))%uint(len(c.Map.Shared))]
+}
+
+// the shard a new version of the element is written to
+func (c *Collection) placeId(id string) *ConcurrentMapShared {
+	if c.PartitionedKeys {
+		if partition, _, err := SplitCompositeKey(id); err == nil {
+			return c.partitionShard(partition)
+		}
+	}
+	return c.Map.GetNextShard()
+}
+
+// the sorted sort parts of the partition, the returned slice must not be modified
+func (c *Collection) sortParts(shard *ConcurrentMapShared, partition string) []string {
+	// read before the shard, so a write during the build makes the result stale
+	generation := atomic.LoadUint64(&shard.generation)
+	c.partitions.mx.Lock()
+	defer c.partitions.mx.Unlock()
+	if cached, ok := c.partitions.shards[shard.Id]; ok && cached.generation == generation {
+		return cached.sorts[partition]
+	}
+	sorts := make(map[string][]string)
+	shard.RLock()
+	for key, item := range shard.Items {
+		if !strings.HasPrefix(key, "id:") || item.Deleted {
+			continue
+		}
+		if p, sortPart, err := SplitCompositeKey(key[len("id:"):]); err == nil {
+			sorts[p] = append(sorts[p], sortPart)
+		}
+	}
+	shard.RUnlock()
+	for _, parts := range sorts {
+		sort.Strings(parts)
+	}
+	if c.partitions.shards == nil {
+		c.partitions.shards = make(map[int]*shardPartitions)
+	}
+	c.partitions.shards[shard.Id] = &shardPartitions{generation, sorts}
+	return sorts[partition]
+}
+
+// calls fn with the elements of the partition with a sort part within [from, to) in the order of the sort parts,
+// an empty to leaves the range open. Returning StopIteration from fn ends the range without an error
+func (c *Collection) partitionRange(ctx context.Context, partition, from, to string, fn func(e *Element) error) error {
+	if !c.PartitionedKeys {
+		return errors.New("collection " + c.Name + " does not place its elements by partition")
+	}
+	shard := c.partitionShard(partition)
+	sorts := c.sortParts(shard, partition)
+	for i := sort.SearchStrings(sorts, from); i < len(sorts) && (to == "" || sorts[i] < to); i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		idKey := "id:" + CompositeKey(partition, sorts[i])
+		shard.RLock()
+		item, ok := shard.Items[idKey]
+		if !ok || item.Deleted {
+			// deleted since the sort parts were built
+			shard.RUnlock()
+			continue
+		}
+		data, err := shard.readAtContext(ctx, item)
+		shard.RUnlock()
+		if err != nil {
+			return err
+		}
+		e, err := c.DecodeElement(data)
+		if err != nil {
+			return err
+		}
+		err = fn(e)
+		if err == StopIteration {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
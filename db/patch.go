@@ -0,0 +1,154 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+)
+
+// Changes only the given fields of the element, the rest is kept. Keys name fields like the segments
+// of query paths (the field name, its json tag or case-insensitively) or keys of maps. A map value patches
+// the nested structure or map instead of replacing it, nil resets a field and removes a key of a map,
+// other values replace the field and are converted to its type, e.g. float64 to int.
+// The element is read, patched and updated under its key lock (WithKeyLock), see Update
+func (c *Collection) Patch(id string, fields map[string]interface{}) error {
+	if err := c.writable(); err != nil {
+		return err
+	}
+	return c.WithKeyLock(id, func() error {
+		if !c.hasId(id) {
+			return errors.New("element " + id + " not found")
+		}
+		data, err := c.FindByIdContext(context.Background(), id)
+		if err != nil {
+			return err
+		}
+		e, err := c.DecodeElement(data)
+		if err != nil {
+			return err
+		}
+		payload, ok := e.Payload.(CustomStructure)
+		if !ok {
+			return errors.New("element " + id + " has no payload")
+		}
+		v := reflect.ValueOf(payload)
+		if v.Kind() != reflect.Ptr {
+			return errors.New("payload of element " + id + " is not a pointer")
+		}
+		if err = applyPatch(v.Elem(), fields); err != nil {
+			return errors.New("failed to patch element " + id + " due " + err.Error())
+		}
+		return c.Update(id, payload)
+	})
+}
+
+// Patch with a JSON merge patch (RFC 7386), {"address": {"city": "Oslo"}, "nickname": null}
+func (c *Collection) MergePatch(id string, patch []byte) error {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(patch, &fields); err != nil {
+		return errors.New("invalid merge patch due " + err.Error())
+	}
+	if fields == nil {
+		return errors.New("merge patch is not an object")
+	}
+	return c.Patch(id, fields)
+}
+
+// patches the structure or the map v, which has to be settable
+func applyPatch(v reflect.Value, fields map[string]interface{}) error {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			if v.Kind() == reflect.Interface {
+				v.Set(reflect.ValueOf(map[string]interface{}{}))
+			} else {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+		}
+		if v.Kind() == reflect.Interface {
+			// the dynamic value is not settable, patch a copy and put it back
+			elem := reflect.New(v.Elem().Type()).Elem()
+			elem.Set(v.Elem())
+			if err := applyPatch(elem, fields); err != nil {
+				return err
+			}
+			v.Set(elem)
+			return nil
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		for name, value := range fields {
+			f := structField(v, name)
+			if !f.IsValid() || !f.CanSet() {
+				return errors.New("field " + name + " does not exist")
+			}
+			if err := patchValue(f, name, value); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return errors.New("map of " + v.Type().String() + " can not be patched")
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		for name, value := range fields {
+			key := reflect.ValueOf(name).Convert(v.Type().Key())
+			if value == nil {
+				v.SetMapIndex(key, reflect.Value{})
+				continue
+			}
+			// map elements are not settable either
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if old := v.MapIndex(key); old.IsValid() {
+				elem.Set(old)
+			}
+			if err := patchValue(elem, name, value); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+		}
+	default:
+		return errors.New(v.Type().String() + " can not be patched")
+	}
+	return nil
+}
+
+func patchValue(f reflect.Value, name string, value interface{}) error {
+	if value == nil {
+		f.Set(reflect.Zero(f.Type()))
+		return nil
+	}
+	if nested, ok := value.(map[string]interface{}); ok {
+		target := indirect(f)
+		if target.Kind() == reflect.Struct || target.Kind() == reflect.Map || isNil(target) {
+			return applyPatch(f, nested)
+		}
+	}
+	converted, err := convertValue(value, f.Type())
+	if err != nil {
+		return errors.New("field " + name + " can not be set due " + err.Error())
+	}
+	f.Set(converted)
+	return nil
+}
+
+// value as t, through its json form unless it is assignable already
+func convertValue(value interface{}, t reflect.Type) (reflect.Value, error) {
+	v := reflect.ValueOf(value)
+	if v.Type().AssignableTo(t) {
+		return v, nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	converted := reflect.New(t)
+	if err = json.Unmarshal(data, converted.Interface()); err != nil {
+		return reflect.Value{}, err
+	}
+	return converted.Elem(), nil
+}
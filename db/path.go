@@ -0,0 +1,213 @@
+package db
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fields are addressed with dotted paths like "address.city". A segment matches a structure field
+// by its name, its json tag or case-insensitively, and a key of a map with string keys.
+// A segment ending with "[]" fans out to every element of a slice, "tags[]" or "items[].name".
+// Paths starting with "$." or "$[" are JSONPath selectors, see parseJSONPath
+
+type pathSegment struct {
+	name   string
+	expand bool
+	// JSONPath steps: the element at index of a slice, negative from its end, or every child of the value
+	indexed  bool
+	index    int
+	wildcard bool
+}
+
+var parsedPaths sync.Map
+
+func parsePath(path string) ([]pathSegment, error) {
+	if cached, ok := parsedPaths.Load(path); ok {
+		return cached.([]pathSegment), nil
+	}
+	if isJSONPath(path) {
+		segments, err := parseJSONPath(path)
+		if err != nil {
+			return nil, err
+		}
+		parsedPaths.Store(path, segments)
+		return segments, nil
+	}
+	parts := strings.Split(path, ".")
+	segments := make([]pathSegment, len(parts))
+	for i, part := range parts {
+		expand := strings.HasSuffix(part, "[]")
+		name := strings.TrimSuffix(part, "[]")
+		if name == "" || strings.ContainsAny(name, "[]") {
+			return nil, errors.New("invalid path " + path)
+		}
+		segments[i] = pathSegment{name: name, expand: expand}
+	}
+	parsedPaths.Store(path, segments)
+	return segments, nil
+}
+
+func indirect(v reflect.Value) reflect.Value {
+	for (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && !v.IsNil() {
+		v = v.Elem()
+	}
+	return v
+}
+
+func structField(v reflect.Value, name string) reflect.Value {
+	if f := v.FieldByName(name); f.IsValid() {
+		return f
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if tag == name || strings.EqualFold(sf.Name, name) {
+			return v.Field(i)
+		}
+	}
+	return reflect.Value{}
+}
+
+// every value under the path, none if the path does not exist in the value.
+// Nil pointers, interfaces, maps and slices are returned as well, see nonNil
+func resolvePath(value interface{}, path string) ([]reflect.Value, error) {
+	segments, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	current := []reflect.Value{reflect.ValueOf(value)}
+	for _, segment := range segments {
+		next := make([]reflect.Value, 0, len(current))
+		for _, v := range current {
+			next = append(next, segment.step(indirect(v))...)
+		}
+		current = next
+	}
+	return current, nil
+}
+
+// the values the segment selects from v
+func (segment pathSegment) step(v reflect.Value) []reflect.Value {
+	switch {
+	case segment.wildcard:
+		return children(v)
+	case segment.indexed:
+		if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+			return nil
+		}
+		i := segment.index
+		if i < 0 {
+			i += v.Len()
+		}
+		if i < 0 || i >= v.Len() {
+			return nil
+		}
+		return []reflect.Value{v.Index(i)}
+	}
+	var f reflect.Value
+	switch v.Kind() {
+	case reflect.Struct:
+		f = structField(v, segment.name)
+	case reflect.Map:
+		if v.Type().Key().Kind() == reflect.String {
+			f = v.MapIndex(reflect.ValueOf(segment.name).Convert(v.Type().Key()))
+		}
+	}
+	if !f.IsValid() {
+		return nil
+	}
+	if !segment.expand {
+		return []reflect.Value{f}
+	}
+	f = indirect(f)
+	if f.Kind() != reflect.Slice && f.Kind() != reflect.Array {
+		return nil
+	}
+	values := make([]reflect.Value, f.Len())
+	for i := range values {
+		values[i] = f.Index(i)
+	}
+	return values
+}
+
+// elements of a slice, values of a map with string keys in the order of the keys, exported fields of a structure
+func children(v reflect.Value) []reflect.Value {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		values := make([]reflect.Value, v.Len())
+		for i := range values {
+			values[i] = v.Index(i)
+		}
+		return values
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		values := make([]reflect.Value, len(keys))
+		for i, k := range keys {
+			values[i] = v.MapIndex(k)
+		}
+		return values
+	case reflect.Struct:
+		values := make([]reflect.Value, 0, v.NumField())
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				values = append(values, v.Field(i))
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		return v.IsNil()
+	}
+	return !v.IsValid()
+}
+
+// the values that are not nil, dereferenced
+func nonNil(values []reflect.Value) []reflect.Value {
+	result := make([]reflect.Value, 0, len(values))
+	for _, v := range values {
+		v = indirect(v)
+		if !isNil(v) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// representation of a value in the index, false for values that can not be indexed.
+// Numbers and times are encoded in order, see EncodeFloat
+func indexString(v reflect.Value) (string, bool) {
+	v = indirect(v)
+	if !v.IsValid() {
+		return "", false
+	}
+	switch {
+	case v.Kind() == reflect.String:
+		return v.String(), true
+	case isNumber(v.Kind()):
+		return EncodeFloat(toFloat(v)), true
+	case v.Kind() == reflect.Bool:
+		return EncodeBool(v.Bool()), true
+	case v.Type() == timeType && v.CanInterface():
+		return EncodeTime(v.Interface().(time.Time)), true
+	}
+	return "", false
+}
@@ -0,0 +1,70 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"sync"
+)
+
+// Reusable elements and read buffers for the hot read paths
+var (
+	elementPool = sync.Pool{New: func() interface{} { return new(Element) }}
+	bufferPool  = sync.Pool{New: func() interface{} { b := make([]byte, 0, 512); return &b }}
+)
+
+// takes an element from the pool, it should be given back with ReleaseElement once it is not used anymore
+func AcquireElement() *Element {
+	return elementPool.Get().(*Element)
+}
+
+func ReleaseElement(e *Element) {
+	if e == nil {
+		return
+	}
+	e.Id = ""
+	e.Payload = nil
+	e.Computed = nil
+	elementPool.Put(e)
+}
+
+// decodes the element with the given id into dst without allocating a read buffer.
+// The payload of dst is replaced, so dst can be an element taken from AcquireElement
+func (c *Collection) ReadInto(id string, dst *Element) error {
+	if dst == nil {
+		return errors.New("destination element is nil")
+	}
+	idKey := "id:" + id
+	shard, err := c.getShardByKeySafe(idKey)
+	if err != nil {
+		return err
+	}
+
+	buf := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(buf)
+
+	shard.RLock()
+	item, ok := shard.Items[idKey]
+	if !ok || item.Deleted {
+		shard.RUnlock()
+		return errors.New("not found")
+	}
+	data, err := shard.readInto(item, *buf)
+	shard.RUnlock()
+	if err != nil {
+		return err
+	}
+	// keep the (possibly grown) storage for the next read
+	*buf = data[:0]
+
+	dst.Id = ""
+	dst.Payload = nil
+	dst.Computed = nil
+	if err = gob.NewDecoder(bytes.NewReader(data)).Decode(dst); err != nil {
+		return err
+	}
+	if err = c.unmarshalPayload(dst); err != nil {
+		return err
+	}
+	return c.decryptPayload(dst.Payload)
+}
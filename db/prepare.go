@@ -0,0 +1,130 @@
+package db
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+)
+
+// Placeholder of a value in the template of a prepared query, set by Bind
+type Param string
+
+// A query checked once and run many times with different values, e.g. on the hot path of a request handler:
+//
+//	byAge, err := people.Prepare(people.Query().Where("age", db.Gte, db.Param("min")).Limit(10))
+//	...
+//	results, err := byAge.Run(map[string]interface{}{"min": 18})
+//
+// The paths and operators are validated and the indexes of the conditions are looked up by Prepare,
+// so a run neither parses the conditions nor searches the indexes again. Indexes added later are picked up.
+// A prepared query can be run by several goroutines at the same time
+type PreparedQuery struct {
+	template Query
+	// conditions of the template taking the parameter, by its name
+	params map[string][]int
+	// the index of every condition, nil for paths without one
+	indexes []*Index
+	// indexVersion of the collection the indexes were looked up at
+	version uint64
+}
+
+// Checks the template once, the values of its conditions may be Params. The template is copied,
+// changing it afterwards does not change the prepared query
+func (c *Collection) Prepare(template *Query) (*PreparedQuery, error) {
+	if template.c != c {
+		return nil, errors.New("query of another collection can not be prepared for " + c.Name)
+	}
+	if err := template.validate(); err != nil {
+		return nil, err
+	}
+	for _, o := range template.order {
+		if _, err := parsePath(o.path); err != nil {
+			return nil, err
+		}
+	}
+	p := &PreparedQuery{template: *template, params: make(map[string][]int)}
+	p.template.conditions = append([]condition(nil), template.conditions...)
+	p.template.order = append([]ordering(nil), template.order...)
+	p.template.iterErr = nil
+	for i, cond := range p.template.conditions {
+		if param, ok := cond.value.(Param); ok {
+			p.params[string(param)] = append(p.params[string(param)], i)
+		}
+	}
+	p.version = atomic.LoadUint64(&c.indexVersion)
+	p.indexes = c.lookupIndexes(p.template.conditions)
+	return p, nil
+}
+
+// names of the parameters, sorted
+func (p *PreparedQuery) Params() []string {
+	names := make([]string, 0, len(p.params))
+	for name := range p.params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The query with the parameters set to the values, run it with any of the methods of Query.
+// Every parameter needs a value, values of unknown parameters are an error
+func (p *PreparedQuery) Bind(values map[string]interface{}) (*Query, error) {
+	for name := range values {
+		if _, ok := p.params[name]; !ok {
+			return nil, errors.New("query has no parameter " + name)
+		}
+	}
+	q := p.template
+	q.prepared = p
+	if len(p.params) == 0 {
+		return &q, nil
+	}
+	q.conditions = append([]condition(nil), p.template.conditions...)
+	for name, conditions := range p.params {
+		value, ok := values[name]
+		if !ok {
+			return nil, errors.New("parameter " + name + " is not bound")
+		}
+		for _, i := range conditions {
+			q.conditions[i].value = value
+		}
+	}
+	return &q, nil
+}
+
+// binds the values and runs the query, see Bind and Query.Run
+func (p *PreparedQuery) Run(values map[string]interface{}) ([]*Element, error) {
+	q, err := p.Bind(values)
+	if err != nil {
+		return nil, err
+	}
+	return q.Run()
+}
+
+// binds the values and returns the first match, see Bind and Query.First
+func (p *PreparedQuery) First(values map[string]interface{}) (*Element, error) {
+	q, err := p.Bind(values)
+	if err != nil {
+		return nil, err
+	}
+	return q.First()
+}
+
+func (c *Collection) lookupIndexes(conditions []condition) []*Index {
+	indexes := make([]*Index, len(conditions))
+	for i, cond := range conditions {
+		if ix, ok := c.readyIndex(cond.path); ok {
+			indexes[i] = &ix
+		}
+	}
+	return indexes
+}
+
+// The declared index of every condition. A prepared query reuses the ones of Prepare
+// while the collection got no new index
+func (q *Query) conditionIndexes() []*Index {
+	if p := q.prepared; p != nil && atomic.LoadUint64(&q.c.indexVersion) == p.version {
+		return p.indexes
+	}
+	return q.c.lookupIndexes(q.conditions)
+}
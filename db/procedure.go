@@ -0,0 +1,49 @@
+package db
+
+import (
+	"errors"
+)
+
+// Named function executed next to the data, it may read and write any collection of the database
+type Procedure func(db *Database, params map[string]interface{}) (interface{}, error)
+
+func (db *Database) RegisterProcedure(name string, fn Procedure) error {
+	if name == "" || fn == nil {
+		return errors.New("invalid procedure")
+	}
+	db.procedureMutex.Lock()
+	defer db.procedureMutex.Unlock()
+	if _, ok := db.procedures[name]; ok {
+		return errors.New("procedure " + name + " is already registered")
+	}
+	db.procedures[name] = fn
+	return nil
+}
+
+func (db *Database) UnregisterProcedure(name string) {
+	db.procedureMutex.Lock()
+	delete(db.procedures, name)
+	db.procedureMutex.Unlock()
+}
+
+func (db *Database) Procedures() []string {
+	db.procedureMutex.RLock()
+	defer db.procedureMutex.RUnlock()
+	names := make([]string, 0, len(db.procedures))
+	for name := range db.procedures {
+		names = append(names, name)
+	}
+	return names
+}
+
+// runs the registered procedure, a panic inside of it is returned as an error
+func (db *Database) Call(name string, params map[string]interface{}) (result interface{}, err error) {
+	db.procedureMutex.RLock()
+	fn, ok := db.procedures[name]
+	db.procedureMutex.RUnlock()
+	if !ok {
+		return nil, errors.New("unknown procedure " + name)
+	}
+	defer recoverPanic("procedure "+name, &err)
+	return fn(db, params)
+}
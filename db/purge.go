@@ -0,0 +1,238 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+type PurgeReport struct {
+	Purged    int   `json:"purged"` // elements, including the ones that were deleted before
+	Keys      int   `json:"keys"`   // removed index keys
+	Shards    []int `json:"shards"` // rewritten shards
+	Reclaimed int64 `json:"reclaimed"`
+	// versions of the purged elements removed from the history of the collection, see SetHistory
+	Versions int `json:"versions"`
+	// none of the purged elements and of their versions is left in the index or in the segment files
+	Verified bool     `json:"verified"`
+	Failures []string `json:"failures,omitempty"`
+}
+
+type purgedShard struct {
+	shard *ConcurrentMapShared
+	keys  []string
+	// encoded elements, looked up in the rewritten segments
+	data [][]byte
+}
+
+// Removes every element matching all of the non-empty indexes of the entry, deleted elements included,
+// and rewrites the affected shards at once, so the data is physically gone from the segment files.
+// The database is synchronized afterwards, the merged segments are only removed once the manifest no longer lists them
+// Purged elements leave no tombstones, see MergeWith. Their versions are purged from the history as well
+func (c *Collection) Purge(entry CustomStructure) (*PurgeReport, error) {
+	indexes, err := c.dataIndex(entry)
+	if err != nil {
+		return nil, err
+	}
+	required := 0
+	for _, ix := range indexes {
+		if ix.Data != "" {
+			required++
+		}
+	}
+	if required == 0 {
+		return nil, errors.New("purge requires at least one index value")
+	}
+	return c.purge(func(shard *ConcurrentMapShared) map[*ShardOffset]bool {
+		matches := make(map[*ShardOffset]int)
+		for _, ix := range indexes {
+			if ix.Data == "" {
+				continue
+			}
+			if ix.Unique {
+				if item, ok := shard.Items[ix.Field+":"+ix.Data]; ok {
+					matches[item]++
+				}
+				continue
+			}
+			shard.eachSlot(ix.Field+":"+ix.Data, func(key string, item *ShardOffset) bool {
+				matches[item]++
+				return true
+			})
+		}
+		targets := make(map[*ShardOffset]bool)
+		for item, n := range matches {
+			if n == required {
+				targets[item] = true
+			}
+		}
+		return targets
+	})
+}
+
+// same as Purge for the elements with the given ids
+func (c *Collection) PurgeById(ids ...string) (*PurgeReport, error) {
+	return c.purge(func(shard *ConcurrentMapShared) map[*ShardOffset]bool {
+		targets := make(map[*ShardOffset]bool)
+		for _, id := range ids {
+			if item, ok := shard.Items["id:"+id]; ok {
+				targets[item] = true
+			}
+		}
+		return targets
+	})
+}
+
+func (c *Collection) purge(match func(shard *ConcurrentMapShared) map[*ShardOffset]bool) (*PurgeReport, error) {
+	if err := c.writable(); err != nil {
+		return nil, err
+	}
+	report := &PurgeReport{Shards: make([]int, 0)}
+	purged := make([]*purgedShard, 0)
+	ids := make([]string, 0)
+	for _, shard := range c.Map.Shared {
+		shard.Lock()
+		targets := match(shard)
+		if len(targets) == 0 {
+			shard.Unlock()
+			continue
+		}
+		ps := &purgedShard{shard: shard}
+		for item := range targets {
+			if item.Tombstone {
+				// only the tombstone of a deleted element is left under its id
+				continue
+			}
+			data, err := shard.readAt(item)
+			if err != nil {
+				shard.Unlock()
+				return report, err
+			}
+			ps.data = append(ps.data, data)
+			if !item.Deleted {
+				item.Deleted = true
+				shard.offsetChanged(item)
+				atomic.AddInt64(&c.ObjectsCounter, -1)
+			}
+		}
+		// keys of an element share its offset
+		for key, item := range shard.Items {
+			if targets[item] {
+				ps.keys = append(ps.keys, key)
+				if strings.HasPrefix(key, "id:") {
+					ids = append(ids, key[3:])
+				}
+			}
+		}
+		shard.markDirty()
+		shard.Unlock()
+		report.Purged += len(targets)
+		report.Keys += len(ps.keys)
+		purged = append(purged, ps)
+	}
+	// cached reads may hold the purged elements
+	c.cacheMx.RLock()
+	c.Cache.Reset()
+	c.cacheMx.RUnlock()
+
+	for _, ps := range purged {
+		reclaimed, _, err := ps.shard.Optimize()
+		if err != nil {
+			return report, errors.New("failed to rewrite shard " + strconv.Itoa(ps.shard.Id) + " due " + err.Error())
+		}
+		report.Reclaimed += reclaimed
+		report.Shards = append(report.Shards, ps.shard.Id)
+		ps.shard.dropTombstones(ps.keys)
+		c.sharedDestMx.Lock()
+		for _, key := range ps.keys {
+			delete(c.ShardDestinations, key)
+		}
+		c.sharedDestMx.Unlock()
+	}
+	atomic.StoreInt32(&c.dirty, 1)
+	if c.database != nil && len(purged) > 0 {
+		if err := c.database.Sync(); err != nil {
+			return report, errors.New("failed to synchronize the purge due " + err.Error())
+		}
+	}
+
+	for _, ps := range purged {
+		report.Failures = append(report.Failures, ps.verify()...)
+	}
+	if hc, err := c.historyCollection(); err == nil && len(ids) > 0 {
+		versions, err := hc.purgeVersions(ids)
+		if err != nil {
+			return report, errors.New("failed to purge the history due " + err.Error())
+		}
+		report.Versions = versions.Purged
+		report.Failures = append(report.Failures, versions.Failures...)
+	}
+	report.Verified = len(report.Failures) == 0
+	return report, nil
+}
+
+// purges the versions of the elements from the history collection, they are found by its Key index
+func (c *Collection) purgeVersions(ids []string) (*PurgeReport, error) {
+	return c.purge(func(shard *ConcurrentMapShared) map[*ShardOffset]bool {
+		targets := make(map[*ShardOffset]bool)
+		for _, id := range ids {
+			shard.eachSlot("Key:"+id, func(key string, item *ShardOffset) bool {
+				targets[item] = true
+				return true
+			})
+		}
+		return targets
+	})
+}
+
+// a purged element leaves no tombstone, MergeWith copies it again from a replica that still has it
+func (shard *ConcurrentMapShared) dropTombstones(keys []string) {
+	shard.Lock()
+	defer shard.Unlock()
+	for _, key := range keys {
+		if item, ok := shard.Items[key]; ok && item.Tombstone {
+			delete(shard.Items, key)
+			shard.rewriteMeta = true
+			shard.markDirty()
+		}
+	}
+}
+
+// looks for leftovers of the purged elements in the index and in every segment of the shard
+func (ps *purgedShard) verify() []string {
+	failures := make([]string, 0)
+	shard := ps.shard
+	shard.RLock()
+	defer shard.RUnlock()
+	for _, key := range ps.keys {
+		if _, ok := shard.Items[key]; ok {
+			failures = append(failures, "key "+key+" is still in the index of shard "+strconv.Itoa(shard.Id))
+		}
+	}
+	for _, segment := range shard.droppedSegments() {
+		if _, err := os.Stat(shard.segmentPath(segment)); err == nil {
+			failures = append(failures, "merged segment "+shard.segmentPath(segment)+" is still on the drive")
+		}
+	}
+	for _, segment := range shard.Segments {
+		data, err := ioutil.ReadFile(shard.segmentPath(segment))
+		if err != nil {
+			failures = append(failures, "failed to read "+shard.segmentPath(segment)+" due "+err.Error())
+			continue
+		}
+		if segment == shard.activeSegment() {
+			data = append(data, shard.pending...)
+		}
+		for _, element := range ps.data {
+			if bytes.Contains(data, element) {
+				failures = append(failures, "purged data is still in "+shard.segmentPath(segment))
+				break
+			}
+		}
+	}
+	return failures
+}
@@ -0,0 +1,486 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"time"
+)
+
+type Operator int
+
+const (
+	Eq Operator = iota
+	Ne
+	Lt
+	Lte
+	Gt
+	Gte
+	// the path has a value, possibly nil. Takes no value
+	Exists
+	// the path has no value or only nil ones. Takes no value
+	IsNull
+)
+
+var OPERATOR_NAMES = map[Operator]string{Eq: "=", Ne: "!=", Lt: "<", Lte: "<=", Gt: ">", Gte: ">=",
+	Exists: "exists", IsNull: "is null"}
+
+func (op Operator) String() string {
+	if name, ok := OPERATOR_NAMES[op]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+type condition struct {
+	path  string
+	op    Operator
+	value interface{}
+}
+
+// Conditions on dotted paths of the elements, all of them have to match.
+// A path with several values ("tags[]") matches if any of the values does, except for Ne,
+// which matches if none of them equals the value. Missing paths and nil values match only Ne and IsNull.
+// An Eq condition on a declared index (AddIndex), IsNull on a non-sparse one and ranges of conditions
+// on the same path are read from the index, other queries scan the collection
+type Query struct {
+	c          *Collection
+	conditions []condition
+	limit      int
+	order      []ordering
+	// reads of the database itself, the query guards of the config do not apply
+	unguarded bool
+	// result of the last loop over Iter
+	iterErr error
+	// set by PreparedQuery.Bind, the query was validated by Prepare
+	prepared *PreparedQuery
+}
+
+func (c *Collection) Query() *Query {
+	return &Query{c: c}
+}
+
+// Where("address.city", Eq, "Oslo"), Where("email", Exists)
+func (q *Query) Where(path string, op Operator, value ...interface{}) *Query {
+	cond := condition{path: path, op: op}
+	if len(value) > 0 {
+		cond.value = value[0]
+	}
+	q.conditions = append(q.conditions, cond)
+	return q
+}
+
+// at most n elements are returned, 0 means no limit
+func (q *Query) Limit(n int) *Query {
+	q.limit = n
+	return q
+}
+
+// collects every matching element, see Stream for result sets that do not fit into memory.
+// The results are served from the query cache of the collection, if it has one (SetQueryCache).
+// A query ended by a guard returns the elements collected up to it with the error of the guard
+func (q *Query) Run() ([]*Element, error) {
+	qc := q.c.getQueryCache()
+	var key string
+	var generation uint64
+	if qc != nil {
+		// read before the query, so a write during it makes the result stale
+		key, generation = q.cacheKey(), q.c.Map.generation()
+		if cached, ok := qc.get(key, generation); ok {
+			return q.runCached(cached)
+		}
+	}
+	results := make([]*Element, 0)
+	err := q.Stream(context.Background(), func(e *Element) error {
+		results = append(results, e)
+		return nil
+	})
+	if err == nil && qc != nil {
+		qc.put(key, generation, append(make([]*Element, 0, len(results)), results...))
+	}
+	return results, err
+}
+
+// the cached results within the guards, like the ones of Stream
+func (q *Query) runCached(cached []*Element) ([]*Element, error) {
+	results := make([]*Element, 0, len(cached))
+	_, collect, done := q.guard().apply(context.Background(), q.limit, func(e *Element) error {
+		results = append(results, e)
+		return nil
+	})
+	for _, e := range cached {
+		if err := collect(e); err != nil {
+			return results, done(err)
+		}
+	}
+	return results, done(nil)
+}
+
+// Leaves the query out of the guards of the config (Config.MaxQueryRows), for the reads
+// of the packages built on the database that have to see every matching element
+func (q *Query) Unguarded() *Query {
+	q.unguarded = true
+	return q
+}
+
+func (q *Query) guard() queryGuard {
+	if q.unguarded {
+		return queryGuard{}
+	}
+	return q.c.options.queryGuard()
+}
+
+func (q *Query) First() (*Element, error) {
+	limit := q.limit
+	q.limit = 1
+	results, err := q.Run()
+	q.limit = limit
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, errors.New("no matching data")
+	}
+	return results[0], nil
+}
+
+func (q *Query) validate() error {
+	for _, cond := range q.conditions {
+		if _, err := parsePath(cond.path); err != nil {
+			return err
+		}
+		if _, ok := OPERATOR_NAMES[cond.op]; !ok {
+			return errors.New("unknown operator of condition on " + cond.path)
+		}
+	}
+	return nil
+}
+
+// the entries of a declared index answering a condition, bounds are inclusive and nil is open
+type indexScan struct {
+	ix       Index
+	from, to *string
+}
+
+func (s *indexScan) bound(cond condition) {
+	value, ok := s.ix.key(reflect.ValueOf(cond.value))
+	if !ok {
+		return
+	}
+	switch cond.op {
+	case Lt, Lte:
+		if s.to == nil || value < *s.to {
+			s.to = &value
+		}
+	case Gt, Gte:
+		if s.from == nil || value > *s.from {
+			s.from = &value
+		}
+	}
+}
+
+func isRange(op Operator) bool {
+	return op == Lt || op == Lte || op == Gt || op == Gte
+}
+
+// the index entries to read instead of scanning the collection, equality is preferred.
+// A range is read only from an index that keeps the order of the values,
+// the read entries are checked against the conditions anyway
+func (q *Query) plan() (*indexScan, bool) {
+	indexes := q.conditionIndexes()
+	for i, cond := range q.conditions {
+		if (cond.op != Eq && cond.op != IsNull) || indexes[i] == nil {
+			continue
+		}
+		ix := *indexes[i]
+		if cond.op == IsNull {
+			// sparse indexes leave out the elements without a value
+			if !ix.Sparse {
+				value := NULL_INDEX_VALUE
+				return &indexScan{ix, &value, &value}, true
+			}
+			continue
+		}
+		if value, ok := ix.key(reflect.ValueOf(cond.value)); ok {
+			return &indexScan{ix, &value, &value}, true
+		}
+	}
+	for i, cond := range q.conditions {
+		if !isRange(cond.op) || indexes[i] == nil {
+			continue
+		}
+		ix := *indexes[i]
+		if q.c.isEncrypted(ix.Field) || (ix.Collation != nil && ix.Collation.Locale != "") {
+			continue
+		}
+		scan := &indexScan{ix: ix}
+		for _, other := range q.conditions {
+			if other.path == cond.path && isRange(other.op) {
+				scan.bound(other)
+			}
+		}
+		if scan.from != nil || scan.to != nil {
+			return scan, true
+		}
+	}
+	return nil, false
+}
+
+// Calls fn with every matching element until the limit is reached. Elements are read and decoded
+// while fn runs only as far as a few chunks ahead, a slow fn slows down the reading.
+// Returning StopIteration from fn ends the query without an error, a cancelled ctx returns its error.
+// An ordered query (OrderBy) calls fn only once every matching element was read.
+// The guards of the config (Config.MaxQueryRows, MaxQueryBytes and QueryTimeout) end a query exceeding them with their error
+func (q *Query) Stream(ctx context.Context, fn func(e *Element) error) error {
+	if q.prepared == nil {
+		if err := q.validate(); err != nil {
+			return err
+		}
+	}
+	ctx, fn, done := q.guard().apply(ctx, q.limit, fn)
+	return done(q.stream(ctx, fn))
+}
+
+func (q *Query) stream(ctx context.Context, fn func(e *Element) error) error {
+	if len(q.order) > 0 {
+		return q.streamOrdered(ctx, fn)
+	}
+	found := 0
+	visit := func(e *Element) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ok, err := q.matches(e)
+		if err != nil || !ok {
+			return err
+		}
+		if err = fn(e); err != nil {
+			return err
+		}
+		found++
+		if q.limit > 0 && found >= q.limit {
+			return StopIteration
+		}
+		return nil
+	}
+
+	if scan, ok := q.plan(); ok {
+		for _, shard := range q.c.Map.Shared {
+			for _, offset := range q.c.scanOffsets(shard, scan) {
+				shard.RLock()
+				data, err := shard.readAtContext(ctx, &offset)
+				shard.RUnlock()
+				if err != nil {
+					return err
+				}
+				e, err := q.c.DecodeElement(data)
+				if err != nil {
+					return err
+				}
+				err = visit(e)
+				if err == StopIteration {
+					return nil
+				} else if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	scanned := uint64(0)
+	err := q.c.forEach(ctx, func(e *Element) error {
+		scanned++
+		return visit(e)
+	})
+	q.recordFullScan(scanned)
+	return err
+}
+
+// Sends the matching elements to the returned channel, which has buf slots and is closed at the end.
+// The error channel receives the result of the query once the elements are sent.
+// A consumer leaving before the end has to cancel ctx, so the query stops
+func (q *Query) Chan(ctx context.Context, buf int) (<-chan *Element, <-chan error) {
+	elements := make(chan *Element, buf)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		err := q.streamTo(ctx, elements)
+		close(elements)
+		errs <- err
+	}()
+	return elements, errs
+}
+
+// a panic of the query is returned as a PanicError instead of crashing the goroutine of Chan
+func (q *Query) streamTo(ctx context.Context, elements chan<- *Element) (err error) {
+	defer recoverPanic("query of "+q.c.Name, &err)
+	return q.Stream(ctx, func(e *Element) error {
+		select {
+		case elements <- e:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+func (q *Query) matches(e *Element) (bool, error) {
+	indexes := q.conditionIndexes()
+	for i, cond := range q.conditions {
+		values, err := q.c.resolve(e.Payload, e.Computed, cond.path)
+		if err != nil {
+			return false, err
+		}
+		switch cond.op {
+		case Exists:
+			if len(values) == 0 {
+				return false, nil
+			}
+			continue
+		case IsNull:
+			if len(nonNil(values)) > 0 {
+				return false, nil
+			}
+			continue
+		}
+		var collation *Collation
+		if indexes[i] != nil {
+			collation = indexes[i].Collation
+		}
+		if !cond.matches(nonNil(values), collation) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// strings are compared with the collation of the index of the path, if it has one
+func (cond condition) matches(values []reflect.Value, collation *Collation) bool {
+	if cond.op == Ne {
+		for _, v := range values {
+			if n, ok := compareValues(v, cond.value, collation); ok && n == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	for _, v := range values {
+		n, ok := compareValues(v, cond.value, collation)
+		if !ok {
+			continue
+		}
+		switch cond.op {
+		case Eq:
+			if n == 0 {
+				return true
+			}
+		case Lt:
+			if n < 0 {
+				return true
+			}
+		case Lte:
+			if n <= 0 {
+				return true
+			}
+		case Gt:
+			if n > 0 {
+				return true
+			}
+		case Gte:
+			if n >= 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isInt(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Int64
+}
+
+func isUint(k reflect.Kind) bool {
+	return k >= reflect.Uint && k <= reflect.Uintptr
+}
+
+func isFloat(k reflect.Kind) bool {
+	return k == reflect.Float32 || k == reflect.Float64
+}
+
+func isNumber(k reflect.Kind) bool {
+	return isInt(k) || isUint(k) || isFloat(k)
+}
+
+func toFloat(v reflect.Value) float64 {
+	switch {
+	case isInt(v.Kind()):
+		return float64(v.Int())
+	case isUint(v.Kind()):
+		return float64(v.Uint())
+	}
+	return v.Float()
+}
+
+func compareOrdered(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// orders the value of an element against the value of a condition,
+// false if the two can only be checked for equality and they differ
+func compareValues(v reflect.Value, target interface{}, collation *Collation) (int, bool) {
+	v = indirect(v)
+	t := indirect(reflect.ValueOf(target))
+	if !v.IsValid() || !t.IsValid() {
+		return 0, !v.IsValid() && !t.IsValid()
+	}
+	vk, tk := v.Kind(), t.Kind()
+	switch {
+	case isInt(vk) && isInt(tk):
+		a, b := v.Int(), t.Int()
+		if a < b {
+			return -1, true
+		} else if a > b {
+			return 1, true
+		}
+		return 0, true
+	case isUint(vk) && isUint(tk):
+		a, b := v.Uint(), t.Uint()
+		if a < b {
+			return -1, true
+		} else if a > b {
+			return 1, true
+		}
+		return 0, true
+	case isNumber(vk) && isNumber(tk):
+		return compareOrdered(toFloat(v), toFloat(t)), true
+	case vk == reflect.String && tk == reflect.String:
+		if collation != nil {
+			return collation.Compare(v.String(), t.String()), true
+		}
+		return strings.Compare(v.String(), t.String()), true
+	case vk == reflect.Bool && tk == reflect.Bool:
+		if v.Bool() == t.Bool() {
+			return 0, true
+		}
+		return 0, false
+	case v.Type() == timeType && t.Type() == timeType && v.CanInterface():
+		a, b := v.Interface().(time.Time), t.Interface().(time.Time)
+		if a.Before(b) {
+			return -1, true
+		} else if a.After(b) {
+			return 1, true
+		}
+		return 0, true
+	}
+	if v.CanInterface() && reflect.DeepEqual(v.Interface(), t.Interface()) {
+		return 0, true
+	}
+	return 0, false
+}
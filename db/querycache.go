@@ -0,0 +1,148 @@
+package db
+
+import (
+	"container/list"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// larger results are not cached, they would push out many small ones
+const QUERY_CACHE_MAX_RESULTS = 10000
+
+type QueryCacheStats struct {
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+	Entries int    `json:"entries"`
+}
+
+// results of Run by the normalized query, the least recently used ones are evicted
+type queryCache struct {
+	mx      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+	hits    uint64
+	misses  uint64
+}
+
+type cachedResult struct {
+	key        string
+	generation uint64
+	results    []*Element
+}
+
+// Keeps the results of up to entries distinct queries run with Run or First, 0 disables the cache.
+// A result is served while the collection has not been written to since it was computed, every write,
+// update or delete of the collection invalidates all of them. The cached elements are shared between
+// the callers, so they must not be modified. Replacing the cache drops the kept results
+func (c *Collection) SetQueryCache(entries int) {
+	var qc *queryCache
+	if entries > 0 {
+		qc = &queryCache{size: entries, entries: make(map[string]*list.Element), lru: list.New()}
+	}
+	c.sharedDestMx.Lock()
+	c.queryCache = qc
+	c.sharedDestMx.Unlock()
+}
+
+func (c *Collection) getQueryCache() *queryCache {
+	c.sharedDestMx.RLock()
+	defer c.sharedDestMx.RUnlock()
+	return c.queryCache
+}
+
+// number of changes of the shards, any write changes it
+func (cm *ConcurrentMap) generation() uint64 {
+	generation := uint64(0)
+	for _, shard := range cm.Shared {
+		generation += atomic.LoadUint64(&shard.generation)
+	}
+	return generation
+}
+
+func (qc *queryCache) get(key string, generation uint64) ([]*Element, bool) {
+	qc.mx.Lock()
+	defer qc.mx.Unlock()
+	if e, ok := qc.entries[key]; ok {
+		cached := e.Value.(*cachedResult)
+		if cached.generation == generation {
+			qc.lru.MoveToFront(e)
+			qc.hits++
+			return cached.results, true
+		}
+		qc.lru.Remove(e)
+		delete(qc.entries, key)
+	}
+	qc.misses++
+	return nil, false
+}
+
+func (qc *queryCache) put(key string, generation uint64, results []*Element) {
+	if len(results) > QUERY_CACHE_MAX_RESULTS {
+		return
+	}
+	qc.mx.Lock()
+	defer qc.mx.Unlock()
+	if e, ok := qc.entries[key]; ok {
+		qc.lru.Remove(e)
+	}
+	qc.entries[key] = qc.lru.PushFront(&cachedResult{key, generation, results})
+	for qc.lru.Len() > qc.size {
+		oldest := qc.lru.Back()
+		qc.lru.Remove(oldest)
+		delete(qc.entries, oldest.Value.(*cachedResult).key)
+	}
+}
+
+func (qc *queryCache) stats() QueryCacheStats {
+	if qc == nil {
+		return QueryCacheStats{}
+	}
+	qc.mx.Lock()
+	defer qc.mx.Unlock()
+	return QueryCacheStats{qc.hits, qc.misses, qc.lru.Len()}
+}
+
+func (qc *queryCache) resetStats() {
+	if qc == nil {
+		return
+	}
+	qc.mx.Lock()
+	qc.hits, qc.misses = 0, 0
+	qc.mx.Unlock()
+}
+
+// The same key for queries giving the same results: the conditions are sorted, numbers are compared
+// by their value whatever their type, so Where("age", Gt, 3) and Where("age", Gt, 3.0) share the entry
+func (q *Query) cacheKey() string {
+	conditions := make([]string, len(q.conditions))
+	for i, cond := range q.conditions {
+		conditions[i] = strconv.Quote(cond.path) + " " + strconv.Itoa(int(cond.op)) + " " + cacheValue(cond.value)
+	}
+	sort.Strings(conditions)
+	var b strings.Builder
+	b.WriteString(strings.Join(conditions, ";"))
+	for _, o := range q.order {
+		b.WriteString("|" + strconv.Quote(o.path) + " " + strconv.FormatBool(o.descending))
+	}
+	b.WriteString("|" + strconv.Itoa(q.limit))
+	return b.String()
+}
+
+func cacheValue(value interface{}) string {
+	v := indirect(reflect.ValueOf(value))
+	switch {
+	case !v.IsValid():
+		return "nil"
+	case v.Kind() == reflect.String:
+		return "s" + strconv.Quote(v.String())
+	case isNumber(v.Kind()):
+		return "n" + EncodeFloat(toFloat(v))
+	}
+	return fmt.Sprintf("%T%v", v.Interface(), v.Interface())
+}
@@ -0,0 +1,405 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+)
+
+// Writes of an element seen by a version of it, counted by the replica that made them
+type VectorClock map[string]uint64
+
+const (
+	clockEqual = iota
+	clockBefore
+	clockAfter
+	clockConcurrent
+)
+
+// how the clock relates to the other one
+func (v VectorClock) compare(other VectorClock) int {
+	before, after := false, false
+	for replica, n := range v {
+		if n > other[replica] {
+			after = true
+		}
+	}
+	for replica, n := range other {
+		if n > v[replica] {
+			before = true
+		}
+	}
+	switch {
+	case before && after:
+		return clockConcurrent
+	case before:
+		return clockBefore
+	case after:
+		return clockAfter
+	}
+	return clockEqual
+}
+
+// pointwise maximum of the clocks
+func (v VectorClock) merge(other VectorClock) VectorClock {
+	merged := make(VectorClock, len(v))
+	for replica, n := range v {
+		merged[replica] = n
+	}
+	for replica, n := range other {
+		if n > merged[replica] {
+			merged[replica] = n
+		}
+	}
+	return merged
+}
+
+// A write of a replica: its count in the vector clock and its Lamport time, which orders concurrent writes
+type Dot struct {
+	Replica string `json:"r"`
+	Counter uint64 `json:"n"`
+	Time    uint64 `json:"t"`
+}
+
+// the last writer wins, ties are broken by the replica
+func (d Dot) after(other Dot) bool {
+	if d.Time != other.Time {
+		return d.Time > other.Time
+	}
+	return d.Replica > other.Replica
+}
+
+// Version of an element written while DatabaseOptions.ReplicaId is set. MergeWith keeps the version that has seen
+// the other one. Concurrent versions are resolved field by field: the last write of a field wins and the values of
+// a slice field are an observed-remove set, a value is kept unless the other side removed it after seeing it
+type ElementVersion struct {
+	Clock VectorClock `json:"c"`
+	// last write of every exported field
+	Fields map[string]Dot `json:"f,omitempty"`
+	// writes that added the values of the slice fields, by field and JSON encoded value
+	Values map[string]map[string]Dot `json:"s,omitempty"`
+}
+
+// Lamport time of the last write
+func (v *ElementVersion) time() uint64 {
+	time := uint64(0)
+	for _, dot := range v.Fields {
+		if dot.Time > time {
+			time = dot.Time
+		}
+	}
+	for _, values := range v.Values {
+		for _, dot := range values {
+			if dot.Time > time {
+				time = dot.Time
+			}
+		}
+	}
+	return time
+}
+
+// Kept by Optimize in place of a deleted element, so MergeWith knows the id was deleted and which version was
+type tombstone struct {
+	Id      string          `json:"x"`
+	Version *ElementVersion `json:"v,omitempty"`
+}
+
+// only the clock of the delete is kept, the values of the element are gone with it
+func newTombstone(id string, version *ElementVersion) tombstone {
+	if version == nil {
+		return tombstone{Id: id}
+	}
+	return tombstone{id, &ElementVersion{Clock: version.Clock}}
+}
+
+// the version stored with the element or the tombstone, nil for the ones written without a ReplicaId
+func decodeVersion(item *ShardOffset, data []byte) (*ElementVersion, error) {
+	if item.Tombstone {
+		t := new(tombstone)
+		err := json.Unmarshal(data, t)
+		return t.Version, err
+	}
+	// the payload is skipped, its type does not have to be registered
+	var e struct {
+		Id      string
+		Version *ElementVersion
+	}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&e)
+	return e.Version, err
+}
+
+// the struct the payload points to
+func versionedStruct(payload interface{}) (reflect.Value, error) {
+	v := reflect.ValueOf(payload)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return v, errors.New("versioned payload is not a struct")
+	}
+	return v, nil
+}
+
+// the values of slice fields are merged as a set, byte slices are plain values
+func isSetField(v reflect.Value) bool {
+	return v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8
+}
+
+// the distinct values of the slice by their encoding, in the order of the slice
+func setValues(v reflect.Value) ([]string, map[string]reflect.Value, error) {
+	keys := make([]string, 0, v.Len())
+	values := make(map[string]reflect.Value, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		data, err := json.Marshal(v.Index(i).Interface())
+		if err != nil {
+			return nil, nil, err
+		}
+		key := string(data)
+		if _, ok := values[key]; ok {
+			continue
+		}
+		keys = append(keys, key)
+		values[key] = v.Index(i)
+	}
+	return keys, values, nil
+}
+
+// The version of a write of the payload by the replica. Previous is the stored version, nil for a new element,
+// previousPayload is nil when the element was deleted. Only the changed fields and the added values get the new dot
+func nextVersion(replica string, previous *ElementVersion, previousPayload, payload interface{}) (*ElementVersion, error) {
+	next := &ElementVersion{Clock: VectorClock{}, Fields: make(map[string]Dot), Values: make(map[string]map[string]Dot)}
+	time := uint64(0)
+	if previous != nil {
+		next.Clock = previous.Clock.merge(nil)
+		time = previous.time()
+	}
+	next.Clock[replica]++
+	dot := Dot{replica, next.Clock[replica], time + 1}
+
+	v, err := versionedStruct(payload)
+	if err != nil {
+		return nil, err
+	}
+	var pv reflect.Value
+	if previous != nil && previousPayload != nil {
+		if pv, err = versionedStruct(previousPayload); err != nil || pv.Type() != v.Type() {
+			pv = reflect.Value{}
+		}
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath != "" {
+			// unexported
+			continue
+		}
+		name := t.Field(i).Name
+		stamp, ok := previous.field(name)
+		if !ok || !pv.IsValid() || !reflect.DeepEqual(v.Field(i).Interface(), pv.Field(i).Interface()) {
+			stamp = dot
+		}
+		next.Fields[name] = stamp
+		if !isSetField(v.Field(i)) {
+			continue
+		}
+		keys, _, err := setValues(v.Field(i))
+		if err != nil {
+			return nil, errors.New("failed to version field " + name + " due " + err.Error())
+		}
+		values := make(map[string]Dot, len(keys))
+		for _, key := range keys {
+			if added, ok := previous.value(name, key); ok && pv.IsValid() {
+				values[key] = added
+			} else {
+				values[key] = dot
+			}
+		}
+		next.Values[name] = values
+	}
+	return next, nil
+}
+
+func (v *ElementVersion) field(name string) (Dot, bool) {
+	if v == nil {
+		return Dot{}, false
+	}
+	dot, ok := v.Fields[name]
+	return dot, ok
+}
+
+func (v *ElementVersion) value(field, key string) (Dot, bool) {
+	if v == nil {
+		return Dot{}, false
+	}
+	dot, ok := v.Values[field][key]
+	return dot, ok
+}
+
+// Resolves concurrent versions of an element field by field, both sides get the same result
+func mergeVersions(local *ElementVersion, localPayload interface{}, other *ElementVersion, otherPayload interface{}) (interface{}, *ElementVersion, error) {
+	lv, err := versionedStruct(localPayload)
+	if err != nil {
+		return nil, nil, err
+	}
+	ov, err := versionedStruct(otherPayload)
+	if err != nil {
+		return nil, nil, err
+	}
+	if lv.Type() != ov.Type() {
+		return nil, nil, errors.New("versions of the element are of different types")
+	}
+	result := reflect.New(lv.Type())
+	result.Elem().Set(lv)
+	rv := result.Elem()
+	merged := &ElementVersion{Clock: local.Clock.merge(other.Clock), Fields: make(map[string]Dot),
+		Values: make(map[string]map[string]Dot)}
+
+	t := lv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath != "" {
+			continue
+		}
+		name := t.Field(i).Name
+		lstamp, lok := local.Fields[name]
+		ostamp, ook := other.Fields[name]
+		otherWins := ook && (!lok || ostamp.after(lstamp))
+		if otherWins {
+			rv.Field(i).Set(ov.Field(i))
+			merged.Fields[name] = ostamp
+		} else if lok {
+			merged.Fields[name] = lstamp
+		}
+		if !isSetField(lv.Field(i)) {
+			continue
+		}
+
+		lkeys, lvalues, err := setValues(lv.Field(i))
+		if err != nil {
+			return nil, nil, err
+		}
+		okeys, ovalues, err := setValues(ov.Field(i))
+		if err != nil {
+			return nil, nil, err
+		}
+		ldots, odots := local.Values[name], other.Values[name]
+		kept := make(map[string]Dot)
+		for _, key := range lkeys {
+			dot := ldots[key]
+			if odot, ok := odots[key]; ok {
+				if odot.after(dot) {
+					dot = odot
+				}
+				kept[key] = dot
+			} else if dot.Counter > other.Clock[dot.Replica] {
+				// added after the other side's version, not removed by it
+				kept[key] = dot
+			}
+		}
+		for _, key := range okeys {
+			if _, ok := lvalues[key]; ok {
+				continue
+			}
+			if dot := odots[key]; dot.Counter > local.Clock[dot.Replica] {
+				kept[key] = dot
+			}
+		}
+		merged.Values[name] = kept
+
+		// the values keep the order of the winning side, the ones only the other side has follow sorted
+		keys, values, restKeys, restValues := lkeys, lvalues, okeys, ovalues
+		if otherWins {
+			keys, values, restKeys, restValues = okeys, ovalues, lkeys, lvalues
+		}
+		if len(kept) == 0 {
+			rv.Field(i).Set(reflect.Zero(lv.Field(i).Type()))
+			continue
+		}
+		slice := reflect.MakeSlice(lv.Field(i).Type(), 0, len(kept))
+		for _, key := range keys {
+			if _, ok := kept[key]; ok {
+				slice = reflect.Append(slice, values[key])
+			}
+		}
+		rest := make([]string, 0)
+		for _, key := range restKeys {
+			if _, ok := kept[key]; ok {
+				if _, taken := values[key]; !taken {
+					rest = append(rest, key)
+				}
+			}
+		}
+		sort.Strings(rest)
+		for _, key := range rest {
+			slice = reflect.Append(slice, restValues[key])
+		}
+		rv.Field(i).Set(slice)
+	}
+	return result.Interface(), merged, nil
+}
+
+// the version of a write of the payload under the id, nil unless the database has a ReplicaId
+func (c *Collection) nextVersion(id string, payload CustomStructure) (*ElementVersion, error) {
+	replica := c.options.replicaId()
+	if replica == "" {
+		return nil, nil
+	}
+	previous, previousPayload, err := c.storedVersion(id)
+	if err != nil {
+		return nil, errors.New("failed to read the version of " + id + " due " + err.Error())
+	}
+	return nextVersion(replica, previous, previousPayload, payload)
+}
+
+// the stored version of the element and its payload, a deleted element has no payload
+func (c *Collection) storedVersion(id string) (*ElementVersion, interface{}, error) {
+	idKey := "id:" + id
+	shard, err := c.getShardByKeySafe(idKey)
+	if err != nil {
+		return nil, nil, nil
+	}
+	shard.RLock()
+	item, ok := shard.Items[idKey]
+	if !ok {
+		shard.RUnlock()
+		return nil, nil, nil
+	}
+	current := *item
+	data, err := shard.readAt(item)
+	shard.RUnlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	version, err := decodeVersion(&current, data)
+	if err != nil || current.Deleted {
+		return version, nil, err
+	}
+	e, err := c.DecodeElement(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return version, e.Payload, nil
+}
+
+// the version of a delete of the element, nil unless the database has a ReplicaId and the element is live
+func (c *Collection) deleteVersion(id string) (*ElementVersion, error) {
+	replica := c.options.replicaId()
+	if replica == "" {
+		return nil, nil
+	}
+	previous, previousPayload, err := c.storedVersion(id)
+	if err != nil {
+		return nil, errors.New("failed to read the version of " + id + " due " + err.Error())
+	}
+	if previousPayload == nil {
+		return nil, nil
+	}
+	clock := VectorClock(nil)
+	if previous != nil {
+		clock = previous.Clock
+	}
+	clock = clock.merge(nil)
+	clock[replica]++
+	return &ElementVersion{Clock: clock}, nil
+}
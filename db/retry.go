@@ -0,0 +1,36 @@
+package db
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+type RetryPolicy struct {
+	Attempts int           // total number of attempts, values below 2 disable the retries
+	Backoff  time.Duration // delay before the first retry, doubled after every attempt
+	// decides whether the error is worth another attempt, IsTransientError when nil
+	Retryable func(err error) bool
+}
+
+// errors that are likely to disappear on their own (interrupted calls, busy or unresponsive storage)
+func IsTransientError(err error) bool {
+	return errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.ETIMEDOUT)
+}
+
+// runs fn until it succeeds, fails with a permanent error or runs out of attempts
+func (p RetryPolicy) Do(fn func() error) error {
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsTransientError
+	}
+	backoff := p.Backoff
+	err := fn()
+	for attempt := 1; err != nil && attempt < p.Attempts && retryable(err); attempt++ {
+		time.Sleep(backoff)
+		backoff *= 2
+		err = fn()
+	}
+	return err
+}
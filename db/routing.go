@@ -0,0 +1,66 @@
+package db
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Where a key of a collection is routed to and what the shards store under it
+type RoutingExplanation struct {
+	Key string `json:"key"`
+	// shard recorded in the destinations of the collection, -1 when the key has none
+	Destination int `json:"destination"`
+	// shards storing the key. Several of them or one other than the destination means a broken routing
+	Shards []int `json:"shards"`
+	// shard the entry below is read from, the destination when it stores the key. -1 when no shard does
+	Shard int `json:"shard"`
+	// segment file holding the element
+	Path   string       `json:"path,omitempty"`
+	Offset *ShardOffset `json:"offset,omitempty"`
+	// every key of the shard pointing at the element, sorted
+	IndexEntries []string `json:"index_entries,omitempty"`
+}
+
+// Explains the routing of a key for debugging, e.g. of elements that can't be found after a merge or a migration.
+// The key is an element id or a key of the destinations (id:<id>, <field>:<value> or <slot>:<field>:<value>).
+// Every shard is searched for the key, so this is slow on large collections
+func (c *Collection) ExplainRouting(key string) *RoutingExplanation {
+	if !strings.Contains(key, ":") {
+		key = "id:" + key
+	}
+	e := &RoutingExplanation{Key: key, Destination: -1, Shards: make([]int, 0), Shard: -1}
+	c.sharedDestMx.RLock()
+	if dest, ok := c.ShardDestinations[key]; ok && dest != nil {
+		e.Destination = *dest
+	}
+	c.sharedDestMx.RUnlock()
+
+	for _, shard := range c.Map.Shared {
+		shard.RLock()
+		item, ok := shard.Items[key]
+		if ok {
+			e.Shards = append(e.Shards, shard.Id)
+			if e.Shard == -1 || shard.Id == e.Destination {
+				e.explainEntry(shard, item)
+			}
+		}
+		shard.RUnlock()
+	}
+	return e
+}
+
+// the lock of the shard must be held
+func (e *RoutingExplanation) explainEntry(shard *ConcurrentMapShared, item *ShardOffset) {
+	offset := *item
+	e.Shard = shard.Id
+	e.Offset = &offset
+	e.Path = filepath.Join(shard.SyncDestination, shardSegmentName(shard.Id, item.Segment))
+	e.IndexEntries = make([]string, 0)
+	for key, other := range shard.Items {
+		if other == item {
+			e.IndexEntries = append(e.IndexEntries, key)
+		}
+	}
+	sort.Strings(e.IndexEntries)
+}
@@ -0,0 +1,172 @@
+package db
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+type shardReservoir struct {
+	shard *ConcurrentMapShared
+	// number of live elements in the shard
+	count int
+	// uniform sample of the live elements in random order
+	items []ShardOffset
+}
+
+// reservoir sampling of n live elements of the shard
+func (shard *ConcurrentMapShared) reservoir(n int) *shardReservoir {
+	shard.RLock()
+	defer shard.RUnlock()
+	r := &shardReservoir{shard: shard, items: make([]ShardOffset, 0, n)}
+	for key, item := range shard.Items {
+		// every element has exactly one id key
+		if item.Deleted || !strings.HasPrefix(key, "id:") {
+			continue
+		}
+		r.count++
+		if len(r.items) < n {
+			r.items = append(r.items, *item)
+		} else if j := rand.Intn(r.count); j < n {
+			r.items[j] = *item
+		}
+	}
+	rand.Shuffle(len(r.items), func(i, j int) { r.items[i], r.items[j] = r.items[j], r.items[i] })
+	return r
+}
+
+// uniform random sample of n live elements (fewer if the collection is smaller).
+// Every shard is sampled separately and the samples are merged in proportion to the shard sizes,
+// only the chosen elements are read from the drive
+func (c *Collection) Sample(n int) ([]*Element, error) {
+	if n <= 0 {
+		return nil, errors.New("invalid sample size")
+	}
+	reservoirs := make([]*shardReservoir, 0, len(c.Map.Shared))
+	total := 0
+	for _, shard := range c.Map.Shared {
+		r := shard.reservoir(n)
+		if r.count > 0 {
+			reservoirs = append(reservoirs, r)
+			total += r.count
+		}
+	}
+
+	result := make([]*Element, 0, n)
+	for len(result) < n && total > 0 {
+		// choosing the shard by its remaining size keeps the merged sample uniform
+		pick := rand.Intn(total)
+		var r *shardReservoir
+		for _, r = range reservoirs {
+			if pick < r.count {
+				break
+			}
+			pick -= r.count
+		}
+		offset := r.items[0]
+		r.items = r.items[1:]
+		r.count--
+		total--
+
+		r.shard.RLock()
+		data, err := r.shard.readAt(&offset)
+		r.shard.RUnlock()
+		if err != nil {
+			return result, err
+		}
+		e, err := c.DecodeElement(data)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, e)
+	}
+	return result, nil
+}
+
+// uniformly chosen live element
+func (c *Collection) RandomElement() (*Element, error) {
+	sample, err := c.Sample(1)
+	if err != nil {
+		return nil, err
+	}
+	if len(sample) == 0 {
+		return nil, errors.New("collection is empty")
+	}
+	return sample[0], nil
+}
+
+// value of the field stored in the index key, false for keys of other fields
+func indexedValue(key, field string) (string, bool) {
+	if strings.HasPrefix(key, field+":") {
+		// unique key
+		return key[len(field)+1:], true
+	}
+	pos := strings.Index(key, ":")
+	if pos <= 0 || !strings.HasPrefix(key[pos+1:], field+":") {
+		return "", false
+	}
+	if _, err := strconv.Atoi(key[:pos]); err != nil {
+		return "", false
+	}
+	return key[pos+1+len(field)+1:], true
+}
+
+// the numeric value of an index entry. Declared indexes keep numbers as EncodeFloat, the values of
+// GetDataIndex are taken as decimal. Encoded ones there (EncodeInt, EncodeFloat...) can't be told apart
+// from each other and from a decimal of 16 digits, they are rejected
+func indexWeight(value string, declared bool) (float64, bool) {
+	if declared {
+		weight, err := DecodeFloat(value)
+		return weight, err == nil
+	}
+	if _, err := DecodeUint(value); err == nil {
+		return 0, false
+	}
+	weight, err := strconv.ParseFloat(value, 64)
+	return weight, err == nil
+}
+
+// live element chosen with a probability proportional to the numeric value of the indexed field,
+// elements with a missing, non-numeric or non-positive value are never chosen, see indexWeight.
+// Only the index is walked, the chosen element is the only one read from the drive
+func (c *Collection) RandomElementWeighted(field string) (*Element, error) {
+	var (
+		chosen      ShardOffset
+		chosenShard *ConcurrentMapShared
+		total       float64
+	)
+	_, declared := c.declaredIndex(field)
+	for _, shard := range c.Map.Shared {
+		shard.RLock()
+		for key, item := range shard.Items {
+			if item.Deleted {
+				continue
+			}
+			value, ok := indexedValue(key, field)
+			if !ok {
+				continue
+			}
+			weight, ok := indexWeight(value, declared)
+			if !ok || weight <= 0 {
+				continue
+			}
+			// weighted reservoir of a single element
+			total += weight
+			if rand.Float64()*total < weight {
+				chosen, chosenShard = *item, shard
+			}
+		}
+		shard.RUnlock()
+	}
+	if chosenShard == nil {
+		return nil, errors.New("no element has a positive weight in the indexed field " + field)
+	}
+	chosenShard.RLock()
+	data, err := chosenShard.readAt(&chosen)
+	chosenShard.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	return c.DecodeElement(data)
+}
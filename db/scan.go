@@ -0,0 +1,175 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Size of a single read issued by sequential scans, neighbouring elements are read at once
+var READ_AHEAD_SIZE int64 = 1024 * 1024
+
+// Returned by the callback of ForEach to stop the iteration without an error
+var StopIteration = errors.New("stop iteration")
+
+type scanChunk struct {
+	segment int
+	start   int64
+	length  int64
+	items   []*ShardOffset
+}
+
+type scannedChunk struct {
+	parts [][]byte
+	err   error
+}
+
+type decodedElement struct {
+	element *Element
+	err     error
+}
+
+// groups the live elements of the shard into chunks that can be read with a single call
+func (shard *ConcurrentMapShared) planScan() []*scanChunk {
+	shard.RLock()
+	defer shard.RUnlock()
+
+	order := make(map[int]int, len(shard.Segments))
+	for i, segment := range shard.Segments {
+		order[segment] = i
+	}
+	items := make([]*ShardOffset, 0, len(shard.Items))
+	for key, item := range shard.Items {
+		// every element has exactly one id key
+		if !item.Deleted && strings.HasPrefix(key, "id:") {
+			items = append(items, &ShardOffset{Start: item.Start, Length: item.Length, Segment: item.Segment})
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Segment != items[j].Segment {
+			return order[items[i].Segment] < order[items[j].Segment]
+		}
+		return items[i].Start < items[j].Start
+	})
+
+	active := shard.activeSegment()
+	chunks := make([]*scanChunk, 0)
+	var current *scanChunk
+	for _, item := range items {
+		end := item.Start + int64(item.Length)
+		// buffered data can not be read together with the data on the drive
+		buffered := item.Segment == active && item.Start >= shard.flushed
+		if current == nil || current.segment != item.Segment || end-current.start > READ_AHEAD_SIZE ||
+			(buffered && current.start < shard.flushed) {
+			current = &scanChunk{segment: item.Segment, start: item.Start}
+			chunks = append(chunks, current)
+		}
+		current.length = end - current.start
+		current.items = append(current.items, item)
+	}
+	return chunks
+}
+
+// walks every live element of the collection in the order it is stored on the drive.
+// The next chunk is read and decoded in the background while the callback runs.
+// Returning StopIteration from the callback ends the walk without an error
+func (c *Collection) ForEach(fn func(e *Element) error) error {
+	return c.forEach(context.Background(), fn)
+}
+
+// the reads honor the context, its error ends the iteration
+func (c *Collection) forEach(ctx context.Context, fn func(e *Element) error) error {
+	done := make(chan struct{})
+	elements := make(chan decodedElement, 64)
+	chunks := make(chan scannedChunk, 2)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	// reader
+	go func() {
+		defer wg.Done()
+		defer close(chunks)
+		for _, shard := range c.Map.Shared {
+			for _, chunk := range shard.planScan() {
+				data, err := c.readScanned(ctx, shard, chunk)
+				if err != nil {
+					select {
+					case chunks <- scannedChunk{err: err}:
+					case <-done:
+					}
+					return
+				}
+				parts := make([][]byte, len(chunk.items))
+				for i, item := range chunk.items {
+					parts[i] = data[item.Start-chunk.start : item.Start-chunk.start+int64(item.Length)]
+				}
+				select {
+				case chunks <- scannedChunk{parts: parts}:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+	// decoder
+	go func() {
+		defer wg.Done()
+		defer close(elements)
+		for chunk := range chunks {
+			if chunk.err != nil {
+				select {
+				case elements <- decodedElement{err: chunk.err}:
+				case <-done:
+				}
+				return
+			}
+			for _, part := range chunk.parts {
+				var de decodedElement
+				de.element, de.err = c.decodeScanned(part)
+				select {
+				case elements <- de:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+
+	// deferred, so a panicking fn stops the pipeline as well
+	defer func() {
+		close(done)
+		// drain whatever is left so the pipeline can finish
+		for range elements {
+		}
+		wg.Wait()
+	}()
+	var err error
+	for de := range elements {
+		err = de.err
+		if err == nil {
+			err = fn(de.element)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == StopIteration {
+		return nil
+	}
+	return err
+}
+
+// panics of the scanning goroutines end the scan with a PanicError
+func (c *Collection) readScanned(ctx context.Context, shard *ConcurrentMapShared, chunk *scanChunk) (data []byte, err error) {
+	defer recoverPanic("scan of "+c.Name, &err)
+	shard.RLock()
+	defer shard.RUnlock()
+	return shard.readAtContext(ctx, &ShardOffset{Start: chunk.start, Length: int(chunk.length), Segment: chunk.segment})
+}
+
+func (c *Collection) decodeScanned(data []byte) (e *Element, err error) {
+	defer recoverPanic("scan of "+c.Name, &err)
+	return c.DecodeElement(data)
+}
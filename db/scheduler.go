@@ -0,0 +1,171 @@
+package db
+
+import (
+	"errors"
+	"sync"
+)
+
+const (
+	PRIORITY_LOW = iota
+	PRIORITY_NORMAL
+	PRIORITY_HIGH
+)
+
+// Returned for the tasks still queued when the scheduler is closed
+var ErrSchedulerClosed = errors.New("scheduler is closed")
+
+type task struct {
+	name string
+	fn   func() error
+	done chan error
+}
+
+// Runs the background work of a database (synchronization, compaction, maintenance of indexes and caches)
+// on a limited number of workers, so it never takes more than the budget set by the application.
+// Higher priorities run first, tasks of the same priority in the order they were submitted.
+// Low priority tasks may be confined to maintenance windows, see SetMaintenanceWindows
+type Scheduler struct {
+	mx   sync.Mutex
+	cond *sync.Cond
+	// by priority
+	queues  [PRIORITY_HIGH + 1][]*task
+	workers int
+	alive   int
+	running int
+	closed  bool
+	wg      sync.WaitGroup
+	// set by SetMaintenanceWindows
+	windows    []MaintenanceWindow
+	clock      Clock
+	windowStop chan struct{}
+	windowDone chan struct{}
+}
+
+// workers below 1 are raised to 1
+func NewScheduler(workers int) *Scheduler {
+	s := &Scheduler{}
+	s.cond = sync.NewCond(&s.mx)
+	s.SetWorkers(workers)
+	return s
+}
+
+// changes the number of workers, surplus workers stop once their current task is finished
+func (s *Scheduler) SetWorkers(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.workers = workers
+	for s.alive < s.workers && !s.closed {
+		s.alive++
+		s.wg.Add(1)
+		go s.work()
+	}
+	s.cond.Broadcast()
+}
+
+func (s *Scheduler) Workers() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.workers
+}
+
+// Queues the task, the returned channel receives its result. A panic of the task is returned as a PanicError
+func (s *Scheduler) Submit(name string, priority int, fn func() error) <-chan error {
+	if priority < PRIORITY_LOW {
+		priority = PRIORITY_LOW
+	} else if priority > PRIORITY_HIGH {
+		priority = PRIORITY_HIGH
+	}
+	t := &task{name, fn, make(chan error, 1)}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.closed {
+		t.done <- ErrSchedulerClosed
+		return t.done
+	}
+	s.queues[priority] = append(s.queues[priority], t)
+	s.cond.Signal()
+	return t.done
+}
+
+// number of queued and running tasks
+func (s *Scheduler) Pending() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	n := s.running
+	for _, q := range s.queues {
+		n += len(q)
+	}
+	return n
+}
+
+// the queued task of the highest priority, the lock is held
+func (s *Scheduler) next() *task {
+	for p := PRIORITY_HIGH; p >= PRIORITY_LOW; p-- {
+		if p == PRIORITY_LOW && !s.inMaintenance() {
+			continue
+		}
+		if len(s.queues[p]) > 0 {
+			t := s.queues[p][0]
+			s.queues[p][0] = nil
+			s.queues[p] = s.queues[p][1:]
+			return t
+		}
+	}
+	return nil
+}
+
+func (s *Scheduler) work() {
+	defer s.wg.Done()
+	s.mx.Lock()
+	for {
+		if s.alive > s.workers || s.closed {
+			s.alive--
+			s.mx.Unlock()
+			return
+		}
+		t := s.next()
+		if t == nil {
+			s.cond.Wait()
+			continue
+		}
+		s.running++
+		s.mx.Unlock()
+		t.done <- t.run()
+		s.mx.Lock()
+		s.running--
+	}
+}
+
+func (t *task) run() (err error) {
+	defer recoverPanic("background task "+t.name, &err)
+	return t.fn()
+}
+
+// waits for the running tasks, the queued ones receive ErrSchedulerClosed
+func (s *Scheduler) Close() {
+	s.mx.Lock()
+	s.closed = true
+	for p := range s.queues {
+		for _, t := range s.queues[p] {
+			t.done <- ErrSchedulerClosed
+		}
+		s.queues[p] = nil
+	}
+	s.cond.Broadcast()
+	stop, done := s.windowStop, s.windowDone
+	s.windowStop, s.windowDone = nil, nil
+	s.mx.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	s.wg.Wait()
+}
+
+// scheduler of the background work of the database, applications can queue their own tasks too
+func (db *Database) Scheduler() *Scheduler {
+	return db.scheduler
+}
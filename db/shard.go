@@ -1,36 +1,106 @@
 package db
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
-	"io/ioutil"
+	"io"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Data of every shard is split along segment files of %SEGMENT_SIZE% bytes.
+// Only the last (active) segment is appended to, sealed segments are never modified
+// and get merged into a new one by the compaction.
+var SEGMENT_SIZE int64 = 64 * 1024 * 1024
+
 // A "thread" safe string to anything map.
 type ConcurrentMapShared struct {
 	Id         int                     `json:"id"`
 	Items      map[string]*ShardOffset `json:"items"`
 	Capacities map[string]int          `json:"enum"`
-	file       *os.File                `json:"-"`
+	Segments   []int                   `json:"segments"` // the last one is the active segment
+	file       *os.File                `json:"-"`        // active segment
+	segments   map[int]*os.File        `json:"-"`
+	flushed    int64                   `json:"-"` // size of the active segment on the drive
+	synced     int64                   `json:"-"` // size of the active segment at its last fsync
+
+	// data appended to the active segment that has not been written to the drive yet
+	pending     []byte
+	bufferLimit int
+	// set when the items change, cleared once the meta is written
+	dirty int32
+	// counts the changes, see ConcurrentMap.generation
+	generation uint64
+	options    *DatabaseOptions
+	io         *shardIO
+	ioOnce     sync.Once
+	// meta mapped at the load, decoded by the first lock of the shard
+	meta     *flatMeta
+	metaOnce sync.Once
+	mapped   int32
+	// loaded from a meta written by an older version
+	legacy bool
+	// entries changed since the meta was written, appended to it by the next sync (encodeMetaDelta)
+	changedKeys       map[string]bool
+	changedOffsets    map[*ShardOffset]bool
+	changedCapacities map[string]bool
+	// the entries were moved, the next sync rewrites the meta
+	rewriteMeta bool
+	// bytes of the meta file and of its base tables, 0 when the file is not known to be intact
+	metaSize, metaBase int64
+	// syncs share the read lock, they take turns on the file
+	metaMx sync.Mutex
+	// segments merged by Optimize that the meta on the drive still lists, and the ones
+	// a written meta left out already, removed by the next manifest. Guarded by metaMx
+	retired, obsolete []int
+	// segments are opened for reading only
+	readOnly bool
+	// the segments are read from a bundle or a file system instead of their files
+	external *externalSegments
 
 	mx sync.RWMutex // Read Write mutex, guards access to internal map.
 
 	SyncDestination string
 }
 
+type segmentPosition struct {
+	segment int
+	start   int64
+}
+
 func NewConcurrentMapShared(syncDest string, id int, f *os.File) *ConcurrentMapShared {
-	return &ConcurrentMapShared{Id: id, Items: make(map[string]*ShardOffset), Capacities: make(map[string]int), file: f, SyncDestination: syncDest}
+	shard := &ConcurrentMapShared{Id: id, Items: make(map[string]*ShardOffset), Capacities: make(map[string]int),
+		Segments: []int{0}, file: f, segments: map[int]*os.File{0: f}, SyncDestination: syncDest}
+	if f != nil {
+		if fi, err := f.Stat(); err == nil {
+			shard.flushed = fi.Size()
+		}
+	}
+	return shard
+}
+
+func shardSegmentName(id, segment int) string {
+	if segment == 0 {
+		return shardDataName(id)
+	}
+	return "shard_" + strconv.Itoa(id) + "." + strconv.Itoa(segment) + ".gobs"
 }
 
 func (shard *ConcurrentMapShared) Lock() {
+	shard.loadMeta()
 	shard.mx.Lock()
 }
 
 func (shard *ConcurrentMapShared) RLock() {
+	shard.loadMeta()
 	shard.mx.RLock()
 }
 
@@ -43,84 +113,625 @@ func (shard *ConcurrentMapShared) RUnlock() {
 }
 
 func (shard *ConcurrentMapShared) Sync() error {
-	shard.mx.RLock()
-	defer shard.mx.RUnlock()
-	p := NewEncodedCompressedPackage(shard.SyncDestination + "/shard_" + strconv.Itoa(shard.Id) + "_meta.gob.gzip")
-	p.SetData(shard)
-	return p.Save()
+	return shard.SyncContext(context.Background())
 }
 
-func (shard *ConcurrentMapShared) applyOffset(move, after int64) {
-	for _, item := range shard.Items {
-		if item.Start > after {
-			item.Start -= move
+func (shard *ConcurrentMapShared) SyncContext(ctx context.Context) error {
+	if shard.IsMapped() {
+		// never accessed since the load, the file is up to date
+		return nil
+	}
+	shard.RLock()
+	defer shard.RUnlock()
+	shard.metaMx.Lock()
+	defer shard.metaMx.Unlock()
+	// writers are excluded by the lock, so nothing can be missed between here and the save
+	atomic.StoreInt32(&shard.dirty, 0)
+	err := shard.writeMeta(ctx)
+	if err != nil {
+		shard.markDirty()
+	}
+	return err
+}
+
+// the segments merged by Optimize that a written meta left out
+func (shard *ConcurrentMapShared) obsoleteSegments() []int {
+	shard.metaMx.Lock()
+	defer shard.metaMx.Unlock()
+	return append([]int(nil), shard.obsolete...)
+}
+
+// the segments merged by Optimize whose files were not removed yet
+func (shard *ConcurrentMapShared) droppedSegments() []int {
+	shard.metaMx.Lock()
+	defer shard.metaMx.Unlock()
+	return append(append([]int(nil), shard.retired...), shard.obsolete...)
+}
+
+// removes the files of the obsolete segments once a saved manifest describes the shard without them
+func (shard *ConcurrentMapShared) removeSegments(segments []int) {
+	shard.metaMx.Lock()
+	defer shard.metaMx.Unlock()
+	removed := make(map[int]bool, len(segments))
+	for _, segment := range segments {
+		os.Remove(shard.segmentPath(segment))
+		removed[segment] = true
+	}
+	obsolete := shard.obsolete[:0]
+	for _, segment := range shard.obsolete {
+		if !removed[segment] {
+			obsolete = append(obsolete, segment)
 		}
 	}
+	shard.obsolete = obsolete
 }
 
-func (shard *ConcurrentMapShared) adjustCapacity(key string) {
-	fullKey := "n:" + key
-	if item, ok := shard.Capacities[fullKey]; ok {
-		item--
-		if item <= 0 {
-			shard.DeleteCapacityKey(key)
-			return
+// appends the changes to the meta file or rewrites it
+func (shard *ConcurrentMapShared) writeMeta(ctx context.Context) error {
+	path := filepath.Join(shard.SyncDestination, shardMetaName(shard.Id))
+	delta, ok, err := shard.encodeMetaDelta()
+	if err != nil {
+		return err
+	}
+	if ok {
+		err = shard.options.appendContext(ctx, path, delta)
+		if err != nil {
+			// the end of the file is unknown
+			shard.metaSize = 0
+			return err
 		}
-		shard.Capacities[fullKey] = item
+		shard.metaWritten(shard.metaSize+int64(len(delta)), shard.metaBase)
+		return nil
+	}
+	data, err := shard.encodeFlatMeta()
+	if err != nil {
+		return err
 	}
+	err = shard.options.writeAtomicallyContext(ctx, path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	shard.metaWritten(int64(len(data)), int64(len(data)))
+	return nil
 }
 
-func (shard *ConcurrentMapShared) Optimize() (int64, error) {
-	shard.mx.Lock()
-	defer shard.mx.Unlock()
+func (shard *ConcurrentMapShared) markDirty() {
+	atomic.AddUint64(&shard.generation, 1)
+	atomic.StoreInt32(&shard.dirty, 1)
+}
 
-	fi, err := shard.file.Stat()
+func (shard *ConcurrentMapShared) IsDirty() bool {
+	return atomic.LoadInt32(&shard.dirty) == 1
+}
+
+func (shard *ConcurrentMapShared) activeSegment() int {
+	return shard.Segments[len(shard.Segments)-1]
+}
+
+func (shard *ConcurrentMapShared) nextSegment() int {
+	next := 0
+	for _, s := range shard.Segments {
+		if s >= next {
+			next = s + 1
+		}
+	}
+	return next
+}
+
+func (shard *ConcurrentMapShared) segmentPath(segment int) string {
+	return filepath.Join(shard.SyncDestination, shardSegmentName(shard.Id, segment))
+}
+
+func (shard *ConcurrentMapShared) segmentFile(segment int) (*os.File, error) {
+	if f, ok := shard.segments[segment]; ok {
+		return f, nil
+	}
+	return nil, errors.New("segment " + strconv.Itoa(segment) + " of shard " + strconv.Itoa(shard.Id) + " does not exist")
+}
+
+// the reader of the segment and the position of the segment in it, the segments of a bundle share its file
+func (shard *ConcurrentMapShared) segmentReader(segment int) (io.ReaderAt, int64, error) {
+	if shard.external != nil {
+		s, ok := shard.external.segments[segment]
+		if !ok {
+			return nil, 0, errors.New("segment " + strconv.Itoa(segment) + " of shard " + strconv.Itoa(shard.Id) + " does not exist")
+		}
+		return s.r, s.base, nil
+	}
+	f, err := shard.segmentFile(segment)
 	if err != nil {
-		return 0, err
+		return nil, 0, err
 	}
+	return shard.instrument(f), 0, nil
+}
 
-	_, err = shard.file.Seek(0, 0)
+// opens every segment listed in the meta
+func (shard *ConcurrentMapShared) openSegments() error {
+	if len(shard.Segments) == 0 {
+		// shard was written before the segments existed
+		shard.Segments = []int{0}
+	}
+	shard.segments = make(map[int]*os.File, len(shard.Segments))
+	flag := os.O_RDWR
+	if shard.readOnly {
+		flag = os.O_RDONLY
+	}
+	for _, segment := range shard.Segments {
+		f, err := os.OpenFile(shard.segmentPath(segment), flag, os.ModePerm)
+		if err != nil {
+			shard.closeSegments()
+			return errors.New("shard segment (" + shardSegmentName(shard.Id, segment) + ") is unavailable")
+		}
+		shard.segments[segment] = f
+	}
+	shard.file = shard.segments[shard.activeSegment()]
+	fi, err := shard.file.Stat()
 	if err != nil {
-		return 0, err
+		shard.closeSegments()
+		return err
 	}
+	shard.flushed = fi.Size()
+	return nil
+}
+
+func (shard *ConcurrentMapShared) closeSegments() {
+	for _, f := range shard.segments {
+		f.Close()
+	}
+	if shard.external != nil {
+		shard.external.close()
+	}
+}
 
-	// load the whole shard into the memory
-	shardData := make([]byte, fi.Size())
-	_, err = shard.file.Read(shardData)
+// writes out the buffer, closes the active segment to flush it and opens it again
+func (shard *ConcurrentMapShared) reopenActive(ctx context.Context) error {
+	err := shard.flushPendingContext(ctx)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	// closing the file and flushing the data
+	active := shard.activeSegment()
 	shard.file.Close()
-	buffer := NewSuperBuffer(shardData)
+	f, err := os.OpenFile(shard.segmentPath(active), os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	shard.segments[active] = f
+	shard.file = f
+	return nil
+}
 
-	// redistribute the data
-	pos := 0
-	counter := int64(0)
+// same as reopenActive, takes the lock. Deferred unlocking keeps the shard usable after a recovered panic
+func (shard *ConcurrentMapShared) reopenActiveLocked(ctx context.Context) error {
+	shard.Lock()
+	defer shard.Unlock()
+	return shard.reopenActive(ctx)
+}
+
+// starts a new active segment, the lock must be held
+func (shard *ConcurrentMapShared) seal() error {
+	err := shard.flushPending()
+	if err != nil {
+		return err
+	}
+	next := shard.nextSegment()
+	f, err := shard.options.create(shard.segmentPath(next))
+	if err != nil {
+		return err
+	}
+	shard.instrument(shard.file).Sync()
+	shard.Segments = append(shard.Segments, next)
+	shard.segments[next] = f
+	shard.file = f
+	shard.flushed = 0
+	shard.synced = 0
+	return nil
+}
+
+// size of the write buffer, 0 disables the buffering. The lock must be held
+func (shard *ConcurrentMapShared) setBufferLimit(limit int) error {
+	shard.bufferLimit = limit
+	if limit <= 0 {
+		return shard.flushPending()
+	}
+	return nil
+}
+
+// writes the buffered data to the active segment, the lock must be held
+func (shard *ConcurrentMapShared) flushPending() error {
+	return shard.flushPendingContext(context.Background())
+}
+
+// the buffer is written in chunks checking the context between them. A chunk is never abandoned,
+// so whatever was written stays accounted for and the rest is written by the next flush
+func (shard *ConcurrentMapShared) flushPendingContext(ctx context.Context) error {
+	for len(shard.pending) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		chunk, n := shard.pending[:chunkEnd(0, len(shard.pending))], 0
+		err := shard.options.retryIO(func() (err error) {
+			n, err = shard.instrument(shard.file).WriteAt(chunk, shard.flushed)
+			return err
+		})
+		shard.flushed += int64(n)
+		shard.pending = shard.pending[n:]
+		if err != nil {
+			return err
+		}
+	}
+	shard.pending = nil
+	return nil
+}
+
+// appends the data to the active segment, the lock must be held
+func (shard *ConcurrentMapShared) appendData(data []byte) (*ShardOffset, error) {
+	return shard.appendDataContext(context.Background(), data)
+}
+
+func (shard *ConcurrentMapShared) appendDataContext(ctx context.Context, data []byte) (*ShardOffset, error) {
+	end := shard.flushed + int64(len(shard.pending))
+	if end > 0 && end+int64(len(data)) > SEGMENT_SIZE {
+		err := shard.seal()
+		if err != nil {
+			return nil, err
+		}
+		end = 0
+	}
+	if shard.bufferLimit <= 0 {
+		n := 0
+		err := shard.options.retryIO(func() (err error) {
+			n, err = chunkedWriteAt(ctx, shard.instrument(shard.file), data, end)
+			return err
+		})
+		if err != nil {
+			// an abandoned chunk may still land, the whole region is skipped so it can't overwrite newer data
+			shard.flushed += int64(len(data))
+			return nil, err
+		}
+		shard.flushed += int64(n)
+		return &ShardOffset{Start: end, Length: n, Segment: shard.activeSegment()}, nil
+	}
+	if len(shard.pending)+len(data) > shard.bufferLimit {
+		err := shard.flushPendingContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	shard.pending = append(shard.pending, data...)
+	return &ShardOffset{Start: end, Length: len(data), Segment: shard.activeSegment()}, nil
+}
+
+// reads the data either from the segment file or from the write buffer, the lock must be held
+func (shard *ConcurrentMapShared) readAt(offset *ShardOffset) ([]byte, error) {
+	return shard.readInto(offset, make([]byte, offset.Length))
+}
+
+// same as readAt, the file is read in chunks honoring the context
+func (shard *ConcurrentMapShared) readAtContext(ctx context.Context, offset *ShardOffset) ([]byte, error) {
+	if offset.Segment == shard.activeSegment() && offset.Start >= shard.flushed {
+		return shard.readAt(offset)
+	}
+	r, base, err := shard.segmentReader(offset.Segment)
+	if err != nil {
+		return nil, err
+	}
+	// a fresh buffer, an abandoned chunk may still be written into it
+	data := make([]byte, offset.Length)
+	err = shard.options.retryIO(func() error {
+		_, err := chunkedReadAt(ctx, r, data, base+offset.Start)
+		return err
+	})
+	return data, err
+}
+
+// same as readAt, but the data is read into the given buffer (grown when too small)
+func (shard *ConcurrentMapShared) readInto(offset *ShardOffset, data []byte) ([]byte, error) {
+	if cap(data) < offset.Length {
+		data = make([]byte, offset.Length)
+	}
+	data = data[:offset.Length]
+	if offset.Segment == shard.activeSegment() && offset.Start >= shard.flushed {
+		start := offset.Start - shard.flushed
+		if start+int64(offset.Length) > int64(len(shard.pending)) {
+			return nil, errors.New("offset is out of the shard bounds")
+		}
+		copy(data, shard.pending[start:])
+		return data, nil
+	}
+	r, base, err := shard.segmentReader(offset.Segment)
+	if err != nil {
+		return nil, err
+	}
+	err = shard.options.retryIO(func() error {
+		_, err := r.ReadAt(data, base+offset.Start)
+		return err
+	})
+	return data, err
+}
+
+// gob does not preserve shared pointers, so after the loading every key of an element
+// has its own copy of the offset. Make them share a single one again
+func (shard *ConcurrentMapShared) shareOffsets() {
+	shared := make(map[segmentPosition]*ShardOffset, len(shard.Items))
 	for key, item := range shard.Items {
-		if item.Deleted {
-			buffer.Cut(item.Start, item.Length)
-			shard.applyOffset(int64(item.Length), item.Start)
-			// adjust the capacity of a set
-			pos = strings.Index(key, ":")
-			if pos >= 0 {
-				shard.adjustCapacity(key[pos+1:])
-			}
+		pos := segmentPosition{item.Segment, item.Start}
+		if s, ok := shared[pos]; ok {
+			s.Deleted = s.Deleted || item.Deleted
+			shard.Items[key] = s
+			continue
+		}
+		shared[pos] = item
+	}
+}
+
+// splits the key of a regular index entry "<slot>:<field>:<value>" into its slot and set
+func slotKey(key string) (int, string, bool) {
+	pos := strings.Index(key, ":")
+	if pos <= 0 {
+		return 0, "", false
+	}
+	slot, err := strconv.Atoi(key[:pos])
+	if err != nil {
+		return 0, "", false
+	}
+	return slot, key[pos+1:], true
+}
+
+// moves the remaining entries of the sets to the lowest slots, so the sets have no gaps
+func (shard *ConcurrentMapShared) compactSets(sets map[string]bool) {
+	for set := range sets {
+		items := make([]*ShardOffset, 0)
+		shard.eachSlot(set, func(key string, item *ShardOffset) bool {
+			items = append(items, item)
 			delete(shard.Items, key)
-			counter += int64(item.Length)
+			return true
+		})
+		for i, item := range items {
+			shard.Items[strconv.Itoa(i)+":"+set] = item
+		}
+		if len(items) == 0 {
+			shard.DeleteCapacityKey(set)
+		} else {
+			shard.SetCapacityKey(set, len(items))
+		}
+	}
+}
+
+// bytes written to the segments, the lock must be held
+func (shard *ConcurrentMapShared) storedBytes() int64 {
+	stored := shard.flushed + int64(len(shard.pending))
+	for _, segment := range shard.Segments[:len(shard.Segments)-1] {
+		if f, err := shard.segmentFile(segment); err == nil {
+			if info, err := f.Stat(); err == nil {
+				stored += info.Size()
+			}
+		}
+	}
+	return stored
+}
+
+// merges the sealed segments into a new one leaving out the deleted data.
+// Live data is copied without holding the lock, so the shard stays available meanwhile.
+// Returns the number of reclaimed bytes and the number of rewritten elements
+func (shard *ConcurrentMapShared) Optimize() (int64, int, error) {
+	shard.Lock()
+	// nothing to do unless there is deleted data or several sealed segments to merge
+	garbage := len(shard.Segments) > 2
+	referenced := make(map[segmentPosition]int64, len(shard.Items))
+	for _, item := range shard.Items {
+		if item.Deleted && !item.Tombstone {
+			garbage = true
+			break
+		}
+		referenced[segmentPosition{item.Segment, item.Start}] = int64(item.Length)
+	}
+	if !garbage {
+		// deletes and updates of versioned elements leave data no key points to
+		used := int64(0)
+		for _, length := range referenced {
+			used += length
+		}
+		garbage = shard.storedBytes() > used
+	}
+	if !garbage {
+		shard.mx.Unlock()
+		return 0, 0, nil
+	}
+	err := shard.seal()
+	if err != nil {
+		shard.mx.Unlock()
+		return 0, 0, err
+	}
+	old := make(map[int]*os.File, len(shard.Segments)-1)
+	for _, segment := range shard.Segments[:len(shard.Segments)-1] {
+		old[segment] = shard.segments[segment]
+	}
+	live := make(map[segmentPosition]int)
+	// deleted ids by the position of their last version, they are kept as tombstones
+	dead := make(map[segmentPosition]string)
+	for key, item := range shard.Items {
+		pos := segmentPosition{item.Segment, item.Start}
+		if !item.Deleted || item.Tombstone {
+			live[pos] = item.Length
+		} else if strings.HasPrefix(key, "id:") {
+			dead[pos] = key[3:]
+		}
+	}
+	mergedId := shard.nextSegment()
+	shard.mx.Unlock()
+
+	// copy the live data in the order it was written
+	positions := make([]segmentPosition, 0, len(live))
+	for pos := range live {
+		positions = append(positions, pos)
+	}
+	sort.Slice(positions, func(i, j int) bool {
+		if positions[i].segment != positions[j].segment {
+			return positions[i].segment < positions[j].segment
+		}
+		return positions[i].start < positions[j].start
+	})
+
+	mergedPath := shard.segmentPath(mergedId)
+	merged, err := shard.options.create(mergedPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	abort := func(err error) (int64, int, error) {
+		merged.Close()
+		os.Remove(mergedPath)
+		return 0, 0, err
+	}
+	written := int64(0)
+	moved := make(map[segmentPosition]*ShardOffset, len(positions))
+	copyData := func(pos segmentPosition, length int) error {
+		data := make([]byte, length)
+		_, err := shard.instrument(old[pos.segment]).ReadAt(data, pos.start)
+		if err != nil {
+			return err
+		}
+		n, err := shard.instrument(merged).Write(data)
+		if err != nil {
+			return err
+		}
+		moved[pos] = &ShardOffset{Start: written, Length: n, Segment: mergedId}
+		written += int64(n)
+		return nil
+	}
+	// the tombstone of a deleted id keeps the version of the delete, so a merge does not bring the element back
+	buried := make(map[segmentPosition]*ShardOffset, len(dead))
+	bury := func(pos segmentPosition, length int, id string) error {
+		data := make([]byte, length)
+		_, err := shard.instrument(old[pos.segment]).ReadAt(data, pos.start)
+		if err != nil {
+			return err
+		}
+		// an element that can not be decoded is buried without a version
+		version, _ := decodeVersion(&ShardOffset{}, data)
+		record, err := json.Marshal(newTombstone(id, version))
+		if err != nil {
+			return err
+		}
+		n, err := shard.instrument(merged).Write(record)
+		if err != nil {
+			return err
+		}
+		buried[pos] = &ShardOffset{Start: written, Length: n, Deleted: true, Segment: mergedId, Tombstone: true}
+		written += int64(n)
+		return nil
+	}
+	copyStart := time.Now()
+	for _, pos := range positions {
+		err = copyData(pos, live[pos])
+		if err != nil {
+			return abort(err)
 		}
+		throttle(shard.options.compactionRate(), written, copyStart)
 	}
+	shard.mx.RLock()
+	lengths := make(map[segmentPosition]int, len(dead))
+	for key, item := range shard.Items {
+		if pos := (segmentPosition{item.Segment, item.Start}); strings.HasPrefix(key, "id:") && dead[pos] != "" {
+			lengths[pos] = item.Length
+		}
+	}
+	shard.mx.RUnlock()
+	for pos, id := range dead {
+		if lengths[pos] == 0 {
+			// written again meanwhile
+			continue
+		}
+		if err = bury(pos, lengths[pos], id); err != nil {
+			return abort(err)
+		}
+	}
+
+	shard.mx.Lock()
+	defer shard.mx.Unlock()
 
-	fName := shard.SyncDestination + "/" + fi.Name()
-	err = ioutil.WriteFile(fName, buffer.Bytes(), os.ModePerm)
+	for key, item := range shard.Items {
+		if _, ok := old[item.Segment]; !ok {
+			continue
+		}
+		itemPos := segmentPosition{item.Segment, item.Start}
+		if item.Deleted && !item.Tombstone {
+			if _, ok := buried[itemPos]; !ok && strings.HasPrefix(key, "id:") {
+				// deleted while the segments were being merged
+				if err = bury(itemPos, item.Length, key[3:]); err != nil {
+					return abort(err)
+				}
+			}
+			continue
+		}
+		if _, ok := moved[itemPos]; !ok {
+			// restored while the segments were being merged
+			err = copyData(itemPos, item.Length)
+			if err != nil {
+				return abort(err)
+			}
+		}
+	}
+	// nothing points to the merged segment before it reached the drive
+	err = shard.instrument(merged).Sync()
 	if err != nil {
-		return 0, err
+		return abort(err)
 	}
 
-	shardData = nil
-	buffer = nil
-	shard.file, err = os.OpenFile(fName, os.O_RDWR, os.ModePerm)
-	return counter, err
+	counter := int64(0)
+	released := make(map[segmentPosition]bool)
+	sets := make(map[string]bool)
+	tombstones := make(map[segmentPosition]bool)
+	for key, item := range shard.Items {
+		if _, ok := old[item.Segment]; !ok {
+			continue
+		}
+		itemPos := segmentPosition{item.Segment, item.Start}
+		if item.Deleted && !item.Tombstone {
+			if _, set, ok := slotKey(key); ok {
+				sets[set] = true
+			}
+			if grave, ok := buried[itemPos]; ok && strings.HasPrefix(key, "id:") {
+				shard.Items[key] = grave
+			} else {
+				delete(shard.Items, key)
+			}
+			if _, ok := moved[itemPos]; !ok && !released[itemPos] {
+				released[itemPos] = true
+				counter += int64(item.Length)
+			}
+			continue
+		}
+		target := moved[itemPos]
+		item.Start, item.Length, item.Segment = target.Start, target.Length, target.Segment
+		if item.Tombstone {
+			tombstones[itemPos] = true
+		}
+	}
+	shard.compactSets(sets)
+	shard.rewriteMeta = true
+	shard.markDirty()
+	active := shard.activeSegment()
+	shard.metaMx.Lock()
+	for segment, f := range old {
+		f.Close()
+		delete(shard.segments, segment)
+		// the meta and the manifest on the drive still point to the old segments
+		shard.retired = append(shard.retired, segment)
+	}
+	shard.metaMx.Unlock()
+	if written == 0 {
+		merged.Close()
+		os.Remove(mergedPath)
+		shard.Segments = []int{active}
+	} else {
+		shard.segments[mergedId] = merged
+		shard.Segments = []int{mergedId, active}
+	}
+	// the copied tombstones are not elements
+	return counter, len(moved) - len(tombstones), nil
 }
 
 //! Not intended to be used in production environment
@@ -151,6 +762,7 @@ func (shard *ConcurrentMapShared) GetItem(id string) *ShardOffset {
 
 func (shard *ConcurrentMapShared) SetCapacityKey(key string, n int) {
 	shard.Capacities["n:"+key] = n
+	shard.capacityChanged("n:" + key)
 }
 
 func (shard *ConcurrentMapShared) GetCapacityKey(key string) int {
@@ -163,4 +775,88 @@ func (shard *ConcurrentMapShared) GetCapacityKey(key string) int {
 
 func (shard *ConcurrentMapShared) DeleteCapacityKey(key string) {
 	delete(shard.Capacities, "n:"+key)
+	shard.capacityChanged("n:" + key)
+}
+
+// stores the item under the key of the index entry, a regular key takes the next free slot.
+// Returns the key the item is stored under
+func (shard *ConcurrentMapShared) addIndexKey(ix *FullDataIndex, item *ShardOffset) (string, error) {
+	fullKey := ix.Field + ":" + ix.Data
+	if ix.Unique {
+		// the key of a deleted element is taken over
+		if taken, ok := shard.Items[fullKey]; ok && !taken.Deleted {
+			return "", errors.New("unique primary key duplicate")
+		}
+		shard.Items[fullKey] = item
+		shard.keyChanged(fullKey)
+		return fullKey, nil
+	}
+	index := shard.GetCapacityKey(fullKey)
+	lastAvailable := ""
+	for {
+		lastAvailable = strconv.Itoa(index) + ":" + fullKey
+		if _, ok := shard.Items[lastAvailable]; ok {
+			index++
+		} else {
+			break
+		}
+	}
+	shard.Items[lastAvailable] = item
+	shard.keyChanged(lastAvailable)
+	shard.SetCapacityKey(fullKey, index+1)
+	return lastAvailable, nil
+}
+
+// whether the item is already stored under the key of the index entry
+func (shard *ConcurrentMapShared) hasIndexKey(ix *FullDataIndex, item *ShardOffset) bool {
+	fullKey := ix.Field + ":" + ix.Data
+	if ix.Unique {
+		return shard.Items[fullKey] == item
+	}
+	found := false
+	shard.eachSlot(fullKey, func(key string, slotted *ShardOffset) bool {
+		found = slotted == item
+		return !found
+	})
+	return found
+}
+
+// live items stored under the key of the index entry
+func (shard *ConcurrentMapShared) indexItems(ix *FullDataIndex) []*ShardOffset {
+	fullKey := ix.Field + ":" + ix.Data
+	if ix.Unique {
+		if item, ok := shard.Items[fullKey]; ok && !item.Deleted {
+			return []*ShardOffset{item}
+		}
+		return nil
+	}
+	items := make([]*ShardOffset, 0)
+	shard.eachSlot(fullKey, func(key string, item *ShardOffset) bool {
+		if !item.Deleted {
+			items = append(items, item)
+		}
+		return true
+	})
+	return items
+}
+
+// Calls fn with every entry of the set of a regular index key until it returns false.
+// The capacity of a set is the number of its slots, slots of removed keys stay empty until
+// the shard is optimized. Sets written by older versions store the last slot as the capacity,
+// so the walk goes on while there are further slots
+func (shard *ConcurrentMapShared) eachSlot(set string, fn func(key string, item *ShardOffset) bool) {
+	capacity := shard.GetCapacityKey(set)
+	for i := 0; ; i++ {
+		key := strconv.Itoa(i) + ":" + set
+		item, ok := shard.Items[key]
+		if !ok {
+			if i >= capacity {
+				return
+			}
+			continue
+		}
+		if !fn(key, item) {
+			return
+		}
+	}
 }
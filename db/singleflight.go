@@ -0,0 +1,58 @@
+package db
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Reads in progress by their key: a caller missing the cache while another one reads the same key
+// waits for that read and shares its result, so a burst of misses reads the shard once.
+// The zero value is ready to use
+type flightGroup struct {
+	mx      sync.Mutex
+	flights map[string]*flight
+	// callers that shared the read of another one
+	coalesced uint64
+}
+
+type flight struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+func (g *flightGroup) do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mx.Lock()
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	if f, ok := g.flights[key]; ok {
+		g.mx.Unlock()
+		atomic.AddUint64(&g.coalesced, 1)
+		<-f.done
+		return f.value, f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mx.Unlock()
+
+	// the waiters are released even if fn panics
+	defer func() {
+		g.mx.Lock()
+		delete(g.flights, key)
+		g.mx.Unlock()
+		close(f.done)
+	}()
+	f.err = errors.New("read of " + key + " panicked")
+	f.value, f.err = fn()
+	return f.value, f.err
+}
+
+func (g *flightGroup) coalescedReads() uint64 {
+	return atomic.LoadUint64(&g.coalesced)
+}
+
+func (g *flightGroup) resetStats() {
+	atomic.StoreUint64(&g.coalesced, 0)
+}
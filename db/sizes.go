@@ -0,0 +1,92 @@
+package db
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Upper bounds (bytes) of the buckets of the encoded element sizes, the last bucket is always +Inf
+var SIZE_BUCKETS = []float64{64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+
+// Upper bounds of the buckets of the live elements per shard, the last bucket is always +Inf
+var COUNT_BUCKETS = []float64{100, 1000, 1e4, 1e5, 1e6, 1e7}
+
+// Distribution of the live elements of a collection, taken from the offsets the shards keep in memory,
+// so nothing is read from the drive. Shards whose meta is still mapped after the load are counted from its tables,
+// they stay mapped (see IsMapped). Unlike the latency histograms they describe the current state,
+// ResetMetrics leaves them alone
+type SizeStats struct {
+	// encoded sizes of the live elements in bytes
+	ElementSize HistogramSnapshot `json:"element_size"`
+	// live elements of the shards
+	ShardElements HistogramSnapshot `json:"shard_elements"`
+	// live elements by shard id
+	Shards []int `json:"shards"`
+}
+
+// histograms of the shards, a shard recounts its elements on the first read after it changed.
+// Unchanged shards are not locked
+type sizeCache struct {
+	mx     sync.Mutex
+	shards map[int]*shardSizes
+}
+
+type shardSizes struct {
+	generation uint64
+	live       int
+	sizes      HistogramSnapshot
+}
+
+func (c *Collection) shardSizes(shard *ConcurrentMapShared) *shardSizes {
+	// read before the shard, so a write during the count makes the result stale
+	generation := atomic.LoadUint64(&shard.generation)
+	c.sizes.mx.Lock()
+	defer c.sizes.mx.Unlock()
+	if cached, ok := c.sizes.shards[shard.Id]; ok && cached.generation == generation {
+		return cached
+	}
+	h := NewHistogram(SIZE_BUCKETS)
+	s := &shardSizes{generation: generation}
+	observe := func(length int) {
+		s.live++
+		h.observe(float64(length))
+	}
+	// not RLock, it would decode a mapped meta
+	shard.mx.RLock()
+	if shard.meta != nil {
+		shard.meta.eachLive(observe)
+	} else {
+		for key, item := range shard.Items {
+			// every element has exactly one id key
+			if item.Deleted || !strings.HasPrefix(key, "id:") {
+				continue
+			}
+			observe(item.Length)
+		}
+	}
+	shard.mx.RUnlock()
+	s.sizes = h.Snapshot()
+	if c.sizes.shards == nil {
+		c.sizes.shards = make(map[int]*shardSizes)
+	}
+	c.sizes.shards[shard.Id] = s
+	return s
+}
+
+// The sizes of the live elements and their spread over the shards, e.g. to find out why a collection is large
+func (c *Collection) SizeStats() *SizeStats {
+	stats := &SizeStats{Shards: make([]int, len(c.Map.Shared))}
+	counts := NewHistogram(COUNT_BUCKETS)
+	for i, shard := range c.Map.Shared {
+		s := c.shardSizes(shard)
+		stats.ElementSize = stats.ElementSize.add(s.sizes)
+		stats.Shards[i] = s.live
+		counts.observe(float64(s.live))
+	}
+	if len(stats.ElementSize.Buckets) == 0 {
+		stats.ElementSize = NewHistogram(SIZE_BUCKETS).Snapshot()
+	}
+	stats.ShardElements = counts.Snapshot()
+	return stats
+}
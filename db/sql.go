@@ -0,0 +1,388 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Result of Execute
+type QueryResult struct {
+	Collection string `json:"collection"`
+	// selected paths, nil for SELECT *
+	Columns []string `json:"columns,omitempty"`
+	// values of the columns by element, a path with several values gives a slice and a missing one nil.
+	// Nil for SELECT *
+	Rows     [][]interface{} `json:"rows,omitempty"`
+	Elements []*Element      `json:"elements"`
+}
+
+// Runs a query written as text, for tools and ad-hoc exploration:
+//
+//	SELECT * | path [, path ...] FROM collection
+//	  [WHERE condition [AND condition ...]]
+//	  [ORDER BY path [ASC | DESC] [, ...]]
+//	  [LIMIT n]
+//
+// A condition is "path op value" with =, !=, <>, <, <=, > or >=, "path IS NULL" or "path EXISTS".
+// Values are numbers, 'strings' or "strings", true, false and ? placeholders taking the args in their order.
+// Paths are the dotted paths of Query, keywords are case-insensitive
+func (db *Database) Execute(query string, args ...interface{}) (*QueryResult, error) {
+	return db.ExecuteContext(context.Background(), query, args...)
+}
+
+// same as Execute, gives up once the context ends
+func (db *Database) ExecuteContext(ctx context.Context, query string, args ...interface{}) (*QueryResult, error) {
+	stmt, err := parseSelect(query)
+	if err != nil {
+		return nil, errors.New("failed to parse the query due " + err.Error())
+	}
+	if stmt.placeholders != len(args) {
+		return nil, errors.New("query takes " + strconv.Itoa(stmt.placeholders) + " argument(s), got " + strconv.Itoa(len(args)))
+	}
+	c := db.GetCollection(stmt.collection)
+	if c == nil {
+		return nil, errors.New("collection " + stmt.collection + " does not exist")
+	}
+	q := c.Query().Limit(stmt.limit)
+	arg := 0
+	for _, cond := range stmt.conditions {
+		value := cond.value
+		if _, ok := value.(placeholder); ok {
+			value = args[arg]
+			arg++
+		}
+		q.Where(cond.path, cond.op, value)
+	}
+	for _, o := range stmt.order {
+		q.OrderBy(o.path, o.descending)
+	}
+
+	result := &QueryResult{Collection: c.Name, Columns: stmt.columns, Elements: make([]*Element, 0)}
+	if stmt.columns != nil {
+		result.Rows = make([][]interface{}, 0)
+	}
+	err = q.Stream(ctx, func(e *Element) error {
+		result.Elements = append(result.Elements, e)
+		if stmt.columns == nil {
+			return nil
+		}
+		row := make([]interface{}, len(stmt.columns))
+		for i, path := range stmt.columns {
+			values, err := c.resolve(e.Payload, e.Computed, path)
+			if err != nil {
+				return err
+			}
+			row[i] = columnValue(values)
+		}
+		result.Rows = append(result.Rows, row)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func columnValue(values []reflect.Value) interface{} {
+	switch len(values) {
+	case 0:
+		return nil
+	case 1:
+		return values[0].Interface()
+	}
+	all := make([]interface{}, len(values))
+	for i, v := range values {
+		all[i] = v.Interface()
+	}
+	return all
+}
+
+// the value of a condition taken from the args of Execute
+type placeholder struct{}
+
+type selectStatement struct {
+	columns      []string
+	collection   string
+	conditions   []condition
+	order        []ordering
+	limit        int
+	placeholders int
+}
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenString
+	tokenNumber
+	tokenSymbol
+	tokenEnd
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// characters of the operators and separators, everything else up to a space is part of a word
+const sqlSymbols = "=!<>,*?"
+
+func tokenize(query string) ([]token, error) {
+	tokens := make([]token, 0)
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '\'' || r == '"':
+			var b strings.Builder
+			start := i
+			for i++; ; i++ {
+				if i >= len(runes) {
+					return nil, errors.New("unterminated string at " + strconv.Itoa(start))
+				}
+				if runes[i] == r {
+					// a doubled quote stands for the quote itself
+					if i+1 < len(runes) && runes[i+1] == r {
+						b.WriteRune(r)
+						i++
+						continue
+					}
+					break
+				}
+				b.WriteRune(runes[i])
+			}
+			tokens = append(tokens, token{tokenString, b.String(), start})
+			i++
+		case strings.ContainsRune(sqlSymbols, r):
+			start := i
+			i++
+			if i < len(runes) && (r == '<' || r == '>' || r == '!') && (runes[i] == '=' || (r == '<' && runes[i] == '>')) {
+				i++
+			}
+			tokens = append(tokens, token{tokenSymbol, string(runes[start:i]), start})
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune(sqlSymbols+"'\"", runes[i]) {
+				// brackets of JSONPath selectors may hold anything, "$.items[*]" or "$['a b']"
+				if runes[i] == '[' {
+					for i < len(runes) && runes[i] != ']' {
+						i++
+					}
+				}
+				// the wildcard of "$.attributes.*"
+				if i+1 < len(runes) && runes[i] == '.' && runes[i+1] == '*' {
+					i++
+				}
+				i++
+			}
+			text := string(runes[start:i])
+			kind := tokenWord
+			if _, err := strconv.ParseFloat(text, 64); err == nil {
+				kind = tokenNumber
+			}
+			tokens = append(tokens, token{kind, text, start})
+		}
+	}
+	return append(tokens, token{tokenEnd, "", len(runes)}), nil
+}
+
+type selectParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *selectParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *selectParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEnd {
+		p.pos++
+	}
+	return t
+}
+
+// the next token is the keyword, it is consumed then
+func (p *selectParser) keyword(word string) bool {
+	t := p.peek()
+	if t.kind == tokenWord && strings.EqualFold(t.text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *selectParser) expect(word string) error {
+	if !p.keyword(word) {
+		return p.unexpected(word)
+	}
+	return nil
+}
+
+func (p *selectParser) unexpected(expected string) error {
+	t := p.peek()
+	if t.kind == tokenEnd {
+		return errors.New("expected " + expected + " at the end")
+	}
+	return errors.New("expected " + expected + " at " + strconv.Itoa(t.pos) + ", found " + strconv.Quote(t.text))
+}
+
+var sqlKeywords = map[string]bool{"SELECT": true, "FROM": true, "WHERE": true, "AND": true, "ORDER": true, "BY": true,
+	"ASC": true, "DESC": true, "LIMIT": true, "IS": true, "NULL": true, "EXISTS": true}
+
+func (p *selectParser) path() (string, error) {
+	t := p.peek()
+	if t.kind != tokenWord || sqlKeywords[strings.ToUpper(t.text)] {
+		return "", p.unexpected("a path")
+	}
+	if _, err := parsePath(t.text); err != nil {
+		return "", err
+	}
+	p.pos++
+	return t.text, nil
+}
+
+func parseSelect(query string) (*selectStatement, error) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &selectParser{tokens: tokens}
+	stmt := &selectStatement{}
+	if err = p.expect("SELECT"); err != nil {
+		return nil, err
+	}
+	if p.peek().text == "*" {
+		p.next()
+	} else {
+		for {
+			path, err := p.path()
+			if err != nil {
+				return nil, err
+			}
+			stmt.columns = append(stmt.columns, path)
+			if p.peek().text != "," {
+				break
+			}
+			p.next()
+		}
+	}
+	if err = p.expect("FROM"); err != nil {
+		return nil, err
+	}
+	if t := p.next(); t.kind == tokenWord || t.kind == tokenString {
+		stmt.collection = t.text
+	} else {
+		return nil, errors.New("expected a collection at " + strconv.Itoa(t.pos))
+	}
+	if p.keyword("WHERE") {
+		for {
+			cond, err := p.condition(stmt)
+			if err != nil {
+				return nil, err
+			}
+			stmt.conditions = append(stmt.conditions, cond)
+			if !p.keyword("AND") {
+				break
+			}
+		}
+	}
+	if p.keyword("ORDER") {
+		if err = p.expect("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			path, err := p.path()
+			if err != nil {
+				return nil, err
+			}
+			o := ordering{path: path}
+			if p.keyword("DESC") {
+				o.descending = true
+			} else {
+				p.keyword("ASC")
+			}
+			stmt.order = append(stmt.order, o)
+			if p.peek().text != "," {
+				break
+			}
+			p.next()
+		}
+	}
+	if p.keyword("LIMIT") {
+		t := p.next()
+		limit, err := strconv.Atoi(t.text)
+		if t.kind != tokenNumber || err != nil || limit < 0 {
+			return nil, errors.New("expected a limit at " + strconv.Itoa(t.pos))
+		}
+		stmt.limit = limit
+	}
+	if p.peek().kind != tokenEnd {
+		return nil, p.unexpected("the end of the query")
+	}
+	return stmt, nil
+}
+
+var sqlOperators = map[string]Operator{"=": Eq, "!=": Ne, "<>": Ne, "<": Lt, "<=": Lte, ">": Gt, ">=": Gte}
+
+func (p *selectParser) condition(stmt *selectStatement) (condition, error) {
+	path, err := p.path()
+	if err != nil {
+		return condition{}, err
+	}
+	if p.keyword("EXISTS") {
+		return condition{path: path, op: Exists}, nil
+	}
+	if p.keyword("IS") {
+		if err = p.expect("NULL"); err != nil {
+			return condition{}, err
+		}
+		return condition{path: path, op: IsNull}, nil
+	}
+	t := p.next()
+	op, ok := sqlOperators[t.text]
+	if t.kind != tokenSymbol || !ok {
+		p.pos--
+		return condition{}, p.unexpected("an operator")
+	}
+	value, err := p.value(stmt)
+	if err != nil {
+		return condition{}, err
+	}
+	return condition{path: path, op: op, value: value}, nil
+}
+
+func (p *selectParser) value(stmt *selectStatement) (interface{}, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenString:
+		return t.text, nil
+	case tokenNumber:
+		if n, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return n, nil
+		}
+		return strconv.ParseFloat(t.text, 64)
+	case tokenSymbol:
+		if t.text == "?" {
+			stmt.placeholders++
+			return placeholder{}, nil
+		}
+	case tokenWord:
+		switch strings.ToUpper(t.text) {
+		case "TRUE":
+			return true, nil
+		case "FALSE":
+			return false, nil
+		}
+	}
+	p.pos--
+	return nil, p.unexpected("a value")
+}
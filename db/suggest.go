@@ -0,0 +1,131 @@
+package db
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// A field queried without an index, with the full scans it caused
+type IndexSuggestion struct {
+	Collection string `json:"collection"`
+	Field      string `json:"field"`
+	// queries filtering on the field that read the whole collection
+	Scans uint64 `json:"scans"`
+	// elements read by them, an index would have read only the matching ones
+	ScannedRows uint64 `json:"scanned_rows"`
+}
+
+// full scans of a collection by the paths of their conditions, the zero value is ready to use
+type scanStats struct {
+	mx    sync.Mutex
+	paths map[string]*scannedPath
+}
+
+type scannedPath struct {
+	scans, rows uint64
+	// an index was submitted by the auto-index mode
+	indexing bool
+}
+
+// operators the planner answers from an index
+func indexable(op Operator) bool {
+	return op == Eq || op == IsNull || isRange(op)
+}
+
+// Records a full scan of the query that read rows elements. Paths that have an index are left out,
+// in the auto-index mode (SetAutoIndex) the paths past the threshold are indexed in the background
+func (q *Query) recordFullScan(rows uint64) {
+	c := q.c
+	paths := make(map[string]bool)
+	for _, cond := range q.conditions {
+		if !indexable(cond.op) {
+			continue
+		}
+		if _, ok := c.declaredIndex(cond.path); !ok {
+			paths[cond.path] = true
+		}
+	}
+	if len(paths) == 0 || rows == 0 {
+		return
+	}
+	threshold := uint64(0)
+	if c.database != nil {
+		threshold = atomic.LoadUint64(&c.database.autoIndexRows)
+	}
+	c.scans.mx.Lock()
+	defer c.scans.mx.Unlock()
+	if c.scans.paths == nil {
+		c.scans.paths = make(map[string]*scannedPath)
+	}
+	for path := range paths {
+		sp, ok := c.scans.paths[path]
+		if !ok {
+			sp = &scannedPath{}
+			c.scans.paths[path] = sp
+		}
+		sp.scans++
+		sp.rows += rows
+		if threshold > 0 && sp.rows >= threshold && !sp.indexing {
+			sp.indexing = true
+			c.database.autoIndex(c, path)
+		}
+	}
+}
+
+func (c *Collection) indexSuggestions() []IndexSuggestion {
+	c.scans.mx.Lock()
+	defer c.scans.mx.Unlock()
+	suggestions := make([]IndexSuggestion, 0, len(c.scans.paths))
+	for path, sp := range c.scans.paths {
+		// indexed since
+		if _, ok := c.declaredIndex(path); ok {
+			continue
+		}
+		suggestions = append(suggestions, IndexSuggestion{c.Name, path, sp.scans, sp.rows})
+	}
+	return suggestions
+}
+
+// Fields of the collections whose index would have avoided the most scanned elements, the most scanned first.
+// Only the conditions an index can answer (equality, null and ranges) are counted, the counts start with the database
+func (db *Database) IndexSuggestions() []IndexSuggestion {
+	db.collectionMutex.RLock()
+	suggestions := make([]IndexSuggestion, 0)
+	for _, c := range db.collections {
+		suggestions = append(suggestions, c.indexSuggestions()...)
+	}
+	db.collectionMutex.RUnlock()
+	sort.Slice(suggestions, func(i, j int) bool {
+		a, b := suggestions[i], suggestions[j]
+		if a.ScannedRows != b.ScannedRows {
+			return a.ScannedRows > b.ScannedRows
+		}
+		if a.Collection != b.Collection {
+			return a.Collection < b.Collection
+		}
+		return a.Field < b.Field
+	})
+	return suggestions
+}
+
+// Indexes a field in the background once the full scans filtering on it read rows elements of its collection,
+// 0 disables it. The indexes are regular, not unique ones, and are added by the scheduler of the database
+func (db *Database) SetAutoIndex(rows uint64) {
+	atomic.StoreUint64(&db.autoIndexRows, rows)
+}
+
+func (db *Database) autoIndex(c *Collection, path string) {
+	db.scheduler.Submit("index "+c.Name+"."+path, PRIORITY_LOW, func() error {
+		if _, ok := c.declaredIndex(path); ok {
+			return nil
+		}
+		err := c.AddIndex(path, false)
+		if err != nil {
+			db.logf(LOG_WARNING, "failed to add the suggested index", c.Name+"."+path, "due", err)
+			return err
+		}
+		db.logf(LOG_INFO, "added the suggested index", c.Name+"."+path)
+		return nil
+	})
+}
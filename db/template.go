@@ -0,0 +1,82 @@
+package db
+
+import (
+	"errors"
+)
+
+// Setup shared by structurally identical collections (per tenant, per day...), see AddCollectionFromTemplate.
+// The shard count and the compression are set for the whole database by its options
+type CollectionTemplate struct {
+	// declared indexes, see CreateIndex
+	Indexes []Index
+	// megabytes of the read cache, 0 keeps the config of the database
+	CacheSize int
+	// 0 keeps the config of the database
+	WriteBufferSize int64
+	FieldFragments  bool
+	// encrypted with the key the provider returns for the name of every collection
+	EncryptedFields []string
+	Keys            KeyProvider
+}
+
+func (t *CollectionTemplate) validate() error {
+	if len(t.EncryptedFields) > 0 && t.Keys == nil {
+		return errors.New("template with encrypted fields needs a key provider")
+	}
+	for _, ix := range t.Indexes {
+		if _, err := parsePath(ix.Field); err != nil {
+			return err
+		}
+		if ix.Collation != nil {
+			if err := ix.Collation.validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *CollectionTemplate) apply(c *Collection) error {
+	if t.CacheSize != 0 {
+		c.resizeCache(t.CacheSize)
+	}
+	if t.WriteBufferSize != 0 {
+		if err := c.SetWriteBufferSize(t.WriteBufferSize); err != nil {
+			return err
+		}
+	}
+	if t.FieldFragments {
+		c.SetFieldFragments(true)
+	}
+	if len(t.EncryptedFields) > 0 {
+		if err := c.SetEncryption(t.Keys, t.EncryptedFields...); err != nil {
+			return err
+		}
+	}
+	for _, ix := range t.Indexes {
+		if err := c.CreateIndex(ix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Adds a collection set up by the template. The collection is not added when any part of the template fails
+func (db *Database) AddCollectionFromTemplate(name string, template *CollectionTemplate) (*Collection, error) {
+	if template == nil {
+		return db.AddCollection(name)
+	}
+	if err := template.validate(); err != nil {
+		return nil, errors.New("invalid template due " + err.Error())
+	}
+	c, err := db.AddCollection(name)
+	if err != nil {
+		return nil, err
+	}
+	err = template.apply(c)
+	if err != nil {
+		db.removeCollection(c)
+		return nil, errors.New("failed to apply the template to collection " + name + " due " + err.Error())
+	}
+	return c, nil
+}
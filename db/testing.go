@@ -0,0 +1,30 @@
+package db
+
+import (
+	"testing"
+)
+
+// Database in a temporary directory of the test, closed and removed when the test ends.
+// Background synchronization is off and only warnings are logged
+func NewTestDatabase(t testing.TB) *Database {
+	options := DefaultDatabaseOptions()
+	options.Config.LogLevel = LOG_WARNING
+	options.Config.BackgroundWorkers = 1
+	return NewTestDatabaseWithOptions(t, options)
+}
+
+// Same as NewTestDatabase with the given options, background workers run as configured.
+// An empty Dir is replaced by the temporary directory
+func NewTestDatabaseWithOptions(t testing.TB, options DatabaseOptions) *Database {
+	t.Helper()
+	if options.Dir == "" {
+		options.Dir = t.TempDir()
+	}
+	db := NewDatabaseWithOptions("test", options)
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Error("failed to close the test database due " + err.Error())
+		}
+	})
+	return db
+}
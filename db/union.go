@@ -0,0 +1,163 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Several collections read as one, e.g. the partitions of a family or the collections of split tenants.
+// Unions are read-only and not stored, the members stay regular collections
+type Union struct {
+	Name    string
+	members []*Collection
+}
+
+func (db *Database) Union(name string, collections ...string) (*Union, error) {
+	if len(collections) == 0 {
+		return nil, errors.New("union " + name + " has no collections")
+	}
+	u := &Union{Name: name, members: make([]*Collection, 0, len(collections))}
+	seen := make(map[string]bool, len(collections))
+	for _, cName := range collections {
+		if seen[cName] {
+			continue
+		}
+		seen[cName] = true
+		c := db.GetCollection(cName)
+		if c == nil {
+			return nil, errors.New("collection " + cName + " of union " + name + " does not exist")
+		}
+		u.members = append(u.members, c)
+	}
+	return u, nil
+}
+
+func (u *Union) Members() []*Collection {
+	return append([]*Collection(nil), u.members...)
+}
+
+func (u *Union) Size() int64 {
+	size := int64(0)
+	for _, c := range u.members {
+		size += c.Size()
+	}
+	return size
+}
+
+// the element of the first member having the id
+func (u *Union) FindById(id string) ([]byte, error) {
+	for _, c := range u.members {
+		if data, err := c.FindByIdContext(context.Background(), id); err == nil {
+			return data, nil
+		}
+	}
+	return nil, errors.New("not found")
+}
+
+// Conditions are the same as the ones of Query. The members are read in parallel,
+// so the elements come in no particular order
+type UnionQuery struct {
+	u          *Union
+	conditions []condition
+	limit      int
+}
+
+func (u *Union) Query() *UnionQuery {
+	return &UnionQuery{u: u}
+}
+
+func (uq *UnionQuery) Where(path string, op Operator, value ...interface{}) *UnionQuery {
+	q := &Query{conditions: uq.conditions}
+	uq.conditions = q.Where(path, op, value...).conditions
+	return uq
+}
+
+// at most n elements are returned from all of the members, 0 means no limit
+func (uq *UnionQuery) Limit(n int) *UnionQuery {
+	uq.limit = n
+	return uq
+}
+
+func (uq *UnionQuery) Run() ([]*Element, error) {
+	results := make([]*Element, 0)
+	err := uq.Stream(context.Background(), func(e *Element) error {
+		results = append(results, e)
+		return nil
+	})
+	return results, err
+}
+
+// Same as Query.Stream, every member is queried by its own goroutine. fn is called by the calling goroutine only.
+// The guards of the config apply to the union as a whole
+func (uq *UnionQuery) Stream(ctx context.Context, fn func(e *Element) error) error {
+	queries := make([]*Query, len(uq.u.members))
+	for i, c := range uq.u.members {
+		queries[i] = &Query{c: c, conditions: uq.conditions, unguarded: true}
+		if err := queries[i].validate(); err != nil {
+			return err
+		}
+	}
+	// the members belong to the same database
+	ctx, fn, done := uq.u.members[0].options.queryGuard().apply(ctx, uq.limit, fn)
+	return done(streamParallel(ctx, queries, uq.limit, fn))
+}
+
+// runs the queries at the same time and passes their elements to fn until the limit is reached
+func streamParallel(ctx context.Context, queries []*Query, limit int, fn func(e *Element) error) error {
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	elements := make(chan *Element, len(queries))
+	var errMx sync.Mutex
+	var queryErr error
+	var wg sync.WaitGroup
+	wg.Add(len(queries))
+	for _, q := range queries {
+		go func(q *Query) {
+			defer wg.Done()
+			err := q.streamTo(runCtx, elements)
+			if err != nil && runCtx.Err() == nil {
+				errMx.Lock()
+				if queryErr == nil {
+					queryErr = err
+				}
+				errMx.Unlock()
+				// the other queries are not needed anymore
+				cancel()
+			}
+		}(q)
+	}
+	go func() {
+		wg.Wait()
+		close(elements)
+	}()
+
+	found := 0
+	var err error
+	for e := range elements {
+		if err != nil {
+			// drain until the queries notice the cancellation
+			continue
+		}
+		err = fn(e)
+		if err == nil {
+			found++
+			if limit > 0 && found >= limit {
+				err = StopIteration
+			}
+		}
+		if err != nil {
+			cancel()
+		}
+	}
+	if err == StopIteration {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	if queryErr != nil {
+		return queryErr
+	}
+	return ctx.Err()
+}
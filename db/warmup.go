@@ -0,0 +1,183 @@
+package db
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// file of the collection directory keeping the most read ids of TrackHotKeys, rewritten by every sync
+const HOT_KEYS_NAME = "hot.keys"
+
+type HotKey struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+// Space-saving sketch of the most read ids: at most capacity of them are counted, a new id replaces
+// the least read one and inherits its count, so the frequent ids stay in it while the rare ones come and go
+type hotKeys struct {
+	mx       sync.Mutex
+	capacity int
+	keys     map[string]*hotKey
+	order    hotKeyHeap
+}
+
+type hotKey struct {
+	HotKey
+	index int
+}
+
+// least read on the top
+type hotKeyHeap []*hotKey
+
+func (h hotKeyHeap) Len() int           { return len(h) }
+func (h hotKeyHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h hotKeyHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *hotKeyHeap) Push(x interface{}) {
+	k := x.(*hotKey)
+	k.index = len(*h)
+	*h = append(*h, k)
+}
+
+func (h *hotKeyHeap) Pop() interface{} {
+	old := *h
+	k := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return k
+}
+
+// Counts the ids read by FindById, keeping the capacity most read ones, 0 stops the counting.
+// The counted ids are saved next to the collection by every sync, WarmupFromAccessLog reads them
+// into the cache after a restart. Replacing the sketch drops the counts
+func (c *Collection) TrackHotKeys(capacity int) {
+	var hk *hotKeys
+	if capacity > 0 {
+		hk = &hotKeys{capacity: capacity, keys: make(map[string]*hotKey)}
+	}
+	c.sharedDestMx.Lock()
+	c.hotKeys = hk
+	c.sharedDestMx.Unlock()
+}
+
+func (c *Collection) getHotKeys() *hotKeys {
+	c.sharedDestMx.RLock()
+	defer c.sharedDestMx.RUnlock()
+	return c.hotKeys
+}
+
+func (hk *hotKeys) touch(key string) {
+	if hk == nil {
+		return
+	}
+	hk.mx.Lock()
+	defer hk.mx.Unlock()
+	if k, ok := hk.keys[key]; ok {
+		k.Count++
+		heap.Fix(&hk.order, k.index)
+		return
+	}
+	if len(hk.order) < hk.capacity {
+		k := &hotKey{HotKey: HotKey{key, 1}}
+		hk.keys[key] = k
+		heap.Push(&hk.order, k)
+		return
+	}
+	k := hk.order[0]
+	delete(hk.keys, k.Key)
+	k.Key = key
+	k.Count++
+	hk.keys[key] = k
+	heap.Fix(&hk.order, 0)
+}
+
+// the counted ids, the most read first
+func (hk *hotKeys) top() []HotKey {
+	if hk == nil {
+		return nil
+	}
+	hk.mx.Lock()
+	keys := make([]HotKey, len(hk.order))
+	for i, k := range hk.order {
+		keys[i] = k.HotKey
+	}
+	hk.mx.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Count != keys[j].Count {
+			return keys[i].Count > keys[j].Count
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	return keys
+}
+
+// the most read ids counted since TrackHotKeys, the most read first
+func (c *Collection) HotKeys() []HotKey {
+	return c.getHotKeys().top()
+}
+
+func (c *Collection) saveHotKeys(ctx context.Context) error {
+	keys := c.getHotKeys().top()
+	if keys == nil {
+		return nil
+	}
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	return c.options.writeAtomicallyContext(ctx, filepath.Join(c.Map.SyncDestination, HOT_KEYS_NAME), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// Reads the elements of the ids into the cache, so the first requests after a start do not wait for the drive.
+// Ids that do not exist are skipped, returns the number of cached elements
+func (c *Collection) Warmup(keys []string) (int, error) {
+	cached := 0
+	for _, key := range keys {
+		if !c.hasId(key) {
+			continue
+		}
+		if _, err := c.findById(key, true); err != nil {
+			if !c.hasId(key) {
+				// deleted meanwhile
+				continue
+			}
+			return cached, err
+		}
+		cached++
+	}
+	return cached, nil
+}
+
+// Warms the cache up with the ids saved by the last sync of a collection tracking them (TrackHotKeys),
+// the most read first. Nothing is cached if they were never saved
+func (c *Collection) WarmupFromAccessLog() (int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(c.Map.SyncDestination, HOT_KEYS_NAME))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var hot []HotKey
+	if err = json.Unmarshal(data, &hot); err != nil {
+		return 0, errors.New("failed to read " + HOT_KEYS_NAME + " due " + err.Error())
+	}
+	keys := make([]string, len(hot))
+	for i, k := range hot {
+		keys[i] = k.Key
+	}
+	return c.Warmup(keys)
+}
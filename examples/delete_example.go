@@ -48,11 +48,11 @@ func RunDeleteExample() {
 		}
 		fmt.Println("restored", n, "records")
 
-		size, err := randCol.Optimize()
+		report, err := randCol.Optimize()
 		if err != nil {
 			panic(err)
 		}
-		fmt.Println("Optimization removed", size, "redundant bytes of data")
+		fmt.Println("Optimization removed", report.Reclaimed, "redundant bytes of data, it took", report.Duration)
 
 		err = database.Sync()
 		if err != nil {
@@ -0,0 +1,268 @@
+package saga
+
+// Crash-safe workflows spanning many writes. A saga runs the steps of its workflow one by one and records
+// every finished step in a collection. When a step fails, the finished ones are undone by their compensations
+// in the reverse order. The database is synchronized after every change of a record, so a saga interrupted by
+// a crash is continued by Resume from the step it was at. Steps and compensations may therefore run again
+// and should be idempotent:
+//
+//	sagas, err := saga.New(database, "sagas")
+//	sagas.Register(saga.Workflow{Name: "order", Steps: []saga.Step{
+//		{Name: "reserve", Action: reserve, Compensate: release},
+//		{Name: "charge", Action: charge, Compensate: refund},
+//	}})
+//	sagas.Resume(ctx) // after a restart, before starting new sagas
+//	id, err := sagas.Start(ctx, "order", orderData)
+
+import (
+	"context"
+	"errors"
+	"shardb/db"
+	"sync"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+// states of a saga
+const (
+	STATE_RUNNING      = "running"
+	STATE_COMPENSATING = "compensating"
+	STATE_DONE         = "done"
+	STATE_COMPENSATED  = "compensated"
+)
+
+// A step of a workflow, Compensate undoes a finished Action and may be nil for steps with nothing to undo.
+// Both get the data the saga was started with
+type Step struct {
+	Name       string
+	Action     func(ctx context.Context, data []byte) error
+	Compensate func(ctx context.Context, data []byte) error
+}
+
+// Workflows are registered by name after every start, the records of the sagas refer to them by it
+type Workflow struct {
+	Name  string
+	Steps []Step
+}
+
+// a saga as it is stored in the collection
+type Record struct {
+	Id       string
+	Workflow string
+	Data     []byte
+	// finished steps, the ones left to compensate while compensating
+	Step  int
+	State string
+	// failure of the step that started the compensation
+	Error string
+	// last failure of a compensation, it is retried by Resume
+	CompensationError string
+	Started           time.Time
+	Updated           time.Time
+}
+
+// the records are looked up through the declared indexes of the collection
+func (r *Record) GetDataIndex() []*db.FullDataIndex {
+	return nil
+}
+
+type Coordinator struct {
+	database  *db.Database
+	c         *db.Collection
+	mx        sync.RWMutex
+	workflows map[string]Workflow
+}
+
+// Keeps the sagas in the collection of the name, it is added if the database has none
+func New(database *db.Database, name string) (*Coordinator, error) {
+	database.RegisterType(&Record{})
+	c := database.GetCollection(name)
+	if c == nil {
+		var err error
+		c, err = database.AddCollection(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	declared := make(map[string]bool)
+	for _, ix := range c.Indexes {
+		declared[ix.Field] = true
+	}
+	if !declared["Id"] {
+		if err := c.AddIndex("Id", true); err != nil {
+			return nil, err
+		}
+	}
+	if !declared["State"] {
+		if err := c.AddIndex("State", false); err != nil {
+			return nil, err
+		}
+	}
+	return &Coordinator{database: database, c: c, workflows: make(map[string]Workflow)}, nil
+}
+
+// the collection of the sagas
+func (co *Coordinator) Collection() *db.Collection {
+	return co.c
+}
+
+func (co *Coordinator) Register(w Workflow) error {
+	if w.Name == "" || len(w.Steps) == 0 {
+		return errors.New("workflow needs a name and steps")
+	}
+	for _, s := range w.Steps {
+		if s.Action == nil {
+			return errors.New("step " + s.Name + " of workflow " + w.Name + " has no action")
+		}
+	}
+	co.mx.Lock()
+	defer co.mx.Unlock()
+	if _, ok := co.workflows[w.Name]; ok {
+		return errors.New("workflow " + w.Name + " is registered already")
+	}
+	co.workflows[w.Name] = w
+	return nil
+}
+
+func (co *Coordinator) workflow(name string) (Workflow, bool) {
+	co.mx.RLock()
+	defer co.mx.RUnlock()
+	w, ok := co.workflows[name]
+	return w, ok
+}
+
+// Runs a new saga of the workflow until it is done or compensated, returns its id.
+// The error is the failure of the step that was compensated for, or the one stopping the compensation,
+// the saga is continued by Resume then
+func (co *Coordinator) Start(ctx context.Context, workflow string, data []byte) (string, error) {
+	w, ok := co.workflow(workflow)
+	if !ok {
+		return "", errors.New("workflow " + workflow + " is not registered")
+	}
+	now := co.database.Clock().Now()
+	r := &Record{Id: xid.New().String(), Workflow: workflow, Data: data, State: STATE_RUNNING, Started: now, Updated: now}
+	if err := co.c.WriteContext(ctx, r); err != nil {
+		return "", err
+	}
+	// the saga is known to Resume before its first step runs
+	if err := co.database.SyncContext(ctx); err != nil {
+		return r.Id, err
+	}
+	_, elementId, err := co.find(ctx, r.Id)
+	if err != nil {
+		return r.Id, err
+	}
+	return r.Id, co.run(ctx, w, r, elementId)
+}
+
+// Continues the sagas that are neither done nor compensated, e.g. after a crash, returns the number of them.
+// Sagas of workflows that are not registered are skipped. Their failures are kept in the records, see Get
+func (co *Coordinator) Resume(ctx context.Context) (int, error) {
+	type pending struct {
+		r  *Record
+		id string
+	}
+	sagas := make([]pending, 0)
+	for _, state := range []string{STATE_RUNNING, STATE_COMPENSATING} {
+		err := co.c.Query().Unguarded().Where("State", db.Eq, state).Stream(ctx, func(e *db.Element) error {
+			sagas = append(sagas, pending{e.Payload.(*Record), e.Id})
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	resumed := 0
+	for _, p := range sagas {
+		w, ok := co.workflow(p.r.Workflow)
+		if !ok {
+			continue
+		}
+		resumed++
+		if err := co.run(ctx, w, p.r, p.id); err != nil && ctx.Err() != nil {
+			return resumed, err
+		}
+	}
+	return resumed, nil
+}
+
+// the record of the saga, nil if there is none
+func (co *Coordinator) Get(id string) (*Record, error) {
+	r, _, err := co.find(context.Background(), id)
+	return r, err
+}
+
+// the record of the saga with the id of its element
+func (co *Coordinator) find(ctx context.Context, id string) (*Record, string, error) {
+	var record *Record
+	var elementId string
+	err := co.c.Query().Unguarded().Where("Id", db.Eq, id).Limit(1).Stream(ctx, func(e *db.Element) error {
+		record, elementId = e.Payload.(*Record), e.Id
+		return nil
+	})
+	return record, elementId, err
+}
+
+// updates the record and synchronizes the database, the manifest has to list the change to survive a crash
+func (co *Coordinator) save(ctx context.Context, r *Record, elementId string) error {
+	r.Updated = co.database.Clock().Now()
+	if err := co.c.Update(elementId, r); err != nil {
+		return err
+	}
+	return co.database.SyncContext(ctx)
+}
+
+func (co *Coordinator) run(ctx context.Context, w Workflow, r *Record, elementId string) error {
+	if r.Step > len(w.Steps) {
+		return errors.New("saga " + r.Id + " has more steps than workflow " + w.Name)
+	}
+	for r.State == STATE_RUNNING && r.Step < len(w.Steps) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		step := w.Steps[r.Step]
+		if err := step.Action(ctx, r.Data); err != nil {
+			r.State = STATE_COMPENSATING
+			r.Error = "step " + step.Name + " failed due " + err.Error()
+		} else {
+			r.Step++
+		}
+		if err := co.save(ctx, r, elementId); err != nil {
+			return err
+		}
+	}
+	if r.State == STATE_RUNNING {
+		r.State = STATE_DONE
+		return co.save(ctx, r, elementId)
+	}
+	for r.State == STATE_COMPENSATING && r.Step > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		step := w.Steps[r.Step-1]
+		if step.Compensate != nil {
+			if err := step.Compensate(ctx, r.Data); err != nil {
+				r.CompensationError = "compensation of step " + step.Name + " failed due " + err.Error()
+				if err := co.save(ctx, r, elementId); err != nil {
+					return err
+				}
+				return errors.New(r.CompensationError)
+			}
+		}
+		r.Step--
+		if err := co.save(ctx, r, elementId); err != nil {
+			return err
+		}
+	}
+	if r.State == STATE_COMPENSATING {
+		r.State = STATE_COMPENSATED
+		if err := co.save(ctx, r, elementId); err != nil {
+			return err
+		}
+	}
+	if r.State == STATE_COMPENSATED {
+		return errors.New("saga " + r.Id + " was compensated, " + r.Error)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package session
+
+// Session backend for web applications on top of a shardb collection. Sessions expire at their deadline,
+// the expired ones are never returned and are removed by a background cleanup. Store satisfies the Store,
+// CtxStore, IterableStore and IterableCtxStore interfaces of github.com/alexedwards/scs/v2 without depending on it:
+//
+//	store, err := session.New(database, "sessions")
+//	defer store.StopCleanup()
+//	sessionManager := scs.New()
+//	sessionManager.Store = store
+
+import (
+	"context"
+	"shardb/db"
+	"time"
+)
+
+// expired sessions are removed this often by New
+const DEFAULT_CLEANUP_INTERVAL = 5 * time.Minute
+
+// a session as it is stored in the collection
+type Record struct {
+	Token  string
+	Data   []byte
+	Expiry time.Time
+}
+
+// the records are looked up through the declared indexes of the collection
+func (r *Record) GetDataIndex() []*db.FullDataIndex {
+	return nil
+}
+
+type Store struct {
+	c *db.Collection
+	// the clock of the database decides the expiry
+	clock db.Clock
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// Keeps the sessions in the collection of the name, it is added if the database has none.
+// Expired sessions are removed every DEFAULT_CLEANUP_INTERVAL
+func New(database *db.Database, name string) (*Store, error) {
+	return NewWithCleanupInterval(database, name, DEFAULT_CLEANUP_INTERVAL)
+}
+
+// same as New, the expired sessions are removed every interval, 0 disables the cleanup
+func NewWithCleanupInterval(database *db.Database, name string, interval time.Duration) (*Store, error) {
+	database.RegisterType(&Record{})
+	c := database.GetCollection(name)
+	if c == nil {
+		var err error
+		c, err = database.AddCollection(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	declared := make(map[string]bool)
+	for _, ix := range c.Indexes {
+		declared[ix.Field] = true
+	}
+	if !declared["Token"] {
+		if err := c.AddIndex("Token", true); err != nil {
+			return nil, err
+		}
+	}
+	if !declared["Expiry"] {
+		if err := c.AddIndex("Expiry", false); err != nil {
+			return nil, err
+		}
+	}
+	s := &Store{c: c, clock: database.Clock()}
+	if interval > 0 {
+		s.stop = make(chan struct{})
+		s.done = make(chan struct{})
+		go s.cleanup(s.clock.NewTicker(interval))
+	}
+	return s, nil
+}
+
+// the collection of the sessions
+func (s *Store) Collection() *db.Collection {
+	return s.c
+}
+
+func (s *Store) cleanup(ticker db.Ticker) {
+	defer close(s.done)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.Chan():
+			s.DeleteExpired()
+		}
+	}
+}
+
+// ends the background cleanup, call it before the database is closed
+func (s *Store) StopCleanup() {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+		s.stop = nil
+	}
+}
+
+// the record of the token with the id of its element, nil if there is none
+func (s *Store) find(ctx context.Context, token string) (*Record, string, error) {
+	var record *Record
+	var id string
+	err := s.c.Query().Unguarded().Where("Token", db.Eq, token).Limit(1).Stream(ctx, func(e *db.Element) error {
+		record, id = e.Payload.(*Record), e.Id
+		return nil
+	})
+	return record, id, err
+}
+
+// the data of the session, found is false when there is none or it expired
+func (s *Store) Find(token string) ([]byte, bool, error) {
+	return s.FindCtx(context.Background(), token)
+}
+
+func (s *Store) FindCtx(ctx context.Context, token string) ([]byte, bool, error) {
+	record, _, err := s.find(ctx, token)
+	if err != nil || record == nil || !record.Expiry.After(s.clock.Now()) {
+		return nil, false, err
+	}
+	return record.Data, true, nil
+}
+
+// adds the session or replaces its data and expiry
+func (s *Store) Commit(token string, b []byte, expiry time.Time) error {
+	return s.CommitCtx(context.Background(), token, b, expiry)
+}
+
+func (s *Store) CommitCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	return s.c.WithKeyLock(token, func() error {
+		_, id, err := s.find(ctx, token)
+		if err != nil {
+			return err
+		}
+		record := &Record{Token: token, Data: b, Expiry: expiry}
+		if id != "" {
+			return s.c.Update(id, record)
+		}
+		return s.c.WriteContext(ctx, record)
+	})
+}
+
+// removes the session, a missing one is not an error
+func (s *Store) Delete(token string) error {
+	return s.DeleteCtx(context.Background(), token)
+}
+
+func (s *Store) DeleteCtx(ctx context.Context, token string) error {
+	return s.c.WithKeyLock(token, func() error {
+		_, id, err := s.find(ctx, token)
+		if err != nil || id == "" {
+			return err
+		}
+		return s.c.DeleteById(id)
+	})
+}
+
+// the data of every session that has not expired, by the token
+func (s *Store) All() (map[string][]byte, error) {
+	return s.AllCtx(context.Background())
+}
+
+func (s *Store) AllCtx(ctx context.Context) (map[string][]byte, error) {
+	sessions := make(map[string][]byte)
+	err := s.c.Query().Unguarded().Where("Expiry", db.Gt, s.clock.Now()).Stream(ctx, func(e *db.Element) error {
+		record := e.Payload.(*Record)
+		sessions[record.Token] = record.Data
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// Removes the expired sessions, returns their number. A session committed again meanwhile is kept
+func (s *Store) DeleteExpired() (int, error) {
+	now := s.clock.Now()
+	expired, err := s.c.Query().Unguarded().Where("Expiry", db.Lte, now).Run()
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, e := range expired {
+		token := e.Payload.(*Record).Token
+		err = s.c.WithKeyLock(token, func() error {
+			record, id, err := s.find(context.Background(), token)
+			if err != nil || record == nil || record.Expiry.After(now) {
+				return err
+			}
+			deleted++
+			return s.c.DeleteById(id)
+		})
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
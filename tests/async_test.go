@@ -0,0 +1,66 @@
+package tests
+
+import (
+	"shardb/db"
+	"strconv"
+	"testing"
+)
+
+// never registered, so it can't be encoded
+type Unregistered struct {
+	ExamplePerson
+}
+
+func TestWriteAsync(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	futures := make([]*db.WriteFuture, 0)
+	for i := 0; i < 200; i++ {
+		futures = append(futures, c.WriteAsync(&ExamplePerson{"person" + strconv.Itoa(i), i % 10}))
+	}
+	// fails alone, the rest of its batch is written
+	failed := c.WriteAsync(&Unregistered{ExamplePerson{"unregistered", 1}})
+	for _, f := range futures {
+		if err := f.Wait(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := failed.Wait(); err == nil {
+		t.Fatal("unregistered type was written")
+	}
+	if c.Size() != 200 {
+		t.Fatal("expected 200 elements, got", c.Size())
+	}
+	data, err := c.FindById(futures[42].Id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := c.DecodeElement(data)
+	if err != nil || e.Payload.(*ExamplePerson).FirstName != "person42" {
+		t.Fatal("element was not written under the id of its future", err)
+	}
+	if c.IOStats().Syncs == 0 {
+		t.Fatal("segments were not synced")
+	}
+	// the written elements survive a crash without a Sync
+	loaded := newTestDatabase(t)
+	if err = loaded.ScanAndLoadData(""); err != nil {
+		t.Fatal(err)
+	}
+	if size := loaded.GetCollection("people").Size(); size != 200 {
+		t.Fatal("expected 200 elements after the crash, got", size)
+	}
+	loaded.Close()
+
+	pending := c.WriteAsync(&ExamplePerson{"last", 1})
+	if err = database.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = pending.Err(); err != nil {
+		t.Fatal("queued write was not finished by Close", err)
+	}
+	if err = c.WriteAsync(&ExamplePerson{"closed", 1}).Wait(); err != db.ErrAsyncClosed {
+		t.Fatal("expected ErrAsyncClosed, got", err)
+	}
+}
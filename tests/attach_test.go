@@ -0,0 +1,84 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"shardb/db"
+	"testing"
+)
+
+func TestAttachCollection(t *testing.T) {
+	// built elsewhere
+	builder := db.NewTestDatabase(t)
+	builder.RegisterType(&ExamplePerson{})
+	built, _ := builder.AddCollection("catalog")
+	fillCollection(t, built, 12)
+	if err := builder.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	path := built.SyncDestination
+	// a nightly artifact is usually not writable
+	if err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			err = os.Chmod(p, 0400)
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	database := db.NewTestDatabase(t)
+	database.RegisterType(&ExamplePerson{})
+	local, _ := database.AddCollection("people")
+	fillCollection(t, local, 3)
+	c, err := database.AttachCollection(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if database.GetCollection("catalog") != c || !c.IsReadOnly() || c.Size() != 12 {
+		t.Fatal("collection was not attached")
+	}
+	if found, err := c.Query().Where("Age", db.Eq, 1).Run(); err != nil || len(found) != 2 {
+		t.Fatal("attached collection was not queried", err)
+	}
+	if _, err = database.AttachCollection(path); err == nil {
+		t.Fatal("collection was attached twice")
+	}
+	if _, err = database.AddCollection("catalog"); err == nil {
+		t.Fatal("collection was added over an attached one")
+	}
+	if err = c.Write(&ExamplePerson{"new", 1}); err != db.ErrReadOnly {
+		t.Fatal("attached collection was written", err)
+	}
+	if _, err = c.Delete(&ExamplePerson{Age: 3}); err != db.ErrReadOnly {
+		t.Fatal("attached collection was deleted from", err)
+	}
+	if err = c.WriteAsync(&ExamplePerson{"new", 1}).Wait(); err != db.ErrReadOnly {
+		t.Fatal("attached collection was written asynchronously", err)
+	}
+	if err = database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := db.NewTestDatabaseWithOptions(t, db.DatabaseOptions{Dir: filepath.Dir(filepath.Dir(local.SyncDestination)), Config: db.DefaultConfig()})
+	loaded.RegisterType(&ExamplePerson{})
+	if err = loaded.ScanAndLoadData(""); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.GetCollection("catalog") != nil || loaded.GetCollection("people") == nil {
+		t.Fatal("attached collection was saved with the database")
+	}
+
+	if err = database.DetachCollection("catalog"); err != nil {
+		t.Fatal(err)
+	}
+	if database.GetCollection("catalog") != nil || len(database.AttachedCollections()) != 0 {
+		t.Fatal("collection was not detached")
+	}
+	if err = database.DetachCollection("people"); err == nil {
+		t.Fatal("regular collection was detached")
+	}
+	if _, err = os.Stat(filepath.Join(path, "catalog.json.gzip")); err != nil {
+		t.Fatal("files of the detached collection were removed", err)
+	}
+}
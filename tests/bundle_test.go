@@ -0,0 +1,201 @@
+package tests
+
+import (
+	"bytes"
+	"io/fs"
+	"io/ioutil"
+	"path/filepath"
+	"shardb/db"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestBundle(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	database.RegisterType(&ExamplePerson{})
+	people, _ := database.AddCollection("people")
+	fillCollection(t, people, 30)
+	if err := people.AddIndex("FirstName", true); err != nil {
+		t.Fatal(err)
+	}
+	others, _ := database.AddCollection("others")
+	fillCollection(t, others, 5)
+	bundlePath := filepath.Join(t.TempDir(), "people.bundle")
+	if err := database.Bundle(bundlePath); err != nil {
+		t.Fatal(err)
+	}
+	// not in the bundle
+	fillCollection(t, others, 1)
+
+	check := func(bundled *db.Database) {
+		c := bundled.GetCollection("people")
+		if c == nil || c.Size() != 30 || !c.IsReadOnly() || bundled.GetCollection("others").Size() != 5 {
+			t.Fatal("bundle was not opened")
+		}
+		e, err := c.Query().Where("FirstName", db.Eq, "person17").First()
+		if err != nil || e.Payload.(*ExamplePerson).Age != 7 {
+			t.Fatal("element was not read from the bundle", err)
+		}
+		if n := 0; c.ForEach(func(e *db.Element) error { n++; return nil }) != nil || n != 30 {
+			t.Fatal("bundle was not scanned", n)
+		}
+		if err = c.Write(&ExamplePerson{"new", 1}); err != db.ErrReadOnly {
+			t.Fatal("bundled collection was written", err)
+		}
+		if err = bundled.Sync(); err != db.ErrReadOnly {
+			t.Fatal("bundle was synchronized", err)
+		}
+		if _, err = bundled.AddCollection("new"); err != db.ErrReadOnly {
+			t.Fatal("collection was added to a bundle", err)
+		}
+	}
+	bundled, err := db.OpenBundle(bundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(bundled)
+	if err = bundled.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(bundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	embedded, err := db.OpenBundleBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(embedded)
+	embedded.Close()
+
+	fsys := fstest.MapFS{"data/people.bundle": &fstest.MapFile{Data: data}}
+	fromFS, err := db.OpenBundleFS(fsys, "data/people.bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(fromFS)
+	fromFS.Close()
+	// files without ReadAt are read into memory
+	sequential, err := db.OpenBundleFS(sequentialFS{fsys}, "data/people.bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(sequential)
+	sequential.Close()
+	if _, err = db.OpenBundleFS(fsys, "missing.bundle"); err == nil {
+		t.Fatal("missing bundle was opened")
+	}
+
+	data[len(data)-20] ^= 0xff
+	if _, err = db.OpenBundleBytes(data); err == nil {
+		t.Fatal("corrupted bundle was opened")
+	}
+	if _, err = db.OpenBundleBytes(data[:len(data)/2]); err == nil {
+		t.Fatal("truncated bundle was opened")
+	}
+}
+
+func TestVerifyAndRestoreBackup(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	database.RegisterType(&ExamplePerson{})
+	people, _ := database.AddCollection("people")
+	fillCollection(t, people, 30)
+	others, _ := database.AddCollection("others")
+	fillCollection(t, others, 5)
+	bundlePath := filepath.Join(t.TempDir(), "backup.bundle")
+	if err := database.Bundle(bundlePath); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(bundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := db.VerifyBackup(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Collections["people"] != 30 || report.Collections["others"] != 5 || report.Files == 0 || report.Bytes == 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	// nothing is written by a dry run
+	target := filepath.Join(t.TempDir(), "restored")
+	dry, err := db.RestoreBundle(bytes.NewReader(data), target, db.RestoreOptions{DryRun: true})
+	if err != nil || dry.Files != report.Files {
+		t.Fatalf("dry run failed %+v %v", dry, err)
+	}
+	if _, err = ioutil.ReadDir(target); err == nil {
+		t.Fatal("dry run wrote the target")
+	}
+	if _, err = db.RestoreBundle(bytes.NewReader(data), target, db.RestoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.RestoreBundle(bytes.NewReader(data), target, db.RestoreOptions{DryRun: true}); err == nil ||
+		!strings.Contains(err.Error(), "is not empty") {
+		t.Fatal("restore would replace a database", err)
+	}
+	restored := db.NewTestDatabaseWithOptions(t, db.DatabaseOptions{Dir: target, Config: db.DefaultConfig()})
+	if err = restored.ScanAndLoadData(""); err != nil {
+		t.Fatal(err)
+	}
+	c := restored.GetCollection("people")
+	if c == nil || c.Size() != 30 || restored.GetCollection("others").Size() != 5 {
+		t.Fatal("backup was not restored")
+	}
+	if e, err := c.Query().Where("FirstName", db.Eq, "person17").First(); err != nil || e.Payload.(*ExamplePerson).Age != 7 {
+		t.Fatal("element was not restored", err)
+	}
+	if err = c.Write(&ExamplePerson{"new", 1}); err != nil {
+		t.Fatal("restored collection is not writable", err)
+	}
+
+	// a flipped byte inside of a segment
+	corrupted := append([]byte(nil), data...)
+	corrupted[100] ^= 0xff
+	if _, err = db.VerifyBackup(bytes.NewReader(corrupted)); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatal("corrupted backup was verified", err)
+	}
+	if _, err = db.RestoreBundle(bytes.NewReader(corrupted), filepath.Join(t.TempDir(), "broken"), db.RestoreOptions{}); err == nil {
+		t.Fatal("corrupted backup was restored")
+	}
+}
+
+func TestRestoreBundleModes(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	database.RegisterType(&ExamplePerson{})
+	people, _ := database.AddCollection("people")
+	fillCollection(t, people, 10)
+	bundlePath := filepath.Join(t.TempDir(), "backup.bundle")
+	if err := database.Bundle(bundlePath); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(bundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enterTempDir(t)
+	if _, err = db.RestoreBundle(bytes.NewReader(data), "restored", db.RestoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	checkModes(t, 0600, 0700)
+
+	enterTempDir(t)
+	options := db.DatabaseOptions{FileMode: 0640, DirMode: 0750}
+	if _, err = db.RestoreBundle(bytes.NewReader(data), "restored", db.RestoreOptions{Options: &options}); err != nil {
+		t.Fatal(err)
+	}
+	checkModes(t, 0640, 0750)
+}
+
+// hides the ReadAt of the files
+type sequentialFS struct {
+	fsys fs.FS
+}
+
+func (s sequentialFS) Open(name string) (fs.File, error) {
+	f, err := s.fsys.Open(name)
+	return struct{ fs.File }{f}, err
+}
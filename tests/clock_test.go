@@ -0,0 +1,151 @@
+package tests
+
+import (
+	"shardb/db"
+	"shardb/session"
+	"testing"
+	"time"
+)
+
+func newVirtualDatabase(t *testing.T) (*db.Database, *db.VirtualClock) {
+	clock := db.NewVirtualClock(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+	options := db.DefaultDatabaseOptions()
+	options.Config.LogLevel = db.LOG_WARNING
+	options.Config.BackgroundWorkers = 1
+	options.Clock = clock
+	database := db.NewTestDatabaseWithOptions(t, options)
+	database.RegisterType(&ExamplePerson{})
+	return database, clock
+}
+
+// waits for the background work a tick started
+func eventually(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal(what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestVirtualClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := db.NewVirtualClock(start)
+	ticker := clock.NewTicker(time.Minute)
+	if clock.Tickers() != 1 {
+		t.Fatal("ticker was not registered")
+	}
+	clock.Advance(59 * time.Second)
+	select {
+	case <-ticker.Chan():
+		t.Fatal("ticked early")
+	default:
+	}
+	// the receiver is behind, the further ticks are dropped
+	clock.Advance(3 * time.Minute)
+	if tick := <-ticker.Chan(); !tick.Equal(start.Add(time.Minute)) {
+		t.Fatal("unexpected tick", tick)
+	}
+	select {
+	case <-ticker.Chan():
+		t.Fatal("dropped tick was delivered")
+	default:
+	}
+	if now := clock.Now(); !now.Equal(start.Add(239 * time.Second)) {
+		t.Fatal("unexpected time", now)
+	}
+	ticker.Stop()
+	if clock.Tickers() != 0 {
+		t.Fatal("ticker was not stopped")
+	}
+}
+
+func TestBackgroundSyncVirtualClock(t *testing.T) {
+	database, clock := newVirtualDatabase(t)
+	c, _ := database.AddCollection("people")
+	cfg := database.Config()
+	cfg.SyncInterval = time.Hour
+	if err := database.ApplyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	fillCollection(t, c, 10)
+	clock.Advance(59 * time.Minute)
+	// nothing may run before the interval passed, the sleep gives a wrong tick the chance to show up
+	time.Sleep(10 * time.Millisecond)
+	if !database.IsDirty() {
+		t.Fatal("synchronized before the interval passed")
+	}
+	clock.Advance(time.Minute)
+	eventually(t, "database was not synchronized in the background", func() bool {
+		return !database.IsDirty()
+	})
+}
+
+func TestNegativeCacheVirtualClock(t *testing.T) {
+	database, clock := newVirtualDatabase(t)
+	c, _ := database.AddCollection("people")
+	c.SetNegativeCache(time.Minute)
+	c.FindById("missing", false)
+	c.FindById("missing", false)
+	if stats := c.Metrics().NegativeCache; stats.Hits != 1 || stats.Entries != 1 {
+		t.Fatalf("absent id was not remembered %+v", stats)
+	}
+	clock.Advance(2 * time.Minute)
+	c.FindById("missing", false)
+	if stats := c.Metrics().NegativeCache; stats.Hits != 1 {
+		t.Fatalf("expired entry was used %+v", stats)
+	}
+}
+
+func TestHistoryMaxAgeVirtualClock(t *testing.T) {
+	database, clock := newVirtualDatabase(t)
+	c, _ := database.AddCollection("people")
+	if err := c.SetHistory(&db.HistoryOptions{MaxAge: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	fillCollection(t, c, 1)
+	e, _ := c.Query().First()
+	clock.Advance(time.Minute)
+	c.Update(e.Id, &ExamplePerson{"person0", 1})
+	versions, _ := c.History(e.Id)
+	if len(versions) != 2 || versions[1].Time.Sub(versions[0].Time) != time.Minute {
+		t.Fatal("versions were not recorded at the time of the clock", versions)
+	}
+
+	// the first version was replaced 30 minutes ago
+	clock.Advance(30 * time.Minute)
+	c.Optimize()
+	if versions, _ = c.History(e.Id); len(versions) != 2 {
+		t.Fatal("versions were dropped early", versions)
+	}
+	clock.Advance(31 * time.Minute)
+	c.Optimize()
+	if versions, _ = c.History(e.Id); len(versions) != 1 {
+		t.Fatal("old version was kept", versions)
+	}
+}
+
+func TestSessionStoreVirtualClock(t *testing.T) {
+	database, clock := newVirtualDatabase(t)
+	store, err := session.NewWithCleanupInterval(database, "sessions", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.StopCleanup()
+	if err = store.Commit("a", []byte("data"), clock.Now().Add(90*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute)
+	if _, found, _ := store.Find("a"); !found {
+		t.Fatal("session expired early")
+	}
+	clock.Advance(time.Minute)
+	if _, found, _ := store.Find("a"); found {
+		t.Fatal("expired session was found")
+	}
+	eventually(t, "expired session was not cleaned up", func() bool {
+		return store.Collection().Size() == 0
+	})
+}
@@ -0,0 +1,67 @@
+package tests
+
+import (
+	"bytes"
+	"shardb/db"
+	"sync"
+	"testing"
+)
+
+func TestCoalescedReads(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	database.RegisterType(&ExamplePerson{})
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 10)
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	e, err := c.Query().Where("FirstName", db.Eq, "person3").First()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := c.FindById(e.Id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ResetMetrics()
+
+	const readers = 50
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			data, err := c.FindById(e.Id, false)
+			if err != nil || !bytes.Equal(data, expected) {
+				t.Error("unexpected data", err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	reads := uint64(0)
+	for _, stats := range c.Metrics().ShardIO {
+		reads += stats.Reads
+	}
+	// every caller either read the shard or shared the read of another one
+	if coalesced := c.Metrics().CoalescedReads; reads == 0 || reads+coalesced != readers {
+		t.Fatal("unexpected reads", reads, coalesced)
+	}
+
+	// cached results are decoded again
+	for i := 0; i < 2; i++ {
+		data, err := c.FindById(e.Id, true)
+		if err != nil || !bytes.Equal(data, expected) {
+			t.Fatal("unexpected cached data", err)
+		}
+		results, err := c.ScanN(&ExamplePerson{Age: 3}, 10, true)
+		if err != nil || len(results) != 1 {
+			t.Fatal("unexpected cached scan", len(results), err)
+		}
+	}
+	if _, err = c.FindById("missing", false); err == nil {
+		t.Fatal("missing element was found")
+	}
+}
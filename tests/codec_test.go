@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"shardb/db"
+	"strings"
+	"testing"
+)
+
+var jsonPersonCodec = db.Codec{
+	MarshalElement: func(payload db.CustomStructure) ([]byte, error) {
+		return json.Marshal(payload)
+	},
+	UnmarshalElement: func(data []byte) (db.CustomStructure, error) {
+		p := new(ExamplePerson)
+		return p, json.Unmarshal(data, p)
+	},
+}
+
+func TestCollectionCodec(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	database.RegisterType(&ExamplePerson{})
+	c, _ := database.AddCollection("people")
+	if err := c.SetCodec("json"); err == nil {
+		t.Fatal("unregistered codec was accepted")
+	}
+	if err := database.RegisterCodec("json", jsonPersonCodec); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetCodec("json"); err != nil {
+		t.Fatal(err)
+	}
+	fillCollection(t, c, 10)
+	// the elements written before keep their codec
+	if err := c.SetCodec(""); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Write(&ExamplePerson{"gob", 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetCodec("json"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(c *db.Collection) {
+		t.Helper()
+		for _, name := range []string{"person4", "gob"} {
+			data, err := c.ScanOne(&ExamplePerson{FirstName: name}, false)
+			if err != nil {
+				t.Fatal(name, err)
+			}
+			e, err := c.DecodeElement(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p, ok := e.Payload.(*ExamplePerson); !ok || p.FirstName != name {
+				t.Fatalf("unexpected payload %#v", e.Payload)
+			}
+		}
+		if found, _ := c.Query().Where("Age", db.Eq, 3).Run(); len(found) != 2 {
+			t.Fatal("unexpected query result", found)
+		}
+	}
+	check(c)
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Dir(filepath.Dir(c.SyncDestination))
+	loaded := db.NewTestDatabaseWithOptions(t, db.DatabaseOptions{Dir: dir, Config: db.DefaultConfig()})
+	loaded.RegisterType(&ExamplePerson{})
+	if err := loaded.ScanAndLoadData(""); err != nil {
+		t.Fatal(err)
+	}
+	lc := loaded.GetCollection("people")
+	if lc.Codec != "json" {
+		t.Fatal("codec was not loaded", lc.Codec)
+	}
+	if err := lc.Write(&ExamplePerson{"unregistered", 1}); err == nil || !strings.Contains(err.Error(), "codec json is not registered") {
+		t.Fatal("write without the codec", err)
+	}
+	data, err := lc.ScanOne(&ExamplePerson{FirstName: "person4"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = lc.DecodeElement(data); err == nil || !strings.Contains(err.Error(), "is not registered") {
+		t.Fatal("element was decoded without its codec", err)
+	}
+	if err = loaded.RegisterCodec("json", jsonPersonCodec); err != nil {
+		t.Fatal(err)
+	}
+	check(lc)
+}
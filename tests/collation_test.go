@@ -0,0 +1,53 @@
+package tests
+
+import (
+	"shardb/db"
+	"testing"
+)
+
+func TestCollatedIndex(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	database.RegisterType(&Customer{})
+	c, _ := database.AddCollection("customers")
+	for i, city := range []string{"Ärla", "ärla", "A\u0308rla", "Zug", "Oslo", "Bergen"} {
+		err := c.Write(&Customer{Name: "customer" + string(rune('a'+i)), Address: &Address{City: city}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// byte-wise the decomposed form is a different value and "Ä" sorts after "Z"
+	checkQuery(t, c.Query().Where("address.city", db.Eq, "ärla"), 1)
+	checkQuery(t, c.Query().Where("address.city", db.Lt, "Zug"), 3)
+
+	err := c.CreateIndex(db.Index{Field: "address.city", Collation: &db.Collation{Locale: "de", IgnoreCase: true, Normalize: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkQuery(t, c.Query().Where("address.city", db.Eq, "ärla"), 3)
+	checkQuery(t, c.Query().Where("address.city", db.Eq, "ÄRLA"), 3)
+	checkQuery(t, c.Query().Where("address.city", db.Ne, "ARLA"), 6)
+	checkQuery(t, c.Query().Where("address.city", db.Lt, "Zug"), 5)
+	checkQuery(t, c.Query().Where("address.city", db.Lt, "b"), 3)
+
+	err = c.CreateIndex(db.Index{Field: "Name", Collation: &db.Collation{Locale: "not a locale!"}})
+	if err == nil {
+		t.Fatal("invalid locale was accepted")
+	}
+}
+
+func TestCollationCompare(t *testing.T) {
+	sv := &db.Collation{Locale: "sv"}
+	de := &db.Collation{Locale: "de"}
+	// Swedish sorts Ö after Z, German next to O
+	if sv.Compare("Öl", "Zug") <= 0 || de.Compare("Öl", "Zug") >= 0 {
+		t.Fatal("locale ordering is not applied")
+	}
+	folded := &db.Collation{IgnoreCase: true, Normalize: true}
+	if folded.Compare("Straße", "STRASSE") != 0 || folded.Key("É") != folded.Key("é") {
+		t.Fatal("case folding and normalization are not applied")
+	}
+	if de.Compare("a", "A") == 0 {
+		t.Fatal("values differing in case are equal without IgnoreCase")
+	}
+}
@@ -0,0 +1,92 @@
+package tests
+
+import (
+	"shardb/db"
+	"testing"
+	"time"
+)
+
+type Account struct {
+	Email   string
+	Created time.Time
+}
+
+func (a *Account) GetDataIndex() []*db.FullDataIndex {
+	return []*db.FullDataIndex{}
+}
+
+func newAccounts(t *testing.T) *db.Database {
+	database := newTestDatabase(t)
+	database.RegisterType(&Account{})
+	return database
+}
+
+func registerComputedFields(t *testing.T, c *db.Collection) {
+	if err := c.AddComputedField("email", db.LowercaseOf("Email")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddComputedField("year", db.YearOf("Created")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestComputedFields(t *testing.T) {
+	enterTempDir(t)
+	database := newAccounts(t)
+	c, _ := database.AddCollection("accounts")
+	// written before the fields exist, computed when read
+	if err := c.Write(&Account{"Old@Example.org", time.Date(2019, 5, 1, 0, 0, 0, 0, time.UTC)}); err != nil {
+		t.Fatal(err)
+	}
+	registerComputedFields(t, c)
+	if err := c.AddComputedField("email", db.LowercaseOf("Email")); err == nil {
+		t.Fatal("computed field was added twice")
+	}
+	if err := c.AddIndex("$email", true); err != nil {
+		t.Fatal(err)
+	}
+	for i, email := range []string{"Alice@Example.org", "BOB@example.org"} {
+		if err := c.Write(&Account{email, time.Date(2023, time.Month(i+1), 1, 0, 0, 0, 0, time.UTC)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e, err := c.Query().Where("$email", db.Eq, "bob@example.org").First()
+	if err != nil || e == nil || e.Payload.(*Account).Email != "BOB@example.org" {
+		t.Fatal("element was not found by its computed field", err)
+	}
+	if e.Computed["year"] != int64(2023) {
+		t.Fatal("computed values were not stored", e.Computed)
+	}
+	if old, err := c.Query().Where("$email", db.Eq, "old@example.org").Run(); err != nil || len(old) != 1 {
+		t.Fatal("element written before the field was not indexed", err)
+	}
+	if found, err := c.Query().Where("$year", db.Lt, 2020).Run(); err != nil || len(found) != 1 {
+		t.Fatal("expected one element before 2020", err)
+	}
+	if _, err = c.Query().Where("$missing", db.Eq, 1).Run(); err == nil {
+		t.Fatal("query on an unknown computed field")
+	}
+	if err = database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newAccounts(t)
+	if err = loaded.ScanAndLoadData(""); err != nil {
+		t.Fatal(err)
+	}
+	c = loaded.GetCollection("accounts")
+	if found, err := c.Query().Where("$year", db.Eq, 2023).Run(); err != nil || len(found) != 2 {
+		t.Fatal("stored values were not queried after the load", err)
+	}
+	if err = c.Write(&Account{"Carol@example.org", time.Now()}); err == nil {
+		t.Fatal("written without the functions of the computed fields")
+	}
+	registerComputedFields(t, c)
+	if err = c.Write(&Account{"Carol@example.org", time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if e, err := c.Query().Where("$email", db.Eq, "carol@example.org").First(); err != nil || e == nil {
+		t.Fatal("element written after the load was not found", err)
+	}
+}
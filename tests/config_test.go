@@ -0,0 +1,131 @@
+package tests
+
+import (
+	"shardb/db"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestApplyConfig(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	defer database.Close()
+	c, _ := database.AddCollection("people")
+
+	var mx sync.Mutex
+	events := make([]db.Event, 0)
+	database.OnEvent(func(e db.Event) {
+		mx.Lock()
+		events = append(events, e)
+		mx.Unlock()
+	})
+
+	cfg := database.Config()
+	cfg.WriteBufferSize = 1024 * 1024
+	cfg.SyncInterval = 20 * time.Millisecond
+	cfg.LogLevel = db.LOG_ERROR
+	err := database.ApplyConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.WriteBufferSize != cfg.WriteBufferSize {
+		t.Fatal("write buffer size was not applied")
+	}
+	mx.Lock()
+	if len(events) != 1 || events[0].Type != db.EVENT_CONFIG_CHANGED || len(events[0].Data.([]db.ConfigChange)) != 3 {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	mx.Unlock()
+
+	// applying the same config changes nothing
+	database.ApplyConfig(cfg)
+	mx.Lock()
+	if len(events) != 1 {
+		t.Fatal("event emitted without changes")
+	}
+	mx.Unlock()
+
+	// the background synchronization picks up the writes
+	fillCollection(t, c, 10)
+	deadline := time.Now().Add(5 * time.Second)
+	for database.IsDirty() {
+		if time.Now().After(deadline) {
+			t.Fatal("database was not synchronized in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	loaded := newTestDatabase(t)
+	err = loaded.ScanAndLoadData("")
+	if err != nil || loaded.GetTotalObjectsCount() != 10 {
+		t.Fatal("background sync did not persist the data", err)
+	}
+
+	cfg.SyncInterval = 0
+	database.ApplyConfig(cfg)
+}
+
+func TestCompactionRate(t *testing.T) {
+	enterTempDir(t)
+	options := db.DefaultDatabaseOptions()
+	options.Config.CompactionRate = 20 * 1024
+	database := db.NewDatabaseWithOptions("test", options)
+	database.RegisterType(&ExamplePerson{})
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 200)
+	c.DeleteN(&ExamplePerson{Age: 1}, 20)
+
+	start := time.Now()
+	report, err := c.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every shard is limited on its own
+	perShard := c.GarbageStats().LiveBytes / int64(db.SHARD_COUNT)
+	minimum := time.Duration(perShard) * time.Second / time.Duration(options.Config.CompactionRate)
+	if report.Rewritten == 0 || time.Since(start) < minimum {
+		t.Fatal("compaction was not throttled", time.Since(start), minimum)
+	}
+}
+
+func TestCacheSizeWhileReading(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	defer database.Close()
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 20)
+	ids := make([]string, 0, 20)
+	for _, e := range c.All() {
+		ids = append(ids, e.Id)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := c.FindById(ids[n%len(ids)], true); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	cfg := database.Config()
+	for _, size := range []int{4, 8, 2, 16} {
+		cfg.CacheSize = size
+		if err := database.ApplyConfig(cfg); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+}
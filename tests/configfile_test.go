@@ -0,0 +1,96 @@
+package tests
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"shardb/db"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	enterTempDir(t)
+	files := map[string]string{
+		"shardb.yaml": `
+dir: data
+file_mode: "0640"
+compression: speed
+cache_size: 64
+sync_interval: 30s
+log_level: warning
+sync:
+  attempts: 3
+  backoff: 50ms
+  rollback_header: true
+io_retry:
+  attempts: 4
+  backoff: 10ms
+`,
+		"shardb.toml": `
+dir = "data"
+file_mode = "0640"
+compression = "speed"
+cache_size = 64
+sync_interval = "30s"
+log_level = "warning"
+
+[sync]
+attempts = 3
+backoff = "50ms"
+rollback_header = true
+
+[io_retry]
+attempts = 4
+backoff = "10ms"
+`,
+		"shardb.json": `{"dir": "data", "file_mode": "0640", "compression": "speed", "cache_size": 64,
+			"sync_interval": "30s", "log_level": "warning",
+			"sync": {"attempts": 3, "backoff": "50ms", "rollback_header": true},
+			"io_retry": {"attempts": 4, "backoff": "10ms"}}`,
+	}
+	for name, content := range files {
+		ioutil.WriteFile(name, []byte(content), 0600)
+		options, err := db.LoadConfig(name)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if options.Dir != "data" || options.FileMode != 0640 || options.DirMode != 0700 ||
+			options.CompressionLevel != gzip.BestSpeed || options.Config.CacheSize != 64 ||
+			options.Config.SyncInterval != 30*time.Second || options.Config.LogLevel != db.LOG_WARNING ||
+			options.SyncPolicy.Retry.Attempts != 3 || options.SyncPolicy.Retry.Backoff != 50*time.Millisecond ||
+			!options.SyncPolicy.RollbackHeader || options.IORetry.Attempts != 4 || options.IORetry.Backoff != 10*time.Millisecond {
+			t.Fatalf("%s: unexpected options %+v", name, options)
+		}
+	}
+
+	ioutil.WriteFile("bad.yaml", []byte("log_level: loud\n"), 0600)
+	if _, err := db.LoadConfig("bad.yaml"); err == nil {
+		t.Fatal("invalid log level was accepted")
+	}
+	if _, err := db.LoadConfig("shardb.ini"); err == nil {
+		t.Fatal("unknown format was accepted")
+	}
+}
+
+func TestDatabaseDirOption(t *testing.T) {
+	enterTempDir(t)
+	options := db.DefaultDatabaseOptions()
+	options.Dir = "data"
+	database := db.NewDatabaseWithOptions("test", options)
+	database.RegisterType(&ExamplePerson{})
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 5)
+	err := database.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := db.NewDatabaseWithOptions("test", options)
+	err = loaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.GetTotalObjectsCount() != 5 {
+		t.Fatal("expected 5 objects, got", loaded.GetTotalObjectsCount())
+	}
+}
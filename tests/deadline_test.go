@@ -0,0 +1,64 @@
+package tests
+
+import (
+	"context"
+	"shardb/db"
+	"testing"
+	"time"
+)
+
+func TestContextDeadlines(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 10)
+
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	if err := database.SyncContext(expired); err == nil {
+		t.Fatal("synchronized with an expired deadline")
+	}
+	if !database.IsDirty() {
+		t.Fatal("abandoned synchronization cleared the dirty flag")
+	}
+	if err := c.WriteContext(expired, &ExamplePerson{"late", 1}); err != context.DeadlineExceeded {
+		t.Fatal("expected the deadline error, got", err)
+	}
+	if err := c.Query().Stream(expired, func(e *db.Element) error { return nil }); err != context.DeadlineExceeded {
+		t.Fatal("expected the deadline error, got", err)
+	}
+
+	// many small chunks within the deadline
+	chunkSize := db.IO_CHUNK_SIZE
+	db.IO_CHUNK_SIZE = 8
+	defer func() { db.IO_CHUNK_SIZE = chunkSize }()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := c.WriteContext(ctx, &ExamplePerson{"chunked", 42}); err != nil {
+		t.Fatal(err)
+	}
+	e, err := c.Query().Where("FirstName", db.Eq, "chunked").First()
+	if err != nil || e == nil {
+		t.Fatal("chunked element was not found", err)
+	}
+	data, err := c.FindByIdContext(ctx, e.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := c.DecodeElement(data)
+	if err != nil || found.Payload.(*ExamplePerson).Age != 42 {
+		t.Fatal("chunked element was not read back", err)
+	}
+	if _, err = c.FindByIdContext(expired, e.Id); err != context.DeadlineExceeded {
+		t.Fatal("expected the deadline error, got", err)
+	}
+	if err = database.SyncContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if database.IsDirty() {
+		t.Fatal("database is still dirty")
+	}
+	if c.Size() != 11 {
+		t.Fatal("expected 11 elements, got", c.Size())
+	}
+}
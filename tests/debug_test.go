@@ -0,0 +1,37 @@
+package tests
+
+import (
+	"encoding/json"
+	"shardb/db"
+	"strings"
+	"testing"
+)
+
+func TestDebugDump(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	database.RegisterType(&ExamplePerson{})
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 10)
+
+	locked := make(chan struct{})
+	release := make(chan struct{})
+	go c.WithKeyLock("person1", func() error {
+		close(locked)
+		<-release
+		return nil
+	})
+	<-locked
+	state := database.DebugDump()
+	close(release)
+
+	if state.Goroutines == 0 || !strings.Contains(state.Stacks, "TestDebugDump") {
+		t.Fatal("goroutines were not captured")
+	}
+	cs := state.Collections["people"]
+	if cs == nil || cs.Objects != 10 || cs.LockedKeys != 1 || cs.KeyWaiters != 0 || len(cs.DirtyShards) == 0 {
+		t.Fatalf("unexpected collection state %+v", cs)
+	}
+	if _, err := json.Marshal(state); err != nil {
+		t.Fatal(err)
+	}
+}
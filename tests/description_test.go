@@ -0,0 +1,133 @@
+package tests
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"shardb/db"
+	"strconv"
+	"testing"
+)
+
+func rewriteDescription(t *testing.T, path string, change func(d map[string]interface{})) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := gzip.NewReader(f)
+	data, _ := ioutil.ReadAll(r)
+	f.Close()
+	d := make(map[string]interface{})
+	json.Unmarshal(data, &d)
+	change(d)
+	data, _ = json.Marshal(d)
+	f, _ = os.Create(path)
+	w := gzip.NewWriter(f)
+	w.Write(data)
+	w.Close()
+	f.Close()
+}
+
+func TestDescriptionSchema(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 5)
+	database.Sync()
+	os.Remove(db.MANIFEST_NAME)
+	description := filepath.Join(db.COLLECTION_DIR_NAME, "people", "people.json.gzip")
+
+	// a description of schema 1 written on Windows
+	rewriteDescription(t, description, func(d map[string]interface{}) {
+		if d["schema"] != float64(db.DESCRIPTION_SCHEMA) {
+			t.Fatal("description has no schema")
+		}
+		delete(d, "schema")
+		d["sync_dest"] = "collections\\people"
+	})
+	loaded := newTestDatabase(t)
+	err := loaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.GetTotalObjectsCount() != 5 {
+		t.Fatal("migrated description was not loaded")
+	}
+
+	rewriteDescription(t, description, func(d map[string]interface{}) {
+		d["schema"] = db.DESCRIPTION_SCHEMA + 1
+	})
+	err = newTestDatabase(t).ScanAndLoadData("")
+	if err == nil {
+		t.Fatal("description of schema " + strconv.Itoa(db.DESCRIPTION_SCHEMA+1) + " was loaded")
+	}
+}
+
+// every setting of the collections is on, so the descriptions have every key MarshalJSON writes
+func TestDescriptionKeysBelongToSchema(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	database.RegisterCodec("json", jsonPersonCodec)
+	c, _ := database.AddCollection("people")
+	c.SetWriteBufferSize(1 << 10)
+	if err := c.SetEncryption(db.StaticKey(bytes.Repeat([]byte{7}, 32)), "FirstName"); err != nil {
+		t.Fatal(err)
+	}
+	c.SetFieldFragments(true)
+	if err := c.AddComputedField("name", db.LowercaseOf("FirstName")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddIndex("Age", false); err != nil {
+		t.Fatal(err)
+	}
+	coded, _ := database.AddCollection("coded")
+	if err := coded.SetCodec("json"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.KV("settings"); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := make(map[string]bool)
+	files, _ := filepath.Glob(filepath.Join(db.COLLECTION_DIR_NAME, "*", "*.json.gzip"))
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, _ := gzip.NewReader(f)
+		d := make(map[string]interface{})
+		err = json.NewDecoder(r).Decode(&d)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key := range d {
+			keys[key] = true
+		}
+	}
+	for _, key := range []string{"schema", "name", "dests", "objects", "sync_dest", "write_buffer", "encrypted",
+		"fragments", "indexes", "computed", "codec", "partitioned_keys"} {
+		if !keys[key] {
+			t.Fatal("description has no", key)
+		}
+	}
+	if err := newTestDatabase(t).ScanAndLoadData(""); err != nil {
+		t.Fatal("description of the current schema was refused", err)
+	}
+
+	// a key unknown to the schema fails the load
+	os.Remove(db.MANIFEST_NAME)
+	rewriteDescription(t, filepath.Join(db.COLLECTION_DIR_NAME, "coded", "coded.json.gzip"), func(d map[string]interface{}) {
+		d["unknown"] = true
+	})
+	if err := newTestDatabase(t).ScanAndLoadData(""); err == nil {
+		t.Fatal("description with an unknown key was loaded")
+	}
+}
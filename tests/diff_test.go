@@ -0,0 +1,69 @@
+package tests
+
+import (
+	"path/filepath"
+	"shardb/db"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	original := db.NewTestDatabase(t)
+	original.RegisterType(&ExamplePerson{})
+	c, _ := original.AddCollection("people")
+	fillCollection(t, c, 10)
+	logs, _ := original.AddCollection("logs")
+	fillCollection(t, logs, 2)
+	if err := original.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	dirA := filepath.Dir(filepath.Dir(c.SyncDestination))
+	dirB := t.TempDir()
+	copyDir(t, dirA, dirB)
+
+	report, err := db.Diff(dirA, dirB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Identical() {
+		t.Fatal("copies differ", report)
+	}
+
+	migrated := db.NewTestDatabaseWithOptions(t, db.DatabaseOptions{Dir: dirB, Config: db.DefaultConfig()})
+	if err = migrated.ScanAndLoadData(""); err != nil {
+		t.Fatal(err)
+	}
+	people := migrated.GetCollection("people")
+	changed, _ := people.Query().Where("FirstName", db.Eq, "person1").First()
+	removed, _ := people.Query().Where("FirstName", db.Eq, "person2").First()
+	people.Update(changed.Id, &ExamplePerson{"person1", 42})
+	people.DeleteById(removed.Id)
+	people.Write(&ExamplePerson{"added", 1})
+	migrated.AddCollection("audit")
+	migrated.DropCollection("logs")
+	if err = migrated.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = db.DiffWithOptions(dirA, dirB, &db.DiffOptions{Values: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Identical() || len(report.AddedCollections) != 1 || report.AddedCollections[0] != "audit" ||
+		len(report.RemovedCollections) != 1 || report.RemovedCollections[0] != "logs" {
+		t.Fatal("unexpected collections", report)
+	}
+	cd := report.Collections["people"]
+	if cd == nil || len(cd.Added) != 1 || len(cd.Removed) != 1 || cd.Removed[0] != removed.Id ||
+		len(cd.Changed) != 1 || cd.Changed[0] != changed.Id {
+		t.Fatal("unexpected elements", cd)
+	}
+	values := cd.Values[changed.Id]
+	if len(values) != 1 || values[0].Path != "Age" || values[0].Old != float64(1) || values[0].New != float64(42) {
+		t.Fatal("unexpected values", values)
+	}
+
+	report, err = db.DiffWithOptions(dirA, dirB, &db.DiffOptions{Collections: []string{"logs"}})
+	if err != nil || len(report.RemovedCollections) != 1 || len(report.AddedCollections) != 0 || len(report.Collections) != 0 {
+		t.Fatal("unexpected report of the selected collections", report, err)
+	}
+}
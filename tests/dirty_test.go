@@ -0,0 +1,38 @@
+package tests
+
+import "testing"
+
+func TestDirtyTracking(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	if database.IsDirty() {
+		t.Fatal("empty database is dirty")
+	}
+	c, _ := database.AddCollection("people")
+	if !database.IsDirty() {
+		t.Fatal("new collection is not reported")
+	}
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if database.IsDirty() || len(c.DirtyShards()) != 0 {
+		t.Fatal("database is dirty right after the sync")
+	}
+
+	fillCollection(t, c, 1)
+	if dirty := c.DirtyShards(); len(dirty) != 1 || !database.IsDirty() {
+		t.Fatal("expected exactly one dirty shard, got", dirty)
+	}
+	database.Sync()
+	if database.IsDirty() {
+		t.Fatal("database is dirty right after the sync")
+	}
+
+	loaded := newTestDatabase(t)
+	if err := loaded.ScanAndLoadData(""); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.IsDirty() {
+		t.Fatal("freshly loaded database is dirty")
+	}
+}
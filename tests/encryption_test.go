@@ -0,0 +1,125 @@
+package tests
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"shardb/db"
+	"testing"
+)
+
+func TestFieldEncryption(t *testing.T) {
+	enterTempDir(t)
+	key := db.StaticKey(bytes.Repeat([]byte{7}, 32))
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	err := c.SetEncryption(key, "FirstName")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillCollection(t, c, 20)
+	err = database.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// neither the data nor the meta files contain the plain values
+	files, _ := filepath.Glob(filepath.Join(db.COLLECTION_DIR_NAME, "people", "*"))
+	for _, f := range files {
+		data, _ := ioutil.ReadFile(f)
+		if bytes.Contains(data, []byte("person1")) {
+			t.Fatal("plain value found in", f)
+		}
+	}
+
+	data, err := c.ScanOne(&ExamplePerson{FirstName: "person12"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	el, err := c.DecodeElement(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := el.Payload.(*ExamplePerson); p.FirstName != "person12" || p.Age != 2 {
+		t.Fatal("unexpected element", p)
+	}
+	dst := db.AcquireElement()
+	defer db.ReleaseElement(dst)
+	if err = c.ReadInto(el.Id, dst); err != nil {
+		t.Fatal(err)
+	}
+	if p := dst.Payload.(*ExamplePerson); p.FirstName != "person12" {
+		t.Fatal("field was not decrypted by ReadInto", p.FirstName)
+	}
+
+	// without the keys the ciphertext is returned and writes fail
+	loaded := newTestDatabase(t)
+	err = loaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := loaded.GetCollection("people")
+	err = lc.ForEach(func(e *db.Element) error {
+		if e.Payload.(*ExamplePerson).FirstName == "person3" {
+			t.Fatal("field was decrypted without the keys")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = lc.Write(&ExamplePerson{"someone", 1}); err == nil {
+		t.Fatal("write without the keys was accepted")
+	}
+	if err = lc.SetEncryption(key, "Age"); err == nil {
+		t.Fatal("encrypted fields were changed")
+	}
+	err = lc.SetEncryption(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = lc.ScanOne(&ExamplePerson{FirstName: "person3"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if el, _ = lc.DecodeElement(data); el.Payload.(*ExamplePerson).FirstName != "person3" {
+		t.Fatal("field was not decrypted")
+	}
+
+	// a wrong key can not decrypt anything
+	wrong := newTestDatabase(t)
+	wrong.ScanAndLoadData("")
+	wc := wrong.GetCollection("people")
+	wc.SetEncryption(db.StaticKey(bytes.Repeat([]byte{8}, 32)))
+	if err = wc.ForEach(func(e *db.Element) error { return nil }); err == nil {
+		t.Fatal("decryption with a wrong key succeeded")
+	}
+}
+
+func TestSetEncryptionWhileReading(t *testing.T) {
+	enterTempDir(t)
+	key := db.StaticKey(bytes.Repeat([]byte{7}, 32))
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	if err := c.SetEncryption(key, "FirstName"); err != nil {
+		t.Fatal(err)
+	}
+	fillCollection(t, c, 20)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			if _, err := c.Query().Where("FirstName", db.Eq, "person3").First(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if err := c.SetEncryption(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
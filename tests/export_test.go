@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"shardb/db"
+	"strings"
+	"testing"
+)
+
+func TestExportJSONLRedaction(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 20)
+
+	var plain bytes.Buffer
+	n, err := c.ExportJSONL(&plain, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 20 || !bytes.Contains(plain.Bytes(), []byte(`"FirstName":"person7"`)) {
+		t.Fatal("unexpected export", n, plain.String())
+	}
+
+	var masked bytes.Buffer
+	_, err = c.ExportJSONL(&masked, &db.ExportOptions{Redact: []string{"Age"}, Hash: []string{"FirstName"}, Salt: "staging"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(&masked)
+	for scanner.Scan() {
+		var line struct {
+			Id      string `json:"x"`
+			Payload struct {
+				FirstName string
+				Age       interface{}
+			} `json:"p"`
+		}
+		err = json.Unmarshal(scanner.Bytes(), &line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line.Id == "" || line.Payload.Age != db.REDACTED || len(line.Payload.FirstName) != 64 {
+			t.Fatal("field was not masked", scanner.Text())
+		}
+		names[line.Payload.FirstName] = true
+	}
+	if len(names) != 20 {
+		t.Fatal("hashes of different values collide")
+	}
+}
+
+func TestImportStream(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	database.RegisterType(&ExamplePerson{})
+	c, _ := database.AddCollection("people")
+	input := `{"name": "ann", "age": 31}
+
+{"name": "bob", "age": -1}
+{"name": "cid", "age": 42}`
+	// rows with an invalid age are dropped, the fields are remapped
+	transform := func(record interface{}) (interface{}, bool) {
+		row := record.(map[string]interface{})
+		age, _ := row["age"].(float64)
+		if age < 0 {
+			return nil, false
+		}
+		return &ExamplePerson{FirstName: row["name"].(string), Age: int(age)}, true
+	}
+	report, err := c.ImportStream(strings.NewReader(input), db.JSONLDecoder{}, transform)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Read != 3 || report.Imported != 2 || report.Dropped != 1 || c.Size() != 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if _, err = c.ScanOne(&ExamplePerson{FirstName: "cid"}, false); err != nil {
+		t.Fatal("record was not imported", err)
+	}
+
+	// records decoded into the payload type are imported as they are
+	typed := db.JSONLDecoder{New: func() interface{} { return &ExamplePerson{} }}
+	report, err = c.ImportStream(strings.NewReader(`{"FirstName": "dan", "Age": 5}`+"\n"+`{"FirstName": `), typed, nil)
+	if err == nil || !strings.Contains(err.Error(), "failed to decode record 2") || report.Imported != 1 {
+		t.Fatalf("broken record was not reported %+v %v", report, err)
+	}
+	if _, err = c.ImportStream(strings.NewReader(input), db.JSONLDecoder{}, nil); err == nil ||
+		!strings.Contains(err.Error(), "is not a CustomStructure") {
+		t.Fatal("record without a payload type was imported", err)
+	}
+}
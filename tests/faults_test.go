@@ -0,0 +1,250 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"shardb/db"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newFaultyDatabase(t *testing.T) (*db.Database, *db.Faults) {
+	faults := db.NewFaults()
+	options := db.DefaultDatabaseOptions()
+	options.Config.LogLevel = db.LOG_ERROR
+	options.Faults = faults
+	database := db.NewTestDatabaseWithOptions(t, options)
+	database.RegisterType(&ExamplePerson{})
+	return database, faults
+}
+
+func reopen(t *testing.T, c *db.Collection) *db.Collection {
+	dir := filepath.Dir(filepath.Dir(c.SyncDestination))
+	loaded := db.NewTestDatabaseWithOptions(t, db.DatabaseOptions{Dir: dir, Config: db.DefaultConfig()})
+	loaded.RegisterType(&ExamplePerson{})
+	if err := loaded.ScanAndLoadData(""); err != nil {
+		t.Fatal("database does not load after the fault", err)
+	}
+	return loaded.GetCollection(c.Name)
+}
+
+func TestFailedWrite(t *testing.T) {
+	database, faults := newFaultyDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 5)
+	faults.FailWrite(1, syscall.EIO)
+	if err := c.Write(&ExamplePerson{"failed", 1}); !errors.Is(err, syscall.EIO) {
+		t.Fatal("injected failure was not returned", err)
+	}
+	if err := c.Write(&ExamplePerson{"next", 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := reopen(t, c)
+	if loaded.Size() != 6 {
+		t.Fatal("unexpected size", loaded.Size())
+	}
+	if data, err := loaded.ScanOne(&ExamplePerson{FirstName: "next"}, false); err != nil || data == nil {
+		t.Fatal("write after the failure was lost", err)
+	}
+}
+
+func TestTornSyncKeepsPreviousState(t *testing.T) {
+	for name, arm := range map[string]func(f *db.Faults){
+		"torn write":    func(f *db.Faults) { f.Only(".tmp").TearWrite(1, 7) },
+		"failed fsync":  func(f *db.Faults) { f.FailSync(syscall.EIO) },
+		"failed rename": func(f *db.Faults) { f.FailRename(syscall.EIO) },
+		// the collections replaced their files already
+		"failed manifest rename": func(f *db.Faults) { f.Only("MANIFEST").FailRename(syscall.EIO) },
+		"torn manifest":          func(f *db.Faults) { f.Only("MANIFEST").TearWrite(1, 7) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			database, faults := newFaultyDatabase(t)
+			c, _ := database.AddCollection("people")
+			fillCollection(t, c, 10)
+			if err := database.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 5; i++ {
+				c.Write(&ExamplePerson{"late" + string(rune('a'+i)), 1})
+			}
+			arm(faults)
+			if err := database.Sync(); err == nil {
+				t.Fatal("sync succeeded despite the fault")
+			}
+			loaded := reopen(t, c)
+			if loaded.Size() != 10 {
+				t.Fatal("unexpected size after the failed sync", loaded.Size())
+			}
+			if _, err := loaded.ScanOne(&ExamplePerson{FirstName: "person9"}, false); err != nil {
+				t.Fatal("synchronized element was lost", err)
+			}
+
+			// the next sync goes through once the drive recovers
+			faults.Clear()
+			if err := database.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			if loaded = reopen(t, c); loaded.Size() != 15 {
+				t.Fatal("unexpected size after the recovery", loaded.Size())
+			}
+		})
+	}
+}
+
+func TestCrashBeforeManifestKeepsPreviousState(t *testing.T) {
+	database, faults := newFaultyDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 10)
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	c.Write(&ExamplePerson{"late", 1})
+	if err := c.AddIndex("Age", false); err != nil {
+		t.Fatal(err)
+	}
+	// the collections replaced their files, the manifest still describes the previous ones
+	faults.Only("MANIFEST").FailRename(syscall.EIO)
+	if err := database.Sync(); err == nil {
+		t.Fatal("sync succeeded despite the fault")
+	}
+	loaded := reopen(t, c)
+	if loaded.Size() != 10 {
+		t.Fatal("unexpected size after the crash", loaded.Size())
+	}
+	if _, err := loaded.ScanOne(&ExamplePerson{FirstName: "person9"}, false); err != nil {
+		t.Fatal("synchronized element was lost", err)
+	}
+
+	faults.Clear()
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded = reopen(t, c); loaded.Size() != 11 {
+		t.Fatal("unexpected size after the recovery", loaded.Size())
+	}
+	// only the snapshots of the saved manifest are kept
+	snapshots, _ := filepath.Glob(filepath.Join(c.SyncDestination, "map.index.*"))
+	if len(snapshots) != 1 {
+		t.Fatal("unexpected snapshots of the map index", snapshots)
+	}
+}
+
+func TestTornMetadataKeepsOldFile(t *testing.T) {
+	database, faults := newFaultyDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 10)
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Dir(filepath.Dir(c.SyncDestination))
+	for _, path := range []string{filepath.Join(c.SyncDestination, "map.index"), filepath.Join(dir, "test.shardb")} {
+		before, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		faults.Only(filepath.Base(path)).TearWrite(1, 1)
+		c.Write(&ExamplePerson{"late", 1})
+		if err = database.Sync(); err == nil {
+			t.Fatal("sync succeeded despite the torn", filepath.Base(path))
+		}
+		faults.Clear()
+		if after, err := os.ReadFile(path); err != nil || !bytes.Equal(before, after) {
+			t.Fatal(filepath.Base(path), "was changed by the torn write", err)
+		}
+	}
+}
+
+func TestOptimizeKeepsSegmentsUntilManifest(t *testing.T) {
+	database, faults := newFaultyDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 40)
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 40; i += 2 {
+		person, err := c.Query().Where("FirstName", db.Eq, "person"+strconv.Itoa(i)).First()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.DeleteById(person.Id)
+	}
+	checkLive := func(c *db.Collection) {
+		for i := 1; i < 40; i += 2 {
+			if _, err := c.ScanOne(&ExamplePerson{FirstName: "person" + strconv.Itoa(i)}, false); err != nil {
+				t.Fatal("person"+strconv.Itoa(i), "was lost", err)
+			}
+		}
+	}
+
+	// the merged segment never reaches the drive, the elements stay in the old ones
+	faults.Only(".gobs").FailSync(syscall.EIO)
+	if _, err := c.Optimize(); err == nil {
+		t.Fatal("optimization succeeded despite the fault")
+	}
+	faults.Clear()
+	checkLive(c)
+
+	// a crash before the manifest loads the old segments
+	if _, err := c.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := reopen(t, c)
+	if loaded.Size() != 40 {
+		t.Fatal("unexpected size after the crash", loaded.Size())
+	}
+	checkLive(loaded)
+
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	loaded = reopen(t, c)
+	if loaded.Size() != 20 {
+		t.Fatal("unexpected size after the sync", loaded.Size())
+	}
+	checkLive(loaded)
+}
+
+func TestNoSpace(t *testing.T) {
+	database, faults := newFaultyDatabase(t)
+	c, _ := database.AddCollection("people")
+	faults.NoSpaceAfter(1000)
+	var err error
+	written := 0
+	for ; written < 1000 && err == nil; written++ {
+		err = c.Write(&ExamplePerson{"person" + string(rune('a'+written%26)) + string(rune('a'+written/26)), 1})
+	}
+	if !errors.Is(err, syscall.ENOSPC) || written < 2 {
+		t.Fatal("writes did not run out of space", written, err)
+	}
+	faults.Clear()
+	if err = c.Write(&ExamplePerson{"after", 1}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := c.ScanOne(&ExamplePerson{FirstName: "after"}, false); err != nil || data == nil {
+		t.Fatal("write after the space was freed is not readable", err)
+	}
+}
+
+func TestDelayedSync(t *testing.T) {
+	database, faults := newFaultyDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 3)
+	faults.Only("shard_0").DelaySync(50 * time.Millisecond)
+	start := time.Now()
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("fsync was not delayed")
+	}
+}
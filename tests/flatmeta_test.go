@@ -0,0 +1,247 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"shardb/db"
+	"testing"
+)
+
+func mappedShards(c *db.Collection) int {
+	n := 0
+	for _, shard := range c.Map.Shared {
+		if shard.IsMapped() {
+			n++
+		}
+	}
+	return n
+}
+
+func TestFlatMetaIsDecodedOnDemand(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 50)
+	first, err := c.Query().Where("FirstName", db.Eq, "person0").First()
+	if err != nil || first == nil {
+		t.Fatal("person0 was not found", err)
+	}
+	if err = c.DeleteById(first.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err = database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	database.Close()
+
+	database = newTestDatabase(t)
+	if err = database.ScanAndLoadData(""); err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	c = database.GetCollection("people")
+	if mappedShards(c) != db.SHARD_COUNT {
+		t.Fatal("shards were decoded by the load")
+	}
+	// a sync of untouched shards keeps them mapped
+	if err = database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if mappedShards(c) != db.SHARD_COUNT {
+		t.Fatal("shards were decoded by the sync")
+	}
+
+	second, err := c.Query().Where("FirstName", db.Eq, "person1").First()
+	if err != nil || second == nil {
+		t.Fatal("person1 was not found", err)
+	}
+	if _, err = c.FindByIdContext(context.Background(), first.Id); err == nil {
+		t.Fatal("deleted element was found")
+	}
+	count := 0
+	err = c.ForEach(func(e *db.Element) error {
+		count++
+		return nil
+	})
+	if err != nil || count != 49 {
+		t.Fatal("expected 49 elements, got", count, err)
+	}
+	if mappedShards(c) != 0 {
+		t.Fatal("scanned shards are still mapped")
+	}
+}
+
+func TestCorruptedFlatMeta(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 10)
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// without the manifest the meta checks itself
+	os.Remove(db.MANIFEST_NAME)
+	meta := filepath.Join(db.COLLECTION_DIR_NAME, "people", "shard_2_meta.flat")
+	data, _ := ioutil.ReadFile(meta)
+	data[len(data)-1] ^= 0xff
+	ioutil.WriteFile(meta, data, os.ModePerm)
+	if err := newTestDatabase(t).ScanAndLoadData(""); err == nil {
+		t.Fatal("corrupted meta file was accepted")
+	}
+}
+
+func TestLegacyMetasAreReplaced(t *testing.T) {
+	src, _ := filepath.Abs(filepath.Join("testdata", "v2"))
+	dir := enterTempDir(t)
+	copyDir(t, src, dir)
+	database := newTestDatabase(t)
+	if err := database.ScanAndLoadData(""); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	database.Close()
+	if legacy, _ := filepath.Glob(filepath.Join(db.COLLECTION_DIR_NAME, "*", "*_meta.gob.gzip")); len(legacy) != 0 {
+		t.Fatal("gob metas were left behind", legacy)
+	}
+
+	database = newTestDatabase(t)
+	if err := database.ScanAndLoadData(""); err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if size := database.GetCollection("people").Size(); size != goldenObjects-goldenDeleted {
+		t.Fatal("unexpected size", size)
+	}
+	found, err := database.GetCollection("people").Query().Where("FirstName", db.Eq, "person7").First()
+	if err != nil || found == nil {
+		t.Fatal("person7 was not found", err)
+	}
+}
+
+func TestFlatMetaDeltas(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	database.RegisterType(&ExamplePerson{})
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 50)
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	meta := filepath.Join(c.SyncDestination, "shard_0_meta.flat")
+	base, _ := ioutil.ReadFile(meta)
+
+	for i := 50; i < 55; i++ {
+		c.Write(&ExamplePerson{"person" + string(rune('a'+i-50)), i % 10})
+	}
+	elements, _ := c.Query().Limit(6).Run()
+	for i, e := range elements {
+		if i%2 == 0 {
+			c.DeleteById(e.Id)
+		} else {
+			c.Update(e.Id, &ExamplePerson{"updated" + e.Id, 42})
+		}
+	}
+	c.Delete(&ExamplePerson{Age: 7})
+	if err := c.AddIndex("Age", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	appended, _ := ioutil.ReadFile(meta)
+	if len(appended) <= len(base) || !bytes.Equal(appended[:len(base)], base) {
+		t.Fatal("changes were not appended to the meta")
+	}
+
+	dir := filepath.Dir(filepath.Dir(c.SyncDestination))
+	reload := func() *db.Collection {
+		loaded := db.NewTestDatabaseWithOptions(t, db.DatabaseOptions{Dir: dir, Config: db.DefaultConfig()})
+		loaded.RegisterType(&ExamplePerson{})
+		if err := loaded.ScanAndLoadData(""); err != nil {
+			t.Fatal(err)
+		}
+		if violations := loaded.CheckInvariants(); len(violations) > 0 {
+			t.Fatal(violations)
+		}
+		return loaded.GetCollection("people")
+	}
+	loaded := reload()
+	if loaded.Size() != c.Size() {
+		t.Fatal("unexpected size", loaded.Size(), c.Size())
+	}
+	for i, e := range elements {
+		_, err := loaded.FindByIdContext(context.Background(), e.Id)
+		if deleted := i%2 == 0; deleted != (err != nil) {
+			t.Fatal("element", e.Id, "was not loaded as it was synchronized", err)
+		}
+	}
+	if found, _ := loaded.Query().Where("Age", db.Eq, 42).Run(); len(found) != 3 {
+		t.Fatal("updated elements were not found by the new index", len(found))
+	}
+
+	// compaction moves the entries, so the meta is written again
+	if _, err := c.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if rewritten, _ := ioutil.ReadFile(meta); bytes.HasPrefix(rewritten, appended) {
+		t.Fatal("meta was not rewritten after the compaction")
+	}
+	if loaded = reload(); loaded.Size() != c.Size() {
+		t.Fatal("unexpected size after the compaction", loaded.Size())
+	}
+}
+
+func TestTornFlatMetaDelta(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	database.RegisterType(&ExamplePerson{})
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 20)
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	meta := filepath.Join(c.SyncDestination, "shard_0_meta.flat")
+	base, _ := ioutil.ReadFile(meta)
+	for i := 0; i < 10; i++ {
+		c.Write(&ExamplePerson{"late" + string(rune('a'+i)), 1})
+	}
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// a crash in the middle of the append, without the manifest the meta checks itself
+	dir := filepath.Dir(filepath.Dir(c.SyncDestination))
+	os.Remove(filepath.Join(dir, db.MANIFEST_NAME))
+	appended, _ := ioutil.ReadFile(meta)
+	ioutil.WriteFile(meta, appended[:len(appended)-3], 0600)
+
+	loaded := db.NewTestDatabaseWithOptions(t, db.DatabaseOptions{Dir: dir, Config: db.DefaultConfig()})
+	loaded.RegisterType(&ExamplePerson{})
+	if err := loaded.ScanAndLoadData(""); err != nil {
+		t.Fatal("torn delta was not left out", err)
+	}
+	// every shard takes one of the writes, the torn tail is replaced by a complete meta
+	people := loaded.GetCollection("people")
+	for i := 0; i < db.SHARD_COUNT; i++ {
+		people.Write(&ExamplePerson{"after" + string(rune('a'+i)), 2})
+	}
+	if err := loaded.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if rewritten, _ := ioutil.ReadFile(meta); bytes.HasPrefix(rewritten, base) {
+		t.Fatal("delta was appended behind the torn one")
+	}
+	reloaded := db.NewTestDatabaseWithOptions(t, db.DatabaseOptions{Dir: dir, Config: db.DefaultConfig()})
+	reloaded.RegisterType(&ExamplePerson{})
+	if err := reloaded.ScanAndLoadData(""); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := reloaded.GetCollection("people").Query().Where("FirstName", db.Eq, "aftera").First(); found == nil {
+		t.Fatal("write after the recovery was lost")
+	}
+}
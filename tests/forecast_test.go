@@ -0,0 +1,140 @@
+package tests
+
+import (
+	"shardb/db"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForecastDiskUsage(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 50)
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.Delete(&ExamplePerson{FirstName: "person7"}); err != nil || n == 0 {
+		t.Fatal("person7 was not deleted", err)
+	}
+	if err := c.SetWriteBufferSize(1024 * 1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Write(&ExamplePerson{"buffered", 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := database.ForecastDiskUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Used == 0 || f.Free == 0 || f.Pending == 0 || f.Backup != f.Used+f.Pending {
+		t.Fatalf("unexpected forecast %+v", f)
+	}
+	largest := int64(0)
+	for _, g := range c.GarbageStats().Shards {
+		if g.LiveBytes > largest {
+			largest = g.LiveBytes
+		}
+	}
+	// the largest shard is copied while its old segments still exist
+	if f.Optimize != largest+f.Pending || f.Sync <= f.Pending {
+		t.Fatalf("unexpected forecast %+v, largest shard %d", f, largest)
+	}
+	if err = f.Check(f.Optimize); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.Check(f.Free + 1).(*db.InsufficientSpaceError); !ok {
+		t.Fatal("expected an InsufficientSpaceError")
+	}
+}
+
+func TestDiskWatchdog(t *testing.T) {
+	clock := db.NewVirtualClock(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+	free := int64(1 << 30)
+	options := db.DefaultDatabaseOptions()
+	options.Config.LogLevel = db.LOG_NONE
+	options.Config.BackgroundWorkers = 1
+	options.Config.DiskCheckInterval = time.Minute
+	options.Config.DiskLowSpace = 1 << 20
+	options.Config.DiskCriticalSpace = 1 << 10
+	options.Clock = clock
+	options.DiskFree = func(dir string) (int64, error) {
+		return atomic.LoadInt64(&free), nil
+	}
+	database := db.NewTestDatabaseWithOptions(t, options)
+	database.RegisterType(&ExamplePerson{})
+	var mx sync.Mutex
+	events := map[string]int{}
+	database.OnEvent(func(e db.Event) {
+		mx.Lock()
+		events[e.Type]++
+		mx.Unlock()
+	})
+	seen := func(event string) int {
+		mx.Lock()
+		defer mx.Unlock()
+		return events[event]
+	}
+
+	clean, _ := database.AddCollection("clean")
+	fillCollection(t, clean, 20)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 50)
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.Delete(&ExamplePerson{Age: 3}); err != nil || n == 0 {
+		t.Fatal("nothing was deleted", err)
+	}
+	if c.GarbageStats().Reclaimable == 0 {
+		t.Fatal("delete left nothing to reclaim")
+	}
+
+	status, err := database.CheckDisk()
+	if err != nil || status.Low || status.ReadOnly || status.Compacting != "" {
+		t.Fatalf("unexpected status %+v %v", status, err)
+	}
+
+	// the watchdog compacts the collection with the most garbage
+	atomic.StoreInt64(&free, 1<<19)
+	clock.Advance(time.Minute)
+	eventually(t, "emergency compaction", func() bool {
+		return seen(db.EVENT_DISK_LOW) > 0 && c.GarbageStats().Reclaimable == 0
+	})
+	if err = c.Write(&ExamplePerson{"low", 1}); err != nil {
+		t.Fatal("write while the space is low", err)
+	}
+
+	atomic.StoreInt64(&free, 1<<9)
+	if status, err = database.CheckDisk(); err != nil || !status.ReadOnly || !status.Low {
+		t.Fatalf("unexpected status %+v %v", status, err)
+	}
+	if seen(db.EVENT_DISK_READ_ONLY) != 1 {
+		t.Fatal("read-only was not reported")
+	}
+	if err = c.Write(&ExamplePerson{"full", 1}); err != db.ErrDiskFull {
+		t.Fatal("write while the drive is full", err)
+	}
+	if n, err := c.Delete(&ExamplePerson{FirstName: "low"}); err != nil || n == 0 {
+		t.Fatal("delete while the drive is full", n, err)
+	}
+
+	// writes stay refused until the space is above the low threshold again
+	atomic.StoreInt64(&free, 1<<15)
+	if status, _ = database.CheckDisk(); !status.ReadOnly {
+		t.Fatal("database became writable below the low threshold")
+	}
+	atomic.StoreInt64(&free, 1<<30)
+	if status, _ = database.CheckDisk(); status.ReadOnly {
+		t.Fatal("database stayed read-only")
+	}
+	if seen(db.EVENT_DISK_RECOVERED) != 1 {
+		t.Fatal("recovery was not reported")
+	}
+	if err = c.Write(&ExamplePerson{"recovered", 1}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,106 @@
+package tests
+
+import (
+	"bytes"
+	"shardb/db"
+	"testing"
+)
+
+type Document struct {
+	Title string
+	Body  []byte
+	Tags  []string
+	Views int
+}
+
+func (d *Document) GetDataIndex() []*db.FullDataIndex {
+	return []*db.FullDataIndex{{Field: "Title", Data: d.Title, Unique: true}}
+}
+
+func writeDocument(t testing.TB, c *db.Collection, title string) string {
+	err := c.Write(&Document{title, bytes.Repeat([]byte("x"), 64*1024), []string{"a", "b"}, 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := c.ScanOne(&Document{Title: title}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	el, err := c.DecodeElement(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return el.Id
+}
+
+func TestGetField(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	database.RegisterType(&Document{})
+	c, _ := database.AddCollection("docs")
+	plain := writeDocument(t, c, "plain")
+	c.SetFieldFragments(true)
+	fragmented := writeDocument(t, c, "fragmented")
+
+	for _, id := range []string{plain, fragmented} {
+		var title string
+		var views int
+		var tags []string
+		if err := c.GetField(id, "Title", &title); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.GetField(id, "Views", &views); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.GetField(id, "Tags", &tags); err != nil {
+			t.Fatal(err)
+		}
+		if (title != "plain" && title != "fragmented") || views != 7 || len(tags) != 2 {
+			t.Fatal("unexpected fields", title, views, tags)
+		}
+		if err := c.GetField(id, "Missing", &title); err == nil {
+			t.Fatal("missing field was found")
+		}
+	}
+	// the whole element still decodes
+	data, _ := c.FindById(fragmented, false)
+	el, err := c.DecodeElement(data)
+	if err != nil || el.Payload.(*Document).Title != "fragmented" {
+		t.Fatal("element with fragments does not decode", err)
+	}
+
+	// fragments survive a reload
+	database.Sync()
+	loaded := newTestDatabase(t)
+	loaded.RegisterType(&Document{})
+	loaded.ScanAndLoadData("")
+	lc := loaded.GetCollection("docs")
+	if !lc.FieldFragments {
+		t.Fatal("fragments setting was not saved")
+	}
+	var views int
+	if err = lc.GetField(fragmented, "Views", &views); err != nil || views != 7 {
+		t.Fatal("field was not read after the reload", err)
+	}
+}
+
+func BenchmarkGetField(b *testing.B) {
+	enterTempDir(b)
+	database := db.NewDatabase("test")
+	database.RegisterType(&Document{})
+	c, _ := database.AddCollection("docs")
+	c.SetFieldFragments(true)
+	id := writeDocument(b, c, "doc")
+	b.Run("fragment", func(b *testing.B) {
+		var views int
+		for i := 0; i < b.N; i++ {
+			c.GetField(id, "Views", &views)
+		}
+	})
+	b.Run("full", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			data, _ := c.FindById(id, false)
+			c.DecodeElement(data)
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package tests
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/fs"
+	"io/ioutil"
+	"path/filepath"
+	"shardb/db"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadFromFS(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	database.RegisterType(&ExamplePerson{})
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 25)
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Dir(filepath.Dir(c.SyncDestination))
+
+	// the data directory under data/ of an in-memory file system and of a zip
+	mapFS := fstest.MapFS{}
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	err := filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		name := "data/" + filepath.ToSlash(rel)
+		mapFS[name] = &fstest.MapFile{Data: data}
+		w, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	})
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, fsys := range map[string]fs.FS{"memory": mapFS, "zip": zr} {
+		options := db.DefaultDatabaseOptions()
+		options.FS = fsys
+		options.Dir = "data"
+		loaded := db.NewDatabaseWithOptions("test", options)
+		loaded.RegisterType(&ExamplePerson{})
+		if err := loaded.ScanAndLoadData(""); err != nil {
+			t.Fatal(name, err)
+		}
+		people := loaded.GetCollection("people")
+		if people == nil || people.Size() != 25 || !people.IsReadOnly() {
+			t.Fatal(name, "collection was not loaded")
+		}
+		e, err := people.Query().Where("FirstName", db.Eq, "person13").First()
+		if err != nil || e.Payload.(*ExamplePerson).Age != 3 {
+			t.Fatal(name, "element was not read", err)
+		}
+		if err = people.Write(&ExamplePerson{"new", 1}); err != db.ErrReadOnly {
+			t.Fatal(name, "collection was written", err)
+		}
+		if err = loaded.Sync(); err != db.ErrReadOnly {
+			t.Fatal(name, "database was synchronized", err)
+		}
+		if _, err = loaded.AddCollection("new"); err != db.ErrReadOnly {
+			t.Fatal(name, "collection was added", err)
+		}
+		if err = loaded.Close(); err != nil {
+			t.Fatal(name, err)
+		}
+	}
+}
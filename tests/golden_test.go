@@ -0,0 +1,121 @@
+package tests
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"shardb/db"
+	"strconv"
+	"testing"
+)
+
+// Every version of the data layout has a golden data directory under testdata/v<DB_VERSION>,
+// the current library must be able to load all of them.
+// After bumping DB_VERSION run `go test -run TestWriteGoldenData -golden` to record the new one
+var writeGolden = flag.Bool("golden", false, "write the golden data directory of the current DB_VERSION")
+
+const (
+	goldenObjects = 40
+	goldenDeleted = 5
+)
+
+// writes the golden database into the current directory
+func writeGoldenData(t *testing.T) {
+	database := newTestDatabase(t)
+	database.Name = "golden"
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	database.AddCollection("empty")
+	fillCollection(t, c, goldenObjects)
+	for i := 0; i < goldenDeleted; i++ {
+		data, err := c.ScanOne(&ExamplePerson{FirstName: "person" + strconv.Itoa(i)}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		el, _ := c.DecodeElement(data)
+		c.DeleteById(el.Id)
+	}
+	err = database.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	database.Close()
+}
+
+func TestWriteGoldenData(t *testing.T) {
+	if !*writeGolden {
+		t.Skip("golden data is only written with -golden")
+	}
+	dir, _ := filepath.Abs(filepath.Join("testdata", "v"+strconv.Itoa(db.DB_VERSION)))
+	os.RemoveAll(dir)
+	os.MkdirAll(dir, os.ModePerm)
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+	writeGoldenData(t)
+}
+
+func copyDir(t *testing.T, src, dst string) {
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, os.ModePerm)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, data, os.ModePerm)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGoldenCompatibility(t *testing.T) {
+	for v := 1; v <= db.DB_VERSION; v++ {
+		src, _ := filepath.Abs(filepath.Join("testdata", "v"+strconv.Itoa(v)))
+		if _, err := os.Stat(src); err != nil {
+			t.Fatal("no golden data for version", v, "- record it with -golden")
+		}
+		t.Run("v"+strconv.Itoa(v), func(t *testing.T) {
+			dir := enterTempDir(t)
+			copyDir(t, src, dir)
+
+			report, err := db.CheckCompatibility("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Version != v || report.Objects != goldenObjects-goldenDeleted || len(report.Collections) != 2 {
+				t.Fatalf("unexpected report %+v", report)
+			}
+
+			database := newTestDatabase(t)
+			err = database.ScanAndLoadData("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer database.Close()
+			seen := make(map[string]bool)
+			err = database.GetCollection("people").ForEach(func(e *db.Element) error {
+				seen[e.Payload.(*ExamplePerson).FirstName] = true
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < goldenObjects; i++ {
+				if seen["person"+strconv.Itoa(i)] != (i >= goldenDeleted) {
+					t.Fatal("person" + strconv.Itoa(i) + " was not loaded correctly")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package tests
+
+import (
+	"shardb/db"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	database.RegisterType(&ExamplePerson{})
+	c, _ := database.AddCollection("people")
+	if err := c.SetHistory(&db.HistoryOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	fillCollection(t, c, 5)
+	e, _ := c.Query().Where("FirstName", db.Eq, "person1").First()
+	id := e.Id
+
+	times := []time.Time{time.Now()}
+	for _, age := range []int{20, 30} {
+		time.Sleep(time.Millisecond)
+		if err := c.Update(id, &ExamplePerson{"person1", age}); err != nil {
+			t.Fatal(err)
+		}
+		times = append(times, time.Now())
+	}
+	time.Sleep(time.Millisecond)
+	if err := c.DeleteById(id); err != nil {
+		t.Fatal(err)
+	}
+	times = append(times, time.Now())
+
+	versions, err := c.History(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 4 || !versions[3].Deleted || versions[3].Element != nil {
+		t.Fatal("unexpected versions", versions)
+	}
+	for i, age := range []int{1, 20, 30} {
+		if got := versions[i].Element.Payload.(*ExamplePerson).Age; got != age {
+			t.Fatal("unexpected version", i, got)
+		}
+		old, err := c.GetAsOf(id, times[i])
+		if err != nil || old.Payload.(*ExamplePerson).Age != age {
+			t.Fatal("unexpected element as of", times[i], old, err)
+		}
+	}
+	if _, err = c.GetAsOf(id, times[3]); err != db.ErrKeyNotFound {
+		t.Fatal("deleted element was found", err)
+	}
+	if _, err = c.GetAsOf(id, versions[0].Time.Add(-time.Nanosecond)); err != db.ErrKeyNotFound {
+		t.Fatal("element was found before its first write", err)
+	}
+
+	// deletions by index are recorded as well
+	deleted, _ := c.Query().Where("FirstName", db.Eq, "person2").First()
+	if _, err = c.Delete(&ExamplePerson{FirstName: "person2"}); err != nil {
+		t.Fatal(err)
+	}
+	if versions, _ = c.History(deleted.Id); len(versions) != 2 || !versions[1].Deleted {
+		t.Fatal("deletion by index was not recorded", versions)
+	}
+	other, _ := c.Query().Where("FirstName", db.Eq, "person3").First()
+	e, _ = c.Query().Where("FirstName", db.Eq, "person4").First()
+	versions, _ = c.History(e.Id)
+	if len(versions) != 1 {
+		t.Fatal("unexpected versions of an unchanged element", versions)
+	}
+
+	// compaction drops the versions past the bounds
+	for i := 0; i < 3; i++ {
+		c.Update(other.Id, &ExamplePerson{"person3", 40 + i})
+	}
+	if err = c.SetHistory(&db.HistoryOptions{MaxVersions: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	versions, _ = c.History(other.Id)
+	if len(versions) != 2 || versions[1].Element.Payload.(*ExamplePerson).Age != 42 {
+		t.Fatal("unexpected versions after compaction", versions)
+	}
+	if err = c.SetHistory(&db.HistoryOptions{MaxAge: time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err = c.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	if versions, _ = c.History(id); len(versions) != 0 {
+		t.Fatal("versions of a deleted element were kept", versions)
+	}
+	if versions, _ = c.History(other.Id); len(versions) != 1 {
+		t.Fatal("current version was not kept", versions)
+	}
+
+	// recording stops, the kept versions stay readable
+	c.SetHistory(nil)
+	c.Update(other.Id, &ExamplePerson{"person3", 50})
+	if versions, _ = c.History(other.Id); len(versions) != 1 {
+		t.Fatal("version was recorded without history", versions)
+	}
+}
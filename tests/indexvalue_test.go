@@ -0,0 +1,112 @@
+package tests
+
+import (
+	"math"
+	"shardb/db"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type Reading struct {
+	Sensor string
+	Value  float64
+	Count  int
+	At     time.Time
+}
+
+func (r *Reading) GetDataIndex() []*db.FullDataIndex {
+	return []*db.FullDataIndex{
+		{Field: "Sensor", Data: r.Sensor, Unique: true},
+		{Field: "Count", Data: db.EncodeInt(int64(r.Count)), Unique: false},
+	}
+}
+
+func TestEncodingsKeepOrder(t *testing.T) {
+	ints := []int64{math.MinInt64, -1000, -9, -1, 0, 1, 9, 10, 1000, math.MaxInt64}
+	floats := []float64{math.Inf(-1), -1e10, -2.5, -0.1, 0, 0.1, 2.5, 9, 10, 1e10, math.Inf(1)}
+	encodedInts := make([]string, len(ints))
+	for i, v := range ints {
+		encodedInts[i] = db.EncodeInt(v)
+	}
+	encodedFloats := make([]string, len(floats))
+	for i, v := range floats {
+		encodedFloats[i] = db.EncodeFloat(v)
+	}
+	if !sort.StringsAreSorted(encodedInts) || !sort.StringsAreSorted(encodedFloats) {
+		t.Fatal("encoding does not keep the order")
+	}
+	for _, v := range ints {
+		if d, err := db.DecodeInt(db.EncodeInt(v)); err != nil || d != v {
+			t.Fatal("int", v, "decoded as", d, err)
+		}
+	}
+	for _, v := range floats {
+		if d, err := db.DecodeFloat(db.EncodeFloat(v)); err != nil || d != v {
+			t.Fatal("float", v, "decoded as", d, err)
+		}
+	}
+	if db.EncodeFloat(math.Copysign(0, -1)) != db.EncodeFloat(0) {
+		t.Fatal("negative zero has its own entry")
+	}
+	now := time.Now()
+	if d, err := db.DecodeTime(db.EncodeTime(now)); err != nil || !d.Equal(now) {
+		t.Fatal("time decoded as", d, err)
+	}
+	if db.EncodeTime(now) >= db.EncodeTime(now.Add(time.Nanosecond)) {
+		t.Fatal("time encoding does not keep the order")
+	}
+	if _, err := db.DecodeInt("10"); err == nil {
+		t.Fatal("decimal value was decoded")
+	}
+}
+
+func TestRangeQueries(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	database.RegisterType(&Reading{})
+	c, _ := database.AddCollection("readings")
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := -10; i < 20; i++ {
+		err := c.Write(&Reading{"sensor" + strconv.Itoa(i), float64(i) / 2, i, start.Add(time.Duration(i) * time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// typed values in GetDataIndex
+	dataSet, err := c.Scan(&Reading{Count: 9}, false)
+	if err != nil || len(dataSet) != 1 {
+		t.Fatal("expected a single reading with count 9", err)
+	}
+
+	for _, indexed := range []bool{false, true} {
+		if indexed {
+			for _, path := range []string{"Value", "Count", "At"} {
+				if err := c.AddIndex(path, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		// "10" < "9" as strings
+		checkReadings(t, c.Query().Where("Count", db.Gte, 9).Where("Count", db.Lt, 11), 2)
+		checkReadings(t, c.Query().Where("Value", db.Lt, -2.5), 5)
+		checkReadings(t, c.Query().Where("Value", db.Lte, -2.5), 6)
+		checkReadings(t, c.Query().Where("Value", db.Gt, 0).Where("Value", db.Lte, 1), 2)
+		checkReadings(t, c.Query().Where("At", db.Gte, start.Add(15*time.Hour)), 5)
+		checkReadings(t, c.Query().Where("At", db.Eq, start), 1)
+		checkReadings(t, c.Query().Where("Count", db.Eq, uint8(3)), 1)
+		checkReadings(t, c.Query().Where("Count", db.Gt, "1"), 0)
+	}
+}
+
+func checkReadings(t *testing.T, q *db.Query, expected int) {
+	t.Helper()
+	results, err := q.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != expected {
+		t.Fatal("expected", expected, "readings, got", len(results))
+	}
+}
@@ -0,0 +1,119 @@
+package tests
+
+import (
+	"path/filepath"
+	"shardb/db"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckInvariants(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	database.RegisterType(&ExamplePerson{})
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 50)
+	check := func(stage string) {
+		t.Helper()
+		if violations := database.CheckInvariants(); len(violations) > 0 {
+			t.Fatalf("%s: %v", stage, violations)
+		}
+	}
+	check("written")
+
+	elements, err := c.Query().Limit(10).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, e := range elements {
+		if i%2 == 0 {
+			err = c.Update(e.Id, &ExamplePerson{"updated" + e.Id, 99})
+		} else {
+			err = c.DeleteById(e.Id)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = c.Delete(&ExamplePerson{Age: 7}); err != nil {
+		t.Fatal(err)
+	}
+	// cached copies are compared with the drive
+	for _, e := range elements[:2] {
+		c.FindById(e.Id, true)
+	}
+	check("changed")
+
+	if _, err = c.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	check("optimized")
+
+	if err = database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Dir(filepath.Dir(c.SyncDestination))
+	loaded := db.NewTestDatabaseWithOptions(t, db.DatabaseOptions{Dir: dir, Config: db.DefaultConfig()})
+	loaded.RegisterType(&ExamplePerson{})
+	if err = loaded.ScanAndLoadData(""); err != nil {
+		t.Fatal(err)
+	}
+	if violations := loaded.CheckInvariants(); len(violations) > 0 {
+		t.Fatalf("loaded: %v", violations)
+	}
+
+	// an index entry left behind by a broken write
+	shard := c.Map.Shared[0]
+	shard.Lock()
+	shard.Items["FirstName:ghost"] = &db.ShardOffset{Start: 0, Length: 0, Segment: shard.Segments[len(shard.Segments)-1]}
+	shard.Unlock()
+	atomic.AddInt64(&c.ObjectsCounter, 1)
+	violations := c.CheckInvariants()
+	if len(violations) != 2 {
+		t.Fatalf("unexpected violations %v", violations)
+	}
+	messages := violations[0].String() + "\n" + violations[1].String()
+	if !strings.Contains(messages, "FirstName:ghost: index entry points to no live element") ||
+		!strings.Contains(messages, "objects counter is") {
+		t.Fatalf("unexpected violations %v", violations)
+	}
+}
+
+func TestInvariantAudit(t *testing.T) {
+	database, clock := newVirtualDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 10)
+
+	var mx sync.Mutex
+	events := make([]db.Event, 0)
+	database.OnEvent(func(e db.Event) {
+		mx.Lock()
+		if e.Type == db.EVENT_INVARIANT_VIOLATED {
+			events = append(events, e)
+		}
+		mx.Unlock()
+	})
+	cfg := database.Config()
+	cfg.AuditInterval = time.Minute
+	if err := database.ApplyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if violations := database.CheckInvariants(); len(violations) > 0 {
+		t.Fatal(violations)
+	}
+	atomic.AddInt64(&c.ObjectsCounter, -1)
+	clock.Advance(time.Minute)
+	eventually(t, "violation was not reported by the audit", func() bool {
+		mx.Lock()
+		defer mx.Unlock()
+		return len(events) > 0
+	})
+	mx.Lock()
+	defer mx.Unlock()
+	found := events[0].Data.([]db.InvariantViolation)
+	if events[0].Collection != "people" || len(found) != 1 || found[0].Shard != -1 {
+		t.Fatalf("unexpected event %+v", events[0])
+	}
+}
@@ -0,0 +1,54 @@
+package tests
+
+import (
+	"context"
+	"shardb/db"
+	"testing"
+	"time"
+)
+
+func TestRangeOverCollections(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 30)
+
+	ids := make(map[string]bool)
+	for id, e := range c.All() {
+		if e.Id != id {
+			t.Fatal("id does not match the element", id, e.Id)
+		}
+		ids[id] = true
+	}
+	if len(ids) != 30 {
+		t.Fatal("expected 30 elements, got", len(ids))
+	}
+
+	q := c.Query().Where("Age", db.Eq, 3)
+	seen := 0
+	for _, e := range q.Iter() {
+		if e.Payload.(*ExamplePerson).Age != 3 {
+			t.Fatal("element does not match", e.Payload)
+		}
+		seen++
+		break
+	}
+	if seen != 1 || q.Err() != nil {
+		t.Fatal("break did not end the query", seen, q.Err())
+	}
+	for range q.Iter() {
+		seen++
+	}
+	if seen != 4 || q.Err() != nil {
+		t.Fatal("expected 3 matching elements", seen-1, q.Err())
+	}
+
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	for range q.IterContext(expired) {
+		t.Fatal("iterated with an expired context")
+	}
+	if q.Err() != context.DeadlineExceeded {
+		t.Fatal("expected the deadline error, got", q.Err())
+	}
+}
@@ -0,0 +1,91 @@
+package tests
+
+import (
+	"encoding/gob"
+	"shardb/db"
+	"testing"
+)
+
+// schemaless payload
+type Purchase map[string]interface{}
+
+func (o *Purchase) GetDataIndex() []*db.FullDataIndex {
+	return nil
+}
+
+func TestJSONPath(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	database.RegisterType(&Purchase{})
+	gob.Register([]interface{}{})
+	gob.Register(map[string]interface{}{})
+	c, _ := database.AddCollection("orders")
+	orders := []Purchase{
+		{"id": "o1", "items": []interface{}{map[string]interface{}{"sku": "A1", "qty": 2}, map[string]interface{}{"sku": "B2", "qty": 1}}},
+		{"id": "o2", "items": []interface{}{map[string]interface{}{"sku": "B2", "qty": 5}}, "odd.key": map[string]interface{}{"value": 1}},
+		{"id": "o3", "items": []interface{}{map[string]interface{}{"sku": "C3", "qty": 1}, map[string]interface{}{"sku": "A1", "qty": 4}}},
+	}
+	for i := range orders {
+		if err := c.Write(&orders[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids := func(q *db.Query) []string {
+		results, err := q.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := make([]string, 0)
+		for _, e := range results {
+			values, err := c.Select(e, "$.id")
+			if err != nil || len(values) != 1 {
+				t.Fatal("failed to select the id", values, err)
+			}
+			found = append(found, values[0].(string))
+		}
+		return found
+	}
+	expect := func(q *db.Query, expected ...string) {
+		found := ids(q.OrderBy("$.id", false))
+		if len(found) != len(expected) {
+			t.Fatal("unexpected results", found, expected)
+		}
+		for i := range found {
+			if found[i] != expected[i] {
+				t.Fatal("unexpected results", found, expected)
+			}
+		}
+	}
+	expect(c.Query().Where("$.items[0].sku", db.Eq, "A1"), "o1")
+	expect(c.Query().Where("$.items[-1].sku", db.Eq, "A1"), "o3")
+	expect(c.Query().Where("$.items[*].sku", db.Eq, "A1"), "o1", "o3")
+	expect(c.Query().Where("$.items[*].qty", db.Gte, 4), "o2", "o3")
+	expect(c.Query().Where("$['odd.key'].value", db.Exists), "o2")
+	expect(c.Query().Where("$.items[5]", db.IsNull), "o1", "o2", "o3")
+
+	e, err := c.Query().Where("$.id", db.Eq, "o1").First()
+	if err != nil || e == nil {
+		t.Fatal("order not found", err)
+	}
+	skus, err := c.Select(e, "$.items[*].sku")
+	if err != nil || len(skus) != 2 || skus[0] != "A1" || skus[1] != "B2" {
+		t.Fatal("unexpected projection", skus, err)
+	}
+	if all, err := c.Select(e, "$.items[1].*"); err != nil || len(all) != 2 {
+		t.Fatal("unexpected wildcard projection", all, err)
+	}
+
+	result, err := database.Execute("SELECT $.items[*].sku FROM orders WHERE $.id = 'o3'")
+	if err != nil || len(result.Rows) != 1 {
+		t.Fatal("unexpected result", result, err)
+	}
+	if values, ok := result.Rows[0][0].([]interface{}); !ok || len(values) != 2 {
+		t.Fatal("unexpected row", result.Rows)
+	}
+
+	for _, path := range []string{"$..sku", "$.items[?(@.qty > 1)]", "$.items[0:2]", "$.items[x]", "$.items[0", "$.", "$['key"} {
+		if _, err = c.Query().Where(path, db.Exists).Run(); err == nil {
+			t.Fatal("invalid path was accepted", path)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package tests
+
+import (
+	"context"
+	"shardb/db"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWithKeyLock(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("counters")
+	if err := c.Write(&ExamplePerson{"counter", 0}); err != nil {
+		t.Fatal(err)
+	}
+	e, err := c.Query().First()
+	if err != nil || e == nil {
+		t.Fatal("counter was not written", err)
+	}
+
+	// every worker increments the age, read and update must not interleave
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- c.WithKeyLock(e.Id, func() error {
+				data, err := c.FindByIdContext(context.Background(), e.Id)
+				if err != nil {
+					return err
+				}
+				current, err := c.DecodeElement(data)
+				if err != nil {
+					return err
+				}
+				person := current.Payload.(*ExamplePerson)
+				person.Age++
+				return c.Update(e.Id, person)
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := c.FindByIdContext(context.Background(), e.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	final, _ := c.DecodeElement(data)
+	if age := final.Payload.(*ExamplePerson).Age; age != 20 {
+		t.Fatal("expected 20 increments, got", age)
+	}
+}
+
+func TestCollectionLocks(t *testing.T) {
+	database, clock := newVirtualDatabase(t)
+	c, _ := database.AddCollection("people")
+	short := func() context.Context {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		t.Cleanup(cancel)
+		return ctx
+	}
+	if c.LockInfo() != nil {
+		t.Fatal("new collection is locked")
+	}
+
+	first, err := c.LockShared(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := c.LockShared(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := c.LockInfo(); info == nil || info.Mode != db.LOCK_SHARED || info.Holders != 2 {
+		t.Fatalf("unexpected lock info %+v", info)
+	}
+	if _, err = c.LockExclusive(short()); err == nil {
+		t.Fatal("exclusive lock was taken while shared ones are held")
+	}
+
+	// a waiting exclusive caller holds back new shared ones
+	acquired := make(chan *db.CollectionLock)
+	go func() {
+		l, err := c.LockExclusive(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- l
+	}()
+	eventually(t, "exclusive waiter", func() bool {
+		info := c.LockInfo()
+		return info != nil && info.Waiters == 1
+	})
+	if _, err = c.LockShared(short()); err == nil {
+		t.Fatal("shared lock was taken ahead of a waiting exclusive one")
+	}
+	if err = first.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err = second.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	exclusive := <-acquired
+	state := database.DebugDump().Collections["people"]
+	if state.Lock == nil || state.Lock.Mode != db.LOCK_EXCLUSIVE || state.Lock.Holders != 1 || state.Lock.Waiters != 0 {
+		t.Fatalf("unexpected lock state %+v", state.Lock)
+	}
+
+	// a forgotten lock is dropped after the timeout unless it is extended
+	clock.Advance(db.DEFAULT_LOCK_TIMEOUT / 2)
+	if err = exclusive.Extend(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(db.DEFAULT_LOCK_TIMEOUT / 2)
+	if _, err = c.LockShared(short()); err == nil {
+		t.Fatal("extended lock was dropped")
+	}
+	cfg := database.Config()
+	cfg.LockTimeout = time.Hour
+	if err = database.ApplyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	waiting := make(chan *db.CollectionLock)
+	go func() {
+		l, err := c.LockShared(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		waiting <- l
+	}()
+	eventually(t, "shared waiter", func() bool {
+		info := c.LockInfo()
+		return info != nil && info.Waiters == 1
+	})
+	clock.Advance(db.DEFAULT_LOCK_TIMEOUT)
+	shared := <-waiting
+	if err = exclusive.Unlock(); err != db.ErrLockExpired {
+		t.Fatal("unlock of an expired lock", err)
+	}
+	if want := clock.Now().Add(time.Hour); !shared.Expires().Equal(want) {
+		t.Fatal("lock timeout of the config was ignored", shared.Expires(), want)
+	}
+	if err = shared.Unlock(); err != nil || c.LockInfo() != nil {
+		t.Fatal("collection is still locked", err)
+	}
+}
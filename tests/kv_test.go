@@ -0,0 +1,230 @@
+package tests
+
+import (
+	"path/filepath"
+	"shardb/db"
+	"strconv"
+	"testing"
+)
+
+func TestKV(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	kv, err := database.KV("settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = kv.Get("theme"); err != db.ErrKeyNotFound {
+		t.Fatal("missing key was found", err)
+	}
+	for _, key := range []string{"theme", "lang", "zone"} {
+		if err = kv.Set(key, []byte(key+"-1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = kv.Set("theme", []byte("dark")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := kv.Get("theme"); err != nil || string(value) != "dark" || kv.Len() != 3 {
+		t.Fatal("value was not replaced", string(value), err, kv.Len())
+	}
+	if err = kv.Delete("lang"); err != nil {
+		t.Fatal(err)
+	}
+	if err = kv.Delete("lang"); err != nil {
+		t.Fatal("deleting a missing key failed", err)
+	}
+	if _, err = kv.Get("lang"); err != db.ErrKeyNotFound {
+		t.Fatal("deleted key was found", err)
+	}
+
+	keys := ""
+	err = kv.Iterate(func(key string, value []byte) error {
+		keys += key + "=" + string(value) + ";"
+		return nil
+	})
+	if err != nil || keys != "theme=dark;zone=zone-1;" {
+		t.Fatal("unexpected iteration", keys, err)
+	}
+
+	// the bucket is loaded with the database
+	if err = database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := db.NewDatabaseWithOptions("test", db.DatabaseOptions{Dir: filepath.Dir(filepath.Dir(kv.Collection().SyncDestination))})
+	if err = loaded.ScanAndLoadData(""); err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+	reloaded, err := loaded.KV("settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := reloaded.Get("zone"); err != nil || string(value) != "zone-1" || reloaded.Len() != 2 {
+		t.Fatal("bucket was not loaded", string(value), err)
+	}
+}
+
+func TestKVKeyEncodings(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	kv, err := database.KV("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []uint64{9, 10, 100, 1 << 40} {
+		if err = kv.Set(db.EncodeUint(n), []byte(strconv.FormatUint(n, 10))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	numbers := ""
+	err = kv.Range(db.EncodeUint(10), db.EncodeUint(1<<40), func(key string, value []byte) error {
+		numbers += string(value) + ";"
+		return nil
+	})
+	if err != nil || numbers != "10;100;" {
+		t.Fatal("unexpected range of uint64 keys", numbers, err)
+	}
+
+	// partitions sharing a prefix and containing the separator stay apart
+	for _, key := range [][2]string{{"alice", "2024-02"}, {"alice", "2024-01"}, {"alice/x", "2024-01"},
+		{"alic", "2024-01"}, {"alice", "2024-03"}} {
+		if err = kv.Set(db.CompositeKey(key[0], key[1]), []byte(key[0])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if partition, sort, err := db.SplitCompositeKey(db.CompositeKey("alice/x", "2024-01")); err != nil || partition != "alice/x" || sort != "2024-01" {
+		t.Fatal("composite key was not split", partition, sort, err)
+	}
+	collect := func(partition, from, to string) string {
+		found := ""
+		err := kv.Partition(partition, from, to, func(sort string, value []byte) error {
+			if string(value) != partition {
+				t.Fatal("key of partition " + string(value) + " was read")
+			}
+			found += sort + ";"
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return found
+	}
+	if found := collect("alice", "", ""); found != "2024-01;2024-02;2024-03;" {
+		t.Fatal("unexpected partition", found)
+	}
+	if found := collect("alice", "2024-02", "2024-03"); found != "2024-02;" {
+		t.Fatal("unexpected range of the partition", found)
+	}
+	if found := collect("alice/x", "", ""); found != "2024-01;" {
+		t.Fatal("unexpected partition", found)
+	}
+
+	// the ranges are read from the index of the keys
+	if len(kv.Collection().Indexes) != 1 || kv.Collection().Indexes[0].Field != "Key" {
+		t.Fatal("keys are not indexed", kv.Collection().Indexes)
+	}
+}
+
+func TestKVPartitionShard(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	kv, err := database.KV("events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !kv.Collection().PartitionedKeys {
+		t.Fatal("new bucket does not place its keys by partition")
+	}
+	for user := 0; user < 5; user++ {
+		for n := 9; n >= 0; n-- {
+			key := db.CompositeKey("user"+strconv.Itoa(user), db.EncodeUint(uint64(n)))
+			if err = kv.Set(key, []byte(strconv.Itoa(n))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// the elements of a partition share a shard
+	shard := kv.Collection().ExplainRouting(db.CompositeKey("user1", db.EncodeUint(0))).Shard
+	for n := 1; n < 10; n++ {
+		if other := kv.Collection().ExplainRouting(db.CompositeKey("user1", db.EncodeUint(uint64(n)))).Shard; other != shard {
+			t.Fatal("partition is spread over shards", shard, other)
+		}
+	}
+
+	collect := func(kv *db.KV, from, to uint64) string {
+		found := ""
+		err := kv.Partition("user1", db.EncodeUint(from), db.EncodeUint(to), func(sort string, value []byte) error {
+			found += string(value) + ";"
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return found
+	}
+	if found := collect(kv, 2, 6); found != "2;3;4;5;" {
+		t.Fatal("unexpected range of the partition", found)
+	}
+	// changes of the shard are seen by the next range
+	if err = kv.Set(db.CompositeKey("user1", db.EncodeUint(3)), []byte("three")); err != nil {
+		t.Fatal(err)
+	}
+	if err = kv.Delete(db.CompositeKey("user1", db.EncodeUint(4))); err != nil {
+		t.Fatal(err)
+	}
+	if found := collect(kv, 2, 6); found != "2;three;5;" {
+		t.Fatal("changes were not seen", found)
+	}
+	if violations := database.CheckInvariants(); len(violations) > 0 {
+		t.Fatal(violations)
+	}
+
+	if err = database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := db.NewTestDatabaseWithOptions(t, db.DatabaseOptions{Dir: filepath.Dir(filepath.Dir(kv.Collection().SyncDestination)), Config: db.DefaultConfig()})
+	if err = loaded.ScanAndLoadData(""); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := loaded.KV("events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.Collection().PartitionedKeys {
+		t.Fatal("placement by partition was not loaded")
+	}
+	if found := collect(reloaded, 0, 3); found != "0;1;2;" {
+		t.Fatal("unexpected range of the loaded partition", found)
+	}
+}
+
+func TestKVRangeIgnoresQueryGuards(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	kv, err := database.KV("counters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 20; n++ {
+		if err = kv.Set(db.EncodeUint(uint64(n)), []byte(strconv.Itoa(n))); err != nil {
+			t.Fatal(err)
+		}
+		if err = kv.Set(db.CompositeKey("user1", db.EncodeUint(uint64(n))), []byte(strconv.Itoa(n))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	guardQueries(t, database, 10, 0, 0)
+	found := 0
+	err = kv.Range(db.EncodeUint(0), "", func(key string, value []byte) error {
+		found++
+		return nil
+	})
+	if err != nil || found != 40 {
+		t.Fatal("range was cut by the query guards", found, err)
+	}
+	found = 0
+	err = kv.Partition("user1", db.EncodeUint(0), "", func(sort string, value []byte) error {
+		found++
+		return nil
+	})
+	if err != nil || found != 20 {
+		t.Fatal("partition was cut by the query guards", found, err)
+	}
+}
@@ -0,0 +1,58 @@
+package tests
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"shardb/db"
+	"testing"
+)
+
+func writeThreeCollections(t *testing.T) {
+	database := newTestDatabase(t)
+	for _, name := range []string{"good", "nometa", "corrupted"} {
+		c, _ := database.AddCollection(name)
+		fillCollection(t, c, 5)
+	}
+	err := database.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the meta and its snapshot
+	metas, _ := filepath.Glob(filepath.Join(db.COLLECTION_DIR_NAME, "nometa", "shard_4_meta.flat*"))
+	for _, meta := range metas {
+		os.Remove(meta)
+	}
+	ioutil.WriteFile(filepath.Join(db.COLLECTION_DIR_NAME, "corrupted", "shard_1_meta.flat"), []byte("junk"), 0600)
+}
+
+func checkLenientLoad(t *testing.T) {
+	if err := newTestDatabase(t).ScanAndLoadData(""); err == nil {
+		t.Fatal("strict load accepted broken collections")
+	}
+	database := newTestDatabase(t)
+	report, err := database.ScanAndLoadDataLenient("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Loaded) != 1 || report.Loaded[0] != "good" || len(report.Failed) != 2 ||
+		report.Failed["nometa"] == nil || report.Failed["corrupted"] == nil {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if database.GetCollectionsCount() != 1 || database.GetCollection("good").Size() != 5 {
+		t.Fatal("good collection was not loaded")
+	}
+}
+
+func TestLenientLoad(t *testing.T) {
+	enterTempDir(t)
+	writeThreeCollections(t)
+	checkLenientLoad(t)
+}
+
+func TestLenientLoadWithoutManifest(t *testing.T) {
+	enterTempDir(t)
+	writeThreeCollections(t)
+	os.Remove(db.MANIFEST_NAME)
+	checkLenientLoad(t)
+}
@@ -0,0 +1,90 @@
+package tests
+
+import (
+	"path/filepath"
+	"shardb/db"
+	"testing"
+)
+
+func TestManager(t *testing.T) {
+	dir := t.TempDir()
+	m := db.NewManager(db.ManagerOptions{BackgroundWorkers: 3, CacheSize: 8})
+	defer m.Close()
+	options := func(name string) db.DatabaseOptions {
+		o := db.DefaultDatabaseOptions()
+		o.Config.LogLevel = db.LOG_WARNING
+		o.Dir = filepath.Join(dir, name)
+		return o
+	}
+
+	for _, name := range []string{"eu", "us"} {
+		database, err := m.Open(name, options(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		database.RegisterType(&ExamplePerson{})
+		c, err := database.AddCollection("people")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fillCollection(t, c, 5)
+		// cached reads
+		for _, e := range c.All() {
+			if _, err := c.FindById(e.Id, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// the budget was split again by AddCollection, the caches were resized in place
+	if cfg := m.Get("eu").Config(); cfg.CacheSize != 4 {
+		t.Fatal("budget was not shared with the added collection", cfg.CacheSize)
+	}
+	if entries := m.Get("eu").DebugDump().Collections["people"].CacheEntries; entries != 5 {
+		t.Fatal("resized cache lost its entries, got", entries)
+	}
+	if _, err := m.Open("eu", options("other")); err == nil {
+		t.Fatal("name was opened twice")
+	}
+	if _, err := m.Open("copy", options("eu")); err == nil {
+		t.Fatal("directory was opened twice")
+	}
+	if names := m.Names(); len(names) != 2 || names[0] != "eu" || names[1] != "us" {
+		t.Fatal("unexpected databases", names)
+	}
+	if err := m.Rebalance(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := m.Get("eu").Config(); cfg.CacheSize != 4 || cfg.BackgroundWorkers != 3 {
+		t.Fatalf("budget was not shared %+v", cfg)
+	}
+	if err := m.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.CloseDatabase("us"); err != nil {
+		t.Fatal(err)
+	}
+	if m.Get("us") != nil {
+		t.Fatal("closed database is still listed")
+	}
+	if m.Get("eu").Config().CacheSize != 8 {
+		t.Fatal("budget of the closed database was not given back")
+	}
+	// the shared scheduler keeps running for the others
+	if err := <-m.Get("eu").Scheduler().Submit("noop", db.PRIORITY_LOW, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := m.Open("us", options("us"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := reopened.GetCollection("people"); c == nil || c.Size() != 5 {
+		t.Fatal("database was not loaded from its directory")
+	}
+	if err = m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.Open("late", options("late")); err == nil {
+		t.Fatal("opened by a closed manager")
+	}
+}
@@ -0,0 +1,141 @@
+package tests
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"shardb/db"
+	"strconv"
+	"testing"
+)
+
+// moves the test into an empty directory, collections are created relative to it
+func enterTempDir(t testing.TB) string {
+	dir, err := ioutil.TempDir("", "shardb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func newTestDatabase(t *testing.T) *db.Database {
+	database := db.NewDatabase("test")
+	database.RegisterType(&ExamplePerson{})
+	return database
+}
+
+func fillCollection(t *testing.T, c *db.Collection, n int) {
+	for i := 0; i < n; i++ {
+		err := c.Write(&ExamplePerson{"person" + strconv.Itoa(i), i % 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, err := database.AddCollection("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillCollection(t, c, 100)
+	err = database.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := db.LoadManifest(db.MANIFEST_NAME)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Collections) != 1 || len(m.Collections[0].Shards) != db.SHARD_COUNT {
+		t.Fatal("unexpected manifest contents")
+	}
+
+	// stray files must not confuse the loader
+	ioutil.WriteFile(filepath.Join(db.COLLECTION_DIR_NAME, "people", "shard_99.gobs"), []byte("junk"), os.ModePerm)
+	os.MkdirAll(filepath.Join(db.COLLECTION_DIR_NAME, "leftover"), os.ModePerm)
+
+	loaded := newTestDatabase(t)
+	err = loaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.GetTotalObjectsCount() != 100 {
+		t.Fatal("expected 100 objects, got", loaded.GetTotalObjectsCount())
+	}
+	data, err := loaded.GetCollection("people").ScanOne(&ExamplePerson{FirstName: "person42"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	el, err := loaded.GetCollection("people").DecodeElement(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if el.Payload.(*ExamplePerson).Age != 2 {
+		t.Fatal("loaded the wrong element")
+	}
+}
+
+func TestManifestDetectsCorruption(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 10)
+	err := database.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := filepath.Join(db.COLLECTION_DIR_NAME, "people", "shard_3_meta.flat")
+	ioutil.WriteFile(meta, []byte("corrupted"), os.ModePerm)
+
+	err = newTestDatabase(t).ScanAndLoadData("")
+	if err == nil {
+		t.Fatal("corrupted meta file was accepted")
+	}
+}
+
+func TestFailedMetaWriteKeepsOldFile(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 10)
+	err := database.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(db.COLLECTION_DIR_NAME, "people", "*.tmp")); len(tmp) != 0 {
+		t.Fatal("temporary files were left behind", tmp)
+	}
+
+	// the temporary file of shard 0 can not be created
+	meta := filepath.Join(db.COLLECTION_DIR_NAME, "people", "shard_0_meta.flat")
+	before, _ := ioutil.ReadFile(meta)
+	os.Mkdir(meta+".tmp", 0700)
+	fillCollection(t, c, 40)
+	if err = c.Sync(); err == nil {
+		t.Fatal("sync succeeded without writing the meta")
+	}
+	after, _ := ioutil.ReadFile(meta)
+	if string(before) != string(after) {
+		t.Fatal("meta file was modified by the failed write")
+	}
+	os.Remove(meta + ".tmp")
+
+	loaded := newTestDatabase(t)
+	err = loaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.GetTotalObjectsCount() != 10 {
+		t.Fatal("expected the last complete state, got", loaded.GetTotalObjectsCount())
+	}
+}
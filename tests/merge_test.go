@@ -0,0 +1,320 @@
+package tests
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"shardb/db"
+	"testing"
+)
+
+func openInSubdir(t *testing.T, root, name string) *db.Database {
+	dir := filepath.Join(root, name)
+	os.MkdirAll(dir, os.ModePerm)
+	os.Chdir(dir)
+	database := newTestDatabase(t)
+	database.ScanAndLoadData("")
+	return database
+}
+
+func livePeople(t *testing.T, c *db.Collection) map[string]string {
+	people := make(map[string]string)
+	err := c.ForEach(func(e *db.Element) error {
+		people[e.Id] = e.Payload.(*ExamplePerson).FirstName
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return people
+}
+
+func TestMergeWithConverges(t *testing.T) {
+	root := enterTempDir(t)
+	a := openInSubdir(t, root, "a")
+	ca, _ := a.AddCollection("people")
+	fillCollection(t, ca, 20)
+
+	b := openInSubdir(t, root, "b")
+	report, err := b.MergeWith(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Added != 20 {
+		t.Fatal("expected 20 added elements, got", report.Added)
+	}
+	cb := b.GetCollection("people")
+
+	// concurrent changes on both sides
+	data, _ := ca.ScanOne(&ExamplePerson{FirstName: "person3"}, false)
+	el, _ := ca.DecodeElement(data)
+	ca.DeleteById(el.Id)
+	ca.Write(&ExamplePerson{"alice", 30})
+	cb.Write(&ExamplePerson{"bob", 40})
+	// the same unique key written on both sides can not be merged
+	ca.Write(&ExamplePerson{"carol", 1})
+	cb.Write(&ExamplePerson{"carol", 2})
+
+	report, err = b.MergeWith(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Added != 1 || report.Deleted != 1 || report.Conflicts != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	report, err = a.MergeWith(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Added != 1 || report.Deleted != 0 || report.Conflicts != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	pa, pb := livePeople(t, ca), livePeople(t, cb)
+	if len(pa) != 22 || len(pb) != 22 {
+		t.Fatal("expected 22 elements on both sides, got", len(pa), len(pb))
+	}
+	for id, name := range pa {
+		if name != "carol" && pb[id] != name {
+			t.Fatal("databases did not converge on", name)
+		}
+	}
+	if _, ok := pb[el.Id]; ok {
+		t.Fatal("the delete was not merged")
+	}
+}
+
+func TestMergeKeepsUpdatedElement(t *testing.T) {
+	a := db.NewTestDatabase(t)
+	a.RegisterType(&ExamplePerson{})
+	ca, _ := a.AddCollection("people")
+	fillCollection(t, ca, 50)
+	b := db.NewTestDatabase(t)
+	b.RegisterType(&ExamplePerson{})
+	if _, err := b.MergeWith(a); err != nil {
+		t.Fatal(err)
+	}
+
+	// every update of an element keeps its single id entry
+	person, err := ca.Query().Where("FirstName", db.Eq, "person7").First()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err = ca.Update(person.Id, &ExamplePerson{"person7", 70 + i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := b.MergeWith(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Deleted != 0 {
+		t.Fatalf("the update was merged as a delete %+v", report)
+	}
+	if _, ok := livePeople(t, b.GetCollection("people"))[person.Id]; !ok {
+		t.Fatal("the updated element was deleted by the merge")
+	}
+}
+
+func TestRepairFrom(t *testing.T) {
+	a := db.NewTestDatabase(t)
+	a.RegisterType(&ExamplePerson{})
+	ca, _ := a.AddCollection("people")
+	fillCollection(t, ca, 200)
+	b := db.NewTestDatabase(t)
+	b.RegisterType(&ExamplePerson{})
+	if _, err := b.MergeWith(a); err != nil {
+		t.Fatal(err)
+	}
+	cb := b.GetCollection("people")
+	if !sameTrees(ca.MerkleTree(), cb.MerkleTree()) {
+		t.Fatal("trees of equal replicas differ")
+	}
+
+	data, _ := ca.ScanOne(&ExamplePerson{FirstName: "person3"}, false)
+	el, _ := ca.DecodeElement(data)
+	ca.DeleteById(el.Id)
+	ca.Write(&ExamplePerson{"alice", 30})
+	cb.Write(&ExamplePerson{"bob", 40})
+
+	report, err := b.RepairFrom(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Added != 1 || report.Deleted != 1 || report.Leaves > 3 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if report, err = a.RepairFrom(b); err != nil || report.Added != 1 || report.Deleted != 0 {
+		t.Fatalf("unexpected report %+v %v", report, err)
+	}
+	if !sameTrees(ca.MerkleTree(), cb.MerkleTree()) {
+		t.Fatal("replicas did not converge")
+	}
+	if report, err = a.RepairFrom(b); err != nil || report.Leaves != 0 || report.Added != 0 {
+		t.Fatalf("converged replicas were repaired %+v %v", report, err)
+	}
+	if len(livePeople(t, ca)) != 201 || len(livePeople(t, cb)) != 201 {
+		t.Fatal("unexpected elements after the repair")
+	}
+}
+
+func TestRepairFromExchangesUpdates(t *testing.T) {
+	a, b := newReplica(t, "a", ""), newReplica(t, "b", "")
+	ca, _ := a.AddCollection("people")
+	fillCollection(t, ca, 50)
+	if _, err := b.RepairFrom(a); err != nil {
+		t.Fatal(err)
+	}
+	cb := b.GetCollection("people")
+	person, err := ca.Query().Where("FirstName", db.Eq, "person7").First()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ca.Update(person.Id, &ExamplePerson{"person7", 77}); err != nil {
+		t.Fatal(err)
+	}
+	if sameTrees(ca.MerkleTree(), cb.MerkleTree()) {
+		t.Fatal("the update did not change the tree")
+	}
+	report, err := b.RepairFrom(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Leaves != 1 || report.Updated != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	e, err := cb.Query().Where("FirstName", db.Eq, "person7").First()
+	if err != nil || e.Payload.(*ExamplePerson).Age != 77 {
+		t.Fatal("the update was not repaired", err)
+	}
+	if !sameTrees(ca.MerkleTree(), cb.MerkleTree()) {
+		t.Fatal("replicas did not converge")
+	}
+}
+
+func sameTrees(a, b *db.MerkleTree) bool {
+	return bytes.Equal(a.Root, b.Root)
+}
+
+func newReplica(t *testing.T, id, dir string) *db.Database {
+	options := db.DefaultDatabaseOptions()
+	options.Config.LogLevel = db.LOG_ERROR
+	options.ReplicaId = id
+	options.Dir = dir
+	database := db.NewTestDatabaseWithOptions(t, options)
+	database.RegisterType(&ExamplePerson{})
+	database.RegisterType(&Article{})
+	if dir != "" {
+		if err := database.ScanAndLoadData(""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return database
+}
+
+func mergeBothWays(t *testing.T, a, b *db.Database) {
+	if _, err := a.MergeWith(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.MergeWith(a); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeResolvesConcurrentUpdates(t *testing.T) {
+	a, b := newReplica(t, "a", ""), newReplica(t, "b", "")
+	ca, _ := a.AddCollection("people")
+	ca.Write(&ExamplePerson{"ann", 1})
+	articles, _ := a.AddCollection("articles")
+	articles.Write(&Article{"post", []string{"x", "y"}})
+	mergeBothWays(t, a, b)
+	cb := b.GetCollection("people")
+	person, err := ca.Query().Where("FirstName", db.Eq, "ann").First()
+	if err != nil {
+		t.Fatal(err)
+	}
+	post, err := articles.Query().Where("Slug", db.Eq, "post").First()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every side changes another field, one removes a tag the other one saw, the other one adds a tag
+	ca.Update(person.Id, &ExamplePerson{"ann", 2})
+	cb.Update(person.Id, &ExamplePerson{"anna", 1})
+	articles.Update(post.Id, &Article{"post", []string{"x", "y", "z"}})
+	b.GetCollection("articles").Update(post.Id, &Article{"post", []string{"y"}})
+	report, err := a.MergeWith(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Updated != 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if _, err = b.MergeWith(a); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, database := range []*db.Database{a, b} {
+		e, err := database.GetCollection("people").Query().Where("FirstName", db.Eq, "anna").First()
+		if err != nil {
+			t.Fatal("concurrent update of the name was lost", err)
+		}
+		if age := e.Payload.(*ExamplePerson).Age; age != 2 {
+			t.Fatal("concurrent update of the age was lost", age)
+		}
+		e, err = database.GetCollection("articles").Query().Where("Slug", db.Eq, "post").First()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags := make(map[string]bool)
+		for _, tag := range e.Payload.(*Article).Tags {
+			tags[tag] = true
+		}
+		if len(tags) != 2 || !tags["y"] || !tags["z"] {
+			t.Fatal("unexpected tags", e.Payload.(*Article).Tags)
+		}
+	}
+
+	// merged versions have seen both sides
+	if report, err = a.MergeWith(b); err != nil || report.Updated != 0 {
+		t.Fatalf("replicas did not converge %+v %v", report, err)
+	}
+}
+
+func TestMergeKeepsTombstones(t *testing.T) {
+	a, b := newReplica(t, "a", ""), newReplica(t, "b", "")
+	ca, _ := a.AddCollection("people")
+	fillCollection(t, ca, 20)
+	mergeBothWays(t, a, b)
+	cb := b.GetCollection("people")
+	ann, _ := ca.Query().Where("FirstName", db.Eq, "person3").First()
+	bob, _ := ca.Query().Where("FirstName", db.Eq, "person4").First()
+
+	// a delete the other side has seen wins, an update wins over a concurrent delete
+	ca.DeleteById(ann.Id)
+	ca.DeleteById(bob.Id)
+	cb.Update(bob.Id, &ExamplePerson{"person4", 44})
+	if _, err := ca.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	// the tombstone is kept by the meta
+	if err := a.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := newReplica(t, "a", filepath.Dir(filepath.Dir(ca.SyncDestination)))
+	mergeBothWays(t, loaded, b)
+
+	for _, c := range []*db.Collection{loaded.GetCollection("people"), cb} {
+		people := livePeople(t, c)
+		if _, ok := people[ann.Id]; ok {
+			t.Fatal("deleted element came back")
+		}
+		if _, ok := people[bob.Id]; !ok {
+			t.Fatal("concurrent update was deleted")
+		}
+		if len(people) != 19 {
+			t.Fatal("unexpected size", len(people))
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package tests
+
+import (
+	"bytes"
+	"shardb/db"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSyncAndOptimizeMetrics(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 10)
+	database.Sync()
+	database.Sync()
+	database.Optimize()
+
+	m := database.Metrics()
+	if m.Sync.Count != 2 || m.Optimize.Count != 1 {
+		t.Fatal("unexpected number of observations", m.Sync.Count, m.Optimize.Count)
+	}
+	cm := m.Collections["people"]
+	if cm == nil || cm.Sync.Count != 2 || cm.ShardFlush[0].Count != 2 {
+		t.Fatal("collection metrics are missing")
+	}
+	last := m.Sync.Buckets[len(m.Sync.Buckets)-1]
+	if last.Count != m.Sync.Count {
+		t.Fatal("buckets are not cumulative")
+	}
+
+	var out bytes.Buffer
+	err := m.WritePrometheus(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `shardb_sync_duration_seconds_bucket{le="+Inf"} 2`) ||
+		!strings.Contains(out.String(), `shardb_shard_flush_duration_seconds_count{collection="people",shard="3"} 2`) {
+		t.Fatal("unexpected exposition:\n" + out.String())
+	}
+
+	database.ResetMetrics()
+	if database.Metrics().Collections["people"].Sync.Count != 0 || database.Metrics().Sync.Count != 0 {
+		t.Fatal("metrics were not reset")
+	}
+}
+
+func TestShardIOStats(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 10)
+	io := c.IOStats()
+	if io.Writes != 10 || io.BytesWritten == 0 || io.Reads != 0 || io.WriteLatency.Count != 10 {
+		t.Fatalf("unexpected stats after the writes %+v", io)
+	}
+	e, err := c.Query().Where("FirstName", db.Eq, "person3").First()
+	if err != nil || e == nil {
+		t.Fatal("person3 was not found", err)
+	}
+	if _, err = c.FindById(e.Id, false); err != nil {
+		t.Fatal(err)
+	}
+	io = c.IOStats()
+	if io.Reads == 0 || io.BytesRead == 0 {
+		t.Fatalf("reads were not counted %+v", io)
+	}
+	shards := c.Map.ShardIOStats()
+	writes := uint64(0)
+	for _, s := range shards {
+		writes += s.Writes
+	}
+	if writes != 10 {
+		t.Fatal("writes of the shards do not add up", writes)
+	}
+
+	var out bytes.Buffer
+	if err = database.Metrics().WritePrometheus(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `shardb_shard_writes_total{collection="people",shard="0"}`) {
+		t.Fatal("unexpected exposition:\n" + out.String())
+	}
+	database.ResetMetrics()
+	if io = c.IOStats(); io.Writes != 0 || io.BytesRead != 0 {
+		t.Fatal("stats were not reset")
+	}
+}
+
+func TestSizeStats(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 10)
+	var large strings.Builder
+	for i := 0; large.Len() < 64<<10; i++ {
+		large.WriteString(strconv.Itoa(i * 7919))
+	}
+	if err := c.Write(&ExamplePerson{large.String(), 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(live int) {
+		t.Helper()
+		stats := c.SizeStats()
+		total := 0
+		for _, n := range stats.Shards {
+			total += n
+		}
+		if total != live || stats.ElementSize.Count != uint64(live) || stats.ShardElements.Count != uint64(len(c.Map.Shared)) {
+			t.Fatalf("unexpected stats %+v", stats)
+		}
+		// the small elements fit into 1KB, the large one does not
+		if small := stats.ElementSize.Buckets[2]; small.UpperBound != 1024 || small.Count != uint64(live-1) {
+			t.Fatalf("unexpected buckets %+v", stats.ElementSize.Buckets)
+		}
+	}
+	check(11)
+	e, err := c.Query().Where("FirstName", db.Eq, "person4").First()
+	if err != nil || e == nil {
+		t.Fatal("person4 was not found", err)
+	}
+	if err = c.DeleteById(e.Id); err != nil {
+		t.Fatal(err)
+	}
+	check(10)
+
+	var out bytes.Buffer
+	if err = database.Metrics().WritePrometheus(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `shardb_collection_element_size_bytes_count{collection="people"} 10`) ||
+		!strings.Contains(out.String(), `shardb_shard_elements{collection="people",shard="0"}`) {
+		t.Fatal("unexpected exposition:\n" + out.String())
+	}
+	// the sizes describe the data, they are not reset
+	database.ResetMetrics()
+	if m := database.Metrics().Collections["people"]; m.ElementSize.Count != 10 {
+		t.Fatal("element sizes were reset", m.ElementSize.Count)
+	}
+
+	// the mapped metas of a loaded database are counted without decoding them, deltas included
+	if err = database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	e, err = c.Query().Where("FirstName", db.Eq, "person5").First()
+	if err != nil || e == nil {
+		t.Fatal("person5 was not found", err)
+	}
+	if err = c.DeleteById(e.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Write(&ExamplePerson{"person10", 0}); err != nil {
+		t.Fatal(err)
+	}
+	if err = database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := newTestDatabase(t)
+	if err = loaded.ScanAndLoadData(""); err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+	c = loaded.GetCollection("people")
+	check(10)
+	if mappedShards(c) != db.SHARD_COUNT {
+		t.Fatal("shards were decoded by the stats")
+	}
+	out.Reset()
+	if err = loaded.Metrics().WritePrometheus(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `shardb_collection_element_size_bytes_count{collection="people"} 10`) ||
+		!strings.Contains(out.String(), `shardb_shard_elements{collection="people",shard="0"}`) {
+		t.Fatal("unexpected exposition of the mapped shards:\n" + out.String())
+	}
+}
@@ -0,0 +1,62 @@
+package tests
+
+import (
+	"context"
+	"reflect"
+	"shardb/db"
+	"testing"
+)
+
+func TestMultiGet(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	people, _ := database.AddCollection("people")
+	fillCollection(t, people, 20)
+	pets, _ := database.AddCollection("pets")
+	fillCollection(t, pets, 5)
+	ids := func(c *db.Collection) []string {
+		elements, err := c.Query().Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]string, len(elements))
+		for i, e := range elements {
+			ids[i] = e.Id
+		}
+		return ids
+	}
+	personIds, petIds := ids(people), ids(pets)
+
+	result, err := database.MultiGet(map[string][]string{
+		"people": {personIds[3], personIds[7], "absent"},
+		"pets":   petIds,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Elements["people"]) != 2 || len(result.Elements["pets"]) != len(petIds) {
+		t.Fatalf("unexpected elements %v", result.Elements)
+	}
+	e := result.Get("people", personIds[7])
+	if e == nil || e.Id != personIds[7] {
+		t.Fatal("element was not read", e)
+	}
+	if _, ok := e.Payload.(*ExamplePerson); !ok {
+		t.Fatalf("payload was not decoded %#v", e.Payload)
+	}
+	if result.Get("people", "absent") != nil || result.Get("unknown", personIds[3]) != nil {
+		t.Fatal("missing element was returned")
+	}
+	if !reflect.DeepEqual(result.Missing, map[string][]string{"people": {"absent"}}) {
+		t.Fatal("unexpected missing ids", result.Missing)
+	}
+
+	if _, err = database.MultiGet(map[string][]string{"people": personIds, "unknown": {"x"}}); err == nil {
+		t.Fatal("unknown collection was accepted")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = database.MultiGetContext(ctx, map[string][]string{"people": personIds}); err != context.Canceled {
+		t.Fatal("canceled multi get", err)
+	}
+}
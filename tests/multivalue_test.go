@@ -0,0 +1,151 @@
+package tests
+
+import (
+	"shardb/db"
+	"strconv"
+	"testing"
+)
+
+type Article struct {
+	Slug string
+	Tags []string
+}
+
+// one entry for every tag
+func (a *Article) GetDataIndex() []*db.FullDataIndex {
+	indexes := []*db.FullDataIndex{{Field: "Slug", Data: a.Slug, Unique: true}}
+	for _, tag := range a.Tags {
+		indexes = append(indexes, &db.FullDataIndex{Field: "Tags", Data: tag, Unique: false})
+	}
+	return indexes
+}
+
+// slugs of the articles with the tag
+func tagged(t *testing.T, c *db.Collection, tag string) map[string]bool {
+	t.Helper()
+	found := make(map[string]bool)
+	dataSet, err := c.Scan(&Article{Tags: []string{tag}}, false)
+	if err != nil {
+		return found
+	}
+	for _, data := range dataSet {
+		e, err := c.DecodeElement(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slug := e.Payload.(*Article).Slug
+		if found[slug] {
+			t.Fatal(slug, "was returned twice for", tag)
+		}
+		found[slug] = true
+	}
+	return found
+}
+
+func newArticles(t *testing.T) *db.Collection {
+	database := newTestDatabase(t)
+	database.RegisterType(&Article{})
+	c, err := database.AddCollection("articles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		tags := []string{"all", "group" + strconv.Itoa(i%4)}
+		if i%5 == 0 {
+			// repeated values are stored once
+			tags = append(tags, "fifth", "fifth")
+		}
+		err := c.Write(&Article{"article" + strconv.Itoa(i), tags})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c
+}
+
+func articleId(t *testing.T, c *db.Collection, slug string) string {
+	data, err := c.ScanOne(&Article{Slug: slug}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, _ := c.DecodeElement(data)
+	return e.Id
+}
+
+func TestMultiValueIndex(t *testing.T) {
+	enterTempDir(t)
+	c := newArticles(t)
+	if n := len(tagged(t, c, "all")); n != 20 {
+		t.Fatal("expected 20 articles tagged all, got", n)
+	}
+	if n := len(tagged(t, c, "fifth")); n != 4 {
+		t.Fatal("expected 4 articles tagged fifth, got", n)
+	}
+	found := tagged(t, c, "group1")
+	if len(found) != 5 || !found["article1"] || !found["article17"] {
+		t.Fatal("unexpected articles in group1", found)
+	}
+
+	// deleted elements are gone under every tag
+	if err := c.DeleteById(articleId(t, c, "article5")); err != nil {
+		t.Fatal(err)
+	}
+	if tagged(t, c, "all")["article5"] || tagged(t, c, "fifth")["article5"] || tagged(t, c, "group1")["article5"] {
+		t.Fatal("deleted article is still tagged")
+	}
+	if _, err := c.ScanOne(&Article{Slug: "article5"}, false); err == nil {
+		t.Fatal("deleted article was found by its unique key")
+	}
+	// and the unique value is free again
+	if err := c.Write(&Article{"article5", []string{"rewritten"}}); err != nil {
+		t.Fatal(err)
+	}
+	if !tagged(t, c, "rewritten")["article5"] || tagged(t, c, "group1")["article5"] {
+		t.Fatal("rewritten article has the wrong tags")
+	}
+}
+
+func TestUpdateReplacesIndexEntries(t *testing.T) {
+	enterTempDir(t)
+	c := newArticles(t)
+	id := articleId(t, c, "article10")
+	err := c.Update(id, &Article{"article10", []string{"all", "updated"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tagged(t, c, "fifth")["article10"] || tagged(t, c, "group2")["article10"] {
+		t.Fatal("removed tags still find the updated article")
+	}
+	if !tagged(t, c, "updated")["article10"] || len(tagged(t, c, "all")) != 20 {
+		t.Fatal("updated article is not found under its tags")
+	}
+	if articleId(t, c, "article10") != id || c.Size() != 20 {
+		t.Fatal("update changed the id or the number of elements")
+	}
+	if err = c.Update("missing", &Article{Slug: "missing"}); err == nil {
+		t.Fatal("missing element was updated")
+	}
+
+	// the sets stay consistent when the shards drop the deleted entries
+	for i := 0; i < 20; i += 2 {
+		c.DeleteById(articleId(t, c, "article"+strconv.Itoa(i)))
+	}
+	if _, err = c.Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(tagged(t, c, "all")); n != 10 {
+		t.Fatal("expected 10 articles after optimization, got", n)
+	}
+	if found := tagged(t, c, "group1"); len(found) != 5 || !found["article1"] {
+		t.Fatal("unexpected articles in group1", found)
+	}
+	if err = c.Write(&Article{"late", []string{"group1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(tagged(t, c, "group1")); n != 6 {
+		t.Fatal("expected 6 articles in group1, got", n)
+	}
+	if n, _ := c.Restore(&Article{Tags: []string{"group0"}}); n != 0 {
+		t.Fatal("optimized elements were restored")
+	}
+}
@@ -0,0 +1,53 @@
+package tests
+
+import (
+	"shardb/db"
+	"testing"
+	"time"
+)
+
+func TestNegativeCache(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	database.RegisterType(&ExamplePerson{})
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 10)
+	c.SetNegativeCache(time.Hour)
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.ScanOne(&ExamplePerson{FirstName: "nobody"}, false); err == nil {
+			t.Fatal("absent element was found")
+		}
+		if _, err := c.Scan(&ExamplePerson{Age: 42}, false); err == nil {
+			t.Fatal("absent age was found")
+		}
+	}
+	if stats := c.Metrics().NegativeCache; stats.Hits != 4 || stats.Entries != 2 {
+		t.Fatalf("absent keys were not remembered %+v", stats)
+	}
+
+	// writes forget the keys of the element
+	if err := c.Write(&ExamplePerson{"nobody", 42}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ScanOne(&ExamplePerson{FirstName: "nobody"}, false); err != nil {
+		t.Fatal("written element was not found", err)
+	}
+	if data, err := c.Scan(&ExamplePerson{Age: 42}, false); err != nil || len(data) != 1 {
+		t.Fatal("written age was not found", err)
+	}
+	if _, err := c.FindById("missing", false); err == nil {
+		t.Fatal("absent id was found")
+	}
+	if stats := c.Metrics().NegativeCache; stats.Entries != 1 {
+		t.Fatalf("absent id was not remembered %+v", stats)
+	}
+
+	// entries expire
+	c.SetNegativeCache(time.Millisecond)
+	c.FindById("missing", false)
+	time.Sleep(5 * time.Millisecond)
+	c.FindById("missing", false)
+	if stats := c.Metrics().NegativeCache; stats.Hits != 0 {
+		t.Fatalf("expired entry was used %+v", stats)
+	}
+}
@@ -0,0 +1,95 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"shardb/db"
+	"testing"
+)
+
+func checkModes(t *testing.T, file, dir os.FileMode) {
+	err := filepath.Walk(".", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == "." {
+			return nil
+		}
+		expected := file
+		if info.IsDir() {
+			expected = dir
+		}
+		if info.Mode().Perm() != expected {
+			t.Errorf("%s has mode %v, expected %v", path, info.Mode().Perm(), expected)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDefaultFileModes(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 10)
+	err := database.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkModes(t, 0600, 0700)
+}
+
+func TestConfiguredFileModes(t *testing.T) {
+	enterTempDir(t)
+	database := db.NewDatabaseWithOptions("test", db.DatabaseOptions{FileMode: 0640, DirMode: 0750})
+	database.RegisterType(&ExamplePerson{})
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 10)
+	err := database.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// compaction creates new segment files
+	c.DeleteN(&ExamplePerson{Age: 1}, 1)
+	_, err = c.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkModes(t, 0640, 0750)
+}
+
+func TestShardCountPerDatabase(t *testing.T) {
+	options := db.DefaultDatabaseOptions()
+	options.ShardCount = 64
+	wide := db.NewTestDatabaseWithOptions(t, options)
+	wide.RegisterType(&ExamplePerson{})
+	narrow := db.NewTestDatabase(t)
+	narrow.RegisterType(&ExamplePerson{})
+
+	wc, _ := wide.AddCollection("people")
+	nc, _ := narrow.AddCollection("people")
+	fillCollection(t, wc, 100)
+	fillCollection(t, nc, 100)
+	if len(wc.Map.Shared) != 64 || len(nc.Map.Shared) != db.SHARD_COUNT {
+		t.Fatal("unexpected shard counts", len(wc.Map.Shared), len(nc.Map.Shared))
+	}
+	// every shard of both maps is visited
+	if wc.Map.Count() != nc.Map.Count() || wc.Size() != 100 {
+		t.Fatal("unexpected counts", wc.Map.Count(), nc.Map.Count())
+	}
+	if err := wide.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	options.Dir = filepath.Dir(filepath.Dir(wc.SyncDestination))
+	loaded := db.NewTestDatabaseWithOptions(t, options)
+	loaded.RegisterType(&ExamplePerson{})
+	if err := loaded.ScanAndLoadData(""); err != nil {
+		t.Fatal(err)
+	}
+	if lc := loaded.GetCollection("people"); lc == nil || lc.Size() != 100 || len(lc.Map.Shared) != 64 {
+		t.Fatal("collection with 64 shards was not loaded")
+	}
+}
@@ -0,0 +1,74 @@
+package tests
+
+import (
+	"path/filepath"
+	"shardb/db"
+	"shardb/testutil"
+	"testing"
+)
+
+func orderedNames(t *testing.T, q *db.Query) []string {
+	results, err := q.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(results))
+	for i, e := range results {
+		names[i] = e.Payload.(*ExamplePerson).FirstName
+	}
+	return names
+}
+
+func TestOrderBy(t *testing.T) {
+	options := db.DefaultDatabaseOptions()
+	options.Config.LogLevel = db.LOG_WARNING
+	// a few entries per sorted run, so they are merged in several passes
+	options.Config.SortMemory = 256
+	database := db.NewTestDatabaseWithOptions(t, options)
+	database.RegisterType(&ExamplePerson{})
+	c, _ := database.AddCollection("people")
+	g, _ := testutil.NewGenerator(&ExamplePerson{})
+	g.Field("FirstName", testutil.Sequence("p")).Field("Age", testutil.Uniform(0, 50))
+	if err := g.Populate(c, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	spilled := orderedNames(t, c.Query().Where("Age", db.Gte, 10).OrderBy("Age", true).OrderBy("FirstName", false))
+	if leftovers, _ := filepath.Glob(filepath.Join(filepath.Dir(filepath.Dir(c.SyncDestination)), db.SORT_DIR_PREFIX+"*")); len(leftovers) > 0 {
+		t.Fatal("sort files were not removed", leftovers)
+	}
+	ages := make(map[string]int)
+	for _, e := range c.All() {
+		ages[e.Payload.(*ExamplePerson).FirstName] = e.Payload.(*ExamplePerson).Age
+	}
+	previous := -1
+	for i, name := range spilled {
+		age := ages[name]
+		if age < 10 || (previous >= 0 && age > previous) || (age == previous && name < spilled[i-1]) {
+			t.Fatal("elements are out of order at", i, name, age)
+		}
+		previous = age
+	}
+
+	cfg := database.Config()
+	cfg.SortMemory = 0
+	if err := database.ApplyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	inMemory := orderedNames(t, c.Query().Where("Age", db.Gte, 10).OrderBy("Age", true).OrderBy("FirstName", false))
+	if len(inMemory) != len(spilled) || len(spilled) == 0 {
+		t.Fatal("expected the same results", len(inMemory), len(spilled))
+	}
+	for i := range inMemory {
+		if inMemory[i] != spilled[i] {
+			t.Fatal("spilled and in-memory orders differ at", i)
+		}
+	}
+
+	if first := orderedNames(t, c.Query().OrderBy("FirstName", true).Limit(2)); len(first) != 2 || first[0] != "p999" || first[1] != "p998" {
+		t.Fatal("unexpected first elements", first)
+	}
+	if _, err := c.Query().OrderBy("Age[", false).Run(); err == nil {
+		t.Fatal("ordered by an invalid path")
+	}
+}
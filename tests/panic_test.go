@@ -0,0 +1,100 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"shardb/db"
+	"sync"
+	"testing"
+)
+
+// fails to decode when it is broken
+type Fragile struct {
+	Name   string
+	Broken bool
+}
+
+func (f *Fragile) GetDataIndex() []*db.FullDataIndex {
+	return []*db.FullDataIndex{{Field: "Name", Data: f.Name, Unique: true}}
+}
+
+func (f *Fragile) GobEncode() ([]byte, error) {
+	if f.Broken {
+		return []byte("!" + f.Name), nil
+	}
+	return []byte(f.Name), nil
+}
+
+func (f *Fragile) GobDecode(data []byte) error {
+	if len(data) > 0 && data[0] == '!' {
+		panic("broken element " + string(data[1:]))
+	}
+	f.Name = string(data)
+	return nil
+}
+
+func TestPanicsInScansAreReturned(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	database.RegisterType(&Fragile{})
+	c, _ := database.AddCollection("fragile")
+	for _, f := range []*Fragile{{"a", false}, {"b", true}, {"c", false}} {
+		if err := c.Write(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var panicErr *db.PanicError
+	err := c.ForEach(func(e *db.Element) error { return nil })
+	if !errors.As(err, &panicErr) {
+		t.Fatal("expected a PanicError, got", err)
+	}
+	elements, errs := c.Query().Where("Name", db.Ne, "a").Chan(context.Background(), 0)
+	for range elements {
+	}
+	if err := <-errs; !errors.As(err, &panicErr) {
+		t.Fatal("expected a PanicError, got", err)
+	}
+}
+
+func TestPanicInSyncFailsTheCollection(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	// the manifest would read the broken collection in this goroutine
+	database.SetSyncPolicy(db.SyncPolicy{RollbackHeader: true})
+	good, _ := database.AddCollection("good")
+	broken, _ := database.AddCollection("broken")
+	fillCollection(t, good, 5)
+	fillCollection(t, broken, 5)
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	var mx sync.Mutex
+	events := make([]db.Event, 0)
+	database.OnEvent(func(e db.Event) {
+		if e.Type == db.EVENT_PANIC {
+			mx.Lock()
+			events = append(events, e)
+			mx.Unlock()
+		}
+	})
+
+	shard := broken.Map.Shared[0]
+	broken.Map.Shared[0] = nil
+	err := database.Sync()
+	broken.Map.Shared[0] = shard
+	syncErr, ok := err.(*db.SyncError)
+	if !ok {
+		t.Fatal("expected a SyncError, got", err)
+	}
+	if _, ok := syncErr.Collections["broken"].(*db.PanicError); !ok || len(syncErr.Collections) != 1 {
+		t.Fatal("unexpected failed collections", syncErr)
+	}
+	mx.Lock()
+	if len(events) != 1 || events[0].Collection != "broken" {
+		t.Fatal("expected a single panic event of the broken collection", events)
+	}
+	mx.Unlock()
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,107 @@
+package tests
+
+import (
+	"shardb/db"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPartitionedCollection(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	now := time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)
+	events, err := database.PartitionedCollection("events", db.PartitionOptions{
+		Period:      db.PARTITION_DAY,
+		MaxElements: 5,
+		Retention:   48 * time.Hour,
+		Template:    &db.CollectionTemplate{Indexes: []db.Index{{Field: "Age"}}},
+		Now:         func() time.Time { return now },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an unrelated collection sharing the prefix
+	database.AddCollection("events_archive")
+
+	for day := 0; day < 4; day++ {
+		for i := 0; i < 7; i++ {
+			err := events.Write(&ExamplePerson{"day" + strconv.Itoa(day) + "_" + strconv.Itoa(i), day})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		now = now.Add(24 * time.Hour)
+	}
+	names := make([]string, 0)
+	for _, c := range events.Partitions() {
+		names = append(names, c.Name)
+		if len(c.Indexes) != 1 {
+			t.Fatal("template was not applied to", c.Name)
+		}
+	}
+	expected := []string{"events_2024_06_10", "events_2024_06_10_1", "events_2024_06_11", "events_2024_06_11_1",
+		"events_2024_06_12", "events_2024_06_12_1", "events_2024_06_13", "events_2024_06_13_1"}
+	if len(names) != len(expected) {
+		t.Fatal("unexpected partitions", names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Fatal("unexpected partitions", names)
+		}
+	}
+	if events.Size() != 28 {
+		t.Fatal("expected 28 elements, got", events.Size())
+	}
+
+	results, err := events.Query().Where("Age", db.Gte, 2).Run()
+	if err != nil || len(results) != 14 {
+		t.Fatal("expected 14 elements of the last two days", len(results), err)
+	}
+	results, err = events.Query().Where("Age", db.Lt, 3).Limit(10).Run()
+	if err != nil || len(results) != 10 || results[0].Payload.(*ExamplePerson).Age != 0 {
+		t.Fatal("expected the 10 oldest elements", err)
+	}
+
+	// now is the 14th, data of the 10th and the 11th ended more than two days ago
+	dropped, err := events.DropExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dropped) != 4 || database.GetCollection("events_2024_06_10") != nil {
+		t.Fatal("unexpected dropped partitions", dropped)
+	}
+	if database.GetCollection("events_archive") == nil {
+		t.Fatal("unrelated collection was dropped")
+	}
+	if events.Size() != 14 {
+		t.Fatal("expected 14 elements, got", events.Size())
+	}
+	if err = database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPartitionsBySize(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	if _, err := database.PartitionedCollection("logs", db.PartitionOptions{}); err == nil {
+		t.Fatal("partitions without a period or a size were accepted")
+	}
+	logs, _ := database.PartitionedCollection("logs", db.PartitionOptions{MaxElements: 3, MaxPartitions: 2})
+	for i := 0; i < 10; i++ {
+		if err := logs.Write(&ExamplePerson{"entry" + strconv.Itoa(i), i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(logs.Partitions()) != 4 || logs.Partitions()[3].Name != "logs_3" {
+		t.Fatal("expected 4 partitions")
+	}
+	dropped, err := logs.DropExpired()
+	if err != nil || len(dropped) != 2 || dropped[0] != "logs_0" {
+		t.Fatal("expected the two oldest partitions to be dropped", dropped, err)
+	}
+	if logs.Size() != 4 {
+		t.Fatal("expected 4 elements, got", logs.Size())
+	}
+}
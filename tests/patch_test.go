@@ -0,0 +1,85 @@
+package tests
+
+import (
+	"shardb/db"
+	"strconv"
+	"testing"
+)
+
+func TestPatch(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	database.RegisterType(&Customer{})
+	c, _ := database.AddCollection("customers")
+	for i := 0; i < 3; i++ {
+		err := c.Write(&Customer{
+			Name:    "customer" + strconv.Itoa(i),
+			Address: &Address{City: cities[i], Street: "street" + strconv.Itoa(i)},
+			Tags:    []string{"all"},
+			Orders:  []Order{{i}, {i * 10}},
+			Meta:    map[string]string{"tier": strconv.Itoa(i)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	e, _ := c.Query().Where("Name", db.Eq, "customer1").First()
+	id := e.Id
+
+	err := c.Patch(id, map[string]interface{}{
+		"address": map[string]interface{}{"city": "Stavanger"},
+		"Meta":    map[string]interface{}{"tier": nil, "plan": "gold"},
+		"tags":    []interface{}{"patched"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err = c.Query().Where("Name", db.Eq, "customer1").First()
+	if err != nil || e == nil {
+		t.Fatal("patched element not found", err)
+	}
+	cu := e.Payload.(*Customer)
+	if cu.Address.City != "Stavanger" || cu.Address.Street != "street1" {
+		t.Fatal("unexpected address", cu.Address)
+	}
+	if _, ok := cu.Meta["tier"]; ok || cu.Meta["plan"] != "gold" {
+		t.Fatal("unexpected meta", cu.Meta)
+	}
+	if len(cu.Tags) != 1 || cu.Tags[0] != "patched" || len(cu.Orders) != 2 {
+		t.Fatal("unexpected fields", cu.Tags, cu.Orders)
+	}
+	// the indexes follow the patch
+	if err = c.Patch(id, map[string]interface{}{"Name": "renamed"}); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := c.Query().Where("Name", db.Eq, "customer1").Run(); len(found) != 0 {
+		t.Fatal("old name is still found")
+	}
+	if found, _ := c.Query().Where("Name", db.Eq, "renamed").Run(); len(found) != 1 || found[0].Id != id {
+		t.Fatal("new name not found", found)
+	}
+	if c.Size() != 3 {
+		t.Fatal("unexpected size", c.Size())
+	}
+
+	err = c.MergePatch(id, []byte(`{"address": null, "Orders": [{"Total": 42}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, _ = c.Query().Where("Name", db.Eq, "renamed").First()
+	if cu = e.Payload.(*Customer); cu.Address != nil || len(cu.Orders) != 1 || cu.Orders[0].Total != 42 {
+		t.Fatal("unexpected merge patch result", cu)
+	}
+
+	if err = c.Patch(id, map[string]interface{}{"missing": 1}); err == nil {
+		t.Fatal("unknown field was patched")
+	}
+	if err = c.Patch(id, map[string]interface{}{"Orders": "text"}); err == nil {
+		t.Fatal("value of another type was set")
+	}
+	if err = c.Patch("nothing", map[string]interface{}{"Name": "x"}); err == nil {
+		t.Fatal("missing element was patched")
+	}
+	if err = c.MergePatch(id, []byte(`[1]`)); err == nil {
+		t.Fatal("merge patch that is not an object was accepted")
+	}
+}
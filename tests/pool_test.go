@@ -0,0 +1,52 @@
+package tests
+
+import (
+	"shardb/db"
+	"testing"
+)
+
+func TestReadInto(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 20)
+	data, _ := c.ScanOne(&ExamplePerson{FirstName: "person5"}, false)
+	el, _ := c.DecodeElement(data)
+
+	dst := db.AcquireElement()
+	defer db.ReleaseElement(dst)
+	err := c.ReadInto(el.Id, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst.Id != el.Id || dst.Payload.(*ExamplePerson).FirstName != "person5" {
+		t.Fatal("wrong element decoded")
+	}
+
+	c.DeleteById(el.Id)
+	if c.ReadInto(el.Id, dst) == nil {
+		t.Fatal("deleted element was read")
+	}
+}
+
+func BenchmarkReadInto(b *testing.B) {
+	enterTempDir(b)
+	database := db.NewDatabase("bench")
+	database.RegisterType(&ExamplePerson{})
+	c, err := database.AddCollection("people")
+	if err != nil {
+		b.Fatal(err)
+	}
+	c.Write(&ExamplePerson{"some", 1})
+	data, _ := c.ScanOne(&ExamplePerson{FirstName: "some"}, false)
+	el, _ := c.DecodeElement(data)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		dst := db.AcquireElement()
+		if err := c.ReadInto(el.Id, dst); err != nil {
+			b.Fatal(err)
+		}
+		db.ReleaseElement(dst)
+	}
+}
@@ -0,0 +1,61 @@
+package tests
+
+import (
+	"shardb/db"
+	"testing"
+)
+
+func TestPreparedQuery(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	database.RegisterType(&ExamplePerson{})
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 30)
+
+	byAge, err := c.Prepare(c.Query().Where("Age", db.Gte, db.Param("min")).Where("Age", db.Lt, db.Param("max")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params := byAge.Params(); len(params) != 2 || params[0] != "max" || params[1] != "min" {
+		t.Fatal("unexpected parameters", params)
+	}
+	for _, bounds := range [][2]int{{0, 10}, {3, 5}, {9, 20}} {
+		results, err := byAge.Run(map[string]interface{}{"min": bounds[0], "max": bounds[1]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, _ := c.Query().Where("Age", db.Gte, bounds[0]).Where("Age", db.Lt, bounds[1]).Run()
+		if len(results) != len(expected) {
+			t.Fatal("unexpected results", bounds, len(results), len(expected))
+		}
+	}
+	if _, err = byAge.Run(map[string]interface{}{"min": 1}); err == nil {
+		t.Fatal("unbound parameter was accepted")
+	}
+	if _, err = byAge.Run(map[string]interface{}{"min": 1, "max": 2, "other": 3}); err == nil {
+		t.Fatal("unknown parameter was accepted")
+	}
+
+	// an index added after Prepare is used
+	byName, err := c.Prepare(c.Query().Where("FirstName", db.Eq, db.Param("name")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.AddIndex("FirstName", true); err != nil {
+		t.Fatal(err)
+	}
+	e, err := byName.First(map[string]interface{}{"name": "person7"})
+	if err != nil || e.Payload.(*ExamplePerson).Age != 7 {
+		t.Fatal("unexpected element", err)
+	}
+	if len(database.IndexSuggestions()) != 1 {
+		t.Fatal("prepared query did not use the added index", database.IndexSuggestions())
+	}
+
+	if _, err = c.Prepare(c.Query().Where("Age..x", db.Eq, 1)); err == nil {
+		t.Fatal("invalid path was prepared")
+	}
+	other, _ := database.AddCollection("other")
+	if _, err = c.Prepare(other.Query()); err == nil {
+		t.Fatal("query of another collection was prepared")
+	}
+}
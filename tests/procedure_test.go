@@ -0,0 +1,62 @@
+package tests
+
+import (
+	"shardb/db"
+	"testing"
+)
+
+func TestProcedures(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 20)
+
+	// moves everybody of the given age into a new collection
+	err := database.RegisterProcedure("archive", func(database *db.Database, params map[string]interface{}) (interface{}, error) {
+		archive := database.GetCollection("archive")
+		if archive == nil {
+			var err error
+			if archive, err = database.AddCollection("archive"); err != nil {
+				return nil, err
+			}
+		}
+		people := database.GetCollection("people")
+		data, err := people.Scan(&ExamplePerson{Age: params["age"].(int)}, false)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range data {
+			el, err := people.DecodeElement(d)
+			if err != nil {
+				return nil, err
+			}
+			if err = archive.Write(el.Payload.(*ExamplePerson)); err != nil {
+				return nil, err
+			}
+			people.DeleteById(el.Id)
+		}
+		return len(data), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if database.RegisterProcedure("archive", func(*db.Database, map[string]interface{}) (interface{}, error) { return nil, nil }) == nil {
+		t.Fatal("duplicate procedure was registered")
+	}
+
+	moved, err := database.Call("archive", map[string]interface{}{"age": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.(int) != 2 || database.GetCollection("archive").ObjectsCounter != 2 {
+		t.Fatal("unexpected result", moved)
+	}
+
+	// a missing parameter panics inside of the procedure
+	if _, err = database.Call("archive", nil); err == nil {
+		t.Fatal("panic was not reported")
+	}
+	if _, err = database.Call("missing", nil); err == nil {
+		t.Fatal("unknown procedure was called")
+	}
+}
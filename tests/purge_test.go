@@ -0,0 +1,135 @@
+package tests
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"shardb/db"
+	"testing"
+)
+
+func segmentsContain(t *testing.T, value string) bool {
+	files, _ := filepath.Glob(filepath.Join(db.COLLECTION_DIR_NAME, "people", "shard_*.gobs"))
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte(value)) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPurge(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 50)
+	database.Sync()
+
+	// soft deleted elements are purged as well
+	data, _ := c.ScanOne(&ExamplePerson{FirstName: "person13"}, false)
+	el, _ := c.DecodeElement(data)
+	c.DeleteById(el.Id)
+	if !segmentsContain(t, "person13") {
+		t.Fatal("test data is missing")
+	}
+
+	report, err := c.Purge(&ExamplePerson{Age: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Verified || report.Purged != 5 || report.Reclaimed <= 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	for _, name := range []string{"person13", "person23", "person43"} {
+		if segmentsContain(t, name) {
+			t.Fatal(name, "is still on the drive")
+		}
+	}
+	if c.Size() != 45 {
+		t.Fatal("expected 45 objects, got", c.Size())
+	}
+
+	data, _ = c.ScanOne(&ExamplePerson{FirstName: "person7"}, false)
+	el, _ = c.DecodeElement(data)
+	report, err = c.PurgeById(el.Id)
+	if err != nil || !report.Verified || report.Purged != 1 {
+		t.Fatalf("unexpected report %+v %v", report, err)
+	}
+	if segmentsContain(t, "person7") {
+		t.Fatal("person7 is still on the drive")
+	}
+
+	err = database.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := newTestDatabase(t)
+	err = loaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	loaded.GetCollection("people").ForEach(func(e *db.Element) error {
+		n++
+		return nil
+	})
+	if n != 44 {
+		t.Fatal("expected 44 elements after the reload, got", n)
+	}
+	// every index has to match
+	report, err = c.Purge(&ExamplePerson{FirstName: "person10", Age: 1})
+	if err != nil || report.Purged != 0 {
+		t.Fatal("purged an element that does not match", report.Purged, err)
+	}
+}
+
+func TestPurgeHistory(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	if err := c.SetHistory(&db.HistoryOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	fillCollection(t, c, 10)
+	e, _ := c.Query().Where("FirstName", db.Eq, "person3").First()
+	for _, age := range []int{31, 32} {
+		if err := c.Update(e.Id, &ExamplePerson{"person3", age}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	database.Sync()
+	historyContains := func() bool {
+		files, _ := filepath.Glob(filepath.Join(db.COLLECTION_DIR_NAME, db.HISTORY_COLLECTION_PREFIX+"people", "shard_*.gobs"))
+		for _, f := range files {
+			if data, _ := ioutil.ReadFile(f); bytes.Contains(data, []byte("person3")) {
+				return true
+			}
+		}
+		return false
+	}
+	if !historyContains() {
+		t.Fatal("test data is missing")
+	}
+
+	report, err := c.PurgeById(e.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Verified || report.Purged != 1 || report.Versions != 3 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if historyContains() {
+		t.Fatal("versions of the purged element are still on the drive")
+	}
+	if versions, err := c.History(e.Id); err != nil || len(versions) != 0 {
+		t.Fatal("versions of the purged element are still kept", versions, err)
+	}
+	other, _ := c.Query().Where("FirstName", db.Eq, "person4").First()
+	if versions, err := c.History(other.Id); err != nil || len(versions) != 1 {
+		t.Fatal("versions of another element were purged", versions, err)
+	}
+}
@@ -0,0 +1,387 @@
+package tests
+
+import (
+	"context"
+	"shardb/db"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type Address struct {
+	City   string `json:"city"`
+	Street string `json:"street"`
+}
+
+type Customer struct {
+	Name    string
+	Address *Address `json:"address"`
+	Tags    []string `json:"tags"`
+	Orders  []Order
+	Meta    map[string]string
+}
+
+type Order struct {
+	Total int
+}
+
+func (cu *Customer) GetDataIndex() []*db.FullDataIndex {
+	return []*db.FullDataIndex{{Field: "Name", Data: cu.Name, Unique: true}}
+}
+
+var cities = []string{"Oslo", "Bergen", "Tromso"}
+
+func newCustomers(t *testing.T, n int) (*db.Database, *db.Collection) {
+	database := newTestDatabase(t)
+	database.RegisterType(&Customer{})
+	c, err := database.AddCollection("customers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		tags := []string{"all"}
+		if i%2 == 0 {
+			tags = append(tags, "even")
+		}
+		err := c.Write(&Customer{
+			Name:    "customer" + strconv.Itoa(i),
+			Address: &Address{City: cities[i%3], Street: "street" + strconv.Itoa(i)},
+			Tags:    tags,
+			Orders:  []Order{{i}, {i * 10}},
+			Meta:    map[string]string{"tier": strconv.Itoa(i % 4)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return database, c
+}
+
+func names(elements []*db.Element) map[string]bool {
+	result := make(map[string]bool)
+	for _, e := range elements {
+		result[e.Payload.(*Customer).Name] = true
+	}
+	return result
+}
+
+func checkQuery(t *testing.T, q *db.Query, expected int) map[string]bool {
+	t.Helper()
+	results, err := q.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := names(results)
+	if len(results) != expected || len(found) != expected {
+		t.Fatal("expected", expected, "results, got", len(results), found)
+	}
+	return found
+}
+
+func TestQueryNestedPaths(t *testing.T) {
+	enterTempDir(t)
+	_, c := newCustomers(t, 30)
+
+	for _, indexed := range []bool{false, true} {
+		if indexed {
+			if err := c.AddIndex("address.city", false); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.AddIndex("tags[]", false); err != nil {
+				t.Fatal(err)
+			}
+		}
+		found := checkQuery(t, c.Query().Where("address.city", db.Eq, "Oslo"), 10)
+		if !found["customer0"] || !found["customer27"] || found["customer1"] {
+			t.Fatal("wrong customers in Oslo", found)
+		}
+		checkQuery(t, c.Query().Where("tags[]", db.Eq, "even"), 15)
+		checkQuery(t, c.Query().Where("tags[]", db.Ne, "even"), 15)
+		checkQuery(t, c.Query().Where("address.city", db.Eq, "Oslo").Where("tags[]", db.Eq, "even"), 5)
+		checkQuery(t, c.Query().Where("Orders[].Total", db.Gte, 250), 5)
+		checkQuery(t, c.Query().Where("Meta.tier", db.Eq, "1").Where("Orders[].Total", db.Lt, 10), 3)
+		checkQuery(t, c.Query().Where("address.city", db.Eq, "Oslo").Limit(3), 3)
+		checkQuery(t, c.Query().Where("address.zip", db.Eq, "0150"), 0)
+	}
+
+	// elements written after the index was added are indexed as well
+	c.Write(&Customer{Name: "late", Address: &Address{City: "Oslo"}})
+	e, err := c.Query().Where("address.city", db.Eq, "Oslo").Where("Name", db.Eq, "late").First()
+	if err != nil || e.Payload.(*Customer).Name != "late" {
+		t.Fatal("element written after AddIndex was not found", err)
+	}
+	c.Write(&Customer{Name: "homeless"})
+	checkQuery(t, c.Query().Where("address.city", db.Ne, "Oslo"), 21)
+
+	if _, err = c.Query().Where("address..city", db.Eq, "Oslo").Run(); err == nil {
+		t.Fatal("invalid path was accepted")
+	}
+	if err = c.AddIndex("address.city", false); err == nil {
+		t.Fatal("index was added twice")
+	}
+}
+
+func TestUniquePathIndex(t *testing.T) {
+	enterTempDir(t)
+	_, c := newCustomers(t, 12)
+	if err := c.AddIndex("address.city", true); err == nil {
+		t.Fatal("unique index over duplicate values was added")
+	}
+	// the failed index left nothing behind
+	c.Write(&Customer{Name: "extra", Address: &Address{City: "Oslo"}})
+	checkQuery(t, c.Query().Where("address.city", db.Eq, "Oslo"), 5)
+
+	if err := c.AddIndex("address.street", true); err != nil {
+		t.Fatal(err)
+	}
+	found := checkQuery(t, c.Query().Where("address.street", db.Eq, "street7"), 1)
+	if !found["customer7"] {
+		t.Fatal("wrong customer", found)
+	}
+}
+
+func TestPathIndexIsLoaded(t *testing.T) {
+	enterTempDir(t)
+	database, c := newCustomers(t, 9)
+	if err := c.AddIndex("address.city", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newTestDatabase(t)
+	loaded.RegisterType(&Customer{})
+	if err := loaded.ScanAndLoadData(""); err != nil {
+		t.Fatal(err)
+	}
+	lc := loaded.GetCollection("customers")
+	if len(lc.Indexes) != 1 || lc.Indexes[0].Field != "address.city" {
+		t.Fatal("declared indexes were not loaded", lc.Indexes)
+	}
+	checkQuery(t, lc.Query().Where("address.city", db.Eq, "Bergen"), 3)
+}
+
+func TestExistsAndNull(t *testing.T) {
+	enterTempDir(t)
+	_, c := newCustomers(t, 6)
+	for i, cu := range []*Customer{
+		{Name: "no address"},
+		{Name: "no city", Address: &Address{Street: "street"}},
+		{Name: "no meta", Address: &Address{City: "Oslo"}, Meta: map[string]string{}},
+		{Name: "nil tags", Address: &Address{City: "Oslo"}, Meta: map[string]string{"tier": "9"}},
+	} {
+		if i < 3 {
+			cu.Tags = []string{"odd"}
+		}
+		if err := c.Write(cu); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, indexed := range []bool{false, true} {
+		if indexed {
+			if err := c.AddIndex("address", false); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.AddSparseIndex("Meta.tier", false); err != nil {
+				t.Fatal(err)
+			}
+		}
+		found := checkQuery(t, c.Query().Where("address", db.IsNull), 1)
+		if !found["no address"] {
+			t.Fatal("unexpected customers without an address", found)
+		}
+		// a nil value is still there
+		checkQuery(t, c.Query().Where("address", db.Exists), 10)
+		checkQuery(t, c.Query().Where("address.city", db.Exists), 9)
+		checkQuery(t, c.Query().Where("address.city", db.IsNull), 1)
+		checkQuery(t, c.Query().Where("Meta.tier", db.Exists), 7)
+		checkQuery(t, c.Query().Where("Meta.tier", db.IsNull), 3)
+		checkQuery(t, c.Query().Where("tags", db.IsNull), 1)
+		checkQuery(t, c.Query().Where("tags[]", db.Exists), 9)
+		checkQuery(t, c.Query().Where("Meta.tier", db.Eq, "9"), 1)
+	}
+
+	// elements without a value collide in a unique index unless it is sparse
+	if err := c.AddIndex("Orders[].Total", true); err == nil {
+		t.Fatal("unique index with several null values was added")
+	}
+	if err := c.AddSparseIndex("Orders[].Total", true); err != nil {
+		t.Fatal(err)
+	}
+	found := checkQuery(t, c.Query().Where("Orders[].Total", db.Eq, 30), 1)
+	if !found["customer3"] {
+		t.Fatal("wrong customer", found)
+	}
+}
+
+func TestQueryStream(t *testing.T) {
+	enterTempDir(t)
+	_, c := newCustomers(t, 60)
+	c.AddIndex("tags[]", false)
+
+	for _, q := range []*db.Query{c.Query().Where("Meta.tier", db.Ne, "x"), c.Query().Where("tags[]", db.Eq, "all")} {
+		n := 0
+		err := q.Stream(context.Background(), func(e *db.Element) error {
+			n++
+			if n == 25 {
+				return db.StopIteration
+			}
+			return nil
+		})
+		if err != nil || n != 25 {
+			t.Fatal("stream did not stop after 25 elements", n, err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		n = 0
+		err = q.Stream(ctx, func(e *db.Element) error {
+			if n++; n == 10 {
+				cancel()
+			}
+			return nil
+		})
+		if err != context.Canceled || n != 10 {
+			t.Fatal("cancelled stream went on", n, err)
+		}
+
+		elements, errs := q.Chan(context.Background(), 0)
+		seen := make(map[string]bool)
+		for e := range elements {
+			seen[e.Payload.(*Customer).Name] = true
+		}
+		if err = <-errs; err != nil || len(seen) != 60 {
+			t.Fatal("expected 60 elements from the channel, got", len(seen), err)
+		}
+
+		// the producer stops once the consumer cancels
+		ctx, cancel = context.WithCancel(context.Background())
+		elements, errs = q.Chan(ctx, 4)
+		<-elements
+		cancel()
+		if err = <-errs; err != context.Canceled {
+			t.Fatal("expected the query to be cancelled, got", err)
+		}
+	}
+}
+
+// configures the query guards of the database, 0 leaves a guard out
+func guardQueries(t *testing.T, database *db.Database, rows, bytes int64, timeout time.Duration) {
+	t.Helper()
+	cfg := database.Config()
+	cfg.MaxQueryRows, cfg.MaxQueryBytes, cfg.QueryTimeout = rows, bytes, timeout
+	if err := database.ApplyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueryGuards(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 50)
+	guardQueries(t, database, 10, 0, 50*time.Millisecond)
+
+	results, err := c.Query().Run()
+	if err != db.ErrQueryRowsExceeded || len(results) != 10 {
+		t.Fatal("expected 10 results and ErrQueryRowsExceeded, got", len(results), err)
+	}
+	results, err = c.Query().OrderBy("FirstName", false).Run()
+	if err != db.ErrQueryRowsExceeded || len(results) != 10 || results[0].Payload.(*ExamplePerson).FirstName != "person0" {
+		t.Fatal("expected the first 10 ordered results and ErrQueryRowsExceeded, got", len(results), err)
+	}
+	// queries within the guard, by their limit or by their matches
+	if results, err = c.Query().OrderBy("FirstName", false).Limit(10).Run(); err != nil || len(results) != 10 {
+		t.Fatal("limited query was refused", len(results), err)
+	}
+	if results, err = c.Query().Where("Age", db.Eq, 3).Run(); err != nil || len(results) != 5 {
+		t.Fatal("query within the guard was refused", len(results), err)
+	}
+
+	err = c.Query().Limit(3).Stream(context.Background(), func(e *db.Element) error {
+		time.Sleep(40 * time.Millisecond)
+		return nil
+	})
+	if err != db.ErrQueryTimeout {
+		t.Fatal("expected ErrQueryTimeout, got", err)
+	}
+	// the deadline of the caller is not the one of the guard
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	err = c.Query().Limit(3).Stream(ctx, func(e *db.Element) error {
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatal("expected the deadline of the caller, got", err)
+	}
+
+	// the bytes of the encoded elements, the small ones take less than 1KB each
+	guardQueries(t, database, 0, 5000, 0)
+	results, err = c.Query().Run()
+	if err != db.ErrQueryBytesExceeded || len(results) < 5 || len(results) >= 50 {
+		t.Fatal("expected some of the results and ErrQueryBytesExceeded, got", len(results), err)
+	}
+	if results, err = c.Query().Limit(3).Run(); err != nil || len(results) != 3 {
+		t.Fatal("query within the bytes was refused", len(results), err)
+	}
+
+	guardQueries(t, database, 0, 0, 0)
+	if results, err = c.Query().Run(); err != nil || len(results) != 50 {
+		t.Fatal("guards were not lifted", len(results), err)
+	}
+	// the query cache serves its results within the guards
+	c.SetQueryCache(10)
+	if results, err = c.Query().Where("Age", db.Gte, 0).Run(); err != nil || len(results) != 50 {
+		t.Fatal(len(results), err)
+	}
+	guardQueries(t, database, 10, 0, 0)
+	if results, err = c.Query().Where("Age", db.Gte, 0).Run(); err != db.ErrQueryRowsExceeded || len(results) != 10 {
+		t.Fatal("cached results were not guarded, got", len(results), err)
+	}
+}
+
+func TestQueryGuardsOfUnionsAndPartitions(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	for _, name := range []string{"eu", "us"} {
+		c, _ := database.AddCollection(name)
+		fillCollection(t, c, 8)
+	}
+	u, err := database.Union("people", "eu", "us")
+	if err != nil {
+		t.Fatal(err)
+	}
+	guardQueries(t, database, 10, 0, 0)
+	// every member is within the guard, the union is not
+	results, err := u.Query().Run()
+	if err != db.ErrQueryRowsExceeded || len(results) != 10 {
+		t.Fatal("expected 10 results of the union and ErrQueryRowsExceeded, got", len(results), err)
+	}
+
+	guardQueries(t, database, 0, 0, 0)
+	p, err := database.PartitionedCollection("events", db.PartitionOptions{MaxElements: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 12; i++ {
+		if err = p.Write(&ExamplePerson{"person" + strconv.Itoa(i), i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	guardQueries(t, database, 10, 0, 0)
+	results, err = p.Query().Run()
+	if err != db.ErrQueryRowsExceeded || len(results) != 10 {
+		t.Fatal("expected 10 results of the partitions and ErrQueryRowsExceeded, got", len(results), err)
+	}
+	// the timeout is the one of the whole query
+	guardQueries(t, database, 0, 0, 30*time.Millisecond)
+	err = p.Query().Stream(context.Background(), func(e *db.Element) error {
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	})
+	if err != db.ErrQueryTimeout {
+		t.Fatal("expected ErrQueryTimeout, got", err)
+	}
+}
@@ -0,0 +1,61 @@
+package tests
+
+import (
+	"shardb/db"
+	"testing"
+)
+
+func TestQueryCache(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	database.RegisterType(&ExamplePerson{})
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 20)
+	c.SetQueryCache(2)
+
+	adults := func(age interface{}) int {
+		results, err := c.Query().Where("Age", db.Gte, age).Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(results)
+	}
+	expected := adults(5)
+	if n := adults(5.0); n != expected {
+		t.Fatal("cached result differs", n, expected)
+	}
+	if stats := c.Metrics().QueryCache; stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Fatalf("equal queries did not share the entry %+v", stats)
+	}
+
+	if err := c.Write(&ExamplePerson{"new", 99}); err != nil {
+		t.Fatal(err)
+	}
+	if n := adults(5); n != expected+1 {
+		t.Fatal("stale result after a write", n, expected+1)
+	}
+	e, err := c.Query().Where("FirstName", db.Eq, "new").First()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.DeleteById(e.Id); err != nil {
+		t.Fatal(err)
+	}
+	if n := adults(5); n != expected {
+		t.Fatal("stale result after a delete", n, expected)
+	}
+
+	// the least recently used query is evicted
+	c.Query().Where("Age", db.Lt, 5).Run()
+	c.Query().Where("Age", db.Lt, 6).Run()
+	c.ResetMetrics()
+	adults(5)
+	if stats := c.Metrics().QueryCache; stats.Misses != 1 || stats.Entries != 2 {
+		t.Fatalf("expected an evicted entry %+v", stats)
+	}
+
+	c.SetQueryCache(0)
+	adults(5)
+	if stats := c.Metrics().QueryCache; stats != (db.QueryCacheStats{}) {
+		t.Fatalf("disabled cache was used %+v", stats)
+	}
+}
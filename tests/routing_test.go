@@ -0,0 +1,40 @@
+package tests
+
+import (
+	"os"
+	"shardb/db"
+	"testing"
+)
+
+func TestExplainRouting(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 20)
+	e, err := c.Query().Where("FirstName", db.Eq, "person3").First()
+	if err != nil || e == nil {
+		t.Fatal("person3 was not found", err)
+	}
+
+	r := c.ExplainRouting(e.Id)
+	if r.Key != "id:"+e.Id || r.Destination < 0 || len(r.Shards) != 1 || r.Shards[0] != r.Destination || r.Shard != r.Destination {
+		t.Fatalf("unexpected routing %+v", r)
+	}
+	if r.Offset == nil || r.Offset.Deleted {
+		t.Fatal("missing offset entry", r.Offset)
+	}
+	if _, err := os.Stat(r.Path); err != nil {
+		t.Fatal("segment file does not exist", err)
+	}
+	if len(r.IndexEntries) != 3 || r.IndexEntries[0] != "0:Age:3" || r.IndexEntries[1] != "FirstName:person3" || r.IndexEntries[2] != "id:"+e.Id {
+		t.Fatal("unexpected index entries", r.IndexEntries)
+	}
+	if byKey := c.ExplainRouting("FirstName:person3"); byKey.Shard != r.Shard || byKey.Offset.Start != r.Offset.Start {
+		t.Fatalf("unique key is routed elsewhere %+v", byKey)
+	}
+
+	missing := c.ExplainRouting("unknown")
+	if missing.Destination != -1 || len(missing.Shards) != 0 || missing.Shard != -1 || missing.Offset != nil {
+		t.Fatalf("unexpected routing of a missing key %+v", missing)
+	}
+}
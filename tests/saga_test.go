@@ -0,0 +1,168 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"shardb/db"
+	"shardb/saga"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSaga(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	sagas, err := saga.New(database, "sagas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	log := make([]string, 0)
+	step := func(name string, fail *bool) saga.Step {
+		return saga.Step{
+			Name: name,
+			Action: func(ctx context.Context, data []byte) error {
+				if fail != nil && *fail {
+					return errors.New("refused")
+				}
+				log = append(log, name+":"+string(data))
+				return nil
+			},
+			Compensate: func(ctx context.Context, data []byte) error {
+				log = append(log, "undo "+name)
+				return nil
+			},
+		}
+	}
+	failCharge := false
+	err = sagas.Register(saga.Workflow{Name: "order", Steps: []saga.Step{step("reserve", nil), step("charge", &failCharge), step("ship", nil)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sagas.Register(saga.Workflow{Name: "order", Steps: []saga.Step{step("x", nil)}}); err == nil {
+		t.Fatal("workflow was registered twice")
+	}
+
+	id, err := sagas.Start(ctx, "order", []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := sagas.Get(id); r == nil || r.State != saga.STATE_DONE || r.Step != 3 {
+		t.Fatal("unexpected record", r)
+	}
+	if len(log) != 3 || log[2] != "ship:a" {
+		t.Fatal("unexpected steps", log)
+	}
+
+	log = log[:0]
+	failCharge = true
+	id, err = sagas.Start(ctx, "order", []byte("b"))
+	if err == nil {
+		t.Fatal("failed saga returned no error")
+	}
+	if len(log) != 2 || log[0] != "reserve:b" || log[1] != "undo reserve" {
+		t.Fatal("unexpected compensation", log)
+	}
+	if r, _ := sagas.Get(id); r.State != saga.STATE_COMPENSATED || r.Step != 0 || r.Error == "" {
+		t.Fatal("unexpected record", r)
+	}
+	if _, err = sagas.Start(ctx, "unknown", nil); err == nil {
+		t.Fatal("saga of an unknown workflow was started")
+	}
+
+	// a saga interrupted after its second step is finished by Resume
+	failCharge = false
+	log = log[:0]
+	now := time.Now()
+	sagas.Collection().Write(&saga.Record{Id: "interrupted", Workflow: "order", Data: []byte("c"), Step: 2,
+		State: saga.STATE_RUNNING, Started: now, Updated: now})
+	// one interrupted while compensating, its compensation fails at first
+	undoFails := true
+	flaky := saga.Step{Name: "flaky", Action: func(context.Context, []byte) error { return nil },
+		Compensate: func(context.Context, []byte) error {
+			if undoFails {
+				return errors.New("unavailable")
+			}
+			log = append(log, "undo flaky")
+			return nil
+		}}
+	sagas.Register(saga.Workflow{Name: "refund", Steps: []saga.Step{flaky}})
+	sagas.Collection().Write(&saga.Record{Id: "undoing", Workflow: "refund", Step: 1, State: saga.STATE_COMPENSATING})
+
+	resumed, err := sagas.Resume(ctx)
+	if err != nil || resumed != 2 {
+		t.Fatal("unexpected resume", resumed, err)
+	}
+	if r, _ := sagas.Get("interrupted"); r.State != saga.STATE_DONE || len(log) != 1 || log[0] != "ship:c" {
+		t.Fatal("interrupted saga was not finished", r, log)
+	}
+	if r, _ := sagas.Get("undoing"); r.State != saga.STATE_COMPENSATING || r.CompensationError == "" {
+		t.Fatal("failed compensation was not recorded", r)
+	}
+	undoFails = false
+	if resumed, err = sagas.Resume(ctx); err != nil || resumed != 1 {
+		t.Fatal("unexpected resume", resumed, err)
+	}
+	if r, _ := sagas.Get("undoing"); r.State != saga.STATE_COMPENSATED || log[1] != "undo flaky" {
+		t.Fatal("compensation was not retried", r, log)
+	}
+}
+
+func TestSagaRecordsSurviveCrash(t *testing.T) {
+	clock := db.NewVirtualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	options := db.DefaultDatabaseOptions()
+	options.Config.LogLevel = db.LOG_ERROR
+	options.Clock = clock
+	database := db.NewTestDatabaseWithOptions(t, options)
+	sagas, err := saga.New(database, "sagas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	step := saga.Step{Name: "tick", Action: func(context.Context, []byte) error {
+		clock.Advance(time.Minute)
+		return nil
+	}}
+	sagas.Register(saga.Workflow{Name: "ticks", Steps: []saga.Step{step, step}})
+	id, err := sagas.Start(ctx, "ticks", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the database is not synchronized by the caller
+	dir := filepath.Dir(filepath.Dir(sagas.Collection().SyncDestination))
+	loaded := db.NewTestDatabaseWithOptions(t, db.DatabaseOptions{Dir: dir, Config: db.DefaultConfig()})
+	loaded.RegisterType(&saga.Record{})
+	if err = loaded.ScanAndLoadData(""); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := saga.New(loaded, "sagas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := reloaded.Get(id)
+	if err != nil || r == nil || r.State != saga.STATE_DONE {
+		t.Fatal("finished saga was lost by the crash", r, err)
+	}
+	if !r.Started.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) || r.Updated.Sub(r.Started) != 2*time.Minute {
+		t.Fatal("record was not stamped by the clock of the database", r.Started, r.Updated)
+	}
+}
+
+func TestSagaResumeIgnoresQueryGuards(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	sagas, err := saga.New(database, "sagas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sagas.Register(saga.Workflow{Name: "noop", Steps: []saga.Step{{Name: "noop",
+		Action: func(context.Context, []byte) error { return nil }}}})
+	for i := 0; i < 15; i++ {
+		sagas.Collection().Write(&saga.Record{Id: "interrupted" + strconv.Itoa(i), Workflow: "noop", State: saga.STATE_RUNNING})
+	}
+	guardQueries(t, database, 10, 0, 0)
+	if resumed, err := sagas.Resume(context.Background()); err != nil || resumed != 15 {
+		t.Fatal("interrupted sagas were cut by the query guards", resumed, err)
+	}
+}
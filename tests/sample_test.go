@@ -0,0 +1,124 @@
+package tests
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestSample(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 100)
+
+	if _, err := c.Sample(0); err == nil {
+		t.Fatal("empty sample was accepted")
+	}
+	all, err := c.Sample(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 100 {
+		t.Fatal("expected the whole collection, got", len(all))
+	}
+
+	// every element should be picked about equally often
+	hits := make(map[string]int)
+	for i := 0; i < 500; i++ {
+		sample, err := c.Sample(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := make(map[string]bool)
+		for _, e := range sample {
+			if seen[e.Id] {
+				t.Fatal("element was sampled twice")
+			}
+			seen[e.Id] = true
+			hits[e.Id]++
+		}
+		if len(sample) != 10 {
+			t.Fatal("expected 10 elements, got", len(sample))
+		}
+	}
+	// 50 expected hits per element
+	for id, n := range hits {
+		if n < 15 || n > 100 {
+			t.Fatal("element", id, "was sampled", n, "times")
+		}
+	}
+	if len(hits) != 100 {
+		t.Fatal("only", len(hits), "elements were ever sampled")
+	}
+}
+
+func TestRandomElementWeighted(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	if _, err := c.RandomElement(); err == nil {
+		t.Fatal("empty collection returned an element")
+	}
+	fillCollection(t, c, 100)
+
+	e, err := c.RandomElement()
+	if err != nil || e == nil {
+		t.Fatal("no random element", err)
+	}
+
+	ages := make(map[int]int)
+	for i := 0; i < 2000; i++ {
+		e, err := c.RandomElementWeighted("Age")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ages[e.Payload.(*ExamplePerson).Age]++
+	}
+	if ages[0] != 0 {
+		t.Fatal("elements without weight were chosen")
+	}
+	// age 9 weighs 9 times more than age 1
+	if ages[9] < 3*ages[1] {
+		t.Fatal("selection is not weighted", ages)
+	}
+	if _, err := c.RandomElementWeighted("FirstName"); err == nil {
+		t.Fatal("non-numeric field was accepted")
+	}
+}
+
+func TestRandomElementWeightedByEncodedValues(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	database.RegisterType(&Reading{})
+	c, _ := database.AddCollection("readings")
+	if err := c.AddIndex("Value", false); err != nil {
+		t.Fatal(err)
+	}
+	for i := -10; i < 20; i++ {
+		if err := c.Write(&Reading{Sensor: "sensor" + strconv.Itoa(i), Value: float64(i) / 2, Count: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	values := make(map[float64]int)
+	for i := 0; i < 2000; i++ {
+		e, err := c.RandomElementWeighted("Value")
+		if err != nil {
+			t.Fatal(err)
+		}
+		values[e.Payload.(*Reading).Value]++
+	}
+	for value, n := range values {
+		if value <= 0 {
+			t.Fatal("element of value", value, "was chosen", n, "times")
+		}
+	}
+	// 9.5 weighs 19 times more than 0.5
+	if values[9.5] < 5*values[0.5] {
+		t.Fatal("selection is not weighted", values)
+	}
+	// EncodeInt of GetDataIndex
+	if _, err := c.RandomElementWeighted("Count"); err == nil {
+		t.Fatal("encoded value was taken as a decimal weight")
+	}
+}
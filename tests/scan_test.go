@@ -0,0 +1,49 @@
+package tests
+
+import (
+	"shardb/db"
+	"testing"
+)
+
+func TestForEachVisitsEveryLiveElement(t *testing.T) {
+	enterTempDir(t)
+	readAhead := db.READ_AHEAD_SIZE
+	db.READ_AHEAD_SIZE = 128
+	defer func() { db.READ_AHEAD_SIZE = readAhead }()
+
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 150)
+	// part of the elements stays in the write buffer
+	c.SetWriteBufferSize(1024 * 1024)
+	for i := 0; i < 10; i++ {
+		c.Write(&ExamplePerson{"late" + string(rune('a'+i)), 1})
+	}
+	data, _ := c.ScanOne(&ExamplePerson{FirstName: "person3"}, false)
+	el, _ := c.DecodeElement(data)
+	c.DeleteById(el.Id)
+
+	seen := make(map[string]bool)
+	err := c.ForEach(func(e *db.Element) error {
+		seen[e.Payload.(*ExamplePerson).FirstName] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 159 || seen["person3"] || !seen["latej"] {
+		t.Fatal("unexpected elements visited:", len(seen))
+	}
+
+	visited := 0
+	err = c.ForEach(func(e *db.Element) error {
+		visited++
+		if visited == 5 {
+			return db.StopIteration
+		}
+		return nil
+	})
+	if err != nil || visited != 5 {
+		t.Fatal("iteration did not stop", err, visited)
+	}
+}
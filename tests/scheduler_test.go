@@ -0,0 +1,234 @@
+package tests
+
+import (
+	"shardb/db"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSchedulerLimitsWorkers(t *testing.T) {
+	s := db.NewScheduler(3)
+	defer s.Close()
+	var running, peak int32
+	results := make([]<-chan error, 0)
+	for i := 0; i < 20; i++ {
+		results = append(results, s.Submit("work", db.PRIORITY_NORMAL, func() error {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			return nil
+		}))
+	}
+	for _, r := range results {
+		if err := <-r; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if peak != 3 {
+		t.Fatal("expected 3 tasks at a time, got", peak)
+	}
+}
+
+func TestSchedulerPriorities(t *testing.T) {
+	s := db.NewScheduler(1)
+	defer s.Close()
+	// keeps the only worker busy until the rest is queued
+	release := make(chan struct{})
+	s.Submit("blocker", db.PRIORITY_NORMAL, func() error {
+		<-release
+		return nil
+	})
+	var mx sync.Mutex
+	order := make([]string, 0)
+	record := func(name string) func() error {
+		return func() error {
+			mx.Lock()
+			order = append(order, name)
+			mx.Unlock()
+			return nil
+		}
+	}
+	s.Submit("low", db.PRIORITY_LOW, record("low"))
+	s.Submit("normal1", db.PRIORITY_NORMAL, record("normal1"))
+	s.Submit("high", db.PRIORITY_HIGH, record("high"))
+	last := s.Submit("normal2", db.PRIORITY_NORMAL, record("normal2"))
+	failed := s.Submit("panic", db.PRIORITY_LOW, func() error { panic("broken task") })
+	if s.Pending() != 6 {
+		t.Fatal("expected 6 pending tasks, got", s.Pending())
+	}
+	close(release)
+	<-last
+	if err := <-failed; err == nil {
+		t.Fatal("panic of a task was not reported")
+	}
+	mx.Lock()
+	defer mx.Unlock()
+	expected := []string{"high", "normal1", "normal2", "low"}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatal("unexpected order", order)
+		}
+	}
+}
+
+func TestSchedulerClose(t *testing.T) {
+	s := db.NewScheduler(1)
+	started, release := make(chan struct{}), make(chan struct{})
+	running := s.Submit("running", db.PRIORITY_NORMAL, func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+	queued := s.Submit("queued", db.PRIORITY_NORMAL, func() error { return nil })
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+	}()
+	s.Close()
+	if err := <-running; err != nil {
+		t.Fatal("running task was not finished", err)
+	}
+	if err := <-queued; err != db.ErrSchedulerClosed {
+		t.Fatal("queued task was not dropped", err)
+	}
+	if err := <-s.Submit("late", db.PRIORITY_HIGH, func() error { return nil }); err != db.ErrSchedulerClosed {
+		t.Fatal("task was accepted by a closed scheduler", err)
+	}
+}
+
+func TestBackgroundSyncUsesScheduler(t *testing.T) {
+	enterTempDir(t)
+	options := db.DefaultDatabaseOptions()
+	options.Config.SyncInterval = 10 * time.Millisecond
+	database := db.NewDatabaseWithOptions("test", options)
+	database.RegisterType(&ExamplePerson{})
+	defer database.Close()
+
+	// a single worker busy with other work holds the synchronization back
+	cfg := database.Config()
+	cfg.BackgroundWorkers = 1
+	database.ApplyConfig(cfg)
+	if database.Scheduler().Workers() != 1 {
+		t.Fatal("workers were not changed")
+	}
+	release := make(chan struct{})
+	database.Scheduler().Submit("busy", db.PRIORITY_LOW, func() error {
+		<-release
+		return nil
+	})
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 10)
+	time.Sleep(50 * time.Millisecond)
+	if !database.IsDirty() {
+		t.Fatal("synchronized while the worker was busy")
+	}
+	close(release)
+	deadline := time.Now().Add(2 * time.Second)
+	for database.IsDirty() {
+		if time.Now().After(deadline) {
+			t.Fatal("database was not synchronized in the background")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestParseMaintenanceWindow(t *testing.T) {
+	w, err := db.ParseMaintenanceWindow("fri-sun 22:30-02:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.String() != "fri,sat,sun 22:30-02:00" || w.Duration != 3*time.Hour+30*time.Minute {
+		t.Fatalf("unexpected window %v %+v", w, w)
+	}
+	// 2024-06-07 is a friday, the window opened on sunday closes on monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 6, day, hour, minute, 0, 0, time.UTC)
+	}
+	for _, c := range []struct {
+		t    time.Time
+		open bool
+	}{{at(7, 22, 29), false}, {at(7, 22, 30), true}, {at(8, 1, 59), true}, {at(8, 2, 0), false},
+		{at(10, 1, 0), true}, {at(11, 1, 0), false}, {at(6, 23, 0), false}} {
+		if w.Contains(c.t) != c.open {
+			t.Fatal("unexpected state of the window at", c.t)
+		}
+	}
+	for _, invalid := range []string{"01:00-02:00", "* 01:00-01:00", "someday 01:00-02:00", "* 25:00-02:00"} {
+		if _, err = db.ParseMaintenanceWindow(invalid); err == nil {
+			t.Fatal("invalid window was accepted", invalid)
+		}
+	}
+}
+
+func TestMaintenanceWindows(t *testing.T) {
+	database, clock := newVirtualDatabase(t)
+	// the virtual clock starts at 12:00
+	w, _ := db.ParseMaintenanceWindow("* 13:00-14:00")
+	cfg := database.Config()
+	cfg.MaintenanceWindows = []db.MaintenanceWindow{w}
+	if err := database.ApplyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	var low, high int32
+	lowDone := database.Scheduler().Submit("compaction", db.PRIORITY_LOW, func() error {
+		atomic.StoreInt32(&low, 1)
+		return nil
+	})
+	// urgent work runs outside of the windows
+	<-database.Scheduler().Submit("sync", db.PRIORITY_HIGH, func() error {
+		atomic.StoreInt32(&high, 1)
+		return nil
+	})
+	if atomic.LoadInt32(&high) != 1 || atomic.LoadInt32(&low) != 0 {
+		t.Fatal("low priority task ran outside of the window")
+	}
+	clock.Advance(59 * time.Minute)
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadInt32(&low) != 0 {
+		t.Fatal("low priority task ran before the window opened")
+	}
+	clock.Advance(time.Minute)
+	if err := <-lowDone; err != nil || atomic.LoadInt32(&low) != 1 {
+		t.Fatal("held task did not run within the window", err)
+	}
+
+	// removing the windows releases the held tasks right away
+	clock.Advance(time.Hour)
+	held := database.Scheduler().Submit("index", db.PRIORITY_LOW, func() error { return nil })
+	cfg.MaintenanceWindows = nil
+	if err := database.ApplyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-held; err != nil {
+		t.Fatal(err)
+	}
+
+	// an audit held back by the windows does not block the close of the database
+	cfg.MaintenanceWindows = []db.MaintenanceWindow{w}
+	cfg.AuditInterval = time.Minute
+	if err := database.ApplyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute)
+	eventually(t, "audit was not queued", func() bool {
+		return database.Scheduler().Pending() == 1
+	})
+	closed := make(chan error, 1)
+	go func() {
+		closed <- database.Close()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close waited for the held audit")
+	}
+}
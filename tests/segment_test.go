@@ -0,0 +1,88 @@
+package tests
+
+import (
+	"path/filepath"
+	"shardb/db"
+	"strconv"
+	"testing"
+)
+
+func TestSegmentsRollOverAndCompact(t *testing.T) {
+	enterTempDir(t)
+	segmentSize := db.SEGMENT_SIZE
+	db.SEGMENT_SIZE = 256
+	defer func() { db.SEGMENT_SIZE = segmentSize }()
+
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 200)
+
+	segments, _ := filepath.Glob(filepath.Join(db.COLLECTION_DIR_NAME, "people", "shard_*.gobs"))
+	if len(segments) <= db.SHARD_COUNT {
+		t.Fatal("active segments did not roll over")
+	}
+
+	for i := 0; i < 200; i += 2 {
+		data, err := c.ScanOne(&ExamplePerson{FirstName: "person" + strconv.Itoa(i)}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		el, _ := c.DecodeElement(data)
+		err = c.DeleteById(el.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	garbage := c.GarbageStats()
+	if garbage.Deleted != 100 || garbage.Live != 100 || garbage.Reclaimable <= 0 {
+		t.Fatalf("unexpected garbage estimate %+v", garbage)
+	}
+	report, err := c.Optimize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Reclaimed != garbage.Reclaimable || report.Rewritten != 100 || len(report.Shards) != db.SHARD_COUNT {
+		t.Fatalf("unexpected optimization report %+v, estimated %d bytes", report, garbage.Reclaimable)
+	}
+	if garbage = c.GarbageStats(); garbage.Reclaimable != 0 || garbage.Deleted != 0 {
+		t.Fatal("garbage is left after the optimization", garbage.Reclaimable)
+	}
+	err = database.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the merged segments are removed once the manifest no longer lists them
+	segments, _ = filepath.Glob(filepath.Join(db.COLLECTION_DIR_NAME, "people", "shard_*.gobs"))
+	if len(segments) > 2*db.SHARD_COUNT {
+		t.Fatal("sealed segments were not merged,", len(segments), "segment files left")
+	}
+
+	loaded := newTestDatabase(t)
+	err = loaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := loaded.GetCollection("people")
+	if lc.Size() != 100 {
+		t.Fatal("expected 100 objects, got", lc.Size())
+	}
+	for i := 0; i < 200; i++ {
+		data, err := lc.ScanOne(&ExamplePerson{FirstName: "person" + strconv.Itoa(i)}, false)
+		if i%2 == 0 {
+			if err == nil {
+				t.Fatal("deleted element person" + strconv.Itoa(i) + " is still there")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		el, err := lc.DecodeElement(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if el.Payload.(*ExamplePerson).FirstName != "person"+strconv.Itoa(i) {
+			t.Fatal("compaction moved the wrong data")
+		}
+	}
+}
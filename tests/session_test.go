@@ -0,0 +1,107 @@
+package tests
+
+import (
+	"shardb/db"
+	"shardb/session"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSessionStore(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	store, err := session.NewWithCleanupInterval(database, "sessions", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry := time.Now().Add(time.Hour)
+	if err = store.Commit("a", []byte("first"), expiry); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Commit("a", []byte("second"), expiry); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Commit("b", []byte("other"), expiry); err != nil {
+		t.Fatal(err)
+	}
+	data, found, err := store.Find("a")
+	if err != nil || !found || string(data) != "second" || store.Collection().Size() != 2 {
+		t.Fatal("session was not replaced", string(data), found, err)
+	}
+	if _, found, _ = store.Find("missing"); found {
+		t.Fatal("missing session was found")
+	}
+
+	if err = store.Commit("old", []byte("expired"), time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ = store.Find("old"); found {
+		t.Fatal("expired session was found")
+	}
+	all, err := store.All()
+	if err != nil || len(all) != 2 || string(all["b"]) != "other" {
+		t.Fatal("unexpected sessions", all, err)
+	}
+	if n, err := store.DeleteExpired(); err != nil || n != 1 || store.Collection().Size() != 2 {
+		t.Fatal("expired session was not removed", n, err)
+	}
+
+	if err = store.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Delete("a"); err != nil {
+		t.Fatal("deleting a missing session failed", err)
+	}
+	if _, found, _ = store.Find("a"); found {
+		t.Fatal("deleted session was found")
+	}
+	// committed again after the delete
+	if err = store.Commit("a", []byte("third"), expiry); err != nil {
+		t.Fatal(err)
+	}
+	if data, found, _ = store.Find("a"); !found || string(data) != "third" {
+		t.Fatal("session was not committed again", string(data))
+	}
+}
+
+func TestSessionStoreCleanup(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	store, err := session.NewWithCleanupInterval(database, "sessions", 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.StopCleanup()
+	if err = store.Commit("short", nil, time.Now().Add(20*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for store.Collection().Size() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expired session was not cleaned up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionStoreIgnoresQueryGuards(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	store, err := session.NewWithCleanupInterval(database, "sessions", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 15; i++ {
+		if err = store.Commit("expired"+strconv.Itoa(i), nil, time.Now().Add(-time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if err = store.Commit("live"+strconv.Itoa(i), nil, time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	guardQueries(t, database, 10, 0, 0)
+	if all, err := store.All(); err != nil || len(all) != 15 {
+		t.Fatal("live sessions were cut by the query guards", len(all), err)
+	}
+	if deleted, err := store.DeleteExpired(); err != nil || deleted != 15 {
+		t.Fatal("expired sessions were cut by the query guards", deleted, err)
+	}
+}
@@ -0,0 +1,73 @@
+package tests
+
+import (
+	"shardb/db"
+	"testing"
+)
+
+func TestExecute(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	database.RegisterType(&ExamplePerson{})
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 30)
+
+	result, err := database.Execute("SELECT * FROM people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Elements) != 30 || result.Columns != nil || result.Rows != nil {
+		t.Fatal("unexpected result of select *", len(result.Elements), result.Columns)
+	}
+
+	result, err = database.Execute("select FirstName, Age from people where Age > 3 and Age <= 5 order by FirstName desc limit 4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Rows) != 4 || len(result.Elements) != 4 || len(result.Columns) != 2 {
+		t.Fatal("unexpected rows", result.Rows)
+	}
+	previous := "~"
+	for _, row := range result.Rows {
+		name, age := row[0].(string), row[1].(int)
+		if age <= 3 || age > 5 {
+			t.Fatal("row does not match the conditions", row)
+		}
+		if name >= previous {
+			t.Fatal("rows are not in descending order", result.Rows)
+		}
+		previous = name
+	}
+
+	result, err = database.Execute("SELECT Age FROM people WHERE FirstName = ? AND Age != ?", "person7", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Rows) != 1 || result.Rows[0][0] != 7 {
+		t.Fatal("unexpected rows of the parameters", result.Rows)
+	}
+	result, err = database.Execute("SELECT FirstName FROM people WHERE FirstName = 'person1''s' OR Age = 1")
+	if err == nil {
+		t.Fatal("OR was accepted")
+	}
+
+	for _, query := range []string{
+		"",
+		"SELECT FROM people",
+		"SELECT * people",
+		"SELECT * FROM people WHERE Age",
+		"SELECT * FROM people WHERE Age > ",
+		"SELECT * FROM people WHERE Age = 'open",
+		"SELECT * FROM people LIMIT ten",
+		"SELECT * FROM people ORDER Age",
+	} {
+		if _, err = database.Execute(query); err == nil {
+			t.Fatal("invalid query was accepted", query)
+		}
+	}
+	if _, err = database.Execute("SELECT * FROM people WHERE Age = ?"); err == nil {
+		t.Fatal("missing argument was accepted")
+	}
+	if _, err = database.Execute("SELECT * FROM nobody"); err == nil {
+		t.Fatal("unknown collection was accepted")
+	}
+}
@@ -0,0 +1,50 @@
+package tests
+
+import (
+	"shardb/db"
+	"testing"
+	"time"
+)
+
+func TestIndexSuggestions(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	database.RegisterType(&ExamplePerson{})
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 20)
+	if err := c.AddIndex("FirstName", true); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := c.Query().Where("Age", db.Gte, 5).Where("FirstName", db.Exists).Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// answered by the index
+	if _, err := c.Query().Where("FirstName", db.Eq, "person3").Run(); err != nil {
+		t.Fatal(err)
+	}
+	suggestions := database.IndexSuggestions()
+	if len(suggestions) != 1 || suggestions[0] != (db.IndexSuggestion{"people", "Age", 3, 60}) {
+		t.Fatalf("unexpected suggestions %+v", suggestions)
+	}
+
+	database.SetAutoIndex(100)
+	for i := 0; i < 2; i++ {
+		if _, err := c.Query().Where("Age", db.Eq, 5).Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(database.IndexSuggestions()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("suggested index was not added")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if results, err := c.Query().Where("Age", db.Eq, 5).Run(); err != nil || len(results) != 2 {
+		t.Fatal("unexpected results with the added index", len(results), err)
+	}
+	if len(database.IndexSuggestions()) != 0 {
+		t.Fatal("indexed query was counted as a full scan")
+	}
+}
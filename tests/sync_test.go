@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"shardb/db"
+	"testing"
+	"time"
+)
+
+func TestSyncReportsFailedCollections(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	database.SetSyncPolicy(db.SyncPolicy{RollbackHeader: true})
+	good, _ := database.AddCollection("good")
+	broken, _ := database.AddCollection("broken")
+	fillCollection(t, good, 5)
+	fillCollection(t, broken, 5)
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	good.Write(&ExamplePerson{"late", 1})
+	os.RemoveAll(filepath.Join(db.COLLECTION_DIR_NAME, "broken"))
+	err := database.Sync()
+	syncErr, ok := err.(*db.SyncError)
+	if !ok {
+		t.Fatal("expected a SyncError, got", err)
+	}
+	if len(syncErr.Collections) != 1 || syncErr.Collections["broken"] == nil {
+		t.Fatal("unexpected failed collections", syncErr)
+	}
+	m, err := db.LoadManifest(db.MANIFEST_NAME)
+	if err != nil || m.Sequence != 1 {
+		t.Fatal("manifest of the failed sync was written")
+	}
+
+	// the good collection synchronized, it is loaded as the previous manifest describes it
+	loaded := newTestDatabase(t)
+	report, err := loaded.ScanAndLoadDataLenient("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Loaded) != 1 || report.Loaded[0] != "good" || report.Failed["broken"] == nil {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if loaded.GetCollection("good").Size() != 5 {
+		t.Fatal("unexpected size of the good collection", loaded.GetCollection("good").Size())
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	transient := errors.New("transient")
+	calls := 0
+	policy := db.RetryPolicy{Attempts: 3, Backoff: time.Millisecond, Retryable: func(err error) bool { return err == transient }}
+	err := policy.Do(func() error {
+		calls++
+		if calls < 3 {
+			return transient
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatal("expected success on the third attempt", err, calls)
+	}
+
+	calls = 0
+	permanent := errors.New("permanent")
+	err = policy.Do(func() error {
+		calls++
+		return permanent
+	})
+	if err != permanent || calls != 1 {
+		t.Fatal("permanent errors must not be retried", calls)
+	}
+}
+
+func TestIORetryOnLoad(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 10)
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := db.LoadManifest(db.MANIFEST_NAME)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the meta disappears for a moment, like on a flaky network mount
+	meta := filepath.Join(db.COLLECTION_DIR_NAME, "people", manifest.Collections[0].Shards[3].Meta.Name)
+	if err := os.Rename(meta, meta+".away"); err != nil {
+		t.Fatal(err)
+	}
+	if err := newTestDatabase(t).ScanAndLoadData(""); err == nil {
+		t.Fatal("loaded without the meta")
+	}
+
+	options := db.DefaultDatabaseOptions()
+	retries := 0
+	options.IORetry = db.RetryPolicy{Attempts: 3, Backoff: time.Millisecond, Retryable: func(err error) bool {
+		if !os.IsNotExist(err) {
+			return false
+		}
+		retries++
+		return os.Rename(meta+".away", meta) == nil
+	}}
+	loaded := db.NewDatabaseWithOptions("test", options)
+	loaded.RegisterType(&ExamplePerson{})
+	if err := loaded.ScanAndLoadData(""); err != nil {
+		t.Fatal(err)
+	}
+	if retries != 1 {
+		t.Fatal("expected a single retry, got", retries)
+	}
+	if lc := loaded.GetCollection("people"); lc == nil || lc.Size() != 10 {
+		t.Fatal("collection was not loaded")
+	}
+}
@@ -0,0 +1,48 @@
+package tests
+
+import (
+	"shardb/db"
+	"testing"
+)
+
+func TestAddCollectionFromTemplate(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	template := &db.CollectionTemplate{
+		Indexes:         []db.Index{{Field: "Age"}, {Field: "FirstName", Collation: &db.Collation{IgnoreCase: true}}},
+		WriteBufferSize: 64 * 1024,
+		FieldFragments:  true,
+	}
+	for _, name := range []string{"tenant_a", "tenant_b"} {
+		c, err := database.AddCollectionFromTemplate(name, template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c.Indexes) != 2 || c.WriteBufferSize != 64*1024 || !c.FieldFragments {
+			t.Fatal("template was not applied to", name)
+		}
+		fillCollection(t, c, 20)
+		results, err := c.Query().Where("FirstName", db.Eq, "PERSON3").Run()
+		if err != nil || len(results) != 1 {
+			t.Fatal("expected a single person", err)
+		}
+	}
+	if err := database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := database.AddCollectionFromTemplate("invalid", &db.CollectionTemplate{EncryptedFields: []string{"FirstName"}}); err == nil {
+		t.Fatal("encryption without keys was accepted")
+	}
+	// fails only once the collection exists
+	broken := &db.CollectionTemplate{EncryptedFields: []string{"FirstName"}, Keys: db.StaticKey("short")}
+	if _, err := database.AddCollectionFromTemplate("broken", broken); err == nil {
+		t.Fatal("invalid key was accepted")
+	}
+	if database.GetCollection("broken") != nil {
+		t.Fatal("collection of the failed template was kept")
+	}
+	if _, err := database.AddCollection("broken"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,43 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"shardb/db"
+	"testing"
+)
+
+func TestNewTestDatabase(t *testing.T) {
+	var dir string
+	t.Run("isolated", func(t *testing.T) {
+		database := db.NewTestDatabase(t)
+		database.RegisterType(&ExamplePerson{})
+		c, err := database.AddCollection("people")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fillCollection(t, c, 10)
+		if err = database.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		dir = filepath.Dir(c.SyncDestination)
+		if _, err = os.Stat(filepath.Join(dir, "people")); err != nil {
+			t.Fatal("collection is not in the test directory", err)
+		}
+		if _, err = os.Stat(db.COLLECTION_DIR_NAME); !os.IsNotExist(err) {
+			t.Fatal("collections were written to the working directory")
+		}
+
+		loaded := db.NewTestDatabaseWithOptions(t, db.DatabaseOptions{Dir: filepath.Dir(dir), Config: db.DefaultConfig()})
+		loaded.RegisterType(&ExamplePerson{})
+		if err = loaded.ScanAndLoadData(""); err != nil {
+			t.Fatal(err)
+		}
+		if loaded.GetCollection("people").Size() != 10 {
+			t.Fatal("test database was not loaded")
+		}
+	})
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatal("test directory was not removed", err)
+	}
+}
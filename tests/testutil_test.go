@@ -0,0 +1,69 @@
+package tests
+
+import (
+	"reflect"
+	"shardb/db"
+	"shardb/testutil"
+	"testing"
+)
+
+func TestGeneratorPopulatesCollections(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	g, err := testutil.NewGenerator(&ExamplePerson{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.Field("FirstName", testutil.Sequence("p")).Field("Age", testutil.Uniform(18, 30))
+	if err = g.Populate(c, 150); err != nil {
+		t.Fatal(err)
+	}
+	// numbering goes on
+	if err = g.Populate(c, 50); err != nil {
+		t.Fatal(err)
+	}
+	if c.Size() != 200 {
+		t.Fatal("expected 200 elements, got", c.Size())
+	}
+	if e, err := c.Query().Where("FirstName", db.Eq, "p199").First(); err != nil || e == nil {
+		t.Fatal("last element was not found", err)
+	}
+	err = c.ForEach(func(e *db.Element) error {
+		if age := e.Payload.(*ExamplePerson).Age; age < 18 || age > 30 {
+			t.Fatal("age out of range", age)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g.Field("Age", testutil.OneOf("old"))
+	if _, err = g.New(0); err == nil {
+		t.Fatal("a string was assigned to an int")
+	}
+	if _, err = testutil.NewGenerator(nil); err == nil {
+		t.Fatal("generator without a prototype")
+	}
+}
+
+func TestGeneratorIsDeterministic(t *testing.T) {
+	generator := func() *testutil.Generator {
+		g, err := testutil.NewGenerator(&Customer{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return g.Seed(7).Field("Address.City", testutil.OneOf(cities[0], cities[1]))
+	}
+	a, _ := generator().New(3)
+	b, _ := generator().New(3)
+	if !reflect.DeepEqual(a, b) {
+		t.Fatal("same seed gave different elements", a, b)
+	}
+	customer := a.(*Customer)
+	if customer.Name == "" || customer.Address == nil || customer.Address.Street == "" ||
+		(customer.Address.City != cities[0] && customer.Address.City != cities[1]) {
+		t.Fatalf("fields were not filled %+v", customer)
+	}
+}
@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"shardb/db"
+	"strconv"
+	"testing"
+)
+
+func TestUnion(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	names := []string{"tenant_a", "tenant_b", "tenant_c"}
+	for i, name := range names {
+		c, _ := database.AddCollection(name)
+		for j := 0; j < 10; j++ {
+			if err := c.Write(&ExamplePerson{name + strconv.Itoa(j), i*10 + j}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := database.Union("all", "tenant_a", "missing"); err == nil {
+		t.Fatal("union of a missing collection was created")
+	}
+	u, err := database.Union("all", names...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Size() != 30 || len(u.Members()) != 3 {
+		t.Fatal("unexpected union size", u.Size())
+	}
+
+	results, err := u.Query().Where("Age", db.Gte, 5).Where("Age", db.Lt, 25).Run()
+	if err != nil || len(results) != 20 {
+		t.Fatal("expected 20 elements from the first two members", len(results), err)
+	}
+	results, err = u.Query().Limit(7).Run()
+	if err != nil || len(results) != 7 {
+		t.Fatal("expected 7 elements", len(results), err)
+	}
+	data, err := u.FindById(results[0].Id)
+	if err != nil || len(data) == 0 {
+		t.Fatal("element was not found by its id", err)
+	}
+	if _, err = u.FindById("missing"); err == nil {
+		t.Fatal("missing element was found")
+	}
+
+	stop := errors.New("stop")
+	seen := 0
+	err = u.Query().Stream(context.Background(), func(e *db.Element) error {
+		seen++
+		if seen == 3 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || seen != 3 {
+		t.Fatal("error of fn was not returned", err, seen)
+	}
+	if _, err = u.Query().Where("a..b", db.Eq, 1).Run(); err == nil {
+		t.Fatal("invalid path was accepted")
+	}
+}
@@ -0,0 +1,93 @@
+package tests
+
+import (
+	"path/filepath"
+	"shardb/db"
+	"testing"
+)
+
+func TestWarmup(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	database.RegisterType(&ExamplePerson{})
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 20)
+	c.TrackHotKeys(3)
+	elements, err := c.Query().Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first three elements are read the most, after every other one was read once
+	for i := len(elements) - 1; i >= 0; i-- {
+		reads := 1
+		if i < 3 {
+			reads = 10
+		}
+		for n := 0; n < reads; n++ {
+			if _, err = c.FindById(elements[i].Id, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	hot := c.HotKeys()
+	expected := map[string]bool{elements[0].Id: true, elements[1].Id: true, elements[2].Id: true}
+	if len(hot) != 3 || !expected[hot[0].Key] || !expected[hot[1].Key] || !expected[hot[2].Key] {
+		t.Fatalf("unexpected hot keys %+v", hot)
+	}
+	if err = database.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Dir(filepath.Dir(c.SyncDestination))
+	database.Close()
+
+	loaded := db.NewDatabaseWithOptions("test", db.DatabaseOptions{Dir: dir})
+	loaded.RegisterType(&ExamplePerson{})
+	if err = loaded.ScanAndLoadData(""); err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+	c = loaded.GetCollection("people")
+	n, err := c.WarmupFromAccessLog()
+	if err != nil || n != 3 {
+		t.Fatal("hot keys were not warmed up", n, err)
+	}
+	c.ResetMetrics()
+	for _, k := range hot {
+		if _, err = c.FindById(k.Key, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, stats := range c.Metrics().ShardIO {
+		if stats.Reads != 0 {
+			t.Fatal("warmed up element was read from the drive")
+		}
+	}
+	if n, err = c.Warmup([]string{"missing", elements[5].Id}); err != nil || n != 1 {
+		t.Fatal("unexpected warmup", n, err)
+	}
+}
+
+func TestCachedElementsFollowWrites(t *testing.T) {
+	database := db.NewTestDatabase(t)
+	database.RegisterType(&ExamplePerson{})
+	c, _ := database.AddCollection("people")
+	fillCollection(t, c, 10)
+	e, err := c.Query().Where("FirstName", db.Eq, "person4").First()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.FindById(e.Id, true); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := c.Scan(&ExamplePerson{Age: 4}, true); err != nil || len(data) != 1 {
+		t.Fatal("unexpected scan", err)
+	}
+	if _, err = c.Delete(&ExamplePerson{Age: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.FindById(e.Id, true); err == nil {
+		t.Fatal("deleted element was served from the cache")
+	}
+	if _, err = c.Scan(&ExamplePerson{Age: 4}, true); err == nil {
+		t.Fatal("deleted element was scanned from the cache")
+	}
+}
@@ -0,0 +1,50 @@
+package tests
+
+import (
+	"shardb/bench"
+	"shardb/db"
+	"testing"
+)
+
+func runWorkload(b *testing.B, w bench.Workload) {
+	enterTempDir(b)
+	database := db.NewDatabase("bench")
+	bench.RegisterTypes(database)
+	c, err := database.AddCollection("workload")
+	if err != nil {
+		b.Fatal(err)
+	}
+	w.Operations = b.N
+	b.ResetTimer()
+	report, err := bench.Run(c, w)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if report.Errors > 0 {
+		b.Fatal(report.Errors, "operations failed")
+	}
+	b.ReportMetric(report.Throughput, "ops/s")
+	for _, l := range []bench.Latencies{report.Reads, report.Scans, report.Writes} {
+		if l.Count > 0 {
+			b.ReportMetric(float64(l.P99.Nanoseconds()), "p99-ns")
+			break
+		}
+	}
+	b.Log(report)
+}
+
+func BenchmarkWorkloadReadHeavy(b *testing.B) {
+	runWorkload(b, bench.ReadHeavy)
+}
+
+func BenchmarkWorkloadWriteHeavy(b *testing.B) {
+	runWorkload(b, bench.WriteHeavy)
+}
+
+func BenchmarkWorkloadScan(b *testing.B) {
+	runWorkload(b, bench.ScanHeavy)
+}
+
+func BenchmarkWorkloadMixed(b *testing.B) {
+	runWorkload(b, bench.Mixed)
+}
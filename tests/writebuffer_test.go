@@ -0,0 +1,61 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"shardb/db"
+	"testing"
+)
+
+func collectionDiskSize(name string) (size int64) {
+	files, _ := filepath.Glob(filepath.Join(db.COLLECTION_DIR_NAME, name, "shard_*.gobs"))
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			size += fi.Size()
+		}
+	}
+	return size
+}
+
+func TestWriteBuffer(t *testing.T) {
+	enterTempDir(t)
+	database := newTestDatabase(t)
+	c, _ := database.AddCollection("people")
+	err := c.SetWriteBufferSize(1024 * 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillCollection(t, c, 50)
+	if collectionDiskSize("people") != 0 {
+		t.Fatal("buffered writes reached the drive")
+	}
+	data, err := c.ScanOne(&ExamplePerson{FirstName: "person7"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	el, err := c.DecodeElement(data)
+	if err != nil || el.Payload.(*ExamplePerson).FirstName != "person7" {
+		t.Fatal("buffered element could not be read", err)
+	}
+
+	err = database.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if collectionDiskSize("people") == 0 {
+		t.Fatal("sync did not flush the write buffer")
+	}
+
+	loaded := newTestDatabase(t)
+	err = loaded.ScanAndLoadData("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := loaded.GetCollection("people")
+	if lc.WriteBufferSize != 1024*1024 {
+		t.Fatal("write buffer size was not persisted")
+	}
+	if _, err = lc.ScanOne(&ExamplePerson{FirstName: "person49"}, false); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,240 @@
+package testutil
+
+// Synthetic elements for tests and benchmarks, generated from a prototype of a registered CustomStructure
+
+import (
+	"errors"
+	"math/rand"
+	"reflect"
+	"shardb/db"
+	"strconv"
+	"time"
+)
+
+// Value of a field for the i-th generated element
+type Distribution func(r *rand.Rand, i int) interface{}
+
+// integers within [min, max]
+func Uniform(min, max int64) Distribution {
+	return func(r *rand.Rand, i int) interface{} {
+		return min + r.Int63n(max-min+1)
+	}
+}
+
+func Normal(mean, stddev float64) Distribution {
+	return func(r *rand.Rand, i int) interface{} {
+		return r.NormFloat64()*stddev + mean
+	}
+}
+
+// integers within [0, max], small ones are the most frequent. s must be above 1, the larger the more skewed
+func Zipf(s float64, max uint64) Distribution {
+	var z *rand.Zipf
+	var source *rand.Rand
+	return func(r *rand.Rand, i int) interface{} {
+		if z == nil || source != r {
+			z, source = rand.NewZipf(r, s, 1, max), r
+		}
+		return int64(z.Uint64())
+	}
+}
+
+// one of the values picked at random
+func OneOf(values ...interface{}) Distribution {
+	return func(r *rand.Rand, i int) interface{} {
+		return values[r.Intn(len(values))]
+	}
+}
+
+// unique strings, the prefix followed by the number of the element
+func Sequence(prefix string) Distribution {
+	return func(r *rand.Rand, i int) interface{} {
+		return prefix + strconv.Itoa(i)
+	}
+}
+
+// the number of the element modulo n, spreads the elements evenly over n groups
+func Modulo(n int) Distribution {
+	return func(r *rand.Rand, i int) interface{} {
+		return int64(i % n)
+	}
+}
+
+// lowercase words of minLength to maxLength letters
+func Text(minLength, maxLength int) Distribution {
+	return func(r *rand.Rand, i int) interface{} {
+		b := make([]byte, minLength+r.Intn(maxLength-minLength+1))
+		for j := range b {
+			b[j] = byte('a' + r.Intn(26))
+		}
+		return string(b)
+	}
+}
+
+func Bytes(size int) Distribution {
+	return func(r *rand.Rand, i int) interface{} {
+		b := make([]byte, size)
+		r.Read(b)
+		return b
+	}
+}
+
+// random times are picked within the year after this one, so datasets of a seed are always the same
+var TIME_BASE = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Fills the exported fields of new copies of a prototype. Fields without a distribution get random
+// values of their type, nested structs are filled as well and are addressed as "Outer.Inner".
+// A Generator is not safe for concurrent use
+type Generator struct {
+	typ    reflect.Type
+	fields map[string]Distribution
+	rand   *rand.Rand
+	next   int
+}
+
+// the prototype must be a pointer to a struct, the type of the elements the collection stores
+func NewGenerator(prototype db.CustomStructure) (*Generator, error) {
+	typ := reflect.TypeOf(prototype)
+	if typ == nil || typ.Kind() != reflect.Ptr || typ.Elem().Kind() != reflect.Struct {
+		return nil, errors.New("prototype must be a pointer to a struct")
+	}
+	return &Generator{typ: typ.Elem(), fields: make(map[string]Distribution), rand: rand.New(rand.NewSource(1))}, nil
+}
+
+// the same seed gives the same elements
+func (g *Generator) Seed(seed int64) *Generator {
+	g.rand = rand.New(rand.NewSource(seed))
+	return g
+}
+
+func (g *Generator) Field(name string, d Distribution) *Generator {
+	g.fields[name] = d
+	return g
+}
+
+// the i-th element
+func (g *Generator) New(i int) (db.CustomStructure, error) {
+	v := reflect.New(g.typ)
+	err := g.fill(v.Elem(), "", i)
+	if err != nil {
+		return nil, err
+	}
+	payload, ok := v.Interface().(db.CustomStructure)
+	if !ok {
+		return nil, errors.New(g.typ.Name() + " is not a CustomStructure")
+	}
+	return payload, nil
+}
+
+// Writes n elements to the collection, numbered on from the elements of the previous calls
+func (g *Generator) Populate(c *db.Collection, n int) error {
+	for i := 0; i < n; i++ {
+		payload, err := g.New(g.next)
+		if err != nil {
+			return err
+		}
+		err = c.Write(payload)
+		if err != nil {
+			return errors.New("failed to write element " + strconv.Itoa(g.next) + " due " + err.Error())
+		}
+		g.next++
+	}
+	return nil
+}
+
+func (g *Generator) fill(v reflect.Value, prefix string, i int) error {
+	for f := 0; f < v.NumField(); f++ {
+		field := v.Type().Field(f)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := prefix + field.Name
+		if d, ok := g.fields[name]; ok {
+			err := assign(v.Field(f), d(g.rand, i))
+			if err != nil {
+				return errors.New("field " + name + ": " + err.Error())
+			}
+			continue
+		}
+		err := g.randomize(v.Field(f), name, i)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// random value of the type, kinds without a sensible default stay empty
+func (g *Generator) randomize(v reflect.Value, name string, i int) error {
+	r := g.rand
+	switch {
+	case v.Type() == timeType:
+		v.Set(reflect.ValueOf(TIME_BASE.Add(time.Duration(r.Int63n(int64(365 * 24 * time.Hour))))))
+	case v.Kind() == reflect.Struct:
+		return g.fill(v, name+".", i)
+	case v.Kind() == reflect.Ptr && v.Type().Elem().Kind() == reflect.Struct:
+		v.Set(reflect.New(v.Type().Elem()))
+		return g.fill(v.Elem(), name+".", i)
+	case v.Kind() == reflect.String:
+		v.SetString(Text(8, 8)(r, i).(string))
+	case v.Kind() == reflect.Bool:
+		v.SetBool(r.Intn(2) == 0)
+	case intKind(v.Kind()):
+		v.SetInt(r.Int63n(1000))
+	case uintKind(v.Kind()):
+		v.SetUint(uint64(r.Int63n(1000)))
+	case floatKind(v.Kind()):
+		v.SetFloat(r.Float64() * 1000)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes(Bytes(16)(r, i).([]byte))
+	}
+	return nil
+}
+
+// sets the value converting numbers to the kind of the field
+func assign(v reflect.Value, value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	rv := reflect.ValueOf(value)
+	if rv.Type().AssignableTo(v.Type()) {
+		v.Set(rv)
+		return nil
+	}
+	src, dst := rv.Kind(), v.Kind()
+	switch {
+	case v.Type() == timeType && intKind(src):
+		v.Set(reflect.ValueOf(time.Unix(rv.Int(), 0).UTC()))
+	case dst == reflect.String && intKind(src):
+		v.SetString(strconv.FormatInt(rv.Int(), 10))
+	case dst == reflect.String && uintKind(src):
+		v.SetString(strconv.FormatUint(rv.Uint(), 10))
+	case dst == reflect.String && floatKind(src):
+		v.SetString(strconv.FormatFloat(rv.Float(), 'f', -1, 64))
+	case dst == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 && src == reflect.String:
+		v.SetBytes([]byte(rv.String()))
+	case numberKind(dst) && numberKind(src), dst == src && rv.Type().ConvertibleTo(v.Type()):
+		v.Set(rv.Convert(v.Type()))
+	default:
+		return errors.New("can't assign " + rv.Type().String() + " to " + v.Type().String())
+	}
+	return nil
+}
+
+func intKind(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Int64
+}
+
+func uintKind(k reflect.Kind) bool {
+	return k >= reflect.Uint && k <= reflect.Uintptr
+}
+
+func floatKind(k reflect.Kind) bool {
+	return k == reflect.Float32 || k == reflect.Float64
+}
+
+func numberKind(k reflect.Kind) bool {
+	return intKind(k) || uintKind(k) || floatKind(k)
+}